@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// generatedCertificateValidity is how long a certificate generated at startup
+// is valid for. stripe-mock is rarely kept running for long, but a year
+// avoids surprises for those who do.
+const generatedCertificateValidity = 365 * 24 * time.Hour
+
+// getTLSCertificate loads the certificate and key given with -cert-file and
+// -key-file, or generates a self-signed certificate for localhost if neither
+// was given.
+func (o *options) getTLSCertificate() (tls.Certificate, error) {
+	if o.certFile == "" {
+		return generateTLSCertificate()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	return certificate, nil
+}
+
+// generateTLSCertificate generates a self-signed certificate for localhost in
+// memory. A new one is generated every time, so its fingerprint is printed
+// for clients that need to pin it.
+func generateTLSCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error generating TLS key: %v", err)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error generating TLS certificate: %v", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(generatedCertificateValidity),
+
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error generating TLS certificate: %v", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// certificateFingerprint formats the SHA-256 fingerprint of a certificate the
+// way that tools like OpenSSL do, like `AB:CD:...`.
+func certificateFingerprint(certificate tls.Certificate) string {
+	if len(certificate.Certificate) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(certificate.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestOptionsGetTLSCertificate(t *testing.T) {
+	// A certificate for localhost is generated if none was given
+	options := getDefaultOptions()
+	certificate, err := options.getTLSCertificate()
+	assert.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	assert.NoError(t, err)
+	assert.NoError(t, leaf.VerifyHostname("localhost"))
+	assert.NoError(t, leaf.VerifyHostname("127.0.0.1"))
+
+	// Every generated certificate is different
+	other, err := options.getTLSCertificate()
+	assert.NoError(t, err)
+	assert.NotEqual(t, certificateFingerprint(certificate), certificateFingerprint(other))
+
+	// A given certificate is loaded from its files
+	dir := t.TempDir()
+	options.certFile = filepath.Join(dir, "cert.pem")
+	options.keyFile = filepath.Join(dir, "key.pem")
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	assert.NoError(t, err)
+	err = os.WriteFile(options.certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0600)
+	assert.NoError(t, err)
+	err = os.WriteFile(options.keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	assert.NoError(t, err)
+
+	loaded, err := options.getTLSCertificate()
+	assert.NoError(t, err)
+	assert.Equal(t, certificateFingerprint(certificate), certificateFingerprint(loaded))
+
+	// Missing files are an error
+	options.keyFile = filepath.Join(dir, "missing.pem")
+	_, err = options.getTLSCertificate()
+	assert.Error(t, err)
+}
+
+func TestCertificateFingerprint(t *testing.T) {
+	certificate, err := generateTLSCertificate()
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9A-F]{2}(:[0-9A-F]{2}){31}$`),
+		certificateFingerprint(certificate))
+}
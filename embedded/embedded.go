@@ -4,12 +4,6 @@ import (
 	_ "embed"
 )
 
-//go:embed cert/key.pem
-var CertKey []byte
-
-//go:embed cert/cert.pem
-var CertCert []byte
-
 //go:embed openapi/fixtures3.json
 var OpenAPIFixtures []byte
 
@@ -36,47 +36,56 @@ func (r *DataReplacer) ReplaceData(requestData map[string]interface{}, responseD
 // can easily have the relevant one during recursion.
 func (r *DataReplacer) replaceDataInternal(requestData map[string]interface{}, responseData map[string]interface{}, schema *spec.Schema) map[string]interface{} {
 	for k, requestValue := range requestData {
-		responseValue, ok := responseData[k]
-
-		// Recursively call in to replace data, but only if the key is
-		// in both maps.
-		//
-		// A fairly obvious improvement here is if a key is in the
-		// request but not present in the response, then check the
-		// canonical schema to see if it's there. It might be an
-		// optional field that doesn't appear in the fixture, and if it
-		// was given to us with the request, we probably want to
-		// include it.
-		if ok {
-			requestKeyMap, requestKeyOK := requestValue.(map[string]interface{})
-			responseKeyMap, responseKeyOK := responseValue.(map[string]interface{})
-
-			var kSchema *spec.Schema
-			if schema != nil {
-				kSchema = schema.Properties[k]
-
-				if kSchema != nil {
-					kSchema, _ = r.maybeDereference(kSchema, "")
-				}
+		responseValue := responseData[k]
+
+		// Keys are usually declared as properties, but objects like
+		// `metadata` take arbitrary keys whose schema is given by
+		// `additionalProperties` instead.
+		var kSchema *spec.Schema
+		if schema != nil {
+			kSchema = schema.Properties[k]
+			if kSchema == nil {
+				kSchema = schema.AdditionalProperties
 			}
 
-			if requestKeyOK && responseKeyOK {
-				responseData[k] = r.replaceDataInternal(requestKeyMap, responseKeyMap, kSchema)
-			} else {
-				// In the non-map case, just set the respons key's value to
-				// what was in the request, but only if both values are the
-				// same type (this is to prevent problems where a field is set
-				// as an ID, but the response field is the hydrated object of
-				// that).
-				//
-				// While this will largely be "good enough", there's some
-				// obvious cases that aren't going to be handled correctly like
-				// index-based array updates (e.g.,
-				// `additional_owners[1][name]=...`). I'll have to iron out
-				// that rough edges later on.
-				if r.isSameType(kSchema, requestValue) {
-					responseData[k] = requestValue
-				}
+			if kSchema != nil {
+				kSchema, _ = r.maybeDereference(kSchema, "")
+			}
+		}
+
+		requestKeyMap, requestKeyOK := requestValue.(map[string]interface{})
+		responseKeyMap, responseKeyOK := responseValue.(map[string]interface{})
+
+		// Recursively call in to replace data in objects. If the response
+		// doesn't have the object (it's often null in fixtures, like a
+		// customer's `address`), it's started from one with all of its
+		// nullable properties set to null, which is how the API would
+		// respond if only some of them were sent.
+		if requestKeyOK && !responseKeyOK && responseValue == nil {
+			if objectSchema := r.objectSchema(kSchema); objectSchema != nil {
+				responseData[k] = r.replaceDataInternal(requestKeyMap,
+					r.emptyObject(objectSchema), objectSchema)
+				continue
+			}
+		}
+
+		if requestKeyOK && responseKeyOK {
+			responseData[k] = r.replaceDataInternal(requestKeyMap, responseKeyMap, r.objectSchema(kSchema))
+		} else {
+			// In the non-map case, just set the respons key's value to
+			// what was in the request, but only if both values are the
+			// same type (this is to prevent problems where a field is set
+			// as an ID, but the response field is the hydrated object of
+			// that). Keys that are missing from the response are added as
+			// long as the schema declares them.
+			//
+			// While this will largely be "good enough", there's some
+			// obvious cases that aren't going to be handled correctly like
+			// index-based array updates (e.g.,
+			// `additional_owners[1][name]=...`). I'll have to iron out
+			// that rough edges later on.
+			if r.isSameType(kSchema, requestValue) {
+				responseData[k] = requestValue
 			}
 		}
 	}
@@ -84,6 +93,60 @@ func (r *DataReplacer) replaceDataInternal(requestData map[string]interface{}, r
 	return responseData
 }
 
+// emptyObject produces an object for the given object schema in which all of
+// its nullable properties are null. Other properties are left out because
+// there's no sensible value for them.
+func (r *DataReplacer) emptyObject(schema *spec.Schema) map[string]interface{} {
+	object := make(map[string]interface{})
+	for name, propertySchema := range schema.Properties {
+		if r.isNullable(propertySchema) {
+			object[name] = nil
+		}
+	}
+	return object
+}
+
+// isNullable checks whether a schema allows null, either directly or through
+// one of its `anyOf` branches.
+func (r *DataReplacer) isNullable(schema *spec.Schema) bool {
+	if schema == nil {
+		return false
+	}
+
+	schema, _ = r.maybeDereference(schema, "")
+	if schema.Nullable {
+		return true
+	}
+
+	for _, anyOfSchema := range schema.AnyOf {
+		if r.isNullable(anyOfSchema) {
+			return true
+		}
+	}
+	return false
+}
+
+// objectSchema finds the schema of an object that a value for the given
+// schema could be, which is either the schema itself or one of its `anyOf`
+// branches. nil is returned if the value can't be an object.
+func (r *DataReplacer) objectSchema(schema *spec.Schema) *spec.Schema {
+	if schema == nil {
+		return nil
+	}
+
+	schema, _ = r.maybeDereference(schema, "")
+	if schema.Properties != nil || schema.AdditionalProperties != nil {
+		return schema
+	}
+
+	for _, anyOfSchema := range schema.AnyOf {
+		if objectSchema := r.objectSchema(anyOfSchema); objectSchema != nil {
+			return objectSchema
+		}
+	}
+	return nil
+}
+
 func (r *DataReplacer) isSameType(schema *spec.Schema, requestValue interface{}) bool {
 	if schema == nil {
 		return false
@@ -371,3 +371,98 @@ func TestReplaceData_NotInSchema(t *testing.T) {
 		"bar": "response",
 	}, responseData)
 }
+
+func TestReplaceData_AdditionalProperties(t *testing.T) {
+	replacer := DataReplacer{Schema: &spec.Schema{
+		Properties: map[string]*spec.Schema{
+			"metadata": {
+				AdditionalProperties: &spec.Schema{
+					Type: spec.TypeString,
+				},
+				Type: spec.TypeObject,
+			},
+		},
+	}}
+
+	responseData := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"foo": "response",
+		},
+	}
+
+	replacer.ReplaceData(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"bar": "request",
+		},
+	}, responseData)
+
+	assert.Equal(t, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"bar": "request",
+			"foo": "response",
+		},
+	}, responseData)
+}
+
+func TestReplaceData_MissingFromResponse(t *testing.T) {
+	replacer := DataReplacer{Schema: &spec.Schema{
+		Properties: map[string]*spec.Schema{
+			"foo": {
+				Type: spec.TypeString,
+			},
+		},
+	}}
+
+	responseData := map[string]interface{}{}
+
+	replacer.ReplaceData(map[string]interface{}{
+		"foo": "request",
+	}, responseData)
+
+	assert.Equal(t, map[string]interface{}{
+		"foo": "request",
+	}, responseData)
+}
+
+func TestReplaceData_NullObject(t *testing.T) {
+	replacer := DataReplacer{
+		Definitions: map[string]*spec.Schema{
+			"address": {
+				Properties: map[string]*spec.Schema{
+					"city":  {Nullable: true, Type: spec.TypeString},
+					"line1": {Nullable: true, Type: spec.TypeString},
+					"type":  {Type: spec.TypeString},
+				},
+				Type: spec.TypeObject,
+			},
+		},
+		Schema: &spec.Schema{
+			Properties: map[string]*spec.Schema{
+				"address": {
+					AnyOf: []*spec.Schema{
+						{Ref: "#/components/schemas/address"},
+					},
+					Nullable: true,
+				},
+			},
+		},
+	}
+
+	responseData := map[string]interface{}{
+		"address": nil,
+	}
+
+	replacer.ReplaceData(map[string]interface{}{
+		"address": map[string]interface{}{
+			"city": "Berlin",
+		},
+	}, responseData)
+
+	// Nullable properties that weren't sent are null
+	assert.Equal(t, map[string]interface{}{
+		"address": map[string]interface{}{
+			"city":  "Berlin",
+			"line1": nil,
+		},
+	}, responseData)
+}
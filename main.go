@@ -1,22 +1,33 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	_ "embed"
 	"flag"
 	"fmt"
-	"github.com/stripe/stripe-mock/embedded"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/stripe/stripe-mock/embedded"
 	"github.com/stripe/stripe-mock/server"
+	"github.com/stripe/stripe-mock/spec"
 )
 
 const defaultPortHTTP = 12111
 const defaultPortHTTPS = 12112
 
+// defaultShutdownTimeout is how long requests in flight are given to finish
+// when stripe-mock is interrupted unless -shutdown-timeout says otherwise.
+const defaultShutdownTimeout = 5 * time.Second
+
 // verbose tracks whether the program is operating in verbose mode
 var verbose bool
 
@@ -24,6 +35,12 @@ var verbose bool
 // as it's run. Versions built from source will always show master.
 var version = "master"
 
+// hiddenFlags are left out of usage output because they're only meant for
+// testing clients' handling of stripe-mock itself rather than for normal use.
+var hiddenFlags = map[string]bool{
+	"mock-version": true,
+}
+
 // ---
 
 func main() {
@@ -53,14 +70,55 @@ func main() {
 	flag.IntVar(&options.httpsPort, "https-port", -1, "Port to listen on for HTTPS; same as '-https-addr :<port>'")
 	flag.StringVar(&options.httpsUnixSocket, "https-unix", "", "Unix socket to listen on for HTTPS")
 
-	flag.IntVar(&options.port, "port", -1, "Port to listen on; also respects PORT from environment")
+	flag.IntVar(&options.listenFD, "listen-fd", 0, "Serve HTTP on an already open listening socket inherited as the given file descriptor (e.g. 3 under systemd socket activation) instead of binding one")
+
+	flag.StringVar(&options.cpuProfilePath, "cpu-profile", "", "Write a CPU profile covering the server's lifetime to the given file on exit")
+	flag.StringVar(&options.memProfilePath, "mem-profile", "", "Write a memory profile to the given file on exit")
+
+	flag.StringVar(&options.certFile, "cert-file", "", "Path to a PEM-encoded TLS certificate to serve HTTPS with; a self-signed certificate for localhost is generated at startup if empty")
+	flag.StringVar(&options.keyFile, "key-file", "", "Path to the PEM-encoded private key of the certificate given with -cert-file")
+	flag.StringVar(&options.controlToken, "control-token", "", "Token that requests to control endpoints under /_stripe-mock/ must send in the X-Stripe-Mock-Token header; control endpoints are open to anyone if empty, which is insecure in shared environments")
+	flag.StringVar(&options.corsOrigin, "cors-origin", "*", "Origin from which browsers may make cross-origin requests, or '*' for any; CORS headers aren't sent and preflight requests aren't answered if empty")
+	flag.IntVar(&options.port, "port", -1, "Port to listen on; also respects STRIPE_MOCK_PORT or PORT from environment")
+	flag.StringVar(&options.declineRulesFile, "decline-rules", "", "Path to a JSON file of rules by which payments are declined, like for amounts ending in certain digits (see README)")
+	flag.Float64Var(&options.errorRate, "error-rate", 0, "Fraction of requests between 0 and 1 that fail with an injected error (for resilience testing)")
+	flag.IntVar(&options.errorRateStatus, "error-rate-status", http.StatusInternalServerError, "HTTP status of errors injected with -error-rate")
+	flag.BoolVar(&options.fuzz, "fuzz", false, "Randomize generated responses within the constraints of their schemas (favoring edge values like nulls, empty arrays, and long strings) to test clients' parsing; seeded by -seed")
+	flag.StringVar(&options.fixedTime, "fixed-time", "", "Time that generated timestamps like `created` are relative to, as a Unix timestamp or in RFC 3339 format, for reproducible responses; the current time if empty")
 	flag.StringVar(&options.fixturesPath, "fixtures", "", "Path to fixtures to use instead of bundled version (should be JSON)")
+	flag.Var(&options.injectedHeaders, "inject-header", "Header to add to every response as `<name>: <value>`; may be given more than once")
+	flag.StringVar(&options.logFormat, "log-format", server.LogFormatText, fmt.Sprintf("Format in which requests and responses are logged; one of '%s' or '%s' (a JSON object per response on a single line)", server.LogFormatText, server.LogFormatJSON))
+	flag.IntVar(&options.maxExpansionDepth, "max-expansion-depth", server.DefaultMaxExpansionDepth, "How many levels deep a property can be expanded with expand[]; deeper expansions are rejected with a 400")
+	flag.Float64Var(&options.maxRequestsPerSecond, "max-requests-per-second", 0, "Requests allowed per second for each API key before requests are rate limited with a 429 (for testing backoff); unlimited if 0")
+	flag.StringVar(&options.mockVersion, "mock-version", "", "Version to report in the Stripe-Mock-Version header instead of the real one (for testing version-gating logic in clients)")
+	flag.BoolVar(&options.objectsEndpoint, "objects-endpoint", false, "Serve control endpoints that list and clear objects stored in stateful mode at /_stripe-mock/objects")
+	flag.BoolVar(&options.openAPIStrict, "openapi-strict", false, "Fail at startup if the OpenAPI spec contains extensions stripe-mock doesn't know about or malformed constructs like unresolvable references")
+	flag.StringVar(&options.objectTTLs, "object-ttl", "", "Comma-separated list of object types and how long objects of each are kept in stateful mode before they expire; e.g. 'checkout.session=24h,ephemeral_key=1h'")
+	flag.StringVar(&options.proxyAPIKey, "proxy-api-key", "", "API key with which requests forwarded to -proxy-upstream are authorized; requests keep their own Authorization header if empty")
+	flag.Var(&options.proxyPaths, "proxy-path", "Path prefix like '/v1/terminal' of requests that are always forwarded to -proxy-upstream instead of being mocked; may be given more than once")
+	flag.StringVar(&options.proxyUpstream, "proxy-upstream", "", "Base URL of an API like 'https://api.stripe.com' to which requests that stripe-mock can't route are forwarded, relaying its responses; unroutable requests get a 404 if empty")
+	flag.StringVar(&options.recordFile, "record", "", "Append every request and its response to the given file as JSON lines, without timings, for diffing in golden tests")
+	flag.StringVar(&options.replayFile, "replay", "", "Serve responses recorded in the given file (in the format of -record) to requests with the same method and path (and query and body, if recorded) instead of generating them")
+	flag.StringVar(&options.requestLogFile, "request-log-file", "", "Append a transcript of every request and response to the given file as JSON lines")
+	flag.Int64Var(&options.requestLogMaxSize, "request-log-max-size", 10*1024*1024, "Size in bytes beyond which the request log file is rotated to '<file>.1'; 0 to never rotate")
+	flag.StringVar(&options.responseValidation, "response-validation", server.ResponseValidationOff, fmt.Sprintf("Validate generated responses against the OpenAPI spec before sending them; one of '%s', '%s' (log violations), or '%s' (log violations and respond with a 500)", server.ResponseValidationOff, server.ResponseValidationLog, server.ResponseValidationStrict))
+	flag.StringVar(&options.retryAfterFormat, "retry-after-format", server.RetryAfterSeconds, fmt.Sprintf("Format of the Retry-After header on rate limited responses; one of '%s' or '%s'", server.RetryAfterSeconds, server.RetryAfterHTTPDate))
+	flag.BoolVar(&options.routeCoverageReport, "route-coverage-report", false, "List operations in the OpenAPI spec that can't be fully served (no usable 200 response or no request validator) at startup; useful when developing a custom spec")
+	flag.Int64Var(&options.seed, "seed", 0, "Seed for randomized behavior like -error-rate and the IDs of new objects so that it can be reproduced; based on the current time if 0")
+	flag.DurationVar(&options.shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "How long requests in flight are given to finish when stripe-mock is interrupted before they're dropped")
+	flag.BoolVar(&options.stateful, "stateful", false, "Keep created objects in memory so that they're reflected in subsequent responses for some endpoints")
+	flag.BoolVar(&options.specEndpoint, "spec-endpoint", false, "Serve the loaded OpenAPI spec at GET /_stripe-mock/spec")
 	flag.StringVar(&options.specPath, "spec", "", "Path to OpenAPI spec to use instead of bundled version (should be JSON)")
+	flag.StringVar(&options.versionedSpecs, "specs", "", "Comma-separated list of API versions and paths to OpenAPI specs with which requests sending each version in Stripe-Version are served instead of the main spec; e.g. '2020-08-27=./spec-2020.json,2022-11-15=./spec-2022.json'")
 	flag.BoolVar(&options.strictVersionCheck, "strict-version-check", false, "Errors if version sent in Stripe-Version doesn't match the one in OpenAPI")
 	flag.StringVar(&options.unixSocket, "unix", "", "Unix socket to listen on")
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose mode")
+	flag.BoolVar(&options.warnUnmatchedParams, "warn-unmatched-params", false, "Log a warning for request parameters that aren't declared in the endpoint's schema (useful for catching typos)")
+	flag.StringVar(&options.webhookSecret, "webhook-secret", "", "Secret with which webhook events are signed in their Stripe-Signature header, like whsec_123; events aren't signed if empty")
+	flag.StringVar(&options.webhookURL, "webhook-url", "", "URL of an endpoint to which webhook events are delivered")
 	flag.BoolVar(&options.showVersion, "version", false, "Show version and exit")
 	flag.BoolVar(&options.beta, "beta", false, "Run with beta OpenAPI spec and fixtures")
+	flag.Usage = func() { printUsage(flag.CommandLine) }
 	flag.Parse()
 
 	fmt.Printf("stripe-mock %s\n", version)
@@ -75,6 +133,19 @@ func main() {
 	}
 
 	server.Version = version
+	if options.mockVersion != "" {
+		server.Version = options.mockVersion
+	}
+
+	stopProfiling, err := options.startProfiling()
+	if err != nil {
+		abort(err.Error())
+	}
+	if stopProfiling != nil {
+		// Stop profiling on abort too so that the profiles still get
+		// written if the server fails to start.
+		registerCleanup(stopProfiling)
+	}
 
 	// For both spec and fixtures stripe-mock will by default load data from
 	// internal assets compiled into the binary, but either one can be
@@ -85,7 +156,11 @@ func main() {
 		specBytes = embedded.BetaOpenAPISpec
 		fixtureBytes = embedded.BetaOpenAPIFixtures
 	}
-	stripeSpec, err := server.LoadSpec(specBytes, options.specPath)
+	loadSpec := server.LoadSpec
+	if options.openAPIStrict {
+		loadSpec = server.LoadSpecStrict
+	}
+	stripeSpec, err := loadSpec(specBytes, options.specPath)
 	if err != nil {
 		abort(err.Error())
 	}
@@ -95,9 +170,71 @@ func main() {
 		abort(err.Error())
 	}
 
-	stub, err := server.NewStubServer(fixtures, stripeSpec, options.strictVersionCheck, verbose)
+	// Specs for other API versions are only ever loaded from files, and
+	// share the main spec's fixtures.
+	versionedSpecPaths, err := parseVersionedSpecs(options.versionedSpecs)
+	if err != nil {
+		abort(err.Error())
+	}
+	var versionedSpecs map[string]*spec.Spec
+	for version, path := range versionedSpecPaths {
+		versionedSpec, err := loadSpec(nil, path)
+		if err != nil {
+			abort(fmt.Sprintf("Error loading spec for API version %s: %v", version, err))
+		}
+		if versionedSpecs == nil {
+			versionedSpecs = make(map[string]*spec.Spec)
+		}
+		versionedSpecs[version] = versionedSpec
+	}
+
+	objectTTLs, err := parseObjectTTLs(options.objectTTLs)
+	if err != nil {
+		abort(err.Error())
+	}
+
+	fixedTime, err := parseFixedTime(options.fixedTime)
 	if err != nil {
-		abort(fmt.Sprintf("Error initializing router: %v\n", err))
+		abort(err.Error())
+	}
+
+	stub, err := server.NewStubServer(fixtures, stripeSpec, &server.StubServerOptions{
+		ControlToken:              options.controlToken,
+		CORSOrigin:                options.corsOrigin,
+		DeclineRulesFile:          options.declineRulesFile,
+		DeferRouterInitialization: true,
+		ErrorRate:                 options.errorRate,
+		ErrorRateStatus:           options.errorRateStatus,
+		FixedTime:                 fixedTime,
+		Fuzz:                      options.fuzz,
+		InjectedHeaders:           options.injectedHeaders,
+		LogFormat:                 options.logFormat,
+		MaxExpansionDepth:         options.maxExpansionDepth,
+		MaxRequestsPerSecond:      options.maxRequestsPerSecond,
+		ObjectsEndpoint:           options.objectsEndpoint,
+		ObjectTTLs:                objectTTLs,
+		ProxyAPIKey:               options.proxyAPIKey,
+		ProxyPaths:                options.proxyPaths,
+		ProxyUpstream:             options.proxyUpstream,
+		RecordFile:                options.recordFile,
+		ReplayFile:                options.replayFile,
+		RequestLogFile:            options.requestLogFile,
+		RequestLogMaxSize:         options.requestLogMaxSize,
+		ResponseValidation:        options.responseValidation,
+		RetryAfterFormat:          options.retryAfterFormat,
+		RouteCoverageReport:       options.routeCoverageReport,
+		Seed:                      options.seed,
+		SpecEndpoint:              options.specEndpoint,
+		Stateful:                  options.stateful,
+		StrictVersionCheck:        options.strictVersionCheck,
+		Verbose:                   verbose,
+		VersionedSpecs:            versionedSpecs,
+		WarnUnmatchedParams:       options.warnUnmatchedParams,
+		WebhookSecret:             options.webhookSecret,
+		WebhookURL:                options.webhookURL,
+	})
+	if err != nil {
+		abort(fmt.Sprintf("Error initializing server: %v\n", err))
 	}
 
 	httpMux := http.NewServeMux()
@@ -107,23 +244,28 @@ func main() {
 	// `/v1/charges`.
 	handler := &server.DoubleSlashFixHandler{Mux: httpMux}
 
+	// All started servers, so that they can be shut down together.
+	var servers []*http.Server
+
 	httpListener, err := options.getHTTPListener()
 	if err != nil {
+		stub.Close()
 		abort(err.Error())
 	}
 
 	// Only start HTTP if requested (it will activate by default with no arguments, but it won't start if
 	// HTTPS is explicitly requested and HTTP is not).
 	if httpListener != nil {
-		server := http.Server{
+		server := &http.Server{
 			Handler: handler,
 		}
+		servers = append(servers, server)
 
 		// Listen in a new Goroutine that so we can start a simultaneous HTTPS
 		// listener if necessary.
 		go func() {
 			err := server.Serve(httpListener)
-			if err != nil {
+			if err != nil && err != http.ErrServerClosed {
 				abort(err.Error())
 			}
 		}()
@@ -131,6 +273,7 @@ func main() {
 
 	httpsListener, err := options.getNonSecureHTTPSListener()
 	if err != nil {
+		stub.Close()
 		abort(err.Error())
 	}
 
@@ -138,13 +281,15 @@ func main() {
 	// arguments, but it won't start if HTTP is explicitly requested and HTTPS
 	// is not).
 	if httpsListener != nil {
-		// Our self-signed certificate is bundled up using go:embed so that
-		// it stays easy to distribute stripe-mock as a standalone binary with
-		// no other dependencies.
-		certificate, err := getTLSCertificate()
+		// Unless a certificate was given, one is generated so that
+		// stripe-mock stays easy to distribute as a standalone binary with no
+		// other dependencies.
+		certificate, err := options.getTLSCertificate()
 		if err != nil {
+			stub.Close()
 			abort(err.Error())
 		}
+		fmt.Printf("TLS certificate SHA-256 fingerprint: %s\n", certificateFingerprint(certificate))
 
 		tlsConfig := &tls.Config{
 			Certificates: []tls.Certificate{certificate},
@@ -157,32 +302,85 @@ func main() {
 			NextProtos: []string{"h2"},
 		}
 
-		server := http.Server{
+		server := &http.Server{
 			Handler:   handler,
 			TLSConfig: tlsConfig,
 		}
+		servers = append(servers, server)
 		tlsListener := tls.NewListener(httpsListener, tlsConfig)
 
 		go func() {
 			err := server.Serve(tlsListener)
-			if err != nil {
+			if err != nil && err != http.ErrServerClosed {
 				abort(err.Error())
 			}
 		}()
 	}
 
-	// Block forever. The serve Goroutines above will abort the program if
-	// either of them fails.
-	select {}
+	// The router is only initialized once requests can be received, which
+	// takes a while for the full spec, so that those that arrive in the
+	// meantime get a 503 instead of a refused connection.
+	go func() {
+		err := stub.InitializeRouter()
+		if err != nil {
+			abort(fmt.Sprintf("Error initializing router: %v\n", err))
+		}
+	}()
+
+	// Block until we're interrupted. The serve Goroutines above will abort
+	// the program if either of them fails, as will router initialization.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	fmt.Printf("Received %v; shutting down (waiting up to %v for requests in flight)\n",
+		sig, options.shutdownTimeout)
+
+	// Give requests that are still in flight a chance to finish before
+	// exiting, which matters most when latency is being simulated.
+	err = shutdownServers(servers, options.shutdownTimeout)
+	if err != nil {
+		fmt.Printf("Requests still in flight after %v were dropped: %v\n",
+			options.shutdownTimeout, err)
+	}
+	err = stub.Close()
+	if err != nil {
+		fmt.Printf("Error closing files: %v\n", err)
+	}
+	fmt.Printf("Shut down\n")
+
+	runCleanups()
 }
 
 //
 // Private types
 //
 
+// stringListFlag is a flag that can be given more than once, collecting all
+// of its values.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 // options is a container for the command line options passed to stripe-mock.
 type options struct {
-	fixturesPath string
+	certFile         string
+	controlToken     string
+	corsOrigin       string
+	cpuProfilePath   string
+	declineRulesFile string
+	errorRate        float64
+	errorRateStatus  int
+	fixedTime        string
+	fixturesPath     string
+	fuzz             bool
+	memProfilePath   string
 
 	http            bool
 	httpAddr        string
@@ -196,12 +394,43 @@ type options struct {
 	httpsPort        int
 	httpsUnixSocket  string
 
-	port               int
-	showVersion        bool
-	specPath           string
-	strictVersionCheck bool
-	unixSocket         string
-	beta               bool
+	// listenFD is the file descriptor of an inherited listening socket to
+	// serve HTTP on. 0 (which is always stdin) means that none was given.
+	listenFD int
+
+	injectedHeaders      stringListFlag
+	keyFile              string
+	logFormat            string
+	maxExpansionDepth    int
+	maxRequestsPerSecond float64
+	mockVersion          string
+	objectsEndpoint      bool
+	objectTTLs           string
+	openAPIStrict        bool
+	port                 int
+	proxyAPIKey          string
+	proxyPaths           stringListFlag
+	proxyUpstream        string
+	recordFile           string
+	replayFile           string
+	requestLogFile       string
+	requestLogMaxSize    int64
+	responseValidation   string
+	retryAfterFormat     string
+	routeCoverageReport  bool
+	seed                 int64
+	showVersion          bool
+	shutdownTimeout      time.Duration
+	specEndpoint         bool
+	specPath             string
+	stateful             bool
+	strictVersionCheck   bool
+	unixSocket           string
+	versionedSpecs       string
+	warnUnmatchedParams  bool
+	webhookSecret        string
+	webhookURL           string
+	beta                 bool
 }
 
 func (o *options) checkConflictingOptions() error {
@@ -213,6 +442,10 @@ func (o *options) checkConflictingOptions() error {
 	// HTTP
 	//
 
+	if o.listenFD != 0 && (o.http || o.unixSocket != "" || o.port != -1 || o.httpUnixSocket != "" || o.httpAddr != "" || o.httpPort != -1) {
+		return fmt.Errorf("Please don't specify -http, -port, -unix, -http-addr, -http-port, or -http-unix when using -listen-fd")
+	}
+
 	if o.http && (o.httpUnixSocket != "" || o.httpAddr != "" || o.httpPort != -1) {
 		return fmt.Errorf("Please don't specify -http when using -http-addr, -http-port, or -http-unix")
 	}
@@ -241,6 +474,10 @@ func (o *options) checkConflictingOptions() error {
 	// HTTPS
 	//
 
+	if (o.certFile == "") != (o.keyFile == "") {
+		return fmt.Errorf("Please specify both -cert-file and -key-file, or neither")
+	}
+
 	if o.https && (o.httpsUnixSocket != "" || o.httpsAddr != "" || o.httpsPort != -1) {
 		return fmt.Errorf("Please don't specify -https when using -https-addr, -https-port, or -https-unix")
 	}
@@ -273,6 +510,10 @@ func (o *options) checkConflictingOptions() error {
 func (o *options) getHTTPListener() (net.Listener, error) {
 	protocol := "HTTP"
 
+	if o.listenFD != 0 {
+		return getFileDescriptorListener(o.listenFD, protocol)
+	}
+
 	if o.httpAddr != "" {
 		return getPortListener(o.httpAddr, protocol)
 	}
@@ -323,19 +564,11 @@ func (o *options) getNonSecureHTTPSListener() (net.Listener, error) {
 	// HTTPS is active by default, but only if HTTP has not been explicitly
 	// activated. HTTP may be activated with `-http`, `-http-port`, or
 	// `-http-unix`, but also with the old backwards compatible basic `-port`
-	// option.
-	if o.http || o.httpPort != -1 || o.httpUnixSocket != "" || o.port != -1 {
+	// and `-unix` options.
+	if o.http || o.httpPort != -1 || o.httpUnixSocket != "" || o.port != -1 || o.unixSocket != "" || o.listenFD != 0 {
 		return nil, nil
 	}
 
-	if o.port != -1 {
-		return getPortListener(fmt.Sprintf(":%v", o.port), protocol)
-	}
-
-	if o.unixSocket != "" {
-		return getUnixSocketListener(o.unixSocket, protocol)
-	}
-
 	return getPortListenerDefault(o.httpsPortDefault, protocol)
 }
 
@@ -343,14 +576,61 @@ func (o *options) getNonSecureHTTPSListener() (net.Listener, error) {
 // Private functions
 //
 
+// cleanups are functions that run before stripe-mock exits, even if it's
+// because of abort. cleanupsMu also makes an abort wait for the cleanups that
+// another is already running.
+var (
+	cleanups   []func()
+	cleanupsMu sync.Mutex
+)
+
 func abort(message string) {
 	fmt.Fprint(os.Stderr, message)
+	runCleanups()
 	os.Exit(1)
 }
 
-// getTLSCertificate reads a certificate and key embedded into the binary
-func getTLSCertificate() (tls.Certificate, error) {
-	return tls.X509KeyPair(embedded.CertCert, embedded.CertKey)
+// registerCleanup registers a function to run before exiting. Cleanups run in
+// the reverse order they were registered in.
+func registerCleanup(cleanup func()) {
+	cleanupsMu.Lock()
+	defer cleanupsMu.Unlock()
+
+	cleanups = append(cleanups, cleanup)
+}
+
+// runCleanups runs the registered cleanups. Each one runs only once, no
+// matter how many times this is called.
+func runCleanups() {
+	cleanupsMu.Lock()
+	defer cleanupsMu.Unlock()
+
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	cleanups = nil
+}
+
+// getFileDescriptorListener gets a listener for a socket that's already open
+// and listening, and which was inherited from the parent process as the given
+// file descriptor. This is how socket activation by process supervisors like
+// systemd works.
+func getFileDescriptorListener(fd int, protocol string) (net.Listener, error) {
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%v", fd))
+	if file == nil {
+		return nil, fmt.Errorf("error listening on file descriptor %v: invalid file descriptor", fd)
+	}
+
+	// The listener gets its own duplicate of the file descriptor, so the
+	// original can be closed.
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error listening on file descriptor %v: %v", fd, err)
+	}
+
+	fmt.Printf("Listening for %s on file descriptor: %v\n", protocol, fd)
+	return listener, nil
 }
 
 func getPortListener(addr string, protocol string) (net.Listener, error) {
@@ -360,17 +640,39 @@ func getPortListener(addr string, protocol string) (net.Listener, error) {
 	}
 
 	fmt.Printf("Listening for %s at address: %v\n", protocol, listener.Addr())
+
+	// When the system chose the port, print it on a line of its own so that
+	// scripts starting stripe-mock can easily find out what it is.
+	if isSystemChosenPort(addr) {
+		if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok {
+			fmt.Printf("Listening for %s on port: %v\n", protocol, tcpAddr.Port)
+		}
+	}
+
 	return listener, nil
 }
 
+// isSystemChosenPort checks whether listening at an address lets the system
+// choose the port, which it does if the port is `0` or left out, like in
+// `127.0.0.1:`.
+func isSystemChosenPort(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && (port == "" || port == "0")
+}
+
 // getPortListenerDefault gets a port listener based on the environment
-// variable `PORT`, or falls back to a listener on the default port
-// (`defaultPort`) if one was not present.
+// variable `STRIPE_MOCK_PORT` or `PORT` (in that order of preference), or
+// falls back to a listener on the default port (`defaultPort`) if neither was
+// present.
 func getPortListenerDefault(defaultPort int, protocol string) (net.Listener, error) {
-	if os.Getenv("PORT") != "" {
-		envPort, err := strconv.Atoi(os.Getenv("PORT"))
+	for _, name := range []string{"STRIPE_MOCK_PORT", "PORT"} {
+		if os.Getenv(name) == "" {
+			continue
+		}
+
+		envPort, err := strconv.Atoi(os.Getenv(name))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid port in %s: %v", name, err)
 		}
 		return getPortListener(fmt.Sprintf(":%v", envPort), protocol)
 	}
@@ -379,6 +681,13 @@ func getPortListenerDefault(defaultPort int, protocol string) (net.Listener, err
 }
 
 func getUnixSocketListener(unixSocket, protocol string) (net.Listener, error) {
+	err := removeStaleUnixSocket(unixSocket)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket file is removed again when the listener is closed on
+	// shutdown.
 	listener, err := net.Listen("unix", unixSocket)
 	if err != nil {
 		return nil, fmt.Errorf("error listening on socket: %v", err)
@@ -387,3 +696,141 @@ func getUnixSocketListener(unixSocket, protocol string) (net.Listener, error) {
 	fmt.Printf("Listening for %s on Unix socket: %s\n", protocol, unixSocket)
 	return listener, nil
 }
+
+// removeStaleUnixSocket removes a socket file left behind at the given path
+// by a process that didn't exit cleanly, which would otherwise keep a new
+// listener from binding it. Sockets that something is still listening on and
+// files that aren't sockets are left alone, with an error.
+func removeStaleUnixSocket(unixSocket string) error {
+	info, err := os.Lstat(unixSocket)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking socket: %v", err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("error listening on socket: %s exists and isn't a socket", unixSocket)
+	}
+
+	conn, err := net.DialTimeout("unix", unixSocket, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("error listening on socket: %s is already in use", unixSocket)
+	}
+
+	fmt.Printf("Removing stale Unix socket: %s\n", unixSocket)
+	err = os.Remove(unixSocket)
+	if err != nil {
+		return fmt.Errorf("error removing stale socket: %v", err)
+	}
+	return nil
+}
+
+// parseFixedTime parses the value of -fixed-time, which is either a Unix
+// timestamp like `1700000000` or a time in RFC 3339 format like
+// `2023-11-14T22:13:20Z`. The zero time is returned if it's empty.
+func parseFixedTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(timestamp, 0).UTC(), nil
+	}
+
+	fixedTime, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid -fixed-time '%s'; expected a Unix timestamp like '1700000000' or an RFC 3339 time like '2023-11-14T22:13:20Z'", value)
+	}
+	return fixedTime, nil
+}
+
+// parseObjectTTLs parses the value of -object-ttl, a comma-separated list of
+// `<object type>=<duration>` pairs, into a map of object types to durations.
+func parseObjectTTLs(value string) (map[string]time.Duration, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	ttls := make(map[string]time.Duration)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid -object-ttl entry '%s'; expected '<object type>=<duration>'", pair)
+		}
+
+		ttl, err := time.ParseDuration(parts[1])
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("Invalid -object-ttl duration '%s' for %s; expected a positive duration like '1h'", parts[1], parts[0])
+		}
+		ttls[parts[0]] = ttl
+	}
+	return ttls, nil
+}
+
+// parseVersionedSpecs parses the value of -specs, a comma-separated list of
+// pairs like `2020-08-27=./spec-2020.json`, into paths keyed by API version.
+func parseVersionedSpecs(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	paths := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid -specs entry '%s'; expected '<API version>=<path>'", pair)
+		}
+		if _, ok := paths[parts[0]]; ok {
+			return nil, fmt.Errorf("Invalid -specs entry '%s'; API version %s was already given a spec", pair, parts[0])
+		}
+		paths[parts[0]] = parts[1]
+	}
+	return paths, nil
+}
+
+// printUsage prints usage for a set of flags like its default usage output,
+// except that hidden flags are left out.
+func printUsage(flags *flag.FlagSet) {
+	fmt.Fprintf(flags.Output(), "Usage of %s:\n", flags.Name())
+
+	visible := flag.NewFlagSet(flags.Name(), flag.ContinueOnError)
+	visible.SetOutput(flags.Output())
+	flags.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		visible.Var(f.Value, f.Name, f.Usage)
+		visible.Lookup(f.Name).DefValue = f.DefValue
+	})
+	visible.PrintDefaults()
+}
+
+// shutdownServers stops servers from accepting new connections and waits for
+// the requests that they're serving to finish. Connections that are still
+// active after the timeout are closed and an error is returned.
+func shutdownServers(servers []*http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			err := server.Shutdown(ctx)
+			if err != nil {
+				server.Close()
+			}
+			errs <- err
+		}(server)
+	}
+
+	var firstErr error
+	for range servers {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
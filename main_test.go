@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/require"
 )
@@ -116,6 +124,15 @@ func TestCheckConflictingOptions(t *testing.T) {
 		assert.Equal(t, fmt.Errorf("Please don't specify -port or -unix when using -http-addr, -http-port, or -http-unix"), err)
 	}
 
+	{
+		options := getDefaultOptions()
+		options.listenFD = 3
+		options.httpPort = 12111
+
+		err := options.checkConflictingOptions()
+		assert.Equal(t, fmt.Errorf("Please don't specify -http, -port, -unix, -http-addr, -http-port, or -http-unix when using -listen-fd"), err)
+	}
+
 	{
 		options := getDefaultOptions()
 		options.httpAddr = "127.0.0.1:12111"
@@ -191,6 +208,14 @@ func TestCheckConflictingOptions(t *testing.T) {
 		err := options.checkConflictingOptions()
 		assert.Equal(t, fmt.Errorf("Please specify only one of -https-addr, -https-port, or -https-unix"), err)
 	}
+
+	{
+		options := getDefaultOptions()
+		options.certFile = "cert.pem"
+
+		err := options.checkConflictingOptions()
+		assert.Equal(t, fmt.Errorf("Please specify both -cert-file and -key-file, or neither"), err)
+	}
 }
 
 // Specify :0 to ask the OS for a free port.
@@ -219,6 +244,25 @@ func TestOptionsGetHTTPListener(t *testing.T) {
 		listener.Close()
 	}
 
+	// Gets a listener for an inherited socket with `-listen-fd`.
+	{
+		inherited, err := net.Listen("tcp", fmt.Sprintf(":%v", freePort))
+		assert.NoError(t, err)
+		defer inherited.Close()
+
+		file, err := inherited.(*net.TCPListener).File()
+		assert.NoError(t, err)
+		defer file.Close()
+
+		options := &options{
+			listenFD: int(file.Fd()),
+		}
+		listener, err := options.getHTTPListener()
+		assert.NoError(t, err)
+		assert.Equal(t, inherited.Addr().String(), listener.Addr().String())
+		listener.Close()
+	}
+
 	// No listener when HTTPS is explicitly requested, but HTTP is not.
 	{
 		options := &options{
@@ -242,6 +286,74 @@ func TestOptionsGetHTTPListener(t *testing.T) {
 	}
 }
 
+func TestGetPortListenerDefault_Environment(t *testing.T) {
+	// Find a port that's free to listen on again.
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", freePort))
+	assert.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	// STRIPE_MOCK_PORT is preferred over PORT and the default port.
+	t.Setenv("STRIPE_MOCK_PORT", fmt.Sprintf("%v", port))
+	t.Setenv("PORT", "abc")
+	listener, err = getPortListenerDefault(freePort, "HTTP")
+	assert.NoError(t, err)
+	assert.Equal(t, port, listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	t.Setenv("STRIPE_MOCK_PORT", "abc")
+	_, err = getPortListenerDefault(freePort, "HTTP")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "STRIPE_MOCK_PORT")
+}
+
+func TestIsSystemChosenPort(t *testing.T) {
+	assert.True(t, isSystemChosenPort(":0"))
+	assert.True(t, isSystemChosenPort("127.0.0.1:0"))
+	assert.True(t, isSystemChosenPort("127.0.0.1:"))
+	assert.True(t, isSystemChosenPort(":"))
+	assert.False(t, isSystemChosenPort(":12111"))
+	assert.False(t, isSystemChosenPort("127.0.0.1"))
+}
+
+func TestGetUnixSocketListener(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stripe-mock")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	unixSocket := filepath.Join(dir, "stripe-mock.sock")
+
+	// A socket left behind by a process that didn't exit cleanly is replaced
+	{
+		stale, err := net.Listen("unix", unixSocket)
+		assert.NoError(t, err)
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		listener, err := getUnixSocketListener(unixSocket, "HTTP")
+		assert.NoError(t, err)
+
+		// A socket that's still being listened on is left alone
+		_, err = getUnixSocketListener(unixSocket, "HTTP")
+		assert.Error(t, err)
+
+		// The socket is removed when the listener is closed
+		listener.Close()
+		_, err = os.Lstat(unixSocket)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// Files that aren't sockets are never removed
+	{
+		err := os.WriteFile(unixSocket, []byte("data"), 0600)
+		assert.NoError(t, err)
+
+		_, err = getUnixSocketListener(unixSocket, "HTTP")
+		assert.Error(t, err)
+		_, err = os.Lstat(unixSocket)
+		assert.NoError(t, err)
+	}
+}
+
 func TestOptionsGetNonSecureHTTPSListener(t *testing.T) {
 	// Gets a listener when explicitly requested with `-https-addr`.
 	{
@@ -276,6 +388,17 @@ func TestOptionsGetNonSecureHTTPSListener(t *testing.T) {
 		assert.Nil(t, listener)
 	}
 
+	// No listener when HTTP is served on an inherited socket.
+	{
+		options := &options{
+			httpsPort: -1, // Signals not specified
+			listenFD:  3,
+		}
+		listener, err := options.getNonSecureHTTPSListener()
+		assert.NoError(t, err)
+		assert.Nil(t, listener)
+	}
+
 	// No listener when HTTP is explicitly requested with the old `-port`
 	// option.
 	{
@@ -288,6 +411,18 @@ func TestOptionsGetNonSecureHTTPSListener(t *testing.T) {
 		assert.Nil(t, listener)
 	}
 
+	// No listener when HTTP is explicitly requested with the old `-unix`
+	// option, which would otherwise be bound twice.
+	{
+		options := &options{
+			httpsPort:  -1, // Signals not specified
+			unixSocket: "/tmp/stripe-mock.sock",
+		}
+		listener, err := options.getNonSecureHTTPSListener()
+		assert.NoError(t, err)
+		assert.Nil(t, listener)
+	}
+
 	// Activates on the default HTTPS port if no other args provided.
 	{
 		options := &options{
@@ -299,3 +434,156 @@ func TestOptionsGetNonSecureHTTPSListener(t *testing.T) {
 		listener.Close()
 	}
 }
+
+func TestParseFixedTime(t *testing.T) {
+	{
+		fixedTime, err := parseFixedTime("")
+		assert.NoError(t, err)
+		assert.True(t, fixedTime.IsZero())
+	}
+
+	for _, value := range []string{"1700000000", "2023-11-14T22:13:20Z", "2023-11-15T00:13:20+02:00"} {
+		fixedTime, err := parseFixedTime(value)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1700000000), fixedTime.Unix())
+	}
+
+	for _, value := range []string{"yesterday", "2023-11-14", "1.5"} {
+		_, err := parseFixedTime(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseObjectTTLs(t *testing.T) {
+	{
+		ttls, err := parseObjectTTLs("")
+		assert.NoError(t, err)
+		assert.Nil(t, ttls)
+	}
+
+	{
+		ttls, err := parseObjectTTLs("checkout.session=24h,ephemeral_key=90s")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]time.Duration{
+			"checkout.session": 24 * time.Hour,
+			"ephemeral_key":    90 * time.Second,
+		}, ttls)
+	}
+
+	for _, value := range []string{"checkout.session", "=1h", "ephemeral_key=soon", "ephemeral_key=-1h"} {
+		_, err := parseObjectTTLs(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseVersionedSpecs(t *testing.T) {
+	{
+		paths, err := parseVersionedSpecs("")
+		assert.NoError(t, err)
+		assert.Nil(t, paths)
+	}
+
+	{
+		paths, err := parseVersionedSpecs("2020-08-27=./spec-2020.json,2022-11-15=spec=2022.json")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"2020-08-27": "./spec-2020.json",
+			"2022-11-15": "spec=2022.json",
+		}, paths)
+	}
+
+	for _, value := range []string{"./spec.json", "=./spec.json", "2020-08-27=",
+		"2020-08-27=a.json,2020-08-27=b.json"} {
+
+		_, err := parseVersionedSpecs(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestPrintUsage(t *testing.T) {
+	var out bytes.Buffer
+	flags := flag.NewFlagSet("stripe-mock", flag.ContinueOnError)
+	flags.SetOutput(&out)
+	flags.String("mock-version", "", "Hidden flag")
+	flags.Int("port", 12111, "Visible flag")
+
+	printUsage(flags)
+	assert.Contains(t, out.String(), "Usage of stripe-mock:")
+	assert.Contains(t, out.String(), "-port")
+	assert.Contains(t, out.String(), "(default 12111)")
+	assert.NotContains(t, out.String(), "mock-version")
+}
+
+func TestRunCleanups(t *testing.T) {
+	var ran []int
+	registerCleanup(func() { ran = append(ran, 1) })
+	registerCleanup(func() { ran = append(ran, 2) })
+
+	runCleanups()
+	assert.Equal(t, []int{2, 1}, ran)
+
+	// Cleanups that already ran don't run again.
+	runCleanups()
+	assert.Equal(t, []int{2, 1}, ran)
+}
+
+func TestShutdownServers(t *testing.T) {
+	// startServer starts a server whose requests take the given time, and
+	// returns it along with its URL and a channel that receives a value
+	// whenever a request starts.
+	startServer := func(requestTime time.Duration) (*http.Server, string, chan struct{}) {
+		started := make(chan struct{}, 1)
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				time.Sleep(requestTime)
+				w.WriteHeader(http.StatusOK)
+			}),
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go server.Serve(listener)
+
+		return server, "http://" + listener.Addr().String(), started
+	}
+
+	// sendRequest sends a request in the background, returning a channel that
+	// receives its error once it's finished.
+	sendRequest := func(url string) chan error {
+		result := make(chan error, 1)
+		go func() {
+			resp, err := http.Get(url)
+			if err == nil {
+				resp.Body.Close()
+			}
+			result <- err
+		}()
+		return result
+	}
+
+	// Requests in flight that finish within the timeout complete, and new
+	// ones aren't accepted
+	{
+		server, url, started := startServer(200 * time.Millisecond)
+		result := sendRequest(url)
+		<-started
+
+		assert.NoError(t, shutdownServers([]*http.Server{server}, 5*time.Second))
+		assert.NoError(t, <-result)
+
+		_, err := http.Get(url)
+		assert.Error(t, err)
+	}
+
+	// Requests in flight that take longer than the timeout are dropped
+	{
+		server, url, started := startServer(5 * time.Second)
+		result := sendRequest(url)
+		<-started
+
+		err := shutdownServers([]*http.Server{server}, 100*time.Millisecond)
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Error(t, <-result)
+	}
+}
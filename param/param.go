@@ -1,6 +1,9 @@
 package param
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -26,6 +29,10 @@ import (
 // the Stripe API decodes data. These complex types are what makes the param
 // package's implementation non-trivial. We rely on the nestedtypeassembler
 // subpackage to do the heavy lifting for that.
+//
+// The exception is a JSON body, which already has complex types and is
+// decoded as is. Its parameters take precedence over any of the same name in
+// the query string.
 func ParseParams(r *http.Request) (map[string]interface{}, error) {
 	var values form.Values
 
@@ -53,6 +60,22 @@ func ParseParams(r *http.Request) (map[string]interface{}, error) {
 		return nil, err
 	}
 
+	if contentType == JSONMediaType && r.Method != "GET" {
+		jsonParams, err := parseJSONBody(r)
+		if err != nil {
+			return nil, err
+		}
+
+		params, err := nestedtypeassembler.AssembleParams(values)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range jsonParams {
+			params[key] = value
+		}
+		return params, nil
+	}
+
 	if contentType == multipartMediaType {
 		err := r.ParseMultipartForm(maxMemory)
 		if err != nil {
@@ -101,6 +124,72 @@ func ParseParams(r *http.Request) (map[string]interface{}, error) {
 	return nestedtypeassembler.AssembleParams(values)
 }
 
+//
+// Public constants
+//
+
+// JSONMediaType is the `Content-Type` for a request with a JSON body.
+const JSONMediaType = "application/json"
+
+//
+// Private functions
+//
+
+// normalizeJSONNumbers replaces the numbers in decoded JSON with ints if
+// they're whole and float64s otherwise, which are the types that parameters
+// from a form are coerced to.
+func normalizeJSONNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+
+	case map[string]interface{}:
+		for key, subValue := range v {
+			v[key] = normalizeJSONNumbers(subValue)
+		}
+
+	case []interface{}:
+		for i, subValue := range v {
+			v[i] = normalizeJSONNumbers(subValue)
+		}
+	}
+
+	return value
+}
+
+// parseJSONBody decodes a request's JSON body, which must be an object.
+func parseJSONBody(r *http.Request) (map[string]interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+
+	// An empty body is as good as an empty object.
+	if len(bytes.TrimSpace(body)) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var params map[string]interface{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		return nil, fmt.Errorf("Request body isn't a valid JSON object: %v", err)
+	}
+	if params == nil || decoder.More() {
+		return nil, fmt.Errorf("Request body isn't a valid JSON object")
+	}
+
+	normalizeJSONNumbers(params)
+	return params, nil
+}
+
 //
 // Private constants
 //
@@ -45,6 +45,56 @@ func TestParseParams_Form(t *testing.T) {
 	}
 }
 
+func TestParseParams_JSON(t *testing.T) {
+	// JSON objects in the request body, with numbers decoded to the same
+	// types as coerced form values.
+	{
+		req := httptest.NewRequest(http.MethodPost, "/",
+			bytes.NewBufferString(`{"amount":123,"rate":1.5,"metadata":{"foo":"bar"},"items":[{"qty":2}]}`))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		params, err := ParseParams(req)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{
+			"amount":   123,
+			"items":    []interface{}{map[string]interface{}{"qty": 2}},
+			"metadata": map[string]interface{}{"foo": "bar"},
+			"rate":     1.5,
+		}, params)
+	}
+
+	// Values from the query string are included, but the body's take
+	// precedence.
+	{
+		req := httptest.NewRequest(http.MethodPost, "/?query_param=query_val&amount=1",
+			bytes.NewBufferString(`{"amount":123}`))
+		req.Header.Set("Content-Type", "application/json")
+		params, err := ParseParams(req)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{
+			"amount":      123,
+			"query_param": "query_val",
+		}, params)
+	}
+
+	// An empty body has no parameters.
+	{
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Content-Type", "application/json")
+		params, err := ParseParams(req)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{}, params)
+	}
+
+	// Bodies that aren't a JSON object are an error.
+	for _, body := range []string{`{"amount":`, `[1, 2]`, `null`, `{} {}`} {
+		req := httptest.NewRequest(http.MethodPost, "/",
+			bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		_, err := ParseParams(req)
+		assert.Error(t, err, body)
+	}
+}
+
 func TestParseParams_MultipartForm(t *testing.T) {
 	var b bytes.Buffer
 	w := multipart.NewWriter(&b)
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling starts CPU profiling if it was requested with -cpu-profile.
+//
+// It returns a function that stops CPU profiling and writes a heap profile if
+// one was requested with -mem-profile. The function should be called once the
+// server is done serving requests so that the profiles cover the server's
+// whole lifecycle. It's nil if no profiling was requested.
+func (o *options) startProfiling() (func(), error) {
+	if o.cpuProfilePath == "" && o.memProfilePath == "" {
+		return nil, nil
+	}
+
+	var cpuProfile *os.File
+	if o.cpuProfilePath != "" {
+		var err error
+		cpuProfile, err = os.Create(o.cpuProfilePath)
+		if err != nil {
+			return nil, fmt.Errorf("error creating CPU profile: %v", err)
+		}
+
+		err = pprof.StartCPUProfile(cpuProfile)
+		if err != nil {
+			cpuProfile.Close()
+			return nil, fmt.Errorf("error starting CPU profile: %v", err)
+		}
+
+		fmt.Printf("Writing CPU profile to: %s\n", o.cpuProfilePath)
+	}
+
+	return func() {
+		if cpuProfile != nil {
+			pprof.StopCPUProfile()
+			cpuProfile.Close()
+		}
+
+		if o.memProfilePath != "" {
+			err := writeMemProfile(o.memProfilePath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return
+			}
+
+			fmt.Printf("Wrote memory profile to: %s\n", o.memProfilePath)
+		}
+	}, nil
+}
+
+// writeMemProfile writes a heap profile to the given path.
+func writeMemProfile(path string) error {
+	memProfile, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating memory profile: %v", err)
+	}
+	defer memProfile.Close()
+
+	// Get up-to-date statistics on allocations.
+	runtime.GC()
+
+	err = pprof.WriteHeapProfile(memProfile)
+	if err != nil {
+		return fmt.Errorf("error writing memory profile: %v", err)
+	}
+
+	return nil
+}
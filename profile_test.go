@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestOptionsStartProfiling(t *testing.T) {
+	// No profiling requested
+	{
+		options := getDefaultOptions()
+		stopProfiling, err := options.startProfiling()
+		assert.NoError(t, err)
+		assert.Nil(t, stopProfiling)
+	}
+
+	// Both profiles are written when stopped
+	{
+		dir := t.TempDir()
+
+		options := getDefaultOptions()
+		options.cpuProfilePath = filepath.Join(dir, "cpu.prof")
+		options.memProfilePath = filepath.Join(dir, "mem.prof")
+
+		stopProfiling, err := options.startProfiling()
+		assert.NoError(t, err)
+		assert.NotNil(t, stopProfiling)
+		stopProfiling()
+
+		for _, path := range []string{options.cpuProfilePath, options.memProfilePath} {
+			info, err := os.Stat(path)
+			assert.NoError(t, err)
+			assert.True(t, info.Size() > 0)
+		}
+	}
+
+	// Bad CPU profile path
+	{
+		options := getDefaultOptions()
+		options.cpuProfilePath = filepath.Join(t.TempDir(), "doesnt-exist", "cpu.prof")
+
+		_, err := options.startProfiling()
+		assert.Error(t, err)
+	}
+}
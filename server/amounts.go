@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// Private values
+//
+
+const (
+	negativeAmount = "This value must be greater than or equal to 0."
+
+	fractionalAmount = "Invalid integer: %s. %s is a zero-decimal currency, " +
+		"so amounts in it are whole units and can't have a fractional part."
+)
+
+// amountParams are the names of parameters that are amounts of money in the
+// smallest unit of their currency, like cents.
+var amountParams = map[string]bool{
+	"amount":      true,
+	"unit_amount": true,
+}
+
+// zeroDecimalCurrencies are the currencies that don't have a smaller unit, so
+// their amounts are in whole units, like `amount=500` for ¥500.
+var zeroDecimalCurrencies = map[string]bool{
+	"bif": true,
+	"clp": true,
+	"djf": true,
+	"gnf": true,
+	"jpy": true,
+	"kmf": true,
+	"krw": true,
+	"mga": true,
+	"pyg": true,
+	"rwf": true,
+	"ugx": true,
+	"vnd": true,
+	"vuv": true,
+	"xaf": true,
+	"xof": true,
+	"xpf": true,
+}
+
+//
+// Private functions
+//
+
+// checkAmounts checks the amounts in request data before it's validated
+// against its schema, so that invalid ones get errors like the Stripe API's
+// instead of generic validation errors. Amounts can't be negative, and
+// amounts in a zero-decimal currency can't be fractional.
+//
+// The currency of an amount is the `currency` next to it, or that of the
+// nearest object that it's nested in, so that for example `price_data` can
+// have its own.
+func checkAmounts(data map[string]interface{}) *ResponseError {
+	return checkAmountsIn(data, nil, "")
+}
+
+// checkAmountsIn checks the amounts in a value found at the given path of
+// request data. See checkAmounts.
+func checkAmountsIn(value interface{}, path []string, currency string) *ResponseError {
+	switch value := value.(type) {
+	case []interface{}:
+		for i, item := range value {
+			itemPath := append(append([]string{}, path...), strconv.Itoa(i))
+			if stripeError := checkAmountsIn(item, itemPath, currency); stripeError != nil {
+				return stripeError
+			}
+		}
+
+	case map[string]interface{}:
+		if objectCurrency, ok := value["currency"].(string); ok {
+			currency = strings.ToLower(objectCurrency)
+		}
+
+		// Sort keys so that the first invalid amount is always the same one
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			propertyPath := append(append([]string{}, path...), key)
+			if amountParams[key] {
+				if stripeError := checkAmount(value[key], propertyPath, currency); stripeError != nil {
+					return stripeError
+				}
+				continue
+			}
+			if stripeError := checkAmountsIn(value[key], propertyPath, currency); stripeError != nil {
+				return stripeError
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkAmount checks a single amount. Values that aren't numbers are left for
+// schema validation to reject.
+func checkAmount(value interface{}, path []string, currency string) *ResponseError {
+	amount, ok := parseAmount(value)
+	if !ok {
+		return nil
+	}
+
+	param := formatParamName(path)
+
+	if amount < 0 {
+		return createStripeError(typeInvalidRequestError, negativeAmount,
+			withCode("parameter_invalid_integer"), withParam(param))
+	}
+
+	if amount != math.Trunc(amount) && zeroDecimalCurrencies[currency] {
+		message := fmt.Sprintf(fractionalAmount,
+			strconv.FormatFloat(amount, 'f', -1, 64), strings.ToUpper(currency))
+		return createStripeError(typeInvalidRequestError, message,
+			withCode("parameter_invalid_integer"), withParam(param))
+	}
+
+	return nil
+}
+
+// parseAmount gets the number in an amount from request data, which is a
+// string if it was form-encoded and couldn't be coerced to an integer. The
+// second return value is false if it isn't a number.
+func parseAmount(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case string:
+		amount, err := strconv.ParseFloat(value, 64)
+		return amount, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestCheckAmounts(t *testing.T) {
+	testCases := []struct {
+		name    string
+		data    map[string]interface{}
+		param   string
+		message string
+	}{
+		{"valid", map[string]interface{}{"amount": 100, "currency": "usd"}, "", ""},
+		{"zero", map[string]interface{}{"amount": int64(0), "currency": "usd"}, "", ""},
+		{"fractional decimal currency", map[string]interface{}{"amount": 1.5, "currency": "usd"}, "", ""},
+		{"non-numeric", map[string]interface{}{"amount": "abc", "currency": "jpy"}, "", ""},
+		{"negative", map[string]interface{}{"amount": int64(-1), "currency": "usd"},
+			"amount", negativeAmount},
+		{"negative string", map[string]interface{}{"amount": "-1"},
+			"amount", negativeAmount},
+		{"fractional zero-decimal currency", map[string]interface{}{"amount": 1.5, "currency": "JPY"},
+			"amount", "Invalid integer: 1.5. JPY is a zero-decimal currency, " +
+				"so amounts in it are whole units and can't have a fractional part."},
+		{"nested", map[string]interface{}{
+			"currency": "krw",
+			"line_items": []interface{}{
+				map[string]interface{}{"price_data": map[string]interface{}{"unit_amount": 100}},
+				map[string]interface{}{"price_data": map[string]interface{}{"unit_amount": "2.5"}},
+			},
+		}, "line_items[1][price_data][unit_amount]", "Invalid integer: 2.5. KRW is a " +
+			"zero-decimal currency, so amounts in it are whole units and can't have a " +
+			"fractional part."},
+		{"nested currency", map[string]interface{}{
+			"currency":   "jpy",
+			"price_data": map[string]interface{}{"currency": "usd", "unit_amount": 2.5},
+		}, "", ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			stripeError := checkAmounts(testCase.data)
+			if testCase.message == "" {
+				assert.Nil(t, stripeError)
+				return
+			}
+			assert.NotNil(t, stripeError)
+			assert.Equal(t, testCase.message, stripeError.ErrorInfo.Message)
+			assert.Equal(t, testCase.param, stripeError.ErrorInfo.Param)
+			assert.Equal(t, "parameter_invalid_integer", stripeError.ErrorInfo.Code)
+		})
+	}
+}
+
+func TestStubServer_RejectsInvalidAmounts(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=-100&currency=usd", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, negativeAmount, errorInfo["message"])
+	assert.Equal(t, "amount", errorInfo["param"])
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=1.5&currency=jpy", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	errorInfo = decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "amount", errorInfo["param"])
+	assert.Contains(t, errorInfo["message"], "JPY is a zero-decimal currency")
+
+	resp, _ = sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=500&currency=jpy", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,29 @@
+package server
+
+//
+// Private values
+//
+
+// billingPortalURLPrefix is the start of the URLs of billing portal sessions
+// in test mode, which is followed by a secret identifying the session.
+const billingPortalURLPrefix = "https://billing.stripe.com/p/session/test_"
+
+//
+// Private functions
+//
+
+// applyBillingPortalSessionURL gives a generated billing portal session a
+// realistic `url` that's derived from its ID, so a session always has the
+// same URL. Fixtures have a placeholder URL instead.
+func applyBillingPortalSessionURL(data interface{}) {
+	session, ok := data.(map[string]interface{})
+	if !ok || session["object"] != "billing_portal.session" {
+		return
+	}
+
+	id, ok := session["id"].(string)
+	if !ok {
+		return
+	}
+	session["url"] = billingPortalURLPrefix + secretSuffix(id)
+}
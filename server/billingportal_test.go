@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestBillingPortalSessionCreate(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/billing_portal/sessions",
+		"customer=cus_123&return_url=https://example.com/return", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	session := decodeObject(t, body)
+	assert.Equal(t, "cus_123", session["customer"])
+	assert.Equal(t, "https://example.com/return", session["return_url"])
+	assert.Regexp(t,
+		regexp.MustCompile(`^https://billing\.stripe\.com/p/session/test_[0-9A-Za-z]{25}$`),
+		session["url"])
+	assert.Equal(t,
+		billingPortalURLPrefix+secretSuffix(session["id"].(string)),
+		session["url"])
+}
+
+func TestStatefulBillingPortalSessionCreate(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/billing_portal/sessions",
+		"customer="+customerID+"&return_url=https://example.com/return", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, customerID, decodeObject(t, body)["customer"])
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/billing_portal/sessions",
+		"customer=cus_missing", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "No such customer: 'cus_missing'")
+}
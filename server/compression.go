@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//
+// Private values
+//
+
+// gzipEncoding is the content coding with which responses are compressed for
+// clients that accept it.
+const gzipEncoding = "gzip"
+
+//
+// Private functions
+//
+
+// acceptsGzip checks whether a request's `Accept-Encoding` header allows its
+// response to be compressed with gzip, either by name or with a `*`. Codings
+// with a quality of zero, like `gzip;q=0`, aren't acceptable.
+func acceptsGzip(r *http.Request) bool {
+	gzipQuality := -1.0
+	wildcardQuality := -1.0
+
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				value, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err == nil {
+					quality = value
+				}
+			}
+		}
+
+		switch name {
+		case gzipEncoding, "x-gzip":
+			gzipQuality = quality
+		case "*":
+			wildcardQuality = quality
+		}
+	}
+
+	if gzipQuality >= 0 {
+		return gzipQuality > 0
+	}
+	return wildcardQuality > 0
+}
+
+// compressGzip compresses a response body with gzip.
+func compressGzip(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressGzip decompresses a response body compressed with compressGzip.
+func decompressGzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
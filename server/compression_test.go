@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		accepts        bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0, *", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"br, deflate", false},
+		{"identity", false},
+		{"x-gzip", true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.acceptEncoding, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/charges", nil)
+			r.Header.Set("Accept-Encoding", testCase.acceptEncoding)
+			assert.Equal(t, testCase.accepts, acceptsGzip(r))
+		})
+	}
+}
+
+func TestStubServer_GzipResponse(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	headers := getDefaultHeaders()
+	headers["Accept-Encoding"] = "gzip"
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/charges", "", headers)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, gzipEncoding, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+	data, err := decompressGzip(body)
+	assert.NoError(t, err)
+	var list map[string]interface{}
+	err = json.Unmarshal(data, &list)
+	assert.NoError(t, err)
+	assert.Equal(t, "list", list["object"])
+
+	// Errors are compressed too
+	headers["Authorization"] = ""
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/charges", "", headers)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, gzipEncoding, resp.Header.Get("Content-Encoding"))
+	_, err = decompressGzip(body)
+	assert.NoError(t, err)
+
+	// Clients that don't ask for compression are unaffected
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "list", decodeObject(t, body)["object"])
+}
+
+func TestStubServer_GzipRequestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+
+	server := getRealStubServer(t, nil)
+	var err error
+	server.requestLog, err = newRequestLog(path, 0)
+	assert.NoError(t, err)
+
+	headers := getDefaultHeaders()
+	headers["Accept-Encoding"] = "gzip"
+	resp, _ := sendRequestToServer(t, server, "GET", "/v1/charges", "", headers)
+	assert.Equal(t, gzipEncoding, resp.Header.Get("Content-Encoding"))
+
+	// The request log has the response as it was before it was compressed
+	entries := readRequestLog(t, path)
+	assert.Equal(t, 1, len(entries))
+	var list map[string]interface{}
+	err = json.Unmarshal(entries[0].ResponseBody, &list)
+	assert.NoError(t, err)
+	assert.Equal(t, "list", list["object"])
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"regexp"
+)
+
+//
+// Private values
+//
+
+// stripeAccountHeader is the header with which Connect platforms make
+// requests on behalf of one of their connected accounts.
+const stripeAccountHeader = "Stripe-Account"
+
+const invalidStripeAccount = "Invalid `" + stripeAccountHeader + "` header '%s': " +
+	"expected the ID of a connected account like `acct_123`."
+
+// stripeAccountFields are the fields of objects that refer to the connected
+// account that they belong to or were made on behalf of.
+var stripeAccountFields = []string{"account", "on_behalf_of"}
+
+// stripeAccountPattern matches the IDs of connected accounts.
+var stripeAccountPattern = regexp.MustCompile(`\Aacct_[A-Za-z0-9]+\z`)
+
+//
+// Private functions
+//
+
+// applyStripeAccount makes a generated object, or the objects in a generated
+// list, belong to the connected account that a request was made on behalf of
+// with stripeAccountHeader. Only fields that objects already have are set, so
+// objects that can't refer to an account are left alone.
+func applyStripeAccount(account string, data interface{}) {
+	object, ok := data.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if object["object"] == "list" || object["object"] == "search_result" {
+		items, _ := object["data"].([]interface{})
+		for _, item := range items {
+			applyStripeAccount(account, item)
+		}
+		return
+	}
+
+	for _, field := range stripeAccountFields {
+		current, ok := object[field]
+		if !ok {
+			continue
+		}
+
+		// Set the ID of expanded accounts the same way that list filters are
+		// applied
+		if value, ok := applyListFilter(current, account); ok {
+			object[field] = value
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestApplyStripeAccount(t *testing.T) {
+	// Fields referring to accounts are set, whether they're expanded or not
+	{
+		data := map[string]interface{}{
+			"object":       "payment_intent",
+			"on_behalf_of": nil,
+			"transfer_data": map[string]interface{}{
+				"destination": "acct_456",
+			},
+		}
+		applyStripeAccount("acct_123", data)
+		assert.Equal(t, "acct_123", data["on_behalf_of"])
+
+		// Nested fields are left alone
+		assert.Equal(t, "acct_456",
+			data["transfer_data"].(map[string]interface{})["destination"])
+
+		data = map[string]interface{}{
+			"object":  "capability",
+			"account": map[string]interface{}{"id": "acct_456", "object": "account"},
+		}
+		applyStripeAccount("acct_123", data)
+		assert.Equal(t, "acct_123", data["account"].(map[string]interface{})["id"])
+	}
+
+	// Objects without those fields don't get them
+	{
+		data := map[string]interface{}{"object": "customer"}
+		applyStripeAccount("acct_123", data)
+		assert.Equal(t, map[string]interface{}{"object": "customer"}, data)
+	}
+
+	// Objects in lists are all set
+	{
+		data := map[string]interface{}{
+			"object": "list",
+			"data": []interface{}{
+				map[string]interface{}{"object": "charge", "on_behalf_of": nil},
+				map[string]interface{}{"object": "charge", "on_behalf_of": "acct_456"},
+			},
+		}
+		applyStripeAccount("acct_123", data)
+		for _, item := range data["data"].([]interface{}) {
+			assert.Equal(t, "acct_123", item.(map[string]interface{})["on_behalf_of"])
+		}
+	}
+}
+
+func TestStubServer_StripeAccount(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	headers := getDefaultHeaders()
+	headers[stripeAccountHeader] = "acct_123"
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=100&currency=usd", headers)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "acct_123", decodeObject(t, body)["on_behalf_of"])
+
+	// Without the header, generated objects are left as they are
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=100&currency=usd", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, "acct_123", decodeObject(t, body)["on_behalf_of"])
+
+	headers[stripeAccountHeader] = "cus_123"
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/charges", "", headers)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, typeInvalidRequestError, errorInfo["type"])
+	assert.Contains(t, errorInfo["message"], "Invalid `Stripe-Account` header 'cus_123'")
+}
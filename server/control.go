@@ -0,0 +1,280 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//
+// Private values
+//
+
+// controlPathPrefix is the prefix of the paths of stripe-mock's own control
+// endpoints. It's chosen so that it'll never collide with a path in the Stripe
+// API.
+const controlPathPrefix = "/_stripe-mock/"
+
+// healthPath is the path of the health endpoint, which orchestrators can
+// probe to find out whether stripe-mock is up and ready to serve requests.
+const healthPath = controlPathPrefix + "health"
+
+// controlTokenHeader is the header in which requests to control endpoints
+// send the token configured with ControlToken.
+const controlTokenHeader = "X-Stripe-Mock-Token"
+
+const (
+	invalidControlToken = "Please authenticate with the token that " +
+		"stripe-mock was started with in the `" + controlTokenHeader +
+		"` header to use its control endpoints."
+
+	invalidControlRoute = "Unrecognized stripe-mock control endpoint (%s: %s)."
+
+	objectsEndpointDisabled = "The objects endpoint is disabled. Start " +
+		"stripe-mock with `-stateful` and `-objects-endpoint` to enable it."
+
+	objectTypeMissing = "Please specify the `type` of the objects to clear."
+
+	specEndpointDisabled = "The spec endpoint is disabled. Start stripe-mock " +
+		"with `-spec-endpoint` to enable it."
+)
+
+//
+// Private functions
+//
+
+// isHealthRequest checks whether a request is directed at the health
+// endpoint. Unlike other control endpoints, it's available before the router
+// has been initialized and never requires the control token, so that probes
+// don't need any configuration.
+func isHealthRequest(r *http.Request) bool {
+	return r.URL.Path == healthPath && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// isControlRequest checks whether a request is directed at one of
+// stripe-mock's control endpoints rather than the mocked API.
+func isControlRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, controlPathPrefix)
+}
+
+// handleControlRequest handles a request directed at one of stripe-mock's
+// control endpoints.
+//
+// Control endpoints aren't part of the Stripe API, so they don't require the
+// authorization that API requests do. Instead, if a control token has been
+// configured, they require it.
+func (s *StubServer) handleControlRequest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	if !s.checkControlToken(r) {
+		stripeError := createStripeError(typeInvalidRequestError, invalidControlToken)
+		writeResponse(w, r, start, http.StatusUnauthorized, stripeError)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, controlPathPrefix)
+
+	switch {
+	case path == "objects" && r.Method == http.MethodDelete:
+		s.handleObjectsClearRequest(w, r, start)
+
+	case path == "objects" && r.Method == http.MethodGet:
+		s.handleObjectsListRequest(w, r, start)
+
+	case path == "reset" && r.Method == http.MethodPost:
+		s.handleResetRequest(w, r, start)
+
+	case path == "routes" && r.Method == http.MethodGet:
+		s.handleRoutesRequest(w, r, start)
+
+	case path == "spec" && r.Method == http.MethodGet:
+		s.handleSpecRequest(w, r, start)
+
+	case path == "trigger" && r.Method == http.MethodPost:
+		s.handleTriggerRequest(w, r, start)
+
+	case path == "webhooks/attempts" && r.Method == http.MethodGet:
+		s.handleWebhookAttemptsRequest(w, r, start)
+
+	case path == "webhooks/fail_next" && r.Method == http.MethodPost:
+		s.handleWebhookFailNextRequest(w, r, start)
+
+	default:
+		message := fmt.Sprintf(invalidControlRoute, r.Method, r.URL.Path)
+		stripeError := createStripeError(typeInvalidRequestError, message)
+		writeResponse(w, r, start, http.StatusNotFound, stripeError)
+	}
+}
+
+// handleHealthRequest responds with whether stripe-mock is ready to serve
+// requests, along with its version and that of the loaded OpenAPI spec. It
+// responds with a 503 until the router has been initialized, so that it can
+// be used as a readiness probe as well as a liveness one.
+func (s *StubServer) handleHealthRequest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	status := http.StatusOK
+	health := "ok"
+	if !s.ready.Load() {
+		status = http.StatusServiceUnavailable
+		health = "starting"
+	}
+
+	var specVersion string
+	if s.spec != nil && s.spec.Info != nil {
+		specVersion = s.spec.Info.Version
+	}
+
+	writeResponse(w, r, start, status, map[string]interface{}{
+		"spec_version": specVersion,
+		"status":       health,
+		"version":      Version,
+	})
+}
+
+// handleObjectsClearRequest removes all stored objects of the type given by
+// the `type` parameter, and responds with how many were removed.
+func (s *StubServer) handleObjectsClearRequest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	if !s.checkObjectsEndpoint(w, r, start) {
+		return
+	}
+
+	objectType := r.FormValue("type")
+	if objectType == "" {
+		stripeError := createStripeError(typeInvalidRequestError, objectTypeMissing)
+		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+		return
+	}
+
+	removed := s.store.removeAll(func(object map[string]interface{}) bool {
+		return object["object"] == objectType
+	})
+
+	writeResponse(w, r, start, http.StatusOK, map[string]interface{}{
+		"deleted_count": removed,
+		"type":          objectType,
+	})
+}
+
+// handleObjectsListRequest responds with the IDs and types of stored objects
+// in the order that they were stored. They can be narrowed to a single type
+// with the `type` parameter.
+func (s *StubServer) handleObjectsListRequest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	if !s.checkObjectsEndpoint(w, r, start) {
+		return
+	}
+
+	objectType := r.FormValue("type")
+	objects := s.store.list(func(object map[string]interface{}) bool {
+		return objectType == "" || object["object"] == objectType
+	})
+
+	data := make([]interface{}, len(objects))
+	for i, object := range objects {
+		data[i] = map[string]interface{}{
+			"id":     object["id"],
+			"object": object["object"],
+		}
+	}
+
+	writeResponse(w, r, start, http.StatusOK, map[string]interface{}{
+		"object": "list",
+		"data":   data,
+	})
+}
+
+// handleResetRequest clears all of the state that stripe-mock keeps between
+// requests, so that tests can start from scratch without restarting it:
+// objects and events stored in stateful mode, cached responses to idempotent
+// requests, rate limits, and webhook delivery attempts. It responds with how
+// many stored objects were removed.
+func (s *StubServer) handleResetRequest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	removed := 0
+	if s.store != nil {
+		removed = s.store.clear()
+	}
+	if s.events != nil {
+		s.events.clear()
+	}
+	s.idempotency.clear()
+	if s.rateLimiter != nil {
+		s.rateLimiter.reset()
+	}
+	s.webhooks.reset()
+
+	writeResponse(w, r, start, http.StatusOK, map[string]interface{}{
+		"deleted_count": removed,
+		"reset":         true,
+	})
+}
+
+// checkControlToken checks whether a request to a control endpoint sent the
+// configured control token. It always succeeds if there isn't one.
+func (s *StubServer) checkControlToken(r *http.Request) bool {
+	if s.controlToken == "" {
+		return true
+	}
+	token := r.Header.Get(controlTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.controlToken)) == 1
+}
+
+// checkObjectsEndpoint checks whether the objects endpoints are available,
+// which requires them to be enabled and stripe-mock to be in stateful mode.
+// If they're not, an error is written and false is returned.
+func (s *StubServer) checkObjectsEndpoint(w http.ResponseWriter, r *http.Request, start time.Time) bool {
+	if !s.objectsEndpoint || s.store == nil {
+		stripeError := createStripeError(typeInvalidRequestError, objectsEndpointDisabled)
+		writeResponse(w, r, start, http.StatusNotFound, stripeError)
+		return false
+	}
+	return true
+}
+
+// handleRoutesRequest responds with the routing table that was built from the
+// OpenAPI spec, so that users can check why a request is or isn't routed the
+// way they expect. Routes are listed by method in the order that they're
+// tried, and the first one whose pattern matches a path is the one that
+// serves it.
+//
+// Like API requests, the table is that of the spec for the version sent in
+// `Stripe-Version` if one was loaded for it, and the main spec's otherwise.
+func (s *StubServer) handleRoutesRequest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	router := s.versionRouter(r.Header.Get("Stripe-Version"))
+
+	routes := make(map[string]interface{}, len(router.routes))
+	for verb, verbRoutes := range router.routes {
+		data := make([]interface{}, len(verbRoutes))
+		for i, route := range verbRoutes {
+			data[i] = map[string]interface{}{
+				"has_primary_id": route.hasPrimaryID,
+				"operation_id":   route.operation.OperationID,
+				"path":           route.path,
+				"pattern":        route.pattern.String(),
+			}
+		}
+		routes[string(verb)] = data
+	}
+
+	var specVersion string
+	if router.spec.Info != nil {
+		specVersion = router.spec.Info.Version
+	}
+
+	writeResponse(w, r, start, http.StatusOK, map[string]interface{}{
+		"routes":       routes,
+		"spec_version": specVersion,
+	})
+}
+
+// handleSpecRequest responds with the OpenAPI specification that stripe-mock
+// has loaded so that tools can discover the operations that it supports.
+//
+// The full specification is quite large, so the endpoint is only available
+// if it's been explicitly enabled.
+func (s *StubServer) handleSpecRequest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	if !s.specEndpoint {
+		stripeError := createStripeError(typeInvalidRequestError, specEndpointDisabled)
+		writeResponse(w, r, start, http.StatusNotFound, stripeError)
+		return
+	}
+
+	writeResponse(w, r, start, http.StatusOK, s.spec)
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-mock/spec"
+)
+
+func TestControl_UnknownEndpoint(t *testing.T) {
+	resp, body := sendRequest(t, "GET", "/_stripe-mock/doesnt-exist", "", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "Unrecognized stripe-mock control endpoint")
+}
+
+func TestControl_Spec(t *testing.T) {
+	// Control endpoints don't need API authorization, so no headers are sent
+	resp, body := sendRequest(t, "GET", "/_stripe-mock/spec", "", nil,
+		&testStubServerOptions{specEndpoint: true})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, jsonContentType, resp.Header.Get("Content-Type"))
+
+	var data map[string]interface{}
+	err := json.Unmarshal(body, &data)
+	assert.NoError(t, err)
+
+	paths, ok := data["paths"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, len(testSpec.Paths), len(paths))
+	_, ok = paths["/v1/charges"]
+	assert.True(t, ok)
+
+	info, ok := data["info"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, testSpecAPIVersion, info["version"])
+}
+
+func TestControl_SpecDisabled(t *testing.T) {
+	resp, body := sendRequest(t, "GET", "/_stripe-mock/spec", "", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), specEndpointDisabled)
+}
+
+func TestControl_Routes(t *testing.T) {
+	server := getStubServer(t, &testStubServerOptions{
+		controlToken: "secret",
+		versionedSpecs: map[string]*spec.Spec{
+			"2099-01-01": getVersionedSpec("2099-01-01"),
+		},
+	})
+	headers := map[string]string{controlTokenHeader: "secret"}
+
+	resp, _ := sendRequestToServer(t, server, "GET", "/_stripe-mock/routes", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, body := sendRequestToServer(t, server, "GET", "/_stripe-mock/routes", "", headers)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	data := decodeObject(t, body)
+	assert.Equal(t, testSpecAPIVersion, data["spec_version"])
+
+	routes := data["routes"].(map[string]interface{})
+	var getRoutes []string
+	for _, route := range routes["GET"].([]interface{}) {
+		route := route.(map[string]interface{})
+		getRoutes = append(getRoutes, route["path"].(string))
+
+		if route["path"] == "/v1/charges/{id}" {
+			assert.Equal(t, true, route["has_primary_id"])
+			assert.Regexp(t, route["pattern"], "/v1/charges/ch_123")
+		}
+	}
+	assert.Contains(t, getRoutes, "/v1/charges")
+	assert.Contains(t, getRoutes, "/v1/charges/{id}")
+	assert.NotContains(t, getRoutes, "/v1/payments")
+	_, ok := routes["DELETE"]
+	assert.True(t, ok)
+
+	// The routes are those of the spec for the version that was sent
+	headers["Stripe-Version"] = "2099-01-01"
+	_, body = sendRequestToServer(t, server, "GET", "/_stripe-mock/routes", "", headers)
+	data = decodeObject(t, body)
+	assert.Equal(t, "2099-01-01", data["spec_version"])
+	routes = data["routes"].(map[string]interface{})
+	assert.Equal(t, 2, len(routes))
+	_, ok = routes["POST"]
+	assert.True(t, ok)
+	route := routes["GET"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "/v1/payments", route["path"])
+	assert.Equal(t, false, route["has_primary_id"])
+}
+
+func TestControl_Token(t *testing.T) {
+	options := &testStubServerOptions{
+		controlToken: "secret",
+		specEndpoint: true,
+	}
+
+	// Missing token
+	resp, body := sendRequest(t, "GET", "/_stripe-mock/spec", "", nil, options)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, string(body), invalidControlToken)
+
+	// Wrong token
+	resp, _ = sendRequest(t, "GET", "/_stripe-mock/spec", "",
+		map[string]string{controlTokenHeader: "wrong"}, options)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Unknown endpoints don't reveal anything without the token either
+	resp, _ = sendRequest(t, "GET", "/_stripe-mock/doesnt-exist", "", nil, options)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = sendRequest(t, "GET", "/_stripe-mock/spec", "",
+		map[string]string{controlTokenHeader: "secret"}, options)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// API requests don't need the token
+	resp, _ = sendRequest(t, "GET", "/v1/charges", "", getDefaultHeaders(), options)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestControl_Objects(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{
+		objectsEndpoint: true,
+		stateful:        true,
+	})
+
+	var customerIDs []interface{}
+	for i := 0; i < 2; i++ {
+		_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+		customerIDs = append(customerIDs, decodeObject(t, body)["id"])
+	}
+	_, body := sendRequestToServer(t, server, "POST", "/v1/charges",
+		"amount=100&currency=usd", getDefaultHeaders())
+	chargeID := decodeObject(t, body)["id"]
+
+	listIDs := func(params string) []interface{} {
+		resp, body := sendRequestToServer(t, server, "GET", "/_stripe-mock/objects"+params, "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var ids []interface{}
+		for _, object := range decodeObject(t, body)["data"].([]interface{}) {
+			ids = append(ids, object.(map[string]interface{})["id"])
+		}
+		return ids
+	}
+
+	assert.Equal(t, customerIDs, listIDs("?type=customer"))
+	assert.Equal(t, append(append([]interface{}{}, customerIDs...), chargeID), listIDs(""))
+
+	resp, body := sendRequestToServer(t, server, "DELETE", "/_stripe-mock/objects?type=customer", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(2), decodeObject(t, body)["deleted_count"])
+
+	// Only customers were cleared
+	assert.Nil(t, listIDs("?type=customer"))
+	assert.Equal(t, []interface{}{chargeID}, listIDs(""))
+
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/customers/"+customerIDs[0].(string),
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Clearing everything at once isn't allowed
+	resp, _ = sendRequestToServer(t, server, "DELETE", "/_stripe-mock/objects", "", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestControl_ObjectsDisabled(t *testing.T) {
+	for _, options := range []*testStubServerOptions{
+		{stateful: true},
+		{objectsEndpoint: true},
+	} {
+		resp, body := sendRequest(t, "GET", "/_stripe-mock/objects", "", nil, options)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Contains(t, string(body), "The objects endpoint is disabled")
+	}
+}
+
+func TestControl_Reset(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{
+		controlToken: "secret",
+		stateful:     true,
+	})
+	controlHeaders := map[string]string{controlTokenHeader: "secret"}
+
+	headers := getDefaultHeaders()
+	headers["Idempotency-Key"] = "key_123"
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", headers)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	customerID := decodeObject(t, body)["id"].(string)
+
+	// Like other control endpoints, it needs the token
+	resp, _ = sendRequestToServer(t, server, "POST", "/_stripe-mock/reset", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, body = sendRequestToServer(t, server, "POST", "/_stripe-mock/reset", "", controlHeaders)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{
+		"deleted_count": float64(1),
+		"reset":         true,
+	}, decodeObject(t, body))
+
+	// Stored objects and events are gone
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/customers/"+customerID, "", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	_, body = sendRequestToServer(t, server, "GET", "/v1/events", "", getDefaultHeaders())
+	assert.Equal(t, 0, len(decodeObject(t, body)["data"].([]interface{})))
+
+	// The idempotency key can be reused for a new request
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/customers", "", headers)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Idempotent-Replayed"))
+	assert.NotEqual(t, customerID, decodeObject(t, body)["id"])
+}
+
+func TestControl_Health(t *testing.T) {
+	// Neither API authorization nor the control token is needed, and health
+	// checks don't count against the rate limit
+	options := &testStubServerOptions{controlToken: "secret", maxRequestsPerSecond: 1}
+	server := getStubServer(t, options)
+	for i := 0; i < 3; i++ {
+		resp, body := sendRequestToServer(t, server, "GET", "/_stripe-mock/health", "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, map[string]interface{}{
+			"spec_version": testSpecAPIVersion,
+			"status":       "ok",
+			"version":      Version,
+		}, decodeObject(t, body))
+	}
+
+	resp, _ := sendRequestToServer(t, server, "POST", "/_stripe-mock/health", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestControl_HealthNotReady(t *testing.T) {
+	// The router isn't initialized, as if stripe-mock were still starting up
+	server, err := NewStubServer(&testFixtures, &testSpec,
+		&StubServerOptions{DeferRouterInitialization: true})
+	assert.NoError(t, err)
+
+	resp, body := sendRequestToServer(t, server, "GET", "/_stripe-mock/health", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "starting", decodeObject(t, body)["status"])
+
+	err = server.InitializeRouter()
+	assert.NoError(t, err)
+
+	resp, body = sendRequestToServer(t, server, "GET", "/_stripe-mock/health", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", decodeObject(t, body)["status"])
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Private values
+//
+
+// corsExposedHeaders are the response headers that browsers are allowed to
+// read from cross-origin responses. Headers not in the CORS safelist (which
+// includes only a few like `Content-Type`) are hidden from browser clients
+// unless they're listed here.
+var corsExposedHeaders = []string{
+	"Idempotency-Key",
+	"Idempotent-Replayed",
+	"Request-Id",
+	"Retry-After",
+	"Stripe-Should-Retry",
+	"Stripe-Version",
+}
+
+// corsAllowedHeaders are the request headers that browsers are allowed to
+// send with cross-origin requests, which are those that Stripe's client
+// libraries and stripe-mock itself use. Preflight requests for other headers
+// are allowed too by echoing back the headers that they ask for.
+var corsAllowedHeaders = []string{
+	"Authorization",
+	"Content-Type",
+	"Idempotency-Key",
+	"Stripe-Account",
+	"Stripe-Mock-Error",
+	"Stripe-Mock-Response-Status",
+	"Stripe-Mock-Seed",
+	"Stripe-Version",
+	"X-Stripe-Mock-Token",
+}
+
+// corsAllowedMethods are the methods with which browsers are allowed to make
+// cross-origin requests, which are all of those used by the Stripe API.
+var corsAllowedMethods = []string{
+	http.MethodDelete,
+	http.MethodGet,
+	http.MethodPost,
+}
+
+// corsMaxAge is how long browsers can cache the response to a preflight
+// request, so that they don't send one before every request.
+const corsMaxAge = 10 * time.Minute
+
+//
+// Private functions
+//
+
+// isCORSPreflight checks whether a request is a CORS preflight request, which
+// browsers send before cross-origin requests to ask whether they're allowed.
+func isCORSPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// setCORSHeaders sets the headers that allow browsers to make cross-origin
+// requests to stripe-mock and read the Stripe-specific headers of its
+// responses. Nothing is set unless a CORS origin has been configured.
+func (s *StubServer) setCORSHeaders(w http.ResponseWriter) {
+	if s.corsOrigin == "" {
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", s.corsOrigin)
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsAllowedMethods, ", "))
+	w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+
+	// Responses differ depending on whether CORS is allowed, so caches
+	// shouldn't reuse them across origins unless any origin is allowed.
+	if s.corsOrigin != "*" {
+		w.Header().Add("Vary", "Origin")
+	}
+}
+
+// writeCORSPreflight responds to a CORS preflight request, allowing whatever
+// headers it asks for. It's answered before the request is authorized because
+// browsers never send credentials with preflight requests.
+func (s *StubServer) writeCORSPreflight(w http.ResponseWriter, r *http.Request, start time.Time) {
+	if requestedHeaders := r.Header.Get("Access-Control-Request-Headers"); requestedHeaders != "" {
+		w.Header().Set("Access-Control-Allow-Headers", requestedHeaders)
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+	}
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+
+	writeEmptyResponse(w, r, start, http.StatusNoContent)
+}
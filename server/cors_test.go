@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStubServer_CORSHeaders(t *testing.T) {
+	resp, _ := sendRequest(t, "GET", "/v1/charges", "", getDefaultHeaders(),
+		&testStubServerOptions{corsOrigin: "*"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "Request-Id")
+	assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "Stripe-Version")
+	// Responses don't vary by origin when any is allowed
+	assert.Equal(t, []string{"Accept-Encoding"}, resp.Header.Values("Vary"))
+
+	// Headers are also sent with errors so that browsers can read them
+	resp, _ = sendRequest(t, "GET", "/v1/charges", "", nil,
+		&testStubServerOptions{corsOrigin: "https://example.com"})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "https://example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "Request-Id")
+	assert.Equal(t, []string{"Origin", "Accept-Encoding"}, resp.Header.Values("Vary"))
+}
+
+func TestStubServer_CORSHeadersDisabled(t *testing.T) {
+	resp, _ := sendRequest(t, "GET", "/v1/charges", "", getDefaultHeaders(), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", resp.Header.Get("Access-Control-Expose-Headers"))
+}
+
+func TestStubServer_CORSAllowHeaders(t *testing.T) {
+	resp, _ := sendRequest(t, "POST", "/v1/charges", "amount=123", getDefaultHeaders(),
+		&testStubServerOptions{corsOrigin: "*"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "DELETE, GET, POST", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Allow-Headers"), "Authorization")
+	assert.Contains(t, resp.Header.Get("Access-Control-Allow-Headers"), "Stripe-Version")
+}
+
+func TestStubServer_CORSPreflight(t *testing.T) {
+	// Preflight requests are answered without authorization
+	headers := map[string]string{
+		"Access-Control-Request-Headers": "authorization, x-custom",
+		"Access-Control-Request-Method":  "POST",
+		"Origin":                         "https://example.com",
+	}
+	resp, body := sendRequest(t, "OPTIONS", "/v1/charges", "", headers,
+		&testStubServerOptions{corsOrigin: "https://example.com"})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "", string(body))
+	assert.Equal(t, "https://example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "DELETE, GET, POST", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "authorization, x-custom", resp.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", resp.Header.Get("Access-Control-Max-Age"))
+	assert.Equal(t, []string{"Origin", "Access-Control-Request-Headers"}, resp.Header.Values("Vary"))
+
+	// Without CORS configured, they're treated like any other request
+	resp, _ = sendRequest(t, "OPTIONS", "/v1/charges", "", headers, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
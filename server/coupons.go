@@ -0,0 +1,125 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+)
+
+//
+// Private values
+//
+
+// discountParams are the request parameters with which coupons are applied
+// to subscriptions and invoices. They're not merged into objects like other
+// parameters because they're represented as discounts.
+var discountParams = []string{"coupon", "discounts"}
+
+//
+// Private functions
+//
+
+// applyDiscountParams applies the coupons named by a request's `coupon` or
+// `discounts` parameters to a subscription or invoice, storing a discount for
+// each of them and setting the object's `discount` and `discounts`. A 404 is
+// returned if any of the coupons haven't been stored.
+func applyDiscountParams(s *StubServer, ids *rand.Rand, requestData map[string]interface{}, object map[string]interface{}) *requestError {
+	var couponIDs []string
+	if coupon, ok := requestData["coupon"].(string); ok && coupon != "" {
+		couponIDs = append(couponIDs, coupon)
+	}
+	if discounts, ok := requestData["discounts"].([]interface{}); ok {
+		for _, discount := range discounts {
+			discountMap, _ := discount.(map[string]interface{})
+			if coupon, ok := discountMap["coupon"].(string); ok && coupon != "" {
+				couponIDs = append(couponIDs, coupon)
+			}
+		}
+	}
+
+	if len(couponIDs) == 0 {
+		return nil
+	}
+
+	discounts := make([]map[string]interface{}, len(couponIDs))
+	for i, couponID := range couponIDs {
+		coupon, ok := s.store.get(couponID)
+		if !ok {
+			return noSuchObjectError("coupon", couponID)
+		}
+		discounts[i] = newDiscount(s, ids, coupon, object)
+	}
+
+	discountIDs := make([]interface{}, len(discounts))
+	for i, discount := range discounts {
+		discountIDs[i] = discount["id"]
+		s.store.put(discount["id"].(string), discount)
+	}
+
+	// `discount` is only populated when there's exactly one discount
+	object["discount"] = nil
+	if len(discounts) == 1 {
+		object["discount"] = discounts[0]
+	}
+	object["discounts"] = discountIDs
+	return nil
+}
+
+// couponDiscountAmount calculates how much a coupon takes off of an amount.
+// A coupon with an `amount_off` never takes off more than the amount itself.
+func couponDiscountAmount(coupon map[string]interface{}, amount int64) int64 {
+	if amountOff, ok := toInt64(coupon["amount_off"]); ok {
+		if amountOff > amount {
+			return amount
+		}
+		return amountOff
+	}
+
+	if percentOff, ok := toFloat64(coupon["percent_off"]); ok {
+		return int64(math.Round(float64(amount) * percentOff / 100))
+	}
+
+	return 0
+}
+
+// newDiscount produces a discount that applies a coupon to a subscription or
+// invoice.
+func newDiscount(s *StubServer, ids *rand.Rand, coupon map[string]interface{}, object map[string]interface{}) map[string]interface{} {
+	discount := map[string]interface{}{
+		"checkout_session":  nil,
+		"coupon":            coupon,
+		"customer":          object["customer"],
+		"end":               nil,
+		"id":                newID(ids, "di"),
+		"invoice":           nil,
+		"invoice_item":      nil,
+		"object":            "discount",
+		"promotion_code":    nil,
+		"start":             s.generationTime().Unix(),
+		"subscription":      nil,
+		"subscription_item": nil,
+	}
+
+	switch object["object"] {
+	case "invoice":
+		discount["invoice"] = object["id"]
+	case "subscription":
+		discount["subscription"] = object["id"]
+	}
+
+	return discount
+}
+
+// toFloat64 converts a numeric value of any of the types that might be
+// produced by JSON decoding or parameter coercion to a float64. The second
+// return value is false if the value wasn't numeric.
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+)
+
+//
+// Private functions
+//
+
+// findRouteCoverageGaps finds the operations in the loaded spec that
+// stripe-mock can't fully serve, either because they don't have a successful
+// response that it can generate or because it couldn't build a validator for
+// their requests. Each gap is described as `<METHOD> <path>: <problem>`, and
+// they're sorted so that reports are stable.
+//
+// The checks are the same ones that HandleRequest makes at runtime, so these
+// are the operations that would fail with a 500 or skip validation.
+func (s *StubServer) findRouteCoverageGaps() []string {
+	var gaps []string
+
+	for verb, verbRoutes := range s.routes {
+		for _, route := range verbRoutes {
+			if _, _, err := getResponseContent(route.operation, getSuccessStatus(route.operation)); err != nil {
+				gaps = append(gaps, fmt.Sprintf("%s %s: %v", verb, route.path, err))
+			}
+
+			if route.requestValidator == nil {
+				gaps = append(gaps, fmt.Sprintf(
+					"%s %s: Couldn't build a request validator (no request body schema)",
+					verb, route.path))
+			}
+		}
+	}
+
+	sort.Strings(gaps)
+	return gaps
+}
+
+// printRouteCoverageReport prints the gaps found by findRouteCoverageGaps so
+// that problems in a custom spec surface at startup rather than in tests.
+func (s *StubServer) printRouteCoverageReport() {
+	gaps := s.findRouteCoverageGaps()
+	if len(gaps) == 0 {
+		fmt.Printf("Route coverage: every operation can be served\n")
+		return
+	}
+
+	fmt.Printf("Route coverage: %v gap(s) found\n", len(gaps))
+	for _, gap := range gaps {
+		fmt.Printf("    %s\n", gap)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+func TestFindRouteCoverageGaps(t *testing.T) {
+	// The bundled spec can serve all of its operations
+	server := getRealStubServer(t, nil)
+	assert.Equal(t, 0, len(server.findRouteCoverageGaps()))
+
+	gapSpec := spec.Spec{
+		Info: &spec.Info{Version: testSpecAPIVersion},
+		Paths: map[spec.Path]map[spec.HTTPVerb]*spec.Operation{
+			"/v1/widgets": {
+				"get": {
+					Responses: map[spec.StatusCode]spec.Response{
+						"200": {
+							Content: map[string]spec.MediaType{
+								"text/html": {Schema: &spec.Schema{Type: "string"}},
+							},
+						},
+					},
+				},
+				"post": {
+					Responses: map[spec.StatusCode]spec.Response{
+						"200": {
+							Content: map[string]spec.MediaType{
+								"application/json": {Schema: &spec.Schema{Type: "object"}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	server = newTestStubServer(t, &gapSpec, &testFixtures, &testStubServerOptions{})
+
+	assert.Equal(t, []string{
+		"GET /v1/widgets: Couldn't find application/json or application/pdf in response",
+		"POST /v1/widgets: Couldn't build a request validator (no request body schema)",
+	}, server.findRouteCoverageGaps())
+
+	output := captureStdout(t, server.printRouteCoverageReport)
+	assert.Contains(t, output, "Route coverage: 2 gap(s) found")
+	assert.Contains(t, output, "GET /v1/widgets")
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private types
+//
+
+// declineRule is a rule by which payments are declined, like a payment for an
+// amount ending in `02` or with a particular test payment method. A payment
+// matches a rule if it matches all of the conditions that the rule sets.
+type declineRule struct {
+	// Amount, if set, is the exact amount of payments that are declined.
+	Amount *int64 `json:"amount,omitempty"`
+
+	// AmountSuffix, if set, is the digits that the amounts of payments that
+	// are declined end in, like `02`.
+	AmountSuffix string `json:"amount_suffix,omitempty"`
+
+	// Source, if set, is the ID of the payment method, source, or token with
+	// which payments that are declined are made, like `tok_visa_chargeDeclined`.
+	Source string `json:"source,omitempty"`
+
+	// Error is the error with which matching payments are declined. It takes
+	// the same values as errorHeader, like `insufficient_funds`.
+	Error string `json:"error"`
+
+	// requested is Error parsed.
+	requested *requestedError
+}
+
+//
+// Private values
+//
+
+// declinePaths are the paths of the operations that make payments, and which
+// decline rules therefore apply to. They're all `POST` requests.
+var declinePaths = map[spec.Path]bool{
+	"/v1/charges":                          true,
+	"/v1/payment_intents":                  true,
+	"/v1/payment_intents/{intent}/confirm": true,
+}
+
+// defaultDeclineRules decline payments made with Stripe's test payment methods
+// and tokens for declined payments. Rules loaded from a file are checked
+// before them. See:
+//
+// https://stripe.com/docs/testing#declined-payments
+var defaultDeclineRules = []declineRule{
+	{Source: "pm_card_visa_chargeDeclined", Error: "card_declined"},
+	{Source: "tok_visa_chargeDeclined", Error: "card_declined"},
+	{Source: "pm_card_visa_chargeDeclinedInsufficientFunds", Error: "insufficient_funds"},
+	{Source: "tok_visa_chargeDeclinedInsufficientFunds", Error: "insufficient_funds"},
+	{Source: "pm_card_visa_chargeDeclinedLostCard", Error: "lost_card"},
+	{Source: "tok_visa_chargeDeclinedLostCard", Error: "lost_card"},
+	{Source: "pm_card_visa_chargeDeclinedStolenCard", Error: "stolen_card"},
+	{Source: "tok_visa_chargeDeclinedStolenCard", Error: "stolen_card"},
+	{Source: "pm_card_chargeDeclinedExpiredCard", Error: "expired_card"},
+	{Source: "tok_chargeDeclinedExpiredCard", Error: "expired_card"},
+	{Source: "pm_card_chargeDeclinedIncorrectCvc", Error: "incorrect_cvc"},
+	{Source: "tok_chargeDeclinedIncorrectCvc", Error: "incorrect_cvc"},
+	{Source: "pm_card_chargeDeclinedProcessingError", Error: "processing_error"},
+	{Source: "tok_chargeDeclinedProcessingError", Error: "processing_error"},
+}
+
+// declineSourceParams are the parameters with which payments are made with a
+// payment method, source, or token.
+var declineSourceParams = []string{"payment_method", "source"}
+
+//
+// Private functions
+//
+
+// loadDeclineRules loads decline rules from a JSON file containing an array
+// of them, like:
+//
+//	[
+//	  {"amount_suffix": "02", "error": "card_declined"},
+//	  {"amount": 6600, "error": "insufficient_funds"},
+//	  {"source": "pm_card_risky", "error": "fraudulent"}
+//	]
+//
+// The default rules are appended to those in the file. They're all that's
+// returned if the path is empty.
+func loadDeclineRules(path string) ([]declineRule, error) {
+	if path == "" {
+		return parseDeclineRules(defaultDeclineRules)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading decline rules: %v", err)
+	}
+
+	// Unknown fields are rejected so that a misspelled condition doesn't
+	// make a rule decline every payment.
+	var rules []declineRule
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&rules)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding decline rules from %s: %v", path, err)
+	}
+
+	return parseDeclineRules(append(rules, defaultDeclineRules...))
+}
+
+// parseDeclineRules checks that decline rules have at least one condition and
+// parses their errors.
+func parseDeclineRules(rules []declineRule) ([]declineRule, error) {
+	parsed := make([]declineRule, len(rules))
+	for i, rule := range rules {
+		if rule.Amount == nil && rule.AmountSuffix == "" && rule.Source == "" {
+			return nil, fmt.Errorf("Decline rule %d needs at least one of "+
+				"`amount`, `amount_suffix`, or `source`", i+1)
+		}
+
+		requested, err := parseRequestedError(rule.Error)
+		if err != nil {
+			return nil, fmt.Errorf("Decline rule %d has an invalid error: %v", i+1, err)
+		}
+
+		rule.requested = requested
+		parsed[i] = rule
+	}
+	return parsed, nil
+}
+
+// matches checks whether a payment made with the given request data matches
+// a decline rule.
+func (rule *declineRule) matches(requestData map[string]interface{}) bool {
+	if rule.Amount != nil || rule.AmountSuffix != "" {
+		amount, ok := parseAmount(requestData["amount"])
+		if !ok {
+			return false
+		}
+		if rule.Amount != nil && amount != float64(*rule.Amount) {
+			return false
+		}
+		formatted := strconv.FormatFloat(amount, 'f', -1, 64)
+		if rule.AmountSuffix != "" && !strings.HasSuffix(formatted, rule.AmountSuffix) {
+			return false
+		}
+	}
+
+	if rule.Source != "" {
+		matched := false
+		for _, param := range declineSourceParams {
+			if requestData[param] == rule.Source {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeDecline checks whether a request makes a payment that matches one of
+// the decline rules, and responds with the rule's error if it does, like the
+// Stripe API responds to payments with its declining test cards. The return
+// value is true if a response was written.
+func (s *StubServer) writeDecline(w http.ResponseWriter, r *http.Request, start time.Time,
+	route *stubServerRoute, requestData map[string]interface{}) bool {
+
+	if r.Method != http.MethodPost || !declinePaths[route.path] {
+		return false
+	}
+
+	for _, rule := range s.declineRules {
+		if rule.matches(requestData) {
+			writeResponse(w, r, start, rule.requested.status, rule.requested.stripeError())
+			return true
+		}
+	}
+
+	return false
+}
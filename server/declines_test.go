@@ -0,0 +1,124 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestLoadDeclineRules(t *testing.T) {
+	rules, err := loadDeclineRules("")
+	assert.NoError(t, err)
+	assert.Equal(t, len(defaultDeclineRules), len(rules))
+
+	dir := t.TempDir()
+	writeRules := func(content string) string {
+		path := filepath.Join(dir, "rules.json")
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		assert.NoError(t, err)
+		return path
+	}
+
+	rules, err = loadDeclineRules(writeRules(
+		`[{"amount_suffix": "02", "error": "card_declined"}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, len(defaultDeclineRules)+1, len(rules))
+	assert.Equal(t, "02", rules[0].AmountSuffix)
+	assert.Equal(t, "generic_decline", rules[0].requested.declineCode)
+
+	for _, content := range []string{
+		`{}`,
+		`[{"error": "card_declined"}]`,
+		`[{"amount": 100, "error": "not_an_error"}]`,
+		`[{"amount_ending": "02", "error": "card_declined"}]`,
+	} {
+		_, err = loadDeclineRules(writeRules(content))
+		assert.Error(t, err, content)
+	}
+
+	_, err = loadDeclineRules(filepath.Join(dir, "nonexistent.json"))
+	assert.Error(t, err)
+}
+
+func TestDeclineRule_Matches(t *testing.T) {
+	amount := int64(6600)
+	testCases := []struct {
+		rule        declineRule
+		requestData map[string]interface{}
+		matches     bool
+	}{
+		{declineRule{Amount: &amount}, map[string]interface{}{"amount": int64(6600)}, true},
+		{declineRule{Amount: &amount}, map[string]interface{}{"amount": "6600"}, true},
+		{declineRule{Amount: &amount}, map[string]interface{}{"amount": int64(660)}, false},
+		{declineRule{Amount: &amount}, map[string]interface{}{}, false},
+		{declineRule{AmountSuffix: "02"}, map[string]interface{}{"amount": int64(1002)}, true},
+		{declineRule{AmountSuffix: "02"}, map[string]interface{}{"amount": 1020.0}, false},
+		{declineRule{Source: "tok_declined"}, map[string]interface{}{"source": "tok_declined"}, true},
+		{declineRule{Source: "pm_declined"}, map[string]interface{}{"payment_method": "pm_declined"}, true},
+		{declineRule{Source: "pm_declined"}, map[string]interface{}{"payment_method": "pm_card_visa"}, false},
+
+		// All conditions have to match
+		{declineRule{AmountSuffix: "02", Source: "pm_declined"},
+			map[string]interface{}{"amount": int64(1002), "payment_method": "pm_declined"}, true},
+		{declineRule{AmountSuffix: "02", Source: "pm_declined"},
+			map[string]interface{}{"amount": int64(1002), "payment_method": "pm_card_visa"}, false},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.matches, testCase.rule.matches(testCase.requestData),
+			"%+v %+v", testCase.rule, testCase.requestData)
+	}
+}
+
+func TestStubServer_Declines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	err := ioutil.WriteFile(path, []byte(`[
+		{"amount_suffix": "02", "error": "insufficient_funds"},
+		{"amount": 6600, "error": "402:card_error:Custom decline."}
+	]`), 0644)
+	assert.NoError(t, err)
+
+	server := getRealStubServer(t, &testStubServerOptions{declineRulesFile: path})
+
+	testCases := []struct {
+		path        string
+		params      string
+		status      int
+		message     string
+		declineCode string
+	}{
+		{"/v1/payment_intents", "amount=1002&currency=usd",
+			http.StatusPaymentRequired, "Your card has insufficient funds.", "insufficient_funds"},
+		{"/v1/charges", "amount=6600&currency=usd",
+			http.StatusPaymentRequired, "Custom decline.", ""},
+		{"/v1/charges", "amount=2000&currency=usd&source=tok_chargeDeclinedExpiredCard",
+			http.StatusPaymentRequired, "Your card has expired.", "expired_card"},
+		{"/v1/payment_intents/pi_123/confirm", "payment_method=pm_card_visa_chargeDeclined",
+			http.StatusPaymentRequired, "Your card was declined.", "generic_decline"},
+		{"/v1/payment_intents", "amount=2000&currency=usd", http.StatusOK, "", ""},
+
+		// Only payments are declined
+		{"/v1/prices", "unit_amount=1002&currency=usd&product=prod_123", http.StatusOK, "", ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.path+"?"+testCase.params, func(t *testing.T) {
+			resp, body := sendRequestToServer(t, server, "POST", testCase.path,
+				testCase.params, getDefaultHeaders())
+			assert.Equal(t, testCase.status, resp.StatusCode)
+			if testCase.message == "" {
+				return
+			}
+
+			errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+			assert.Equal(t, typeCardError, errorInfo["type"])
+			assert.Equal(t, testCase.message, errorInfo["message"])
+			if testCase.declineCode != "" {
+				assert.Equal(t, testCase.declineCode, errorInfo["decline_code"])
+			} else {
+				assert.Nil(t, errorInfo["decline_code"])
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private functions
+//
+
+// applyDeletedStub makes the response to a `DELETE` request the stub of a
+// deleted object that the Stripe API responds with, like
+// `{"deleted": true, "id": "cus_123", "object": "customer"}`, with the ID of
+// the object taken from the request path.
+//
+// It only applies to responses whose schema declares `deleted`, because some
+// deletes (like detaching a source) respond with the full object instead.
+// Fixtures for deleted objects are often incomplete, so the stub's fields are
+// filled in regardless of what was generated.
+func (g *DataGenerator) applyDeletedStub(schema *spec.Schema, pathParams *PathParamsMap, data interface{}) error {
+	mapData, ok := data.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	schema, _, err := g.maybeDereference(schema, "")
+	if err != nil {
+		return err
+	}
+	if schema.AnyOf != nil {
+		schema, err = g.findAnyOfBranch(schema, true)
+		if err != nil || schema == nil {
+			return err
+		}
+	}
+	if !isDeletedResource(schema) {
+		return nil
+	}
+
+	mapData["deleted"] = true
+	if pathParams != nil && pathParams.PrimaryID != nil {
+		mapData["id"] = *pathParams.PrimaryID
+	}
+	if objectType := deletedObjectType(schema); objectType != "" {
+		mapData["object"] = objectType
+	}
+	return nil
+}
+
+// deletedObjectType finds the type of object that a deleted object's schema
+// describes, from either its `object` property or its resource ID, which is
+// the object's own prefixed with `deleted_`.
+func deletedObjectType(schema *spec.Schema) string {
+	if object, ok := schema.Properties["object"]; ok && len(object.Enum) > 0 {
+		if objectType, ok := object.Enum[0].(string); ok {
+			return objectType
+		}
+	}
+	if strings.HasPrefix(schema.XResourceID, "deleted_") {
+		return strings.TrimPrefix(schema.XResourceID, "deleted_")
+	}
+	return ""
+}
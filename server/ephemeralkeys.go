@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private values
+//
+
+const (
+	ephemeralKeyMissingObject = "You must specify one of `customer`, " +
+		"`issuing_card`, or `verification_session` when creating an " +
+		"ephemeral key."
+
+	ephemeralKeyMissingVersion = "Stripe-Version header must be specified " +
+		"when creating an ephemeral key, and must match the API version used " +
+		"by your mobile SDK."
+)
+
+// ephemeralKeyLifetime is how long after its creation an ephemeral key
+// expires.
+const ephemeralKeyLifetime = time.Hour
+
+// ephemeralKeyObjectParams are the parameters that name the object that an
+// ephemeral key gives access to, mapped to the type of the object.
+var ephemeralKeyObjectParams = []struct {
+	param      string
+	objectType string
+}{
+	{"customer", "customer"},
+	{"issuing_card", "issuing.card"},
+	{"verification_session", "identity.verification_session"},
+}
+
+// ephemeralKeysPath is the path of the endpoint that creates ephemeral keys.
+const ephemeralKeysPath = spec.Path("/v1/ephemeral_keys")
+
+//
+// Private functions
+//
+
+// isEphemeralKeyCreate checks whether a request is one to create an
+// ephemeral key.
+func isEphemeralKeyCreate(r *http.Request, route *stubServerRoute) bool {
+	return r.Method == http.MethodPost && route.path == ephemeralKeysPath
+}
+
+// checkEphemeralKeyRequest rejects requests to create ephemeral keys that the
+// Stripe API would reject, which are ones without a `Stripe-Version` header
+// (mobile SDKs need a key for the API version that they're built for) or that
+// don't name an object to give access to.
+func checkEphemeralKeyRequest(r *http.Request, requestData map[string]interface{}) *ResponseError {
+	if r.Header.Get("Stripe-Version") == "" {
+		return createStripeError(typeInvalidRequestError, ephemeralKeyMissingVersion)
+	}
+
+	for _, objectParam := range ephemeralKeyObjectParams {
+		if id, ok := requestData[objectParam.param].(string); ok && id != "" {
+			return nil
+		}
+	}
+	return createStripeError(typeInvalidRequestError, ephemeralKeyMissingObject)
+}
+
+// applyEphemeralKey fills in the parts of a generated ephemeral key that
+// fixtures don't include: its `secret` and the `associated_objects` that it
+// gives access to. It's created at the given Unix time, and expires
+// ephemeralKeyLifetime after that.
+func applyEphemeralKey(now int64, requestData map[string]interface{}, data map[string]interface{}) {
+	var associatedObjects []interface{}
+	for _, objectParam := range ephemeralKeyObjectParams {
+		if id, ok := requestData[objectParam.param].(string); ok && id != "" {
+			associatedObjects = append(associatedObjects, map[string]interface{}{
+				"id":   id,
+				"type": objectParam.objectType,
+			})
+		}
+	}
+
+	id, _ := data["id"].(string)
+
+	data["associated_objects"] = associatedObjects
+	data["created"] = now
+	data["expires"] = now + int64(ephemeralKeyLifetime/time.Second)
+	data["secret"] = "ek_test_" + secretSuffix(id)
+}
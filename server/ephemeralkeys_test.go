@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestEphemeralKeyCreate(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	headers := getDefaultHeaders()
+	headers["Stripe-Version"] = "2023-10-16"
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/ephemeral_keys",
+		"customer=cus_123", headers)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	key := decodeObject(t, body)
+	assert.Equal(t, "ephemeral_key", key["object"])
+	assert.Regexp(t, regexp.MustCompile(`^ek_test_[0-9A-Za-z]{25}$`), key["secret"])
+	assert.Equal(t, key["created"].(float64)+3600, key["expires"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"id": "cus_123", "type": "customer"},
+	}, key["associated_objects"])
+}
+
+func TestEphemeralKeyCreate_MissingVersion(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/ephemeral_keys",
+		"customer=cus_123", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "Stripe-Version header must be specified")
+}
+
+func TestEphemeralKeyCreate_MissingObject(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	headers := getDefaultHeaders()
+	headers["Stripe-Version"] = "2023-10-16"
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/ephemeral_keys", "", headers)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "You must specify one of `customer`")
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Private types
+//
+
+// requestedError is an error that a request asked to get instead of a
+// normal response.
+type requestedError struct {
+	code        string
+	declineCode string
+	errorType   string
+	message     string
+	status      int
+}
+
+//
+// Private values
+//
+
+// errorHeader is a header with which a request can ask for a specific error
+// instead of a normal response, for testing how clients handle errors. It can
+// also be sent as the errorParam query parameter.
+//
+// Its value is either the name of one of requestedErrors, like
+// `card_declined`, or an error in the form `<status>:<type>:<message>`, like
+// `402:card_error:Your card was declined.`.
+const errorHeader = "Stripe-Mock-Error"
+
+// errorParam is the query parameter equivalent of errorHeader, for clients
+// that can't easily send custom headers.
+const errorParam = "stripe_mock_error"
+
+const invalidRequestedError = "Invalid `" + errorHeader + "` '%s': expected one of " +
+	"%s, or an error in the form `<status>:<type>:<message>`."
+
+// Types of errors returned by the Stripe API, besides typeAPIError and
+// typeInvalidRequestError.
+const (
+	typeCardError      = "card_error"
+	typeRateLimitError = "rate_limit_error"
+)
+
+// requestedErrors are the errors that can be requested by name, which mirror
+// common errors returned by the Stripe API. See:
+//
+// https://stripe.com/docs/declines/codes
+// https://stripe.com/docs/error-codes
+var requestedErrors = map[string]requestedError{
+	"api_error": {
+		errorType: typeAPIError,
+		message:   "An unknown error occurred.",
+		status:    http.StatusInternalServerError,
+	},
+	"card_declined": {
+		code:        "card_declined",
+		declineCode: "generic_decline",
+		errorType:   typeCardError,
+		message:     "Your card was declined.",
+		status:      http.StatusPaymentRequired,
+	},
+	"expired_card": {
+		code:        "expired_card",
+		declineCode: "expired_card",
+		errorType:   typeCardError,
+		message:     "Your card has expired.",
+		status:      http.StatusPaymentRequired,
+	},
+	"fraudulent": {
+		code:        "card_declined",
+		declineCode: "fraudulent",
+		errorType:   typeCardError,
+		message:     "Your card was declined.",
+		status:      http.StatusPaymentRequired,
+	},
+	"incorrect_cvc": {
+		code:        "incorrect_cvc",
+		declineCode: "incorrect_cvc",
+		errorType:   typeCardError,
+		message:     "Your card's security code is incorrect.",
+		status:      http.StatusPaymentRequired,
+	},
+	"insufficient_funds": {
+		code:        "card_declined",
+		declineCode: "insufficient_funds",
+		errorType:   typeCardError,
+		message:     "Your card has insufficient funds.",
+		status:      http.StatusPaymentRequired,
+	},
+	"lost_card": {
+		code:        "card_declined",
+		declineCode: "lost_card",
+		errorType:   typeCardError,
+		message:     "Your card was declined.",
+		status:      http.StatusPaymentRequired,
+	},
+	"processing_error": {
+		code:        "processing_error",
+		declineCode: "processing_error",
+		errorType:   typeCardError,
+		message:     "An error occurred while processing your card. Try again in a little bit.",
+		status:      http.StatusPaymentRequired,
+	},
+	"rate_limit": {
+		code:      "rate_limit",
+		errorType: typeRateLimitError,
+		message:   rateLimited,
+		status:    http.StatusTooManyRequests,
+	},
+	"stolen_card": {
+		code:        "card_declined",
+		declineCode: "stolen_card",
+		errorType:   typeCardError,
+		message:     "Your card was declined.",
+		status:      http.StatusPaymentRequired,
+	},
+}
+
+//
+// Private functions
+//
+
+// parseRequestedError parses the value of errorHeader into the error that it
+// asks for.
+func parseRequestedError(value string) (*requestedError, error) {
+	if requested, ok := requestedErrors[value]; ok {
+		return &requested, nil
+	}
+
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) == 3 && parts[1] != "" && parts[2] != "" {
+		status, err := strconv.Atoi(parts[0])
+		if err == nil && status >= 400 && status <= 599 {
+			return &requestedError{
+				errorType: parts[1],
+				message:   parts[2],
+				status:    status,
+			}, nil
+		}
+	}
+
+	names := make([]string, 0, len(requestedErrors))
+	for name := range requestedErrors {
+		names = append(names, "`"+name+"`")
+	}
+	sort.Strings(names)
+
+	return nil, fmt.Errorf(invalidRequestedError, value, strings.Join(names, ", "))
+}
+
+// writeRequestedError checks whether a request asked for a specific error
+// with errorHeader or errorParam, and responds with that error if it did. The
+// return value is true if a response was written.
+func (s *StubServer) writeRequestedError(w http.ResponseWriter, r *http.Request, start time.Time) bool {
+	value := r.Header.Get(errorHeader)
+	if value == "" {
+		value = r.URL.Query().Get(errorParam)
+	}
+	if value == "" {
+		return false
+	}
+
+	requested, err := parseRequestedError(value)
+	if err != nil {
+		writeResponse(w, r, start, http.StatusBadRequest,
+			createStripeError(typeInvalidRequestError, err.Error()))
+		return true
+	}
+
+	if requested.status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", formatRetryAfter(s.retryAfterFormat, time.Second, time.Now()))
+	}
+
+	writeResponse(w, r, start, requested.status, requested.stripeError())
+	return true
+}
+
+// stripeError creates the error that was requested.
+func (requested *requestedError) stripeError() *ResponseError {
+	var options []stripeErrorOption
+	if requested.code != "" {
+		options = append(options, withCode(requested.code))
+	}
+	stripeError := createStripeError(requested.errorType, requested.message, options...)
+	stripeError.ErrorInfo.DeclineCode = requested.declineCode
+	return stripeError
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStubServer_RequestedError(t *testing.T) {
+	headers := getDefaultHeaders()
+	headers["Stripe-Mock-Error"] = "insufficient_funds"
+
+	resp, body := sendRequest(t, "POST", "/v1/charges", "amount=123", headers, nil)
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+
+	var data map[string]interface{}
+	err := json.Unmarshal(body, &data)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"code":            "card_declined",
+		"decline_code":    "insufficient_funds",
+		"doc_url":         "https://stripe.com/docs/error-codes/card-declined",
+		"message":         "Your card has insufficient funds.",
+		"request_log_url": "https://dashboard.stripe.com/test/logs/" + resp.Header.Get("Request-Id"),
+		"type":            "card_error",
+	}, data["error"])
+}
+
+func TestStubServer_RequestedErrorParam(t *testing.T) {
+	resp, _ := sendRequest(t, "GET", "/v1/charges?stripe_mock_error=rate_limit", "",
+		getDefaultHeaders(), nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
+
+func TestStubServer_InvalidRequestedError(t *testing.T) {
+	headers := getDefaultHeaders()
+	headers["Stripe-Mock-Error"] = "not_an_error"
+
+	resp, body := sendRequest(t, "GET", "/v1/charges", "", headers, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "not_an_error")
+}
+
+func TestParseRequestedError(t *testing.T) {
+	{
+		requested, err := parseRequestedError("api_error")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, requested.status)
+		assert.Equal(t, typeAPIError, requested.errorType)
+	}
+
+	// Messages can have colons in them
+	{
+		requested, err := parseRequestedError("402:card_error:Declined: try again")
+		assert.NoError(t, err)
+		assert.Equal(t, &requestedError{
+			errorType: "card_error",
+			message:   "Declined: try again",
+			status:    http.StatusPaymentRequired,
+		}, requested)
+	}
+
+	for _, value := range []string{
+		"",
+		"card_error",
+		"200:card_error:Declined",
+		"abc:card_error:Declined",
+		"402::Declined",
+		"402:card_error:",
+	} {
+		_, err := parseRequestedError(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//
+// Private values
+//
+
+const injectedError = "stripe-mock returned this error at random because it " +
+	"was started with `-error-rate`."
+
+const typeAPIError = "api_error"
+
+//
+// Private functions
+//
+
+// checkErrorRate checks that a configured error rate is a valid fraction and
+// that the status to respond with is an error.
+func checkErrorRate(rate float64, status int) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("Error rate must be between 0 and 1, but was %v", rate)
+	}
+
+	if status < 400 || status > 599 {
+		return fmt.Errorf("Error rate status must be a 4xx or 5xx status, but was %v", status)
+	}
+
+	return nil
+}
+
+// shouldInjectError decides whether a request should fail with an injected
+// error, which happens for a random fraction of requests given by the
+// configured error rate.
+func (s *StubServer) shouldInjectError() bool {
+	return s.errorRate > 0 && s.rand.Float64() < s.errorRate
+}
+
+// writeInjectedError responds to a request with an injected error.
+func (s *StubServer) writeInjectedError(w http.ResponseWriter, r *http.Request, start time.Time) {
+	errorType := typeAPIError
+	if s.errorRateStatus < 500 {
+		errorType = typeInvalidRequestError
+	}
+
+	stripeError := createStripeError(errorType, injectedError)
+	writeResponse(w, r, start, s.errorRateStatus, stripeError)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStubServer_ErrorRate(t *testing.T) {
+	failurePattern := func() []bool {
+		server := getStubServer(t, &testStubServerOptions{errorRate: 0.5, seed: 42})
+
+		var pattern []bool
+		for i := 0; i < 20; i++ {
+			resp, body := sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+			if resp.StatusCode == http.StatusInternalServerError {
+				assert.Contains(t, string(body), injectedError)
+				pattern = append(pattern, true)
+			} else {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				pattern = append(pattern, false)
+			}
+		}
+		return pattern
+	}
+
+	pattern := failurePattern()
+	assert.Contains(t, pattern, true)
+	assert.Contains(t, pattern, false)
+
+	// The same seed produces the same failures
+	assert.Equal(t, pattern, failurePattern())
+}
+
+func TestStubServer_ErrorRateDisabled(t *testing.T) {
+	server := getStubServer(t, nil)
+	for i := 0; i < 20; i++ {
+		resp, _ := sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestCheckErrorRate(t *testing.T) {
+	assert.NoError(t, checkErrorRate(0, http.StatusInternalServerError))
+	assert.NoError(t, checkErrorRate(1, http.StatusTooManyRequests))
+	assert.Error(t, checkErrorRate(1.5, http.StatusInternalServerError))
+	assert.Error(t, checkErrorRate(-0.1, http.StatusInternalServerError))
+	assert.Error(t, checkErrorRate(0.1, http.StatusOK))
+}
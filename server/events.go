@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+//
+// Private values
+//
+
+// eventTypePrefixes maps the types of objects whose events aren't named after
+// them to the prefix of their event types, like `customer.subscription` in
+// `customer.subscription.created`.
+var eventTypePrefixes = map[interface{}]string{
+	"bank_account": "customer.source",
+	"card":         "customer.source",
+	"discount":     "customer.discount",
+	"source":       "customer.source",
+	"subscription": "customer.subscription",
+	"tax_id":       "customer.tax_id",
+}
+
+//
+// Private functions
+//
+
+// recordObjectEvent records an event for an object that a stateful request
+// created, updated, or deleted, like `customer.created` for
+// `POST /v1/customers`.
+//
+// Requests to a route that ends in an ID (or an action on one, like
+// `/confirm`) update their object, and other `POST` requests create one.
+// `DELETE` requests delete their object, except for those that only cancel
+// it, which update it instead.
+func (s *StubServer) recordObjectEvent(route *stubServerRoute, req *statefulRequest, response interface{}) {
+	object, ok := response.(map[string]interface{})
+	if !ok || object["object"] == "list" {
+		return
+	}
+	objectType, ok := object["object"].(string)
+	if !ok {
+		return
+	}
+
+	var action string
+	switch {
+	case req.method == http.MethodDelete && (object["deleted"] == true || object["status"] == "canceled"):
+		action = "deleted"
+	case req.method == http.MethodDelete || req.method == http.MethodPost && route.hasPrimaryID:
+		action = "updated"
+	case req.method == http.MethodPost:
+		action = "created"
+	default:
+		return
+	}
+
+	prefix, ok := eventTypePrefixes[objectType]
+	if !ok {
+		prefix = objectType
+	}
+	s.recordEvent(req.ids, prefix+"."+action, object)
+}
+
+// recordEvent stores a new event of the given type about an object so that it
+// can be listed and retrieved, and delivers it to the webhook endpoint if one
+// is configured.
+//
+// Delivery happens in the background so that a slow endpoint doesn't hold up
+// the request that produced the event.
+func (s *StubServer) recordEvent(ids *rand.Rand, eventType string, object map[string]interface{}) map[string]interface{} {
+	event := s.newEvent(ids, eventType, object)
+	if s.webhooks.url != "" {
+		event["pending_webhooks"] = 1
+	}
+	s.events.put(event["id"].(string), event)
+
+	if s.webhooks.url != "" {
+		payload, err := json.Marshal(event)
+		if err == nil {
+			go s.deliverEvent(event["id"].(string), payload)
+		}
+	}
+
+	return event
+}
+
+// newEvent builds a new event of the given type about an object, based on the
+// event fixture. Its ID is drawn from ids if it's set.
+func (s *StubServer) newEvent(ids *rand.Rand, eventType string, object map[string]interface{}) map[string]interface{} {
+	event := make(map[string]interface{})
+	if fixture, ok := s.fixtures.Resources["event"].(map[string]interface{}); ok {
+		event = copyObject(fixture)
+	}
+	if s.spec.Info != nil {
+		event["api_version"] = s.spec.Info.Version
+	}
+	event["created"] = s.generationTime().Unix()
+	event["data"] = map[string]interface{}{"object": copyObject(object)}
+	event["id"] = newID(ids, "evt")
+	event["object"] = "event"
+	event["pending_webhooks"] = 0
+	event["type"] = eventType
+	return event
+}
+
+// deliverEvent delivers an event to the webhook endpoint, and marks it as no
+// longer pending if the delivery succeeded.
+func (s *StubServer) deliverEvent(id string, payload []byte) {
+	attempt := s.webhooks.deliver(id, payload)
+	if attempt.Succeeded {
+		s.events.update(id, func(event map[string]interface{}) {
+			event["pending_webhooks"] = 0
+		})
+	}
+}
+
+// matchesEventType checks whether an event's type matches a type filter,
+// which can end in a wildcard like `customer.*`.
+func matchesEventType(eventType string, filter string) bool {
+	if strings.HasSuffix(filter, ".*") {
+		return strings.HasPrefix(eventType, strings.TrimSuffix(filter, "*"))
+	}
+	return eventType == filter
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStatefulEvents_FilterByType(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+	sendRequestToServer(t, server, "POST", "/v1/customers/"+customerID,
+		"description=Updated", getDefaultHeaders())
+	sendRequestToServer(t, server, "POST", "/v1/charges",
+		"amount=100&currency=usd", getDefaultHeaders())
+	sendRequestToServer(t, server, "POST", "/v1/subscriptions",
+		"customer="+customerID, getDefaultHeaders())
+
+	listTypes := func(params string) []interface{} {
+		resp, body := sendRequestToServer(t, server, "GET", "/v1/events"+params, "", getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var types []interface{}
+		for _, event := range decodeObject(t, body)["data"].([]interface{}) {
+			types = append(types, event.(map[string]interface{})["type"])
+		}
+		return types
+	}
+
+	assert.Equal(t, []interface{}{
+		"customer.subscription.created",
+		"charge.created",
+		"customer.updated",
+		"customer.created",
+	}, listTypes(""))
+	assert.Equal(t, []interface{}{"customer.created"}, listTypes("?type=customer.created"))
+	assert.Equal(t, []interface{}{"charge.created", "customer.created"},
+		listTypes("?types[]=customer.created&types[]=charge.created"))
+	assert.Equal(t, []interface{}{
+		"customer.subscription.created",
+		"customer.updated",
+		"customer.created",
+	}, listTypes("?type=customer.*"))
+
+	// Events hold the object that they're about
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/events?type=customer.updated",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	event := decodeObject(t, body)["data"].([]interface{})[0].(map[string]interface{})
+	object := event["data"].(map[string]interface{})["object"].(map[string]interface{})
+	assert.Equal(t, customerID, object["id"])
+	assert.Equal(t, "Updated", object["description"])
+
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/events/"+event["id"].(string),
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "customer.updated", decodeObject(t, body)["type"])
+}
+
+func TestStatefulEvents_FilterByDeliverySuccess(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer endpoint.Close()
+
+	server := getRealStubServer(t, &testStubServerOptions{
+		stateful:   true,
+		webhookURL: endpoint.URL,
+	})
+	server.webhooks.failNextDeliveries(1)
+
+	for i := 0; i < 2; i++ {
+		sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	}
+
+	countEvents := func(params string) int {
+		resp, body := sendRequestToServer(t, server, "GET", "/v1/events"+params, "", getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return len(decodeObject(t, body)["data"].([]interface{}))
+	}
+
+	// Events are delivered in the background
+	for i := 0; i < 100 && countEvents("?delivery_success=true") < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, 1, countEvents("?delivery_success=true"))
+	assert.Equal(t, 1, countEvents("?delivery_success=false"))
+	assert.Equal(t, 2, countEvents(""))
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Public values
+//
+
+// DefaultMaxExpansionDepth is how many levels deep a property can be
+// expanded by default, which is the limit of the Stripe API.
+const DefaultMaxExpansionDepth = 4
+
+//
+// Private values
+//
+
+const expansionTooDeep = "You cannot expand more than %d levels of a property. Property: %s"
+
+const invalidExpansion = "This property cannot be expanded (%s)."
+
+//
+// Private functions
+//
+
+// checkMaxExpansionDepth checks that a configured maximum expansion depth is
+// one that expansions can be within.
+func checkMaxExpansionDepth(depth int) error {
+	if depth < 1 {
+		return fmt.Errorf("Max expansion depth must be at least 1, but was %v", depth)
+	}
+	return nil
+}
+
+// findTooDeepExpansion finds the first of the expansions requested with
+// `expand` that's more levels deep than the given maximum, like
+// `customer.default_source.customer` with a maximum of 2. It's empty if none
+// are. Rejecting these up front keeps pathological requests from generating
+// huge responses.
+func findTooDeepExpansion(expansions []string, maxDepth int) string {
+	for _, expansion := range expansions {
+		if strings.Count(expansion, ".")+1 > maxDepth {
+			return expansion
+		}
+	}
+	return ""
+}
+
+// findInvalidExpansion finds the first of the expansions requested with
+// `expand` that isn't possible for responses of the given schema, like the
+// Stripe API rejects them. It's empty if all of them are.
+//
+// An expansion is a path of properties separated by dots, like
+// `customer.default_source`. Its last property has to be one of its object's
+// `x-expandableFields`, but those before it can be any property leading to an
+// object, like the `lines` of `lines.data.price` on an invoice. `data` by
+// itself expands every expandable field of the objects in a list, and a `*`
+// expands every expandable field of its object.
+func (g *DataGenerator) findInvalidExpansion(schema *spec.Schema, expansions []string) (string, error) {
+	for _, expansion := range expansions {
+		ok, err := g.isValidExpansion(schema, strings.Split(expansion, "."))
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return expansion, nil
+		}
+	}
+	return "", nil
+}
+
+// isValidExpansion checks whether the properties in an expansion's path can
+// be expanded in responses of the given schema.
+func (g *DataGenerator) isValidExpansion(schema *spec.Schema, path []string) (bool, error) {
+	schema, _, err := g.maybeDereference(schema, "")
+	if err != nil {
+		return false, err
+	}
+
+	// The expansion is valid if it is for any of the branches, which covers
+	// expandable fields themselves (whose branches are an ID and the expanded
+	// object) as well as polymorphic objects.
+	if len(schema.AnyOf) != 0 {
+		for _, branch := range schema.AnyOf {
+			ok, err := g.isValidExpansion(branch, path)
+			if ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+
+	if schema.Type == "array" && schema.Items != nil {
+		return g.isValidExpansion(schema.Items, path)
+	}
+
+	field := path[0]
+	if field == "*" && len(path) == 1 {
+		return true, nil
+	}
+
+	property, ok := schema.Properties[field]
+	if !ok {
+		return false, nil
+	}
+
+	if len(path) == 1 {
+		if field == "data" && (isListResource(schema) || isSearchResultResource(schema)) {
+			return true, nil
+		}
+		return isExpandableField(schema, field), nil
+	}
+
+	return g.isValidExpansion(property, path[1:])
+}
+
+// isExpandableField checks whether a field is one of an object's
+// `x-expandableFields`.
+func isExpandableField(schema *spec.Schema, field string) bool {
+	if schema.XExpandableFields == nil {
+		return false
+	}
+	for _, expandableField := range *schema.XExpandableFields {
+		if expandableField == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestFindTooDeepExpansion(t *testing.T) {
+	assert.Equal(t, "", findTooDeepExpansion(nil, 2))
+	assert.Equal(t, "", findTooDeepExpansion([]string{"customer", "customer.default_source"}, 2))
+	assert.Equal(t, "lines.data.price",
+		findTooDeepExpansion([]string{"customer", "lines.data.price"}, 2))
+}
+
+func TestNewStubServer_MaxExpansionDepth(t *testing.T) {
+	server, err := NewStubServer(&testFixtures, &testSpec, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultMaxExpansionDepth, server.maxExpansionDepth)
+
+	server, err = NewStubServer(&testFixtures, &testSpec,
+		&StubServerOptions{MaxExpansionDepth: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, server.maxExpansionDepth)
+
+	_, err = NewStubServer(&testFixtures, &testSpec,
+		&StubServerOptions{MaxExpansionDepth: -1})
+	assert.Error(t, err)
+}
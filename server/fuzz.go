@@ -0,0 +1,175 @@
+package server
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private values
+//
+
+// fuzzChance is the chance of any one value being replaced by an edge value
+// like null, an empty array, or a string of the maximum length when fuzzing.
+const fuzzChance = 0.25
+
+// fuzzPreservedKeys are keys whose values are never fuzzed because they
+// identify objects, which the rest of stripe-mock (like stateful mode) relies
+// on.
+var fuzzPreservedKeys = map[string]bool{
+	"id":     true,
+	"object": true,
+}
+
+//
+// Private functions
+//
+
+// fuzz randomizes generated data within the constraints of its schema so
+// that clients can be tested against varied, but still valid, responses. It
+// favors edge values like null for nullable fields, empty arrays, empty
+// strings, and strings of the maximum length.
+//
+// Only values that are already present are changed. Keys are never added or
+// removed, and the shape of values that could be one of several types (like
+// expandable fields) is kept.
+func (g *DataGenerator) fuzz(r *rand.Rand, schema *spec.Schema, data interface{}) interface{} {
+	schema, _, _ = g.maybeDereference(schema, "")
+
+	if data == nil {
+		return nil
+	}
+
+	if schema.Nullable && r.Float64() < fuzzChance {
+		return nil
+	}
+
+	if len(schema.AnyOf) != 0 {
+		branch := g.findFuzzAnyOfBranch(schema, data)
+		if branch == nil {
+			return data
+		}
+		return g.fuzz(r, branch, data)
+	}
+
+	if len(schema.Enum) != 0 {
+		return schema.Enum[r.Intn(len(schema.Enum))]
+	}
+
+	switch value := data.(type) {
+	case map[string]interface{}:
+		// Keys are visited in order so that the same seed always produces
+		// the same data.
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		// Generated data may share values with fixtures, so fuzzed values go
+		// in a new map rather than replacing the originals.
+		fuzzed := make(map[string]interface{}, len(value))
+		for _, key := range keys {
+			fuzzed[key] = value[key]
+			if fuzzPreservedKeys[key] {
+				continue
+			}
+			if propertySchema, ok := schema.Properties[key]; ok {
+				fuzzed[key] = g.fuzz(r, propertySchema, value[key])
+			} else if schema.AdditionalProperties != nil {
+				fuzzed[key] = g.fuzz(r, schema.AdditionalProperties, value[key])
+			}
+		}
+		return fuzzed
+
+	case []interface{}:
+		if r.Float64() < fuzzChance || schema.Items == nil {
+			return []interface{}{}
+		}
+		fuzzed := make([]interface{}, len(value))
+		for i, item := range value {
+			fuzzed[i] = g.fuzz(r, schema.Items, item)
+		}
+		return fuzzed
+
+	case string:
+		// Strings with a format or a pattern are left alone because they're
+		// often parsed by clients (like decimals and URLs).
+		if schema.Format != "" || schema.Pattern != "" {
+			return value
+		}
+		switch n := r.Float64(); {
+		case n < fuzzChance/2:
+			return ""
+		case n < fuzzChance && schema.MaxLength > 0:
+			return strings.Repeat("x", schema.MaxLength)
+		}
+		return value
+
+	case bool:
+		return r.Intn(2) == 0
+	}
+
+	switch schema.Type {
+	case "integer":
+		switch n := r.Float64(); {
+		case n < fuzzChance/2:
+			return 0
+		case n < fuzzChance:
+			return r.Int63n(1 << 31)
+		}
+	case "number":
+		if r.Float64() < fuzzChance {
+			return r.Float64() * 100
+		}
+	}
+
+	return data
+}
+
+// findFuzzAnyOfBranch finds the branch of a schema containing `anyOf` that
+// describes the given data, so that fuzzing keeps its shape. nil is returned
+// if no branch could be found.
+func (g *DataGenerator) findFuzzAnyOfBranch(schema *spec.Schema, data interface{}) *spec.Schema {
+	dataType := jsonType(data)
+
+	for _, branch := range schema.AnyOf {
+		branch, _, _ := g.maybeDereference(branch, "")
+
+		if branch.Type != dataType && !(dataType == "number" && branch.Type == "integer") {
+			continue
+		}
+
+		// Objects are told apart by their `object` field, which is an enum
+		// with a single value.
+		if object, ok := data.(map[string]interface{}); ok {
+			objectSchema, ok := branch.Properties["object"]
+			if ok && len(objectSchema.Enum) != 0 && objectSchema.Enum[0] != object["object"] {
+				continue
+			}
+		}
+
+		return branch
+	}
+
+	return nil
+}
+
+// jsonType returns the JSON schema type of a generated value. All numbers are
+// reported as `number`.
+func jsonType(data interface{}) string {
+	switch data.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	}
+	return "number"
+}
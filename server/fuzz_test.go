@@ -0,0 +1,106 @@
+package server
+
+import (
+	"math/rand"
+	"net/http"
+	"reflect"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+func TestFuzz_ValidAcrossSeeds(t *testing.T) {
+	generator := DataGenerator{realSpec.Components.Schemas, &realFixtures, verbose}
+	components := spec.GetComponentsForValidation(&realSpec.Components)
+
+	for _, resource := range []string{"charge", "customer", "invoice", "subscription"} {
+		schema := &spec.Schema{Ref: "#/components/schemas/" + resource}
+		validator, err := spec.GetValidatorForOpenAPI3Schema(schema, components)
+		assert.NoError(t, err)
+
+		unfuzzed, err := generator.Generate(&GenerateParams{
+			PathParams: newFuzzTestPathParams(),
+			Schema:     schema,
+		})
+		assert.NoError(t, err)
+
+		var anyChanged bool
+		for seed := int64(1); seed <= 5; seed++ {
+			data, err := generator.Generate(&GenerateParams{
+				Fuzz:       rand.New(rand.NewSource(seed)),
+				PathParams: newFuzzTestPathParams(),
+				Schema:     schema,
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, validateResponse(validator, data),
+				"fuzzed %s with seed %d is invalid", resource, seed)
+
+			dataMap := data.(map[string]interface{})
+			assert.Equal(t, "obj_123", dataMap["id"])
+			assert.Equal(t, resource, dataMap["object"])
+
+			if !reflect.DeepEqual(unfuzzed, data) {
+				anyChanged = true
+			}
+		}
+		assert.True(t, anyChanged, "fuzzing never changed %s", resource)
+	}
+}
+
+func TestFuzz_Reproducible(t *testing.T) {
+	generator := DataGenerator{realSpec.Components.Schemas, &realFixtures, verbose}
+	schema := &spec.Schema{Ref: "#/components/schemas/charge"}
+
+	data1, err := generator.Generate(&GenerateParams{
+		Fuzz:       rand.New(rand.NewSource(123)),
+		PathParams: newFuzzTestPathParams(),
+		Schema:     schema,
+	})
+	assert.NoError(t, err)
+
+	data2, err := generator.Generate(&GenerateParams{
+		Fuzz:       rand.New(rand.NewSource(123)),
+		PathParams: newFuzzTestPathParams(),
+		Schema:     schema,
+	})
+	assert.NoError(t, err)
+	assert.True(t, reflect.DeepEqual(data1, data2))
+
+	// Fixtures aren't modified by fuzzing
+	data3, err := generator.Generate(&GenerateParams{
+		PathParams: newFuzzTestPathParams(),
+		Schema:     schema,
+	})
+	assert.NoError(t, err)
+	data4, err := generator.Generate(&GenerateParams{
+		PathParams: newFuzzTestPathParams(),
+		Schema:     schema,
+	})
+	assert.NoError(t, err)
+	assert.True(t, reflect.DeepEqual(data3, data4))
+}
+
+func TestStubServer_Fuzz(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{fuzz: true, seed: 1})
+
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/charges/ch_123", "",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	charge := decodeObject(t, body)
+	assert.Equal(t, "ch_123", charge["id"])
+	assert.Equal(t, "charge", charge["object"])
+}
+
+//
+// Private functions
+//
+
+// newFuzzTestPathParams produces path parameters with a fixed primary ID so
+// that generated data can be compared.
+func newFuzzTestPathParams() *PathParamsMap {
+	id := "obj_123"
+	return &PathParamsMap{PrimaryID: &id}
+}
@@ -27,6 +27,25 @@ type GenerateParams struct {
 	// none of the original expansions applied.
 	Expansions *ExpansionLevel
 
+	// Fuzz, if set, is a source of randomness with which generated data is
+	// randomized within the constraints of its schema, favoring edge values
+	// like nulls, empty arrays, and long strings.
+	//
+	// nil if the data shouldn't be fuzzed.
+	Fuzz *rand.Rand
+
+	// IDs, if set, is a source of randomness from which new IDs are
+	// generated, which makes them reproducible. See reproducibleID.
+	//
+	// nil if new IDs should be random.
+	IDs *rand.Rand
+
+	// Now, if set, is the Unix time that timestamps in generated objects are
+	// made relative to. See applyTimestamps.
+	//
+	// 0 if timestamps should be left as they are in fixtures.
+	Now int64
+
 	// PathParams, if set, is a collection that contains values for parameters
 	// that were extracted from a request path. This is useful so that we can
 	// reflect those values into responses for a more realistic effect.
@@ -42,7 +61,11 @@ type GenerateParams struct {
 	//
 	// It's used to find opportunities to reflect information included with a
 	// request into the response to make responses look more accurate than
-	// they'd otherwise be if they'd been generated from fixtures alone..
+	// they'd otherwise be if they'd been generated from fixtures alone, and
+	// to choose between the types of object that a polymorphic field can be.
+	//
+	// The value of this field is expected to stay stable across all levels of
+	// recursion.
 	RequestData map[string]interface{}
 
 	// RequestMethod is the HTTP method of the URL being requested which we're
@@ -105,6 +128,7 @@ func (g *DataGenerator) Generate(params *GenerateParams) (interface{}, error) {
 	data, err := g.generateInternal(&GenerateParams{
 		Expansions:    params.Expansions,
 		PathParams:    nil,
+		RequestData:   params.RequestData,
 		RequestMethod: params.RequestMethod,
 		RequestPath:   params.RequestPath,
 		Schema:        params.Schema,
@@ -123,11 +147,22 @@ func (g *DataGenerator) Generate(params *GenerateParams) (interface{}, error) {
 		return data, nil
 	}
 
+	// Timestamps are moved before fuzzing so that fuzzed values are kept.
+	if params.Now != 0 {
+		data = g.applyTimestamps(params.Now, params.Schema, data)
+	}
+
+	// Fuzz before anything is reflected from the request so that the values
+	// that clients sent still come back to them.
+	if params.Fuzz != nil {
+		data = g.fuzz(params.Fuzz, params.Schema, data)
+	}
+
 	// Maybe generate a new primary ID. This kicks in when no primary ID was
 	// extracted from the path, which usually means this is a "create" API
 	// endpoint. This nicety allows create endpoints to return a new ID every
 	// time like the real API would.
-	pathParams := maybeGeneratePrimaryID(params.PathParams, data)
+	pathParams := maybeGeneratePrimaryID(params.IDs, params.PathParams, data)
 
 	if pathParams != nil {
 		// Passses through the generated data and replaces IDs that existed in
@@ -144,6 +179,26 @@ func (g *DataGenerator) Generate(params *GenerateParams) (interface{}, error) {
 		distributeReplacedIDs(pathParams, data)
 	}
 
+	// Lists respond with the page that was asked for, so that clients can
+	// page through them, and with objects that match the filters sent.
+	if params.RequestMethod == http.MethodGet {
+		paginateGeneratedList(params.RequestData, data)
+		applyListFilters(params.RequestData, data)
+	}
+
+	if params.RequestMethod == http.MethodDelete {
+		err := g.applyDeletedStub(params.Schema, params.PathParams, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Now that IDs are final, make client secrets and URLs correspond to
+	// them.
+	applyClientSecrets(data)
+	applyBillingPortalSessionURL(data)
+	applyPaymentLinkURL(data)
+
 	// In `POST` requests we reflect input parameters into responses to try and
 	// simulate a more realistic create or update operation.
 	if params.RequestMethod == http.MethodPost {
@@ -153,6 +208,22 @@ func (g *DataGenerator) Generate(params *GenerateParams) (interface{}, error) {
 				Schema:      params.Schema,
 			}
 			mapData = replacer.ReplaceData(params.RequestData, mapData)
+
+			err := g.applyRequestMetadata(params.Schema, params.RequestData, mapData)
+			if err != nil {
+				return nil, err
+			}
+
+			// Make verification checks reflect any test card that was sent.
+			applyTestCardChecks(params.RequestData, mapData)
+
+			// Flag charges made with risky test cards for review.
+			applyReviewOutcome(params.IDs, params.RequestData, mapData)
+
+			err = g.applyPaymentMethodDetailsType(params.RequestData, mapData)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -175,11 +246,16 @@ func (g *DataGenerator) generateInternal(params *GenerateParams) (interface{}, e
 		return nil, err
 	}
 
-	// Determine if the requested expansions are possible
+	// Determine if the requested expansions are possible. Fields that aren't
+	// expandable can still be expanded through, like the `lines` of an
+	// invoice for `lines.data.price`.
 	if params.Expansions != nil && schema.XExpandableFields != nil {
-		for key := range params.Expansions.expansions {
-			if sort.SearchStrings(*schema.XExpandableFields, key) ==
-				len(*schema.XExpandableFields) {
+		for key, level := range params.Expansions.expansions {
+			if isExpandableField(schema, key) {
+				continue
+			}
+			_, isProperty := schema.Properties[key]
+			if !isProperty || (len(level.expansions) == 0 && !level.wildcard) {
 				return nil, errExpansionNotSupported
 			}
 		}
@@ -205,6 +281,7 @@ func (g *DataGenerator) generateInternal(params *GenerateParams) (interface{}, e
 			return g.generateInternal(&GenerateParams{
 				Expansions:    params.Expansions,
 				PathParams:    nil,
+				RequestData:   params.RequestData,
 				RequestMethod: params.RequestMethod,
 				RequestPath:   params.RequestPath,
 				Schema:        schema.XExpansionResources.OneOf[0],
@@ -219,6 +296,7 @@ func (g *DataGenerator) generateInternal(params *GenerateParams) (interface{}, e
 		return g.generateInternal(&GenerateParams{
 			Expansions:    params.Expansions,
 			PathParams:    nil,
+			RequestData:   params.RequestData,
 			RequestMethod: params.RequestMethod,
 			RequestPath:   params.RequestPath,
 			Schema:        schema.AnyOf[0],
@@ -238,6 +316,7 @@ func (g *DataGenerator) generateInternal(params *GenerateParams) (interface{}, e
 			return g.generateInternal(&GenerateParams{
 				Expansions:    params.Expansions,
 				PathParams:    nil,
+				RequestData:   params.RequestData,
 				RequestMethod: params.RequestMethod,
 				RequestPath:   params.RequestPath,
 				Schema:        schema.AnyOf[0],
@@ -249,13 +328,27 @@ func (g *DataGenerator) generateInternal(params *GenerateParams) (interface{}, e
 	}
 
 	if len(schema.AnyOf) != 0 {
-		anyOfSchema, err := g.findAnyOfBranch(schema, params.RequestMethod == http.MethodDelete)
+		deleted := params.RequestMethod == http.MethodDelete
+
+		// Requests that ask for a particular type of object, like with
+		// `type=card`, get a branch of that type if there is one.
+		anyOfSchema, err := g.findRequestedAnyOfBranch(schema, deleted, params.RequestData)
 		if err != nil {
 			return nil, err
 		}
+		requested := anyOfSchema != nil
+
+		if !requested {
+			anyOfSchema, err = g.findAnyOfBranch(schema, deleted)
+			if err != nil {
+				return nil, err
+			}
+		}
 
 		var context string
-		if anyOfSchema != nil {
+		if requested {
+			context = fmt.Sprintf("%sChoosing branch of anyOf based on requested object type:\n", context)
+		} else if anyOfSchema != nil {
 			context = fmt.Sprintf("%sChoosing branch of anyOf based on request method:\n", context)
 		} else {
 			context = fmt.Sprintf("%sChoosing first branch of anyOf:\n", context)
@@ -268,6 +361,7 @@ func (g *DataGenerator) generateInternal(params *GenerateParams) (interface{}, e
 		return g.generateInternal(&GenerateParams{
 			Expansions:    params.Expansions,
 			PathParams:    nil,
+			RequestData:   params.RequestData,
 			RequestMethod: params.RequestMethod,
 			RequestPath:   params.RequestPath,
 			Schema:        anyOfSchema,
@@ -283,6 +377,7 @@ func (g *DataGenerator) generateInternal(params *GenerateParams) (interface{}, e
 		listData, err := g.generateListResource(&GenerateParams{
 			Expansions:    params.Expansions,
 			PathParams:    nil,
+			RequestData:   params.RequestData,
 			RequestMethod: params.RequestMethod,
 			RequestPath:   params.RequestPath,
 			Schema:        schema,
@@ -300,6 +395,7 @@ func (g *DataGenerator) generateInternal(params *GenerateParams) (interface{}, e
 		searchResultData, err := g.generateSearchResultResource(&GenerateParams{
 			Expansions:    params.Expansions,
 			PathParams:    nil,
+			RequestData:   params.RequestData,
 			RequestMethod: params.RequestMethod,
 			RequestPath:   params.RequestPath,
 			Schema:        schema,
@@ -396,12 +492,20 @@ func (g *DataGenerator) generateInternal(params *GenerateParams) (interface{}, e
 				// If the example omitted this key, then so do we; unless we were asked
 				// to expand the key, in which case we'll have to generate an example
 				// from scratch.
+				//
+				// Required keys that are nullable are the exception. The API
+				// always includes them, as an explicit null when they're unset,
+				// and some clients tell null apart from a missing key.
+				if subSchema.Nullable && isRequiredProperty(schema, key) {
+					resultMap[key] = nil
+				}
 				continue
 			}
 
 			subValue, err := g.generateInternal(&GenerateParams{
 				Expansions:    subExpansions,
 				PathParams:    nil,
+				RequestData:   params.RequestData,
 				RequestMethod: params.RequestMethod,
 				RequestPath:   params.RequestPath,
 				Schema:        subSchema,
@@ -441,6 +545,34 @@ func (g *DataGenerator) findAnyOfBranch(schema *spec.Schema, deleted bool) (*spe
 	return nil, nil
 }
 
+// findRequestedAnyOfBranch finds a branch of a schema containing `anyOf` that's
+// an object of the type that the request asked for in one of
+// anyOfDiscriminatorParams, and that's a deleted resource or not like in
+// findAnyOfBranch. It's nil if the request didn't ask for a type, or if no
+// branch is of that type.
+func (g *DataGenerator) findRequestedAnyOfBranch(schema *spec.Schema, deleted bool,
+	requestData map[string]interface{}) (*spec.Schema, error) {
+
+	for _, name := range anyOfDiscriminatorParams {
+		objectType, ok := requestData[name].(string)
+		if !ok || objectType == "" {
+			continue
+		}
+
+		for _, anyOfSchema := range schema.AnyOf {
+			anyOfSchema, _, err := g.maybeDereference(anyOfSchema, "")
+			if err != nil {
+				return nil, err
+			}
+
+			if isObjectOfType(anyOfSchema, objectType) && isDeletedResource(anyOfSchema) == deleted {
+				return anyOfSchema, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
 func (g *DataGenerator) maybeDereference(schema *spec.Schema, context string) (*spec.Schema, string, error) {
 	if schema.Ref != "" {
 		definition := definitionFromJSONPointer(schema.Ref)
@@ -481,9 +613,20 @@ func (g *DataGenerator) generateListResource(params *GenerateParams) (interface{
 		itemExpansions = params.Expansions.expansions["data"]
 	}
 
+	// A bare `expand[]=data` doesn't name any particular field, so treat it as
+	// a request to expand every expandable field of each item.
+	if itemExpansions != nil && len(itemExpansions.expansions) == 0 && !itemExpansions.wildcard {
+		var err error
+		itemExpansions, err = g.expandableFieldsExpansionLevel(params.Schema.Properties["data"].Items)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	itemData, err := g.generateInternal(&GenerateParams{
 		Expansions:    itemExpansions,
 		PathParams:    nil,
+		RequestData:   params.RequestData,
 		RequestMethod: params.RequestMethod,
 		RequestPath:   params.RequestPath,
 		Schema:        params.Schema.Properties["data"].Items,
@@ -520,6 +663,24 @@ func (g *DataGenerator) generateListResource(params *GenerateParams) (interface{
 	return listData, nil
 }
 
+// expandableFieldsExpansionLevel builds an expansion level that expands every
+// expandable field of the given schema, but nothing nested below them.
+func (g *DataGenerator) expandableFieldsExpansionLevel(schema *spec.Schema) (*ExpansionLevel, error) {
+	schema, _, err := g.maybeDereference(schema, "")
+	if err != nil {
+		return nil, err
+	}
+
+	level := &ExpansionLevel{expansions: make(map[string]*ExpansionLevel)}
+	if schema.XExpandableFields != nil {
+		for _, field := range *schema.XExpandableFields {
+			level.expansions[field] =
+				&ExpansionLevel{expansions: make(map[string]*ExpansionLevel)}
+		}
+	}
+	return level, nil
+}
+
 func (g *DataGenerator) generateSearchResultResource(params *GenerateParams) (interface{}, error) {
 	var itemExpansions *ExpansionLevel
 	if params.Expansions != nil {
@@ -529,6 +690,7 @@ func (g *DataGenerator) generateSearchResultResource(params *GenerateParams) (in
 	itemData, err := g.generateInternal(&GenerateParams{
 		Expansions:    itemExpansions,
 		PathParams:    nil,
+		RequestData:   params.RequestData,
 		RequestMethod: params.RequestMethod,
 		RequestPath:   params.RequestPath,
 		Schema:        params.Schema.Properties["data"].Items,
@@ -592,6 +754,12 @@ const randomIDTimeReference = 1342389380
 
 var errExpansionNotSupported = fmt.Errorf("Expansion not supported")
 
+// anyOfDiscriminatorParams are the request parameters that can name the type
+// of object that a polymorphic field should be, like `object=card` when
+// listing a customer's sources or `type=card`, in order of precedence. See
+// findRequestedAnyOfBranch.
+var anyOfDiscriminatorParams = []string{"object", "type"}
+
 // randomIDRunes are the set of possible runes that may appear in the time part
 // of a random ID.
 var randomIDRunes = []rune("01234567890ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
@@ -820,6 +988,21 @@ func isDeletedResource(schema *spec.Schema) bool {
 	return ok
 }
 
+// isObjectOfType checks whether a schema is of objects of the given type,
+// which is the only value that their `object` property can have.
+func isObjectOfType(schema *spec.Schema, objectType string) bool {
+	objectSchema, ok := schema.Properties["object"]
+	if !ok {
+		return false
+	}
+	for _, value := range objectSchema.Enum {
+		if value == objectType {
+			return true
+		}
+	}
+	return false
+}
+
 func isListResource(schema *spec.Schema) bool {
 	if schema.Type != "object" || schema.Properties == nil {
 		return false
@@ -893,8 +1076,8 @@ func logReplacedID(prevID, newID string, verbose bool) {
 // simulated new objects from stripe-mock all have unique IDs.
 //
 // So for example, a `POST /v1/charges` will result in a newly generated ID
-// with a `ch` prefix like `ch_123`.
-func maybeGeneratePrimaryID(pathParams *PathParamsMap, data interface{}) *PathParamsMap {
+// with a `ch` prefix like `ch_123`. The ID is drawn from ids if it's set.
+func maybeGeneratePrimaryID(ids *rand.Rand, pathParams *PathParamsMap, data interface{}) *PathParamsMap {
 	// Do nothing in case we already have a primary ID.
 	if pathParams != nil && pathParams.PrimaryID != nil {
 		return pathParams
@@ -925,7 +1108,7 @@ func maybeGeneratePrimaryID(pathParams *PathParamsMap, data interface{}) *PathPa
 		prefix = id[:usInd]
 	}
 
-	newID := randomID(prefix)
+	newID := newID(ids, prefix)
 
 	if pathParams == nil {
 		return &PathParamsMap{PrimaryID: &newID}
@@ -968,14 +1151,32 @@ func propertyNames(schema *spec.Schema) string {
 //
 // The random part is a random number encoded to a wider character set.
 func randomID(prefix string) string {
-	return prefix + "_" + randomIDTimePart() + randomIDRandomPart()
+	return prefix + "_" + randomIDTimePart() + randomIDRandomPart(rand.Intn)
+}
+
+// reproducibleID is like randomID, but draws the random part of the ID from
+// the given source of randomness, and leaves out the time part (which is all
+// zeros instead) so that the same source always generates the same IDs.
+func reproducibleID(source *rand.Rand, prefix string) string {
+	timePart := strings.Repeat(string(randomIDRunes[0]), randomIDTimeLength)
+	return prefix + "_" + timePart + randomIDRandomPart(source.Intn)
+}
+
+// newID generates an ID with reproducibleID if ids is set, and with randomID
+// otherwise.
+func newID(ids *rand.Rand, prefix string) string {
+	if ids != nil {
+		return reproducibleID(ids, prefix)
+	}
+	return randomID(prefix)
 }
 
-// randomIDRandomPart generates the random part of a new ID.
-func randomIDRandomPart() string {
+// randomIDRandomPart generates the random part of a new ID, drawing random
+// numbers from intn.
+func randomIDRandomPart(intn func(n int) int) string {
 	runes := make([]rune, randomIDRandomLength)
 	for i := 0; i < randomIDRandomLength; i++ {
-		runes[i] = randomIDRunes[rand.Intn(len(randomIDRunes))]
+		runes[i] = randomIDRunes[intn(len(randomIDRunes))]
 	}
 	return string(runes)
 }
@@ -3,8 +3,10 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"regexp"
+	"strings"
 	"sync"
 	"testing"
 
@@ -211,6 +213,27 @@ func TestGenerateResponseData(t *testing.T) {
 			data.(map[string]interface{})["data"].([]interface{})[0].(map[string]interface{})["id"])
 	}
 
+	// list with a bare `data` expansion
+	{
+		generator := DataGenerator{testSpec.Components.Schemas, &testFixtures, verbose}
+		data, err := generator.Generate(&GenerateParams{
+			Expansions: &ExpansionLevel{
+				expansions: map[string]*ExpansionLevel{"data": {
+					expansions: map[string]*ExpansionLevel{}},
+				},
+			},
+			RequestPath: "/v1/charges",
+			Schema:      listSchema,
+		})
+		assert.Nil(t, err)
+		charge := data.(map[string]interface{})["data"].([]interface{})[0].(map[string]interface{})
+
+		// Every expandable field (i.e. customer) has been expanded
+		assert.Equal(t,
+			testFixtures.Resources["customer"].(map[string]interface{})["id"],
+			charge["customer"].(map[string]interface{})["id"])
+	}
+
 	// nested list
 	{
 		generator := DataGenerator{
@@ -615,6 +638,36 @@ func TestResourcesCanBeGeneratedAndExpanded(t *testing.T) {
 // Tests for private functions
 //
 
+func TestGenerateClientSecret(t *testing.T) {
+	generator := DataGenerator{realSpec.Components.Schemas, &realFixtures, verbose}
+
+	for _, objectType := range []string{"payment_intent", "setup_intent"} {
+		t.Run(objectType, func(t *testing.T) {
+			generate := func(id string) map[string]interface{} {
+				data, err := generator.Generate(&GenerateParams{
+					PathParams: &PathParamsMap{PrimaryID: &id},
+					Schema:     &spec.Schema{Ref: "#/components/schemas/" + objectType},
+				})
+				assert.NoError(t, err)
+				return data.(map[string]interface{})
+			}
+
+			data := generate("obj_123")
+			assert.Equal(t, "obj_123", data["id"])
+			assert.Regexp(t,
+				regexp.MustCompile(`^obj_123_secret_[0-9A-Za-z]{25}$`),
+				data["client_secret"])
+
+			// The same ID always produces the same secret, and a different one
+			// produces a different secret.
+			assert.Equal(t, data["client_secret"], generate("obj_123")["client_secret"])
+			assert.NotEqual(t,
+				strings.TrimPrefix(data["client_secret"].(string), "obj_123"),
+				strings.TrimPrefix(generate("obj_456")["client_secret"].(string), "obj_456"))
+		})
+	}
+}
+
 func TestDefinitionFromJSONPointer(t *testing.T) {
 	definition := definitionFromJSONPointer("#/components/schemas/charge")
 	assert.Equal(t, "charge", definition)
@@ -810,6 +863,68 @@ func TestFindAnyOfBranch(t *testing.T) {
 	}
 }
 
+func TestFindRequestedAnyOfBranch(t *testing.T) {
+	objectSchema := func(objectType string, deleted bool) *spec.Schema {
+		schema := &spec.Schema{
+			Properties: map[string]*spec.Schema{
+				"object": {Type: "string", Enum: []interface{}{objectType}},
+			},
+		}
+		if deleted {
+			schema.Properties["deleted"] = &spec.Schema{Type: "boolean"}
+		}
+		return schema
+	}
+
+	bankAccountSchema := objectSchema("bank_account", false)
+	cardSchema := objectSchema("card", false)
+	deletedCardSchema := objectSchema("card", true)
+
+	schema := &spec.Schema{
+		AnyOf: []*spec.Schema{bankAccountSchema, deletedCardSchema, cardSchema},
+	}
+
+	generator := DataGenerator{nil, nil, verbose}
+
+	testCases := []struct {
+		deleted     bool
+		requestData map[string]interface{}
+		expected    *spec.Schema
+	}{
+		{false, map[string]interface{}{"object": "card"}, cardSchema},
+		{false, map[string]interface{}{"type": "card"}, cardSchema},
+		{true, map[string]interface{}{"type": "card"}, deletedCardSchema},
+		{false, map[string]interface{}{"object": "bank_account", "type": "card"}, bankAccountSchema},
+		{false, map[string]interface{}{"object": "source", "type": "card"}, cardSchema},
+		{false, map[string]interface{}{"type": "source"}, nil},
+		{false, nil, nil},
+	}
+	for _, testCase := range testCases {
+		anyOfSchema, err := generator.findRequestedAnyOfBranch(schema, testCase.deleted, testCase.requestData)
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.expected, anyOfSchema, "%+v", testCase.requestData)
+	}
+}
+
+func TestGenerateRequestedAnyOfBranch(t *testing.T) {
+	generator := DataGenerator{realSpec.Components.Schemas, &realFixtures, verbose}
+
+	// A customer's sources can be any kind of payment source, but a list of
+	// them can be filtered to one kind
+	for _, objectType := range []string{"bank_account", "card", "source"} {
+		data, err := generator.Generate(&GenerateParams{
+			RequestData:   map[string]interface{}{"object": objectType},
+			RequestMethod: http.MethodGet,
+			RequestPath:   "/v1/customers/cus_123/sources",
+			Schema: realSpec.Paths["/v1/customers/{customer}/sources"]["get"].
+				Responses["200"].Content["application/json"].Schema,
+		})
+		assert.NoError(t, err)
+		item := data.(map[string]interface{})["data"].([]interface{})[0]
+		assert.Equal(t, objectType, item.(map[string]interface{})["object"])
+	}
+}
+
 func TestGenerateSyntheticFixture(t *testing.T) {
 	// Scalars (and an array, which is easy)
 	g := DataGenerator{nil, nil, verbose}
@@ -917,6 +1032,73 @@ func TestGenerateForNullableExpansion(t *testing.T) {
 	assert.NotNil(t, example)
 }
 
+func TestGenerateExplicitNulls(t *testing.T) {
+	generator := DataGenerator{
+		definitions: map[string]*spec.Schema{
+			"widget": {
+				Type: "object",
+				Properties: map[string]*spec.Schema{
+					"id":          {Type: "string"},
+					"description": {Type: "string", Nullable: true},
+					"nickname":    {Type: "string", Nullable: true},
+				},
+				Required:    []string{"id", "description"},
+				XResourceID: "widget",
+			},
+		},
+		fixtures: &spec.Fixtures{
+			Resources: map[spec.ResourceID]interface{}{
+				"widget": map[string]interface{}{"id": "wid_123"},
+			},
+		},
+		verbose: verbose,
+	}
+
+	data, err := generator.Generate(&GenerateParams{
+		Schema: &spec.Schema{Ref: "#/components/schemas/widget"},
+	})
+	assert.NoError(t, err)
+	dataMap := data.(map[string]interface{})
+
+	// A required nullable field is present as null even though the fixture
+	// omits it
+	value, ok := dataMap["description"]
+	assert.True(t, ok)
+	assert.Nil(t, value)
+
+	// Optional fields are still omitted
+	_, ok = dataMap["nickname"]
+	assert.False(t, ok)
+}
+
+func TestGenerateDeletedStub(t *testing.T) {
+	generator := DataGenerator{testSpec.Components.Schemas, &testFixtures, verbose}
+	id := "cus_abc"
+
+	// Schemas that declare `deleted` get a stub of the deleted object
+	data, err := generator.Generate(&GenerateParams{
+		PathParams:    &PathParamsMap{PrimaryID: &id},
+		RequestMethod: http.MethodDelete,
+		Schema:        &spec.Schema{Ref: "#/components/schemas/deleted_customer"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"deleted": true,
+		"id":      "cus_abc",
+		"object":  "customer",
+	}, data)
+
+	// Others respond with the full object
+	data, err = generator.Generate(&GenerateParams{
+		PathParams:    &PathParamsMap{PrimaryID: &id},
+		RequestMethod: http.MethodDelete,
+		Schema:        &spec.Schema{Ref: "#/components/schemas/customer"},
+	})
+	assert.NoError(t, err)
+	_, ok := data.(map[string]interface{})["deleted"]
+	assert.False(t, ok)
+}
+
 func TestPropertyNames(t *testing.T) {
 	assert.Equal(t, "bar, foo", propertyNames(&spec.Schema{
 		Properties: map[string]*spec.Schema{
@@ -927,6 +1109,15 @@ func TestPropertyNames(t *testing.T) {
 	assert.Equal(t, "", propertyNames(&spec.Schema{}))
 }
 
+func TestReproducibleID(t *testing.T) {
+	id := reproducibleID(rand.New(rand.NewSource(42)), "ch")
+	assert.Regexp(t, `\Ach_00000[0-9A-Za-z]{10}\z`, id)
+
+	// The same seed always generates the same ID
+	assert.Equal(t, id, reproducibleID(rand.New(rand.NewSource(42)), "ch"))
+	assert.NotEqual(t, id, reproducibleID(rand.New(rand.NewSource(43)), "ch"))
+}
+
 func TestIsDeletedResource(t *testing.T) {
 	assert.True(t, isDeletedResource(&spec.Schema{
 		Properties: map[string]*spec.Schema{
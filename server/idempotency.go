@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+//
+// Private values
+//
+
+// idempotencyKeyTTL is how long the response to a request with an
+// `Idempotency-Key` is replayed for. It's the same as in the Stripe API.
+const idempotencyKeyTTL = 24 * time.Hour
+
+//
+// Private types
+//
+
+// idempotencyCache is an in-memory cache of the responses to requests that
+// were sent with an `Idempotency-Key` header, so that retries of the same
+// request get the same response instead of a newly generated one.
+//
+// It's safe for concurrent use.
+type idempotencyCache struct {
+	mutex sync.Mutex
+
+	// now returns the current time. It's a field so that tests can simulate
+	// the passing of time.
+	now func() time.Time
+
+	// responses maps requests to the responses that they got.
+	responses map[idempotencyCacheKey]*idempotentResponse
+}
+
+// idempotencyCacheKey identifies the requests whose responses are replayed
+// for each other. Keys are scoped to API keys like in the Stripe API, so that
+// two integrations using the same stripe-mock don't see each other's
+// responses.
+type idempotencyCacheKey struct {
+	apiKey         string
+	idempotencyKey string
+	method         string
+	path           string
+}
+
+// idempotentResponse is a response that's replayed for retried requests.
+type idempotentResponse struct {
+	data      interface{}
+	expiresAt time.Time
+	status    int
+}
+
+// newIdempotencyCache initializes a new, empty idempotencyCache.
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		now:       time.Now,
+		responses: make(map[idempotencyCacheKey]*idempotentResponse),
+	}
+}
+
+// clear removes every cached response, so that retried requests are handled
+// as new ones.
+func (c *idempotencyCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.responses = make(map[idempotencyCacheKey]*idempotentResponse)
+}
+
+// get retrieves the response cached for a request. The second return value is
+// false if there's none, or if it has expired.
+func (c *idempotencyCache) get(key idempotencyCacheKey) (*idempotentResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	response, ok := c.responses[key]
+	if !ok || !c.now().Before(response.expiresAt) {
+		return nil, false
+	}
+	return response, true
+}
+
+// put caches the response to a request for idempotencyKeyTTL. Expired
+// responses are removed while at it so that the cache doesn't grow forever.
+func (c *idempotencyCache) put(key idempotencyCacheKey, status int, data interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	for cachedKey, response := range c.responses {
+		if !now.Before(response.expiresAt) {
+			delete(c.responses, cachedKey)
+		}
+	}
+
+	c.responses[key] = &idempotentResponse{
+		data:      data,
+		expiresAt: now.Add(idempotencyKeyTTL),
+		status:    status,
+	}
+}
+
+//
+// Private functions
+//
+
+// getIdempotencyCacheKey gets the key under which the response to a request
+// is cached. The second return value is false for requests whose responses
+// aren't replayed, which are those without an `Idempotency-Key` and those
+// that aren't POSTs, since other methods are idempotent anyway.
+func getIdempotencyCacheKey(r *http.Request) (idempotencyCacheKey, bool) {
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" || r.Method != http.MethodPost {
+		return idempotencyCacheKey{}, false
+	}
+
+	apiKey, _ := parseAuthKey(r.Header.Get("Authorization"))
+	return idempotencyCacheKey{
+		apiKey:         apiKey,
+		idempotencyKey: idempotencyKey,
+		method:         r.Method,
+		path:           r.URL.Path,
+	}, true
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	cache := newIdempotencyCache()
+	now := time.Unix(1500000000, 0)
+	cache.now = func() time.Time { return now }
+
+	key := idempotencyCacheKey{
+		apiKey:         "sk_test_123",
+		idempotencyKey: "my-key",
+		method:         "POST",
+		path:           "/v1/charges",
+	}
+
+	_, ok := cache.get(key)
+	assert.False(t, ok)
+
+	cache.put(key, 200, map[string]interface{}{"id": "ch_123"})
+
+	response, ok := cache.get(key)
+	assert.True(t, ok)
+	assert.Equal(t, 200, response.status)
+	assert.Equal(t, map[string]interface{}{"id": "ch_123"}, response.data)
+
+	otherKey := key
+	otherKey.path = "/v1/customers"
+	_, ok = cache.get(otherKey)
+	assert.False(t, ok)
+
+	now = now.Add(idempotencyKeyTTL - time.Second)
+	_, ok = cache.get(key)
+	assert.True(t, ok)
+
+	now = now.Add(time.Second)
+	_, ok = cache.get(key)
+	assert.False(t, ok)
+
+	// Expired responses are dropped when others are cached
+	cache.put(otherKey, 200, nil)
+	assert.Equal(t, 1, len(cache.responses))
+}
+
+func TestGetIdempotencyCacheKey(t *testing.T) {
+	{
+		req := httptest.NewRequest("POST", "/v1/charges", nil)
+		req.Header.Set("Authorization", "Bearer sk_test_123")
+		req.Header.Set("Idempotency-Key", "my-key")
+
+		key, ok := getIdempotencyCacheKey(req)
+		assert.True(t, ok)
+		assert.Equal(t, idempotencyCacheKey{
+			apiKey:         "sk_test_123",
+			idempotencyKey: "my-key",
+			method:         "POST",
+			path:           "/v1/charges",
+		}, key)
+	}
+
+	// Requests without a key aren't replayed
+	{
+		req := httptest.NewRequest("POST", "/v1/charges", nil)
+		_, ok := getIdempotencyCacheKey(req)
+		assert.False(t, ok)
+	}
+
+	// Neither are requests that are idempotent anyway
+	{
+		req := httptest.NewRequest("GET", "/v1/charges", nil)
+		req.Header.Set("Idempotency-Key", "my-key")
+		_, ok := getIdempotencyCacheKey(req)
+		assert.False(t, ok)
+	}
+}
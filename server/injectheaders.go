@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//
+// Private values
+//
+
+const invalidInjectedHeader = "Invalid header to inject '%s'; expected " +
+	"'<name>: <value>' with a name made up of letters, digits, and " +
+	"punctuation like '-'."
+
+//
+// Private functions
+//
+
+// parseInjectedHeaders parses headers to inject into every response, which
+// are given in the same `<name>: <value>` form that they take in HTTP.
+// Headers with the same name may be given more than once.
+func parseInjectedHeaders(values []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 || !isHeaderName(parts[0]) ||
+			strings.ContainsAny(parts[1], "\r\n") {
+			return nil, fmt.Errorf(invalidInjectedHeader, value)
+		}
+		headers.Add(parts[0], strings.TrimSpace(parts[1]))
+	}
+	return headers, nil
+}
+
+// isHeaderName checks whether a string is a valid HTTP header name, which is
+// a token as defined by RFC 7230.
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		isAlphanumeric := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if !isAlphanumeric && !strings.ContainsRune("!#$%&'*+-.^_`|~", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// setInjectedHeaders sets the headers that stripe-mock was configured to
+// inject into every response.
+func (s *StubServer) setInjectedHeaders(w http.ResponseWriter) {
+	for name, values := range s.injectedHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestInjectedHeaders(t *testing.T) {
+	headers, err := parseInjectedHeaders([]string{"X-Trace-Id: abc123", "X-Test:  a  "})
+	assert.NoError(t, err)
+
+	for _, path := range []string{"/v1/charges", "/_stripe-mock/doesnt-exist"} {
+		resp, _ := sendRequest(t, "GET", path, "", getDefaultHeaders(),
+			&testStubServerOptions{injectedHeaders: headers})
+		assert.Equal(t, "abc123", resp.Header.Get("X-Trace-Id"))
+		assert.Equal(t, "a", resp.Header.Get("X-Test"))
+	}
+}
+
+func TestParseInjectedHeaders(t *testing.T) {
+	{
+		headers, err := parseInjectedHeaders([]string{"X-Test: a", "x-test: b", "X-Empty:"})
+		assert.NoError(t, err)
+		assert.Equal(t, http.Header{
+			"X-Empty": {""},
+			"X-Test":  {"a", "b"},
+		}, headers)
+	}
+
+	for _, value := range []string{"X-Test", ": a", "X Test: a", "X-Test: a\r\nX-Other: b"} {
+		_, err := parseInjectedHeaders([]string{value})
+		assert.Error(t, err, value)
+	}
+}
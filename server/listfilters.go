@@ -0,0 +1,128 @@
+package server
+
+import (
+	"strconv"
+)
+
+//
+// Private values
+//
+
+// nonFilterListParams are the parameters of list endpoints that don't filter
+// the objects in the list.
+var nonFilterListParams = map[string]bool{
+	"ending_before":  true,
+	"expand":         true,
+	"limit":          true,
+	"starting_after": true,
+}
+
+//
+// Private functions
+//
+
+// applyListFilters makes the objects in a generated list match the filters
+// sent as request parameters, like `customer` or `status`, so that a filtered
+// list at least looks like it was filtered.
+//
+// Request data for a list comes from its query string, which has already
+// been validated against the parameters that the endpoint declares, so every
+// parameter other than those for pagination and expansion is a filter. Each
+// one is applied to the field of the same name, and filters for which objects
+// have no such field are ignored.
+//
+// Ranges like `created[gte]` set timestamps to a value within the range.
+func applyListFilters(requestData map[string]interface{}, data interface{}) {
+	list, ok := data.(map[string]interface{})
+	if !ok || list["object"] != "list" {
+		return
+	}
+	items, _ := list["data"].([]interface{})
+
+	for name, value := range requestData {
+		if nonFilterListParams[name] {
+			continue
+		}
+
+		for _, item := range items {
+			object, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			current, ok := object[name]
+			if !ok {
+				continue
+			}
+
+			if filtered, ok := applyListFilter(current, value); ok {
+				object[name] = filtered
+			}
+		}
+	}
+}
+
+// applyListFilter gets the value that a field of an object in a list should
+// have to match a filter on it. The second return value is false if the
+// filter can't be applied, in which case the field should be left alone.
+func applyListFilter(current interface{}, filter interface{}) (interface{}, bool) {
+	switch filterValue := filter.(type) {
+	case map[string]interface{}:
+		if _, ok := toInt64(current); !ok && current != nil {
+			return nil, false
+		}
+		return applyRangeFilter(filterValue)
+
+	case []interface{}:
+		// Filters that take several values are matched by the first.
+		if len(filterValue) == 0 {
+			return nil, false
+		}
+		return applyListFilter(current, filterValue[0])
+
+	case string:
+		// Expanded objects get the ID being filtered by instead.
+		if object, ok := current.(map[string]interface{}); ok {
+			if _, ok := object["id"]; !ok {
+				return nil, false
+			}
+			object["id"] = filterValue
+			return object, true
+		}
+		return filterValue, true
+
+	case bool, int, int64, float64:
+		return filterValue, true
+	}
+
+	return nil, false
+}
+
+// applyRangeFilter gets a timestamp within a range filter like
+// `created[gte]=1600000000&created[lt]=1700000000`, which is its lower bound
+// if it has one and its upper bound otherwise. The second return value is
+// false if the filter has no bounds.
+func applyRangeFilter(filter map[string]interface{}) (interface{}, bool) {
+	bound := func(name string) (int64, bool) {
+		switch value := filter[name].(type) {
+		case string:
+			i, err := strconv.ParseInt(value, 10, 64)
+			return i, err == nil
+		default:
+			return toInt64(value)
+		}
+	}
+
+	if gte, ok := bound("gte"); ok {
+		return gte, true
+	}
+	if gt, ok := bound("gt"); ok {
+		return gt + 1, true
+	}
+	if lte, ok := bound("lte"); ok {
+		return lte, true
+	}
+	if lt, ok := bound("lt"); ok {
+		return lt - 1, true
+	}
+	return nil, false
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestApplyListFilters(t *testing.T) {
+	list := map[string]interface{}{
+		"data": []interface{}{
+			map[string]interface{}{
+				"created":  1234567890,
+				"customer": "cus_123",
+				"id":       "ch_1",
+				"invoice":  map[string]interface{}{"id": "in_123", "object": "invoice"},
+				"paid":     false,
+				"status":   "failed",
+			},
+		},
+		"object": "list",
+	}
+
+	applyListFilters(map[string]interface{}{
+		"created":        map[string]interface{}{"gt": "1600000000", "lt": 1700000000},
+		"customer":       "cus_456",
+		"invoice":        "in_456",
+		"limit":          5,
+		"paid":           true,
+		"payment_intent": "pi_123",
+		"status":         []interface{}{"succeeded", "pending"},
+	}, list)
+
+	assert.Equal(t, map[string]interface{}{
+		"created":  int64(1600000001),
+		"customer": "cus_456",
+		"id":       "ch_1",
+		"invoice":  map[string]interface{}{"id": "in_456", "object": "invoice"},
+		"paid":     true,
+		"status":   "succeeded",
+	}, list["data"].([]interface{})[0])
+}
+
+func TestApplyRangeFilter(t *testing.T) {
+	testCases := []struct {
+		filter map[string]interface{}
+		want   interface{}
+		wantOK bool
+	}{
+		{map[string]interface{}{"gte": 10, "lte": 20}, int64(10), true},
+		{map[string]interface{}{"gt": 10}, int64(11), true},
+		{map[string]interface{}{"lte": 20}, int64(20), true},
+		{map[string]interface{}{"lt": "20"}, int64(19), true},
+		{map[string]interface{}{}, nil, false},
+	}
+	for _, testCase := range testCases {
+		value, ok := applyRangeFilter(testCase.filter)
+		assert.Equal(t, testCase.wantOK, ok)
+		assert.Equal(t, testCase.want, value)
+	}
+}
+
+func TestStubServer_FiltersLists(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "GET",
+		"/v1/charges?customer=cus_123&created[gte]=1600000000&limit=3", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	data := decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, 3, len(data))
+	for _, item := range data {
+		charge := item.(map[string]interface{})
+		assert.Equal(t, "cus_123", charge["customer"])
+		assert.Equal(t, 1600000000.0, charge["created"])
+	}
+}
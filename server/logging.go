@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+//
+// Public values
+//
+
+// Formats in which requests and their responses can be logged.
+const (
+	// LogFormatJSON logs a JSON object on a single line for every response,
+	// which is easy for machines to parse.
+	LogFormatJSON = "json"
+
+	// LogFormatText logs requests and responses as plain text meant for
+	// humans. This is the default.
+	LogFormatText = "text"
+)
+
+//
+// Private types
+//
+
+// loggedRequest is what's known about a request for logging its response.
+// It's stored in the request's context so that a response can be logged
+// wherever it's written from.
+type loggedRequest struct {
+	logger *requestLogger
+	method string
+	path   string
+
+	// operationID is the ID of the operation that the request was routed to.
+	// It's set after the request has been routed, and empty until then.
+	operationID string
+}
+
+// requestLogEvent is a line logged for a response in LogFormatJSON. Its
+// fields are in alphabetical order like the keys of responses.
+type requestLogEvent struct {
+	ElapsedMS   float64 `json:"elapsed_ms"`
+	Method      string  `json:"method"`
+	OperationID string  `json:"operation_id,omitempty"`
+	Path        string  `json:"path"`
+	RequestID   string  `json:"request_id,omitempty"`
+	Status      int     `json:"status"`
+	Time        string  `json:"time"`
+	Upstream    bool    `json:"upstream,omitempty"`
+}
+
+// requestLogMessage is a line logged in LogFormatJSON for a message about a
+// request that isn't its response, like why it was rejected. Its fields are in
+// alphabetical order like those of requestLogEvent.
+type requestLogMessage struct {
+	Message string `json:"message"`
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Time    string `json:"time"`
+}
+
+// requestLogger logs the requests that stripe-mock handles and the responses
+// it sends, in one of the supported log formats.
+type requestLogger struct {
+	format string
+
+	// out is where lines are logged, or standard output if nil. Standard
+	// output isn't stored here because it can be swapped out by tests.
+	out io.Writer
+}
+
+// newRequestLogger initializes a requestLogger that logs to standard output
+// in the given format.
+func newRequestLogger(format string) *requestLogger {
+	return &requestLogger{format: format}
+}
+
+// writer gets the writer to which lines are logged.
+func (l *requestLogger) writer() io.Writer {
+	if l.out == nil {
+		return os.Stdout
+	}
+	return l.out
+}
+
+//
+// Private values
+//
+
+// loggedRequestKey is the request context key of the loggedRequest for a
+// request.
+const loggedRequestKey contextKey = "loggedRequest"
+
+// defaultRequestLogger logs responses to requests that didn't go through
+// HandleRequest, which only happens in tests.
+var defaultRequestLogger = newRequestLogger(LogFormatText)
+
+//
+// Private functions
+//
+
+// checkLogFormat checks that a configured log format is one that's supported.
+func checkLogFormat(format string) error {
+	switch format {
+	case LogFormatJSON, LogFormatText:
+		return nil
+	}
+
+	return fmt.Errorf("Unsupported log format '%s'; expected '%s' or '%s'",
+		format, LogFormatText, LogFormatJSON)
+}
+
+// logResponse logs the response to a request, along with whatever was
+// recorded about the request by startRequest.
+func logResponse(r *http.Request, start time.Time, status int, requestID string, upstream bool) {
+	logged, ok := r.Context().Value(loggedRequestKey).(*loggedRequest)
+	if !ok {
+		logged = &loggedRequest{logger: defaultRequestLogger, method: r.Method, path: r.URL.Path}
+	}
+	elapsed := time.Now().Sub(start)
+
+	if logged.logger.format == LogFormatJSON {
+		line, err := json.Marshal(&requestLogEvent{
+			ElapsedMS:   float64(elapsed.Microseconds()) / 1000,
+			Method:      logged.method,
+			OperationID: logged.operationID,
+			Path:        logged.path,
+			RequestID:   requestID,
+			Status:      status,
+			Time:        start.UTC().Format(time.RFC3339Nano),
+			Upstream:    upstream,
+		})
+		if err != nil {
+			panic(err)
+		}
+		logged.logger.writer().Write(append(line, '\n'))
+		return
+	}
+
+	if upstream {
+		fmt.Fprintf(logged.logger.writer(), "Response: elapsed=%v status=%v (upstream)\n", elapsed, status)
+	} else {
+		fmt.Fprintf(logged.logger.writer(), "Response: elapsed=%v status=%v\n", elapsed, status)
+	}
+}
+
+// logMessage logs a message about a request, like why it was rejected or, in
+// verbose mode, what was generated for it. In LogFormatText it's logged as is,
+// and in LogFormatJSON as a requestLogMessage so that every line stays a JSON
+// object.
+func logMessage(r *http.Request, format string, args ...interface{}) {
+	logged, ok := r.Context().Value(loggedRequestKey).(*loggedRequest)
+	if !ok {
+		logged = &loggedRequest{logger: defaultRequestLogger, method: r.Method, path: r.URL.Path}
+	}
+	message := fmt.Sprintf(format, args...)
+
+	if logged.logger.format == LogFormatJSON {
+		line, err := json.Marshal(&requestLogMessage{
+			Message: message,
+			Method:  logged.method,
+			Path:    logged.path,
+			Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		})
+		if err != nil {
+			panic(err)
+		}
+		logged.logger.writer().Write(append(line, '\n'))
+		return
+	}
+
+	fmt.Fprintln(logged.logger.writer(), message)
+}
+
+// setLoggedOperationID records the operation that a request was routed to so
+// that it's included when its response is logged.
+func setLoggedOperationID(r *http.Request, operationID string) {
+	if logged, ok := r.Context().Value(loggedRequestKey).(*loggedRequest); ok {
+		logged.operationID = operationID
+	}
+}
+
+// startRequest logs a request as it arrives, and returns it with what's needed
+// to log its response in its context. Requests are only logged on their own
+// in LogFormatText. In LogFormatJSON, everything about them is logged with
+// their response instead so that there's a single line for each.
+func (l *requestLogger) startRequest(r *http.Request) *http.Request {
+	if l.format == LogFormatText {
+		fmt.Fprintf(l.writer(), "Request: %v %v\n", r.Method, r.URL.Path)
+	}
+
+	logged := &loggedRequest{logger: l, method: r.Method, path: r.URL.Path}
+	return r.WithContext(context.WithValue(r.Context(), loggedRequestKey, logged))
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestCheckLogFormat(t *testing.T) {
+	assert.NoError(t, checkLogFormat(LogFormatJSON))
+	assert.NoError(t, checkLogFormat(LogFormatText))
+	assert.Error(t, checkLogFormat("xml"))
+}
+
+func TestStubServer_LogFormatJSON(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	var out bytes.Buffer
+	server.logger = &requestLogger{format: LogFormatJSON, out: &out}
+
+	resp, _ := sendRequestToServer(t, server, "GET", "/v1/charges/ch_123", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	requestID := resp.Header.Get("Request-Id")
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/doesnt-exist", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Every line is a JSON object. There's one per response and nothing for
+	// requests on their own, but other messages are logged as their own
+	// events.
+	var events, messages []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var event map[string]interface{}
+		err := json.Unmarshal([]byte(line), &event)
+		assert.NoError(t, err, line)
+		if _, ok := event["message"]; ok {
+			messages = append(messages, event)
+		} else {
+			events = append(events, event)
+		}
+	}
+	assert.Equal(t, 2, len(events))
+	assert.NotEmpty(t, messages)
+	assert.Equal(t, "GET", messages[0]["method"])
+	assert.Equal(t, "/v1/charges/ch_123", messages[0]["path"])
+	assert.NotNil(t, messages[0]["time"])
+
+	event := events[0]
+	assert.Equal(t, "GET", event["method"])
+	assert.Equal(t, "GetChargesCharge", event["operation_id"])
+	assert.Equal(t, "/v1/charges/ch_123", event["path"])
+	assert.Equal(t, requestID, event["request_id"])
+	assert.Equal(t, 200.0, event["status"])
+	assert.NotNil(t, event["elapsed_ms"])
+	assert.NotNil(t, event["time"])
+
+	event = events[1]
+	assert.Equal(t, 404.0, event["status"])
+	_, ok := event["operation_id"]
+	assert.False(t, ok)
+}
+
+func TestStubServer_LogFormatJSONVerbose(t *testing.T) {
+	server := getRealStubServer(t, nil)
+	server.verbose = true
+
+	var out bytes.Buffer
+	server.logger = &requestLogger{format: LogFormatJSON, out: &out}
+
+	// Verbose output and validation errors are logged as JSON too
+	resp, _ := sendRequestToServer(t, server, "GET", "/v1/charges/ch_123", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = sendRequestToServer(t, server, "POST", "/v1/charges", "amount=abc", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		assert.True(t, json.Valid([]byte(line)), line)
+	}
+}
+
+func TestStubServer_LogFormatText(t *testing.T) {
+	server := getStubServer(t, nil)
+
+	var out bytes.Buffer
+	server.logger = &requestLogger{format: LogFormatText, out: &out}
+
+	resp, _ := sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "Request: GET /v1/charges", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "Request data = "))
+	assert.True(t, strings.HasPrefix(lines[2], "Response: elapsed="))
+	assert.True(t, strings.HasSuffix(lines[2], " status=200"))
+}
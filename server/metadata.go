@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private values
+//
+
+// Limits on the `metadata` that can be set on objects. See:
+//
+// https://stripe.com/docs/api/metadata
+const (
+	maxMetadataKeys        = 50
+	maxMetadataKeyLength   = 40
+	maxMetadataValueLength = 500
+)
+
+const (
+	metadataKeyTooLong = "Metadata keys can have up to %d characters, but " +
+		"'metadata[%s]' has %d."
+
+	metadataTooManyKeys = "Metadata can have up to %d keys, but %d were given."
+
+	metadataValueTooLong = "Metadata values can have up to %d characters, but " +
+		"the value of 'metadata[%s]' has %d."
+)
+
+//
+// Private functions
+//
+
+// applyRequestMetadata makes the `metadata` of a generated object exactly the
+// metadata that was sent with the request, rather than that of the fixture
+// with the request's merged in. Keys with empty values are left out because
+// they unset keys in the Stripe API, and an empty string in place of the whole
+// object unsets them all.
+//
+// It only applies to objects whose schema has `metadata` as a map of strings,
+// which it is everywhere in the Stripe API.
+//
+// Generated data is encoded with its keys sorted, so metadata is too,
+// regardless of the order in which it was sent.
+func (g *DataGenerator) applyRequestMetadata(schema *spec.Schema, requestData map[string]interface{}, data map[string]interface{}) error {
+	requestMetadata, ok := requestData["metadata"]
+	if !ok {
+		return nil
+	}
+
+	schema, _, err := g.maybeDereference(schema, "")
+	if err != nil {
+		return err
+	}
+	if schema.AnyOf != nil {
+		schema, err = g.findAnyOfBranch(schema, false)
+		if err != nil || schema == nil {
+			return err
+		}
+	}
+	if !isMetadataSchema(schema.Properties["metadata"]) {
+		return nil
+	}
+
+	metadata := make(map[string]interface{})
+	if requestMetadataMap, ok := requestMetadata.(map[string]interface{}); ok {
+		for key, value := range requestMetadataMap {
+			if value != "" {
+				metadata[key] = fmt.Sprintf("%v", value)
+			}
+		}
+	}
+	data["metadata"] = metadata
+	return nil
+}
+
+// checkMetadata checks that the `metadata` sent with a request is within the
+// limits of the Stripe API.
+func checkMetadata(requestData map[string]interface{}) *ResponseError {
+	metadata, ok := requestData["metadata"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	if len(metadata) > maxMetadataKeys {
+		return createStripeError(typeInvalidRequestError,
+			fmt.Sprintf(metadataTooManyKeys, maxMetadataKeys, len(metadata)),
+			withParam("metadata"))
+	}
+
+	for key, value := range metadata {
+		if length := utf8.RuneCountInString(key); length > maxMetadataKeyLength {
+			return createStripeError(typeInvalidRequestError,
+				fmt.Sprintf(metadataKeyTooLong, maxMetadataKeyLength, key, length),
+				withParam("metadata"))
+		}
+
+		length := utf8.RuneCountInString(fmt.Sprintf("%v", value))
+		if length > maxMetadataValueLength {
+			return createStripeError(typeInvalidRequestError,
+				fmt.Sprintf(metadataValueTooLong, maxMetadataValueLength, key, length),
+				withParam("metadata["+key+"]"))
+		}
+	}
+
+	return nil
+}
+
+// isMetadataSchema checks whether a schema is that of `metadata`, which is an
+// object with arbitrary keys whose values are strings.
+func isMetadataSchema(schema *spec.Schema) bool {
+	if schema == nil || schema.AdditionalProperties == nil {
+		return false
+	}
+	return schema.AdditionalProperties.Type == spec.TypeString
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestCheckMetadata(t *testing.T) {
+	assert.Nil(t, checkMetadata(map[string]interface{}{}))
+	assert.Nil(t, checkMetadata(map[string]interface{}{"metadata": ""}))
+	assert.Nil(t, checkMetadata(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			strings.Repeat("k", maxMetadataKeyLength): strings.Repeat("v", maxMetadataValueLength),
+		},
+	}))
+
+	tooMany := make(map[string]interface{})
+	for i := 0; i <= maxMetadataKeys; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+	stripeError := checkMetadata(map[string]interface{}{"metadata": tooMany})
+	assert.NotNil(t, stripeError)
+	assert.Equal(t, fmt.Sprintf(metadataTooManyKeys, 50, 51), stripeError.ErrorInfo.Message)
+
+	longKey := strings.Repeat("k", maxMetadataKeyLength+1)
+	stripeError = checkMetadata(map[string]interface{}{
+		"metadata": map[string]interface{}{longKey: "value"},
+	})
+	assert.NotNil(t, stripeError)
+	assert.Equal(t, fmt.Sprintf(metadataKeyTooLong, 40, longKey, 41), stripeError.ErrorInfo.Message)
+
+	stripeError = checkMetadata(map[string]interface{}{
+		"metadata": map[string]interface{}{"key": strings.Repeat("v", maxMetadataValueLength+1)},
+	})
+	assert.NotNil(t, stripeError)
+	assert.Equal(t, fmt.Sprintf(metadataValueTooLong, 500, "key", 501), stripeError.ErrorInfo.Message)
+}
+
+func TestStubServer_EchoesMetadata(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/customers",
+		"metadata[order_id]=6735&metadata[unset]=", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{"order_id": "6735"}, decodeObject(t, body)["metadata"])
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/customers/cus_123",
+		"metadata=", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{}, decodeObject(t, body)["metadata"])
+}
+
+func TestStubServer_MetadataLimits(t *testing.T) {
+	params := make([]string, 0, maxMetadataKeys+1)
+	for i := 0; i <= maxMetadataKeys; i++ {
+		params = append(params, fmt.Sprintf("metadata[key%d]=value", i))
+	}
+
+	server := getRealStubServer(t, nil)
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/customers",
+		strings.Join(params, "&"), getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "Metadata can have up to 50 keys")
+}
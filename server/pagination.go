@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//
+// Private values
+//
+
+// defaultListLimit is the number of objects in a page of a list when the
+// request doesn't specify a `limit`, which is the same as in the Stripe API.
+const defaultListLimit = 10
+
+// maxListLimit is the largest page of a list that can be requested, which is
+// the same as in the Stripe API.
+const maxListLimit = 100
+
+// minListLimit is the smallest page of a list that can be requested.
+const minListLimit = 1
+
+// syntheticListSize is the number of objects that generated lists behave as
+// if they contained, so that they can be paged through.
+const syntheticListSize = 100
+
+const invalidListCursor = "Invalid %s: no object with ID '%s' in this list."
+
+const (
+	invalidListLimit  = "Invalid integer: %v"
+	listLimitTooLarge = "This value must be less than or equal to %d."
+	listLimitTooSmall = "This value must be greater than or equal to %d."
+)
+
+//
+// Private functions
+//
+
+// checkListLimit checks that the `limit` of a list request is a whole number
+// within the bounds of the Stripe API, and responds with an error like it does
+// if it isn't. Requests without a `limit` are fine.
+func checkListLimit(requestData map[string]interface{}) *ResponseError {
+	value, ok := requestData["limit"]
+	if !ok {
+		return nil
+	}
+
+	var limit int64
+	valid := true
+	switch v := value.(type) {
+	case float64:
+		limit = int64(v)
+		valid = v == math.Trunc(v)
+	case int, int64:
+		limit, _ = toInt64(v)
+	case string:
+		var err error
+		limit, err = strconv.ParseInt(v, 10, 64)
+		valid = err == nil
+	default:
+		valid = false
+	}
+
+	var message string
+	switch {
+	case !valid:
+		message = fmt.Sprintf(invalidListLimit, value)
+	case limit < minListLimit:
+		message = fmt.Sprintf(listLimitTooSmall, minListLimit)
+	case limit > maxListLimit:
+		message = fmt.Sprintf(listLimitTooLarge, maxListLimit)
+	default:
+		return nil
+	}
+
+	return createStripeError(typeInvalidRequestError, message,
+		withCode("parameter_invalid_integer"), withParam("limit"))
+}
+
+// paginate selects the page of objects requested by the `limit`,
+// `starting_after`, and `ending_before` parameters in request data, and
+// reports whether there are more objects beyond the page.
+//
+// Objects should be in the order in which they're listed, and each needs an
+// `id` for cursors to work. A 400 is returned if a cursor doesn't match any
+// of them.
+func paginate(objects []map[string]interface{}, requestData map[string]interface{}) ([]interface{}, bool, *requestError) {
+	limit := defaultListLimit
+	if requestLimit, ok := toInt64(requestData["limit"]); ok {
+		limit = int(requestLimit)
+	}
+
+	var start, end int
+	var hasMore bool
+
+	// Paging backwards from a cursor selects the objects just before it, and
+	// there are more if any objects precede them
+	if endingBefore, ok := requestData["ending_before"].(string); ok && endingBefore != "" {
+		index, requestErr := findListCursor(objects, "ending_before", endingBefore)
+		if requestErr != nil {
+			return nil, false, requestErr
+		}
+
+		end = index
+		start = end - limit
+		if start < 0 {
+			start = 0
+		}
+		hasMore = start > 0
+	} else {
+		if startingAfter, ok := requestData["starting_after"].(string); ok && startingAfter != "" {
+			index, requestErr := findListCursor(objects, "starting_after", startingAfter)
+			if requestErr != nil {
+				return nil, false, requestErr
+			}
+			start = index + 1
+		}
+
+		end = start + limit
+		if end > len(objects) {
+			end = len(objects)
+		}
+		hasMore = end < len(objects)
+	}
+
+	page := make([]interface{}, 0, end-start)
+	for _, object := range objects[start:end] {
+		page = append(page, object)
+	}
+	return page, hasMore, nil
+}
+
+// findListCursor finds the index of the object with the given ID, which was
+// sent as the named pagination cursor.
+func findListCursor(objects []map[string]interface{}, name string, id string) (int, *requestError) {
+	for i, object := range objects {
+		if object["id"] == id {
+			return i, nil
+		}
+	}
+
+	return 0, &requestError{
+		status: http.StatusBadRequest,
+		stripeError: createStripeError(typeInvalidRequestError,
+			fmt.Sprintf(invalidListCursor, name, id), withParam(name)),
+	}
+}
+
+// paginateGeneratedList fills the `data` of a generated list with the page
+// requested by the `limit`, `starting_after`, and `ending_before` parameters,
+// as if the list contained syntheticListSize copies of its generated item.
+//
+// Each copy gets an ID that ends in its position in the list (like
+// `ch_list004`), so IDs are stable between requests and can be used as
+// cursors. Other cursors are ignored since there's no telling where they'd be
+// in the list. Items without IDs can't be paged through, so lists of them are
+// left alone.
+func paginateGeneratedList(requestData map[string]interface{}, data interface{}) {
+	list, ok := data.(map[string]interface{})
+	if !ok || list["object"] != "list" {
+		return
+	}
+	items, _ := list["data"].([]interface{})
+	if len(items) == 0 {
+		return
+	}
+	item, _ := items[0].(map[string]interface{})
+	id, ok := item["id"].(string)
+	if !ok {
+		return
+	}
+
+	prefix := id
+	if index := strings.LastIndex(id, "_"); index != -1 {
+		prefix = id[:index]
+	}
+
+	objects := make([]map[string]interface{}, syntheticListSize)
+	for i := range objects {
+		objects[i] = map[string]interface{}{"id": fmt.Sprintf("%s_list%03d", prefix, i+1)}
+	}
+
+	params := withoutParams(requestData, "ending_before", "limit", "starting_after")
+	if limit, ok := toInt64(requestData["limit"]); ok {
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+		params["limit"] = limit
+	}
+	for _, name := range []string{"ending_before", "starting_after"} {
+		cursor, _ := requestData[name].(string)
+		if _, requestErr := findListCursor(objects, name, cursor); requestErr == nil {
+			params[name] = cursor
+		}
+	}
+
+	// Cursors have all been checked already, so this can't fail
+	page, hasMore, _ := paginate(objects, params)
+	for i, object := range page {
+		copied := copyObject(item)
+		copied["id"] = object.(map[string]interface{})["id"]
+		page[i] = copied
+	}
+
+	list["data"] = page
+	list["has_more"] = hasMore
+	if _, ok := list["total_count"]; ok {
+		list["total_count"] = syntheticListSize
+	}
+}
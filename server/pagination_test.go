@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestPaginate(t *testing.T) {
+	objects := []map[string]interface{}{
+		{"id": "obj_1"}, {"id": "obj_2"}, {"id": "obj_3"}, {"id": "obj_4"}, {"id": "obj_5"},
+	}
+
+	testCases := []struct {
+		name        string
+		requestData map[string]interface{}
+		wantIDs     []string
+		wantHasMore bool
+	}{
+		{"default limit", nil, []string{"obj_1", "obj_2", "obj_3", "obj_4", "obj_5"}, false},
+		{"limit", map[string]interface{}{"limit": 2}, []string{"obj_1", "obj_2"}, true},
+		{"starting_after", map[string]interface{}{"limit": 2, "starting_after": "obj_2"}, []string{"obj_3", "obj_4"}, true},
+		{"starting_after last page", map[string]interface{}{"limit": 2, "starting_after": "obj_4"}, []string{"obj_5"}, false},
+		{"ending_before", map[string]interface{}{"limit": 2, "ending_before": "obj_5"}, []string{"obj_3", "obj_4"}, true},
+		{"ending_before first page", map[string]interface{}{"limit": 2, "ending_before": "obj_3"}, []string{"obj_1", "obj_2"}, false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			page, hasMore, requestErr := paginate(objects, testCase.requestData)
+			assert.Nil(t, requestErr)
+
+			var ids []string
+			for _, object := range page {
+				ids = append(ids, object.(map[string]interface{})["id"].(string))
+			}
+			assert.Equal(t, testCase.wantIDs, ids)
+			assert.Equal(t, testCase.wantHasMore, hasMore)
+		})
+	}
+}
+
+func TestPaginate_InvalidCursor(t *testing.T) {
+	_, _, requestErr := paginate(nil, map[string]interface{}{"starting_after": "obj_123"})
+	assert.NotNil(t, requestErr)
+	assert.Equal(t, http.StatusBadRequest, requestErr.status)
+	assert.Contains(t, requestErr.stripeError.ErrorInfo.Message, "obj_123")
+}
+
+func TestPaginateGeneratedList(t *testing.T) {
+	newList := func() map[string]interface{} {
+		return map[string]interface{}{
+			"data":        []interface{}{map[string]interface{}{"id": "ch_123", "amount": 100}},
+			"has_more":    false,
+			"object":      "list",
+			"total_count": 1,
+		}
+	}
+	listIDs := func(list map[string]interface{}) []string {
+		var ids []string
+		for _, item := range list["data"].([]interface{}) {
+			ids = append(ids, item.(map[string]interface{})["id"].(string))
+		}
+		return ids
+	}
+
+	list := newList()
+	paginateGeneratedList(nil, list)
+	assert.Equal(t, defaultListLimit, len(list["data"].([]interface{})))
+	assert.Equal(t, "ch_list001", listIDs(list)[0])
+	assert.Equal(t, 100, list["data"].([]interface{})[9].(map[string]interface{})["amount"])
+	assert.Equal(t, true, list["has_more"])
+	assert.Equal(t, syntheticListSize, list["total_count"])
+
+	list = newList()
+	paginateGeneratedList(map[string]interface{}{"limit": 2, "starting_after": "ch_list004"}, list)
+	assert.Equal(t, []string{"ch_list005", "ch_list006"}, listIDs(list))
+
+	list = newList()
+	paginateGeneratedList(map[string]interface{}{"limit": 5, "ending_before": "ch_list003"}, list)
+	assert.Equal(t, []string{"ch_list001", "ch_list002"}, listIDs(list))
+	assert.Equal(t, false, list["has_more"])
+
+	// The limit is capped, after which there's nothing more
+	list = newList()
+	paginateGeneratedList(map[string]interface{}{"limit": 1000}, list)
+	assert.Equal(t, maxListLimit, len(list["data"].([]interface{})))
+	assert.Equal(t, false, list["has_more"])
+
+	// Unknown cursors are ignored
+	list = newList()
+	paginateGeneratedList(map[string]interface{}{"limit": 1, "starting_after": "ch_123"}, list)
+	assert.Equal(t, []string{"ch_list001"}, listIDs(list))
+}
+
+func TestCheckListLimit(t *testing.T) {
+	testCases := []struct {
+		limit   interface{}
+		message string
+	}{
+		{int64(1), ""},
+		{int64(100), ""},
+		{"50", ""},
+		{10.0, ""},
+		{int64(0), "This value must be greater than or equal to 1."},
+		{int64(-1), "This value must be greater than or equal to 1."},
+		{int64(101), "This value must be less than or equal to 100."},
+		{"abc", "Invalid integer: abc"},
+		{10.5, "Invalid integer: 10.5"},
+	}
+	for _, testCase := range testCases {
+		stripeError := checkListLimit(map[string]interface{}{"limit": testCase.limit})
+		if testCase.message == "" {
+			assert.Nil(t, stripeError, "%v", testCase.limit)
+			continue
+		}
+		assert.NotNil(t, stripeError, "%v", testCase.limit)
+		assert.Equal(t, testCase.message, stripeError.ErrorInfo.Message)
+		assert.Equal(t, "limit", stripeError.ErrorInfo.Param)
+	}
+
+	assert.Nil(t, checkListLimit(map[string]interface{}{}))
+}
+
+func TestStubServer_ListLimitBounds(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	for _, limit := range []string{"0", "-1", "101", "abc"} {
+		resp, body := sendRequestToServer(t, server, "GET", "/v1/charges?limit="+limit,
+			"", getDefaultHeaders())
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, limit)
+		errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+		assert.Equal(t, typeInvalidRequestError, errorInfo["type"])
+		assert.Equal(t, "limit", errorInfo["param"])
+	}
+
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/charges?limit=100",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 100, len(decodeObject(t, body)["data"].([]interface{})))
+}
@@ -0,0 +1,91 @@
+package server
+
+//
+// Private functions
+//
+
+// applyPaymentMethodDetailsType makes the `payment_method_details` of any
+// charges in a generated response match the type of payment method requested
+// by the request's parameters.
+//
+// `payment_method_details` is polymorphic: its `type` names one of its other
+// properties, which holds details specific to that type of payment method.
+// Fixtures always contain card details, so when another type is requested,
+// the card details are replaced with a generated object of the right type.
+func (g *DataGenerator) applyPaymentMethodDetailsType(requestData map[string]interface{}, data interface{}) error {
+	paymentMethodType := requestedPaymentMethodType(requestData)
+	if paymentMethodType == "" || paymentMethodType == "type" {
+		return nil
+	}
+
+	detailsSchema, ok := g.definitions["payment_method_details"]
+	if !ok {
+		return nil
+	}
+
+	typeSchema, ok := detailsSchema.Properties[paymentMethodType]
+	if !ok {
+		return nil
+	}
+
+	typeSchema, context, err := g.maybeDereference(typeSchema, "")
+	if err != nil {
+		return err
+	}
+
+	replacePaymentMethodDetails(data, func(details map[string]interface{}) {
+		if details["type"] == paymentMethodType {
+			return
+		}
+
+		for property := range detailsSchema.Properties {
+			delete(details, property)
+		}
+		details["type"] = paymentMethodType
+		details[paymentMethodType] = g.generateSyntheticFixture(typeSchema, context, nil)
+	})
+	return nil
+}
+
+// replacePaymentMethodDetails calls the given function with every
+// `payment_method_details` object found anywhere in generated data, including
+// in expanded objects and lists.
+func replacePaymentMethodDetails(data interface{}, replace func(details map[string]interface{})) {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if details, ok := value.(map[string]interface{}); ok && key == "payment_method_details" {
+				if _, ok := details["type"]; ok {
+					replace(details)
+				}
+				continue
+			}
+			replacePaymentMethodDetails(value, replace)
+		}
+
+	case []interface{}:
+		for _, value := range v {
+			replacePaymentMethodDetails(value, replace)
+		}
+	}
+}
+
+// requestedPaymentMethodType finds the type of payment method that a request
+// wants to pay with from either the type of payment method data sent with it
+// or the first of its allowed payment method types. An empty string is
+// returned if there's no such parameter.
+func requestedPaymentMethodType(requestData map[string]interface{}) string {
+	if paymentMethodData, ok := requestData["payment_method_data"].(map[string]interface{}); ok {
+		if paymentMethodType, ok := paymentMethodData["type"].(string); ok {
+			return paymentMethodType
+		}
+	}
+
+	if paymentMethodTypes, ok := requestData["payment_method_types"].([]interface{}); ok && len(paymentMethodTypes) > 0 {
+		if paymentMethodType, ok := paymentMethodTypes[0].(string); ok {
+			return paymentMethodType
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStubServer_PaymentMethodDetails(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	t.Run("card charge", func(t *testing.T) {
+		resp, body := sendRequestToServer(t, server, "POST", "/v1/charges",
+			"amount=100&currency=usd&source=tok_visa", getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		details := decodeObject(t, body)["payment_method_details"].(map[string]interface{})
+		assert.Equal(t, "card", details["type"])
+		card, ok := details["card"].(map[string]interface{})
+		assert.True(t, ok)
+		assert.NotEmpty(t, card["brand"])
+	})
+
+	t.Run("requested type", func(t *testing.T) {
+		resp, body := sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+			"amount=100&currency=eur&payment_method_types[]=sepa_debit&expand[]=latest_charge",
+			getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		charge := decodeObject(t, body)["latest_charge"].(map[string]interface{})
+		details := charge["payment_method_details"].(map[string]interface{})
+		assert.Equal(t, "sepa_debit", details["type"])
+		_, ok := details["sepa_debit"].(map[string]interface{})
+		assert.True(t, ok)
+		_, ok = details["card"]
+		assert.False(t, ok)
+	})
+}
+
+func TestRequestedPaymentMethodType(t *testing.T) {
+	assert.Equal(t, "", requestedPaymentMethodType(nil))
+	assert.Equal(t, "ideal", requestedPaymentMethodType(map[string]interface{}{
+		"payment_method_data": map[string]interface{}{"type": "ideal"},
+	}))
+	assert.Equal(t, "sepa_debit", requestedPaymentMethodType(map[string]interface{}{
+		"payment_method_types": []interface{}{"sepa_debit", "card"},
+	}))
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+)
+
+//
+// Private values
+//
+
+// maxPaymentLinkLineItems is the most line items that a payment link can
+// have, which is the same as in the Stripe API.
+const maxPaymentLinkLineItems = 20
+
+// paymentLinkURLPrefix is the start of the URLs of payment links in test
+// mode, which is followed by a secret identifying the link.
+const paymentLinkURLPrefix = "https://buy.stripe.com/test_"
+
+const (
+	paymentLinkInvalidQuantity = "Invalid quantity %d for line item %d: " +
+		"quantities must be at least 1."
+
+	paymentLinkTooManyLineItems = "A payment link can have at most %d line " +
+		"items, but %d were given."
+)
+
+//
+// Private functions
+//
+
+// applyPaymentLinkURL gives a generated payment link a realistic `url` that's
+// derived from its ID, so a link always has the same URL. Fixtures have a
+// placeholder URL instead.
+func applyPaymentLinkURL(data interface{}) {
+	link, ok := data.(map[string]interface{})
+	if !ok || link["object"] != "payment_link" {
+		return
+	}
+
+	id, ok := link["id"].(string)
+	if !ok {
+		return
+	}
+	link["url"] = paymentLinkURLPrefix + secretSuffix(id)
+}
+
+// checkPaymentLinkLineItemParams checks that a payment link's `line_items`
+// parameters are within the limits of the Stripe API.
+func checkPaymentLinkLineItemParams(itemParams []interface{}) *requestError {
+	if len(itemParams) > maxPaymentLinkLineItems {
+		return &requestError{
+			status: http.StatusBadRequest,
+			stripeError: createStripeError(typeInvalidRequestError,
+				fmt.Sprintf(paymentLinkTooManyLineItems, maxPaymentLinkLineItems, len(itemParams)),
+				withParam("line_items")),
+		}
+	}
+
+	for i, params := range itemParams {
+		paramsMap, _ := params.(map[string]interface{})
+		if quantity, ok := toInt64(paramsMap["quantity"]); ok && quantity < 1 {
+			return &requestError{
+				status: http.StatusBadRequest,
+				stripeError: createStripeError(typeInvalidRequestError,
+					fmt.Sprintf(paymentLinkInvalidQuantity, quantity, i),
+					withParam(fmt.Sprintf("line_items[%d][quantity]", i))),
+			}
+		}
+	}
+
+	return nil
+}
+
+// newPaymentLinkLineItem produces a line item of a payment link from its
+// `line_items` parameters.
+//
+// The price is looked up in the store, and if it isn't there, the price from
+// fixtures is given its ID instead, like for subscription items.
+func newPaymentLinkLineItem(s *StubServer, ids *rand.Rand, params map[string]interface{}) map[string]interface{} {
+	item := make(map[string]interface{})
+	if fixture, ok := s.fixtures.Resources["item"].(map[string]interface{}); ok {
+		item = copyObject(fixture)
+	}
+	item["id"] = newID(ids, "li")
+	item["object"] = "item"
+
+	priceID, _ := params["price"].(string)
+	price, ok := s.store.get(priceID)
+	if !ok {
+		price, _ = item["price"].(map[string]interface{})
+		if price == nil {
+			price = make(map[string]interface{})
+		}
+		price = copyObject(price)
+		price["id"] = priceID
+	}
+	item["price"] = price
+	item["currency"] = price["currency"]
+
+	// Like in the Stripe API, the description defaults to the name of the
+	// price's product
+	if productID, ok := price["product"].(string); ok {
+		if product, ok := s.store.get(productID); ok {
+			item["description"] = product["name"]
+		}
+	}
+
+	quantity, _ := toInt64(params["quantity"])
+	setPaymentLinkLineItemQuantity(item, quantity)
+	return item
+}
+
+// paymentLinkLineItems returns the line items stored with a payment link.
+func paymentLinkLineItems(link map[string]interface{}) []map[string]interface{} {
+	lineItems, _ := link["line_items"].(map[string]interface{})
+	data, _ := lineItems["data"].([]interface{})
+
+	items := make([]map[string]interface{}, 0, len(data))
+	for _, item := range data {
+		items = append(items, item.(map[string]interface{}))
+	}
+	return items
+}
+
+// setPaymentLinkLineItemQuantity sets the quantity of a payment link's line
+// item along with the amounts that depend on it.
+func setPaymentLinkLineItemQuantity(item map[string]interface{}, quantity int64) {
+	price, _ := item["price"].(map[string]interface{})
+	unitAmount, _ := toInt64(price["unit_amount"])
+
+	item["amount_discount"] = 0
+	item["amount_subtotal"] = unitAmount * quantity
+	item["amount_tax"] = 0
+	item["amount_total"] = unitAmount * quantity
+	item["quantity"] = quantity
+}
+
+// setPaymentLinkLineItems sets the line items stored with a payment link. A
+// payment link has no limit on embedded lists, so all of them are kept in
+// the store, and setPaymentLinkLineItemsExpansion trims them for responses.
+func setPaymentLinkLineItems(link map[string]interface{}, items []map[string]interface{}) {
+	data := make([]interface{}, len(items))
+	for i, item := range items {
+		data[i] = item
+	}
+
+	id, _ := link["id"].(string)
+	link["line_items"] = map[string]interface{}{
+		"data":     data,
+		"has_more": false,
+		"object":   "list",
+		"url":      "/v1/payment_links/" + id + "/line_items",
+	}
+}
+
+// setPaymentLinkLineItemsExpansion prepares a stored payment link for a
+// response. Like in the Stripe API, its `line_items` are only included if
+// they're expanded.
+func setPaymentLinkLineItemsExpansion(req *statefulRequest, link map[string]interface{}) {
+	expansions, _ := extractExpansions(req.requestData)
+	if !isExpanded(expansions, "line_items") {
+		delete(link, "line_items")
+		return
+	}
+
+	id, _ := link["id"].(string)
+	link["line_items"] = newEmbeddedList("/v1/payment_links/"+id+"/line_items",
+		paymentLinkLineItems(link))
+}
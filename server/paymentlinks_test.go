@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestPaymentLinkCreate(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/payment_links",
+		"line_items[0][price]=price_123&line_items[0][quantity]=1", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	link := decodeObject(t, body)
+	assert.Regexp(t,
+		regexp.MustCompile(`^https://buy\.stripe\.com/test_[0-9A-Za-z]{25}$`),
+		link["url"])
+	assert.Equal(t, paymentLinkURLPrefix+secretSuffix(link["id"].(string)), link["url"])
+}
+
+func TestStatefulPaymentLinks(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/products",
+		"name=Hoodie", getDefaultHeaders())
+	productID := decodeObject(t, body)["id"].(string)
+
+	_, body = sendRequestToServer(t, server, "POST", "/v1/prices",
+		"currency=eur&unit_amount=1500&product="+productID, getDefaultHeaders())
+	priceID := decodeObject(t, body)["id"].(string)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/payment_links",
+		"line_items[0][price]="+priceID+"&line_items[0][quantity]=3&expand[]=line_items",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	link := decodeObject(t, body)
+	linkID := link["id"].(string)
+	assert.Equal(t, paymentLinkURLPrefix+secretSuffix(linkID), link["url"])
+	assert.Equal(t, "eur", link["currency"])
+
+	lineItems := link["line_items"].(map[string]interface{})
+	assert.Equal(t, "/v1/payment_links/"+linkID+"/line_items", lineItems["url"])
+	items := lineItems["data"].([]interface{})
+	assert.Equal(t, 1, len(items))
+	item := items[0].(map[string]interface{})
+	assert.Equal(t, "item", item["object"])
+	assert.Equal(t, "Hoodie", item["description"])
+	assert.Equal(t, float64(3), item["quantity"])
+	assert.Equal(t, float64(4500), item["amount_total"])
+	assert.Equal(t, priceID, item["price"].(map[string]interface{})["id"])
+
+	// Line items are only included when expanded
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/payment_links/"+linkID,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	link = decodeObject(t, body)
+	assert.Equal(t, paymentLinkURLPrefix+secretSuffix(linkID), link["url"])
+	_, ok := link["line_items"]
+	assert.False(t, ok)
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/payment_links/"+linkID,
+		"line_items[0][id]="+item["id"].(string)+"&line_items[0][quantity]=2", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/v1/payment_links/"+linkID+"/line_items", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	items = decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, 1, len(items))
+	item = items[0].(map[string]interface{})
+	assert.Equal(t, float64(2), item["quantity"])
+	assert.Equal(t, float64(3000), item["amount_total"])
+}
+
+func TestStatefulPaymentLinks_InvalidLineItems(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/payment_links",
+		"line_items[0][price]=price_123&line_items[0][quantity]=0", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "Invalid quantity 0 for line item 0")
+
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/v1/payment_links/plink_missing/line_items", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "No such payment_link: 'plink_missing'")
+}
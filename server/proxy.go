@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//
+// Private values
+//
+
+const proxyFailed = "Couldn't forward request to upstream %s: %v"
+
+// proxyReplacedHeaders are headers that stripe-mock sets on every response,
+// but that should come from the upstream instead for forwarded requests.
+var proxyReplacedHeaders = []string{
+	"Idempotency-Key",
+	"Request-Id",
+	"Stripe-Version",
+}
+
+//
+// Private types
+//
+
+// upstreamProxy forwards requests that stripe-mock doesn't mock to an
+// upstream API, like the real Stripe API, and relays its responses.
+type upstreamProxy struct {
+	// apiKey is the key that forwarded requests are authorized with instead
+	// of the one that they were sent with. Requests keep their own
+	// authorization if it's empty.
+	apiKey string
+
+	// paths are path prefixes (like `/v1/terminal`) of requests that are
+	// always forwarded, even if stripe-mock has a route for them.
+	paths []string
+
+	// upstream is the base URL of the upstream API.
+	upstream *url.URL
+}
+
+// newUpstreamProxy initializes a new upstreamProxy that forwards requests to
+// the given upstream URL. nil is returned if no upstream was given.
+func newUpstreamProxy(upstream string, apiKey string, paths []string) (*upstreamProxy, error) {
+	if upstream == "" {
+		if len(paths) > 0 {
+			return nil, fmt.Errorf("Proxied paths were given without an upstream")
+		}
+		return nil, nil
+	}
+
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil || upstreamURL.Scheme == "" || upstreamURL.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy upstream URL: %s", upstream)
+	}
+
+	return &upstreamProxy{apiKey: apiKey, paths: paths, upstream: upstreamURL}, nil
+}
+
+// forwardsPath checks whether requests to the given path should always be
+// forwarded because it's one of the explicitly proxied paths or under one.
+func (p *upstreamProxy) forwardsPath(path string) bool {
+	for _, prefix := range p.paths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// serve forwards a request to the upstream and writes its response. If the
+// upstream can't be reached, a 502 is written instead.
+func (p *upstreamProxy) serve(w http.ResponseWriter, r *http.Request, start time.Time) {
+	logMessage(r, "Forwarding request to upstream: %v %v", r.Method, p.upstream)
+
+	for _, name := range proxyReplacedHeaders {
+		w.Header().Del(name)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(p.upstream)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = p.upstream.Host
+		if p.apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+p.apiKey)
+		}
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// stripe-mock's own CORS headers have already been set, and browsers
+		// reject responses that have them twice.
+		for name := range resp.Header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				resp.Header.Del(name)
+			}
+		}
+		logResponse(r, start, resp.StatusCode, resp.Header.Get("Request-Id"), true)
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		message := fmt.Sprintf(proxyFailed, p.upstream, err)
+		logMessage(r, "%s", message)
+		writeResponse(w, r, start, http.StatusBadGateway,
+			createStripeError(typeAPIError, message))
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStubServer_ProxyUpstream(t *testing.T) {
+	var requests []*http.Request
+	var bodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+
+		w.Header().Set("Request-Id", "req_upstream")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"object":"upstream"}`))
+	}))
+	defer upstream.Close()
+
+	server := getStubServer(t, &testStubServerOptions{
+		proxyAPIKey:   "sk_test_upstream",
+		proxyPaths:    []string{"/v1/customers/"},
+		proxyUpstream: upstream.URL,
+	})
+
+	// Requests without a route are forwarded with the proxy's key
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/unmocked?expand[]=a",
+		"foo=bar", getDefaultHeaders())
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, `{"object":"upstream"}`, string(body))
+	assert.Equal(t, []string{"req_upstream"}, resp.Header["Request-Id"])
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "/v1/unmocked", requests[0].URL.Path)
+	assert.Equal(t, "expand[]=a", requests[0].URL.RawQuery)
+	assert.Equal(t, "Bearer sk_test_upstream", requests[0].Header.Get("Authorization"))
+	assert.Equal(t, "foo=bar", bodies[0])
+
+	// Explicitly proxied paths are forwarded even though they have a route
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/customers/cus_123", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, "/v1/customers/cus_123", requests[1].URL.Path)
+
+	// Everything else is still mocked
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, len(requests))
+}
+
+func TestStubServer_ProxyUpstreamUnreachable(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	server := getStubServer(t, &testStubServerOptions{proxyUpstream: upstream.URL})
+
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/unmocked", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Contains(t, string(body), "Couldn't forward request to upstream")
+}
+
+func TestNewUpstreamProxy(t *testing.T) {
+	proxy, err := newUpstreamProxy("", "", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, proxy)
+
+	_, err = newUpstreamProxy("api.stripe.com", "", nil)
+	assert.Error(t, err)
+
+	_, err = newUpstreamProxy("", "", []string{"/v1/terminal"})
+	assert.Error(t, err)
+}
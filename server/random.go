@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// Private values
+//
+
+// seedHeader is a header with which a request can seed the randomness of its
+// response, like newly generated IDs, so that the same request always gets the
+// same response. It takes precedence over the server's seed.
+const seedHeader = "Stripe-Mock-Seed"
+
+const invalidSeed = "Invalid `" + seedHeader + "` header '%s': expected an integer."
+
+// requestIDLength is the length of the random part of a request ID, which is
+// the same as in the Stripe API.
+const requestIDLength = 14
+
+// requestLogURL is the URL of a request's page in the Dashboard, which errors
+// link to like in the Stripe API.
+const requestLogURL = "https://dashboard.stripe.com/test/logs/%s"
+
+//
+// Private types
+//
+
+// lockedRand is a source of pseudo-random numbers that's safe for concurrent
+// use. The server uses one for all randomized behavior so that it can be made
+// reproducible by seeding it.
+type lockedRand struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+// newLockedRand initializes a new lockedRand with the given seed, or with one
+// based on the current time if the seed is zero.
+func newLockedRand(seed int64) *lockedRand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &lockedRand{rand: rand.New(rand.NewSource(seed))}
+}
+
+// Float64 returns a pseudo-random number in [0.0,1.0).
+func (r *lockedRand) Float64() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rand.Float64()
+}
+
+// Int63 returns a non-negative pseudo-random 63-bit integer as an int64.
+func (r *lockedRand) Int63() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rand.Int63()
+}
+
+//
+// Private functions
+//
+
+// newRequestID generates an ID for a request like `req_0PIxkOXE5RVh5T`. It's
+// drawn from the seed sent in seedHeader if there is one, and from the
+// server's source of randomness otherwise, so that request IDs are
+// reproducible along with the rest of the response.
+func (s *StubServer) newRequestID(r *http.Request) string {
+	seed, err := strconv.ParseInt(r.Header.Get(seedHeader), 10, 64)
+	if err != nil {
+		seed = s.rand.Int63()
+	}
+	source := rand.New(rand.NewSource(seed))
+
+	runes := make([]rune, requestIDLength)
+	for i := range runes {
+		runes[i] = randomIDRunes[source.Intn(len(randomIDRunes))]
+	}
+	return "req_" + string(runes)
+}
+
+// requestSeed gets the seed for the randomness of a request's response, which
+// is the one sent in seedHeader if there is one. Otherwise, it's drawn from
+// the server's source of randomness. That makes a sequence of requests
+// reproducible if the server was seeded.
+//
+// The second return value is false if the response shouldn't be reproducible
+// because neither the request nor the server were seeded.
+func (s *StubServer) requestSeed(r *http.Request) (int64, bool, error) {
+	value := r.Header.Get(seedHeader)
+	if value == "" {
+		return s.rand.Int63(), s.seeded, nil
+	}
+
+	seed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf(invalidSeed, value)
+	}
+	return seed, true, nil
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//
+// Public values
+//
+
+// Formats in which the `Retry-After` header of rate limited responses can be
+// sent. Both are allowed by RFC 7231, so robust clients should be able to
+// handle either.
+const (
+	// RetryAfterHTTPDate sends `Retry-After` as an HTTP-date at which the
+	// client may retry, like `Wed, 21 Oct 2015 07:28:00 GMT`.
+	RetryAfterHTTPDate = "http-date"
+
+	// RetryAfterSeconds sends `Retry-After` as a whole number of seconds that
+	// the client should wait before retrying. This is the default.
+	RetryAfterSeconds = "seconds"
+)
+
+//
+// Private values
+//
+
+const rateLimited = "Too many requests hit the API too quickly. We recommend " +
+	"an exponential backoff of your requests."
+
+//
+// Private types
+//
+
+// rateLimiter limits how many requests are allowed per second for each API
+// key with a token bucket, like the Stripe API does. Each key has a bucket
+// that holds up to a second's worth of requests, which is refilled
+// continuously as time passes. Requests take a token from their bucket, and
+// are rate limited if it's empty.
+//
+// It's safe for concurrent use.
+type rateLimiter struct {
+	mutex sync.Mutex
+
+	// buckets maps API keys to their token buckets.
+	buckets map[string]*tokenBucket
+
+	// now returns the current time. It's a field so that tests can simulate
+	// the passing of time.
+	now func() time.Time
+
+	// rate is how many requests are allowed per second.
+	rate float64
+}
+
+// tokenBucket is the state of one API key's requests in a rateLimiter.
+type tokenBucket struct {
+	// tokens is how many requests can be made right now. It's fractional
+	// because the bucket is refilled continuously.
+	tokens float64
+
+	// updatedAt is when tokens was last updated.
+	updatedAt time.Time
+}
+
+// newRateLimiter initializes a new rateLimiter that allows the given number of
+// requests per second for each API key. nil is returned if the rate is zero,
+// in which case requests aren't limited.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+		rate:    rate,
+	}
+}
+
+// capacity is how many tokens a bucket holds, which is a second's worth of
+// requests, but always enough for at least one request.
+func (l *rateLimiter) capacity() float64 {
+	return math.Max(l.rate, 1)
+}
+
+// reset refills the buckets of all API keys, as if no requests had been made.
+func (l *rateLimiter) reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.buckets = make(map[string]*tokenBucket)
+}
+
+// take takes a token from the bucket of the given API key. If the bucket is
+// empty, false is returned along with how long it'll be until a token is
+// available.
+func (l *rateLimiter) take(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.capacity(), updatedAt: now}
+		l.buckets[key] = bucket
+	}
+
+	elapsed := now.Sub(bucket.updatedAt).Seconds()
+	bucket.tokens = math.Min(bucket.tokens+elapsed*l.rate, l.capacity())
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		backoff := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+		return false, backoff
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+//
+// Private functions
+//
+
+// checkRateLimit checks that a configured rate limit is usable.
+func checkRateLimit(rate float64) error {
+	if rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return fmt.Errorf("Maximum requests per second must be a positive number, but was %v", rate)
+	}
+
+	return nil
+}
+
+// checkRetryAfterFormat checks that a configured `Retry-After` format is one
+// that's supported.
+func checkRetryAfterFormat(format string) error {
+	switch format {
+	case RetryAfterHTTPDate, RetryAfterSeconds:
+		return nil
+	}
+
+	return fmt.Errorf("Unsupported Retry-After format '%s'; expected '%s' or '%s'",
+		format, RetryAfterSeconds, RetryAfterHTTPDate)
+}
+
+// formatRetryAfter produces a value for the `Retry-After` header that tells a
+// client to back off for the given duration, in the given format.
+//
+// Seconds are rounded up so that a client honoring the header never retries
+// early, and a client is always asked to wait for at least one second.
+func formatRetryAfter(format string, backoff time.Duration, now time.Time) string {
+	seconds := int64(math.Ceil(backoff.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	if format == RetryAfterHTTPDate {
+		return now.Add(time.Duration(seconds) * time.Second).UTC().Format(http.TimeFormat)
+	}
+
+	return fmt.Sprintf("%d", seconds)
+}
+
+// writeRateLimited responds to a request that's been rate limited with a
+// `rate_limit_error` and a `Retry-After` header asking the client to back off
+// until its request would be allowed.
+func (s *StubServer) writeRateLimited(w http.ResponseWriter, r *http.Request, start time.Time, backoff time.Duration) {
+	w.Header().Set("Retry-After", formatRetryAfter(s.retryAfterFormat, backoff, time.Now()))
+
+	writeResponse(w, r, start, http.StatusTooManyRequests,
+		createStripeError(typeRateLimitError, rateLimited, withCode("rate_limit")))
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestCheckRetryAfterFormat(t *testing.T) {
+	assert.NoError(t, checkRetryAfterFormat(RetryAfterSeconds))
+	assert.NoError(t, checkRetryAfterFormat(RetryAfterHTTPDate))
+	assert.Error(t, checkRetryAfterFormat("minutes"))
+}
+
+func TestFormatRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+
+	testCases := []struct {
+		format  string
+		backoff time.Duration
+		want    string
+	}{
+		{RetryAfterSeconds, 2 * time.Second, "2"},
+		{RetryAfterSeconds, 1500 * time.Millisecond, "2"},
+		{RetryAfterSeconds, 0, "1"},
+		{RetryAfterHTTPDate, 2 * time.Second, "Wed, 21 Oct 2015 07:28:02 GMT"},
+		{RetryAfterHTTPDate, 1500 * time.Millisecond, "Wed, 21 Oct 2015 07:28:02 GMT"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.format+" "+tc.backoff.String(), func(t *testing.T) {
+			value := formatRetryAfter(tc.format, tc.backoff, now)
+			assert.Equal(t, tc.want, value)
+
+			// Make sure that dates round trip through the standard parser
+			// that clients are likely to use.
+			if tc.format == RetryAfterHTTPDate {
+				parsed, err := http.ParseTime(value)
+				assert.NoError(t, err)
+				assert.Equal(t, now.Add(2*time.Second), parsed)
+			}
+		})
+	}
+}
+
+func TestNewStubServer_RetryAfterFormat(t *testing.T) {
+	server, err := NewStubServer(&testFixtures, &testSpec, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, RetryAfterSeconds, server.retryAfterFormat)
+
+	server, err = NewStubServer(&testFixtures, &testSpec,
+		&StubServerOptions{RetryAfterFormat: RetryAfterHTTPDate})
+	assert.NoError(t, err)
+	assert.Equal(t, RetryAfterHTTPDate, server.retryAfterFormat)
+
+	_, err = NewStubServer(&testFixtures, &testSpec,
+		&StubServerOptions{RetryAfterFormat: "minutes"})
+	assert.Error(t, err)
+}
+
+func TestNewStubServer_MaxRequestsPerSecond(t *testing.T) {
+	server, err := NewStubServer(&testFixtures, &testSpec, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, server.rateLimiter)
+
+	server, err = NewStubServer(&testFixtures, &testSpec,
+		&StubServerOptions{MaxRequestsPerSecond: 10})
+	assert.NoError(t, err)
+	assert.NotNil(t, server.rateLimiter)
+
+	_, err = NewStubServer(&testFixtures, &testSpec,
+		&StubServerOptions{MaxRequestsPerSecond: -1})
+	assert.Error(t, err)
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2)
+	now := time.Unix(1500000000, 0)
+	limiter.now = func() time.Time { return now }
+
+	// A second's worth of requests are allowed at once
+	ok, _ := limiter.take("sk_test_123")
+	assert.True(t, ok)
+	ok, _ = limiter.take("sk_test_123")
+	assert.True(t, ok)
+
+	ok, backoff := limiter.take("sk_test_123")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, backoff)
+
+	// Other keys have their own buckets
+	ok, _ = limiter.take("sk_test_456")
+	assert.True(t, ok)
+
+	// Buckets are refilled over time
+	now = now.Add(250 * time.Millisecond)
+	ok, backoff = limiter.take("sk_test_123")
+	assert.False(t, ok)
+	assert.Equal(t, 250*time.Millisecond, backoff)
+
+	now = now.Add(250 * time.Millisecond)
+	ok, _ = limiter.take("sk_test_123")
+	assert.True(t, ok)
+
+	// But never beyond their capacity
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		ok, _ = limiter.take("sk_test_123")
+		assert.True(t, ok)
+	}
+	ok, _ = limiter.take("sk_test_123")
+	assert.False(t, ok)
+
+	// Resetting refills every bucket
+	limiter.reset()
+	ok, _ = limiter.take("sk_test_123")
+	assert.True(t, ok)
+}
+
+func TestRateLimiter_LessThanOnePerSecond(t *testing.T) {
+	limiter := newRateLimiter(0.5)
+	now := time.Unix(1500000000, 0)
+	limiter.now = func() time.Time { return now }
+
+	ok, _ := limiter.take("sk_test_123")
+	assert.True(t, ok)
+
+	ok, backoff := limiter.take("sk_test_123")
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, backoff)
+}
+
+func TestStubServer_RateLimited(t *testing.T) {
+	server := getStubServer(t, &testStubServerOptions{maxRequestsPerSecond: 1})
+
+	resp, _ := sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.Contains(t, string(body), typeRateLimitError)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+//
+// Private types
+//
+
+// recording appends every request and its response to a file as JSON lines,
+// for golden tests that diff stripe-mock's output between runs. Unlike the
+// request log, it leaves out timings (which differ from run to run) and is
+// never rotated.
+//
+// It's safe for concurrent use.
+type recording struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// recordingEntry is a single line in a recording.
+type recordingEntry struct {
+	Method       string          `json:"method"`
+	Path         string          `json:"path"`
+	Query        string          `json:"query,omitempty"`
+	RequestBody  string          `json:"request_body,omitempty"`
+	Status       int             `json:"status"`
+	ResponseBody json.RawMessage `json:"response_body,omitempty"`
+}
+
+// newRecording opens a recording that appends to the file at the given path.
+func newRecording(path string) (*recording, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening recording: %v", err)
+	}
+	return &recording{file: file}, nil
+}
+
+// write appends the request and response of a request log entry to the
+// recording.
+func (r *recording) write(entry *requestLogEntry) error {
+	line, err := json.Marshal(&recordingEntry{
+		Method:       entry.Method,
+		Path:         entry.Path,
+		Query:        entry.Query,
+		RequestBody:  entry.RequestBody,
+		Status:       entry.Status,
+		ResponseBody: entry.ResponseBody,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, err = r.file.Write(line)
+	return err
+}
+
+// close closes the recording's file.
+func (r *recording) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.file.Close()
+}
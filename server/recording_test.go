@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStubServer_Recording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+
+	server := getStubServer(t, nil)
+	var err error
+	server.recording, err = newRecording(path)
+	assert.NoError(t, err)
+
+	resp, _ := sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges?limit=1", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	entries := readRecording(t, path)
+	assert.Equal(t, 2, len(entries))
+
+	assert.Equal(t, "POST", entries[0].Method)
+	assert.Equal(t, "/v1/charges", entries[0].Path)
+	assert.Equal(t, "amount=123", entries[0].RequestBody)
+	assert.Equal(t, http.StatusOK, entries[0].Status)
+	var charge map[string]interface{}
+	err = json.Unmarshal(entries[0].ResponseBody, &charge)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, charge)
+
+	assert.Equal(t, "GET", entries[1].Method)
+	assert.Equal(t, "limit=1", entries[1].Query)
+	assert.Equal(t, http.StatusUnauthorized, entries[1].Status)
+
+	// Nothing is written to a request log that wasn't configured
+	assert.Nil(t, server.requestLog)
+}
+
+func TestStubServer_RecordingReproducible(t *testing.T) {
+	dir := t.TempDir()
+
+	// Recordings of the same requests to servers with the same seed and time
+	// are identical, so they can be diffed
+	var recordings []string
+	for _, name := range []string{"first.jsonl", "second.jsonl"} {
+		path := filepath.Join(dir, name)
+
+		server := getRealStubServer(t, &testStubServerOptions{
+			fixedTime: time.Unix(1700000000, 0),
+			seed:      123,
+		})
+		var err error
+		server.recording, err = newRecording(path)
+		assert.NoError(t, err)
+
+		sendRequestToServer(t, server, "POST", "/v1/customers", "email=jane@example.com",
+			getDefaultHeaders())
+		sendRequestToServer(t, server, "GET", "/v1/charges?limit=2", "", getDefaultHeaders())
+
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		recordings = append(recordings, string(data))
+	}
+	assert.NotEmpty(t, recordings[0])
+	assert.Equal(t, recordings[0], recordings[1])
+}
+
+func TestStubServer_CloseRecording(t *testing.T) {
+	dir := t.TempDir()
+
+	server, err := NewStubServer(&testFixtures, &testSpec, &StubServerOptions{
+		RecordFile: filepath.Join(dir, "recording.jsonl"),
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, server.Close())
+	assert.Error(t, server.recording.write(&requestLogEntry{}))
+
+	// The recording is closed again if the server can't be made
+	_, err = NewStubServer(&testFixtures, &testSpec, &StubServerOptions{
+		RecordFile: filepath.Join(dir, "recording.jsonl"),
+		ReplayFile: filepath.Join(dir, "doesnt-exist.jsonl"),
+	})
+	assert.Error(t, err)
+	if _, err := os.Stat("/proc/self/fd"); err == nil {
+		assert.Equal(t, 0, countOpenFiles(t, dir))
+	}
+}
+
+//
+// Private functions
+//
+
+func readRecording(t *testing.T, path string) []recordingEntry {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	var entries []recordingEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var entry recordingEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		assert.NoError(t, err)
+		entries = append(entries, entry)
+	}
+	assert.NoError(t, scanner.Err())
+	return entries
+}
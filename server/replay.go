@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+//
+// Private values
+//
+
+// maxReplayLineSize is the size in bytes of the longest line that can be read
+// from a file of recorded responses. Lines hold a whole response, which can be
+// large for lists with expanded objects.
+const maxReplayLineSize = 16 * 1024 * 1024
+
+//
+// Private types
+//
+
+// replay holds recorded responses that are served instead of generated ones
+// to requests that match theirs. Its entries are in the format of recordings,
+// so that a recording can be replayed as is, but they can just as well be
+// captured from the Stripe API.
+type replay struct {
+	// entries are the recorded entries keyed by method and path, in the order
+	// they were read.
+	entries map[string][]recordingEntry
+}
+
+//
+// Private functions
+//
+
+// loadReplay loads recorded responses from a file of JSON lines like those
+// written by a recording.
+func loadReplay(path string) (*replay, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading replay file: %v", err)
+	}
+
+	replay := &replay{entries: make(map[string][]recordingEntry)}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxReplayLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var entry recordingEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding line %d of %s: %v", line, path, err)
+		}
+		if entry.Method == "" || entry.Path == "" || entry.Status == 0 {
+			return nil, fmt.Errorf("Line %d of %s needs a `method`, `path`, and `status`",
+				line, path)
+		}
+
+		key := replayKey(entry.Method, entry.Path)
+		replay.entries[key] = append(replay.entries[key], entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading replay file: %v", err)
+	}
+
+	return replay, nil
+}
+
+// find finds the recorded entry for a request. An entry matches if it has the
+// same method and path, and the same query and body unless it has none, in
+// which case it matches requests with any. Entries that match exactly are
+// preferred, and otherwise the first recorded one is used. The second return
+// value is false if there's no match.
+func (p *replay) find(r *http.Request, body []byte) (*recordingEntry, bool) {
+	entries := p.entries[replayKey(r.Method, r.URL.Path)]
+
+	for i, entry := range entries {
+		if entry.Query == r.URL.RawQuery && entry.RequestBody == string(body) {
+			return &entries[i], true
+		}
+	}
+
+	for i, entry := range entries {
+		if (entry.Query == "" || entry.Query == r.URL.RawQuery) &&
+			(entry.RequestBody == "" || entry.RequestBody == string(body)) {
+			return &entries[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// replayKey is the key under which recorded entries for requests with the
+// given method and path are kept.
+func replayKey(method, path string) string {
+	return method + " " + path
+}
+
+// writeReplayedResponse responds to a request with the recorded response for
+// it, if there is one. The return value is true if a response was written.
+func (s *StubServer) writeReplayedResponse(w http.ResponseWriter, r *http.Request, start time.Time,
+	body []byte) bool {
+
+	entry, ok := s.replay.find(r, body)
+	if !ok {
+		return false
+	}
+
+	if len(entry.ResponseBody) == 0 {
+		writeEmptyResponse(w, r, start, entry.Status)
+		return true
+	}
+
+	// Responses that aren't JSON, like PDFs, are recorded as strings.
+	var data interface{} = entry.ResponseBody
+	var text string
+	if json.Unmarshal(entry.ResponseBody, &text) == nil {
+		data = text
+	}
+
+	writeResponse(w, r, start, entry.Status, data)
+	return true
+}
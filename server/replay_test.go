@@ -0,0 +1,133 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestLoadReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "replay.jsonl")
+	err := ioutil.WriteFile(path, []byte(
+		`{"method": "GET", "path": "/v1/charges/ch_123", "status": 200, "response_body": {"id": "ch_123"}}`+"\n"+
+			"\n"+
+			`{"method": "GET", "path": "/v1/charges/ch_123", "query": "expand[]=customer", "status": 200}`+"\n"), 0644)
+	assert.NoError(t, err)
+
+	replay, err := loadReplay(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(replay.entries[replayKey("GET", "/v1/charges/ch_123")]))
+
+	_, err = loadReplay(filepath.Join(dir, "doesnt-exist.jsonl"))
+	assert.Error(t, err)
+
+	for _, contents := range []string{
+		`{"method": "GET"`,
+		`{"method": "GET", "path": "/v1/charges"}`,
+		`{"path": "/v1/charges", "status": 200}`,
+	} {
+		err := ioutil.WriteFile(path, []byte(contents), 0644)
+		assert.NoError(t, err)
+		_, err = loadReplay(path)
+		assert.Error(t, err, contents)
+	}
+}
+
+func TestReplay_Find(t *testing.T) {
+	replay := &replay{entries: map[string][]recordingEntry{
+		replayKey("GET", "/v1/charges"): {
+			{Method: "GET", Path: "/v1/charges", Status: 200, ResponseBody: []byte(`"any"`)},
+			{Method: "GET", Path: "/v1/charges", Query: "limit=1", Status: 200, ResponseBody: []byte(`"limit"`)},
+		},
+		replayKey("POST", "/v1/charges"): {
+			{Method: "POST", Path: "/v1/charges", RequestBody: "amount=123", Status: 200},
+		},
+	}}
+
+	testCases := []struct {
+		method   string
+		url      string
+		body     string
+		expected string
+	}{
+		{"GET", "/v1/charges", "", `"any"`},
+		{"GET", "/v1/charges?limit=1", "", `"limit"`},
+		{"GET", "/v1/charges?limit=2", "", `"any"`},
+		{"POST", "/v1/charges", "amount=123", ""},
+	}
+	for _, testCase := range testCases {
+		r, _ := http.NewRequest(testCase.method, testCase.url, nil)
+		entry, ok := replay.find(r, []byte(testCase.body))
+		assert.True(t, ok, testCase.url)
+		assert.Equal(t, testCase.expected, string(entry.ResponseBody))
+	}
+
+	for _, testCase := range []struct{ method, url, body string }{
+		{"POST", "/v1/charges", "amount=456"},
+		{"GET", "/v1/customers", ""},
+		{"DELETE", "/v1/charges", ""},
+	} {
+		r, _ := http.NewRequest(testCase.method, testCase.url, nil)
+		_, ok := replay.find(r, []byte(testCase.body))
+		assert.False(t, ok, testCase.url)
+	}
+}
+
+func TestStubServer_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.jsonl")
+	err := ioutil.WriteFile(path, []byte(
+		`{"method": "POST", "path": "/v1/charges", "request_body": "amount=123&currency=usd", "status": 200, "response_body": {"id": "ch_recorded", "object": "charge"}}`+"\n"+
+			`{"method": "GET", "path": "/v1/charges/ch_123", "status": 404, "response_body": {"error": {"type": "invalid_request_error"}}}`+"\n"), 0644)
+	assert.NoError(t, err)
+
+	server := getRealStubServer(t, nil)
+	server.replay, err = loadReplay(path)
+	assert.NoError(t, err)
+
+	// Recorded responses are served verbatim, including their status
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123&currency=usd",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"id":"ch_recorded","object":"charge"}`, string(body))
+
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges/ch_123", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Other requests get generated responses
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/charges", "amount=456&currency=usd",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, "ch_recorded", decodeObject(t, body)["id"])
+
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges/ch_456", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Requests still have to be valid to get a recorded response
+	resp, _ = sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123&currency=usd", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestStubServer_ReplayRecording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+
+	// A recording can be replayed as is
+	recorder := getRealStubServer(t, nil)
+	var err error
+	recorder.recording, err = newRecording(path)
+	assert.NoError(t, err)
+	_, recorded := sendRequestToServer(t, recorder, "POST", "/v1/customers",
+		"email=jane@example.com", getDefaultHeaders())
+
+	replayer := getRealStubServer(t, nil)
+	replayer.replay, err = loadReplay(path)
+	assert.NoError(t, err)
+	resp, replayed := sendRequestToServer(t, replayer, "POST", "/v1/customers",
+		"email=jane@example.com", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, decodeObject(t, recorded)["id"], decodeObject(t, replayed)["id"])
+}
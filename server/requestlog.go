@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// Private types
+//
+
+// requestLog appends a transcript of every request and its response to a file
+// as JSON lines.
+//
+// Once the file would grow beyond its maximum size, it's rotated by renaming it
+// with a `.1` suffix (replacing any previous rotated file) and starting a new
+// one, so at most about twice the maximum size is kept on disk.
+//
+// It's safe for concurrent use.
+type requestLog struct {
+	file    *os.File
+	maxSize int64
+	mutex   sync.Mutex
+	path    string
+	size    int64
+}
+
+// requestLogEntry is a single line in a request log.
+type requestLogEntry struct {
+	Elapsed      float64         `json:"elapsed_ms"`
+	Method       string          `json:"method"`
+	Path         string          `json:"path"`
+	Query        string          `json:"query,omitempty"`
+	RequestBody  string          `json:"request_body,omitempty"`
+	ResponseBody json.RawMessage `json:"response_body,omitempty"`
+	Status       int             `json:"status"`
+	Time         string          `json:"time"`
+}
+
+// newRequestLog opens a request log that appends to the file at the given
+// path. If maxSize is greater than zero, the file is rotated when it would
+// grow beyond that many bytes.
+func newRequestLog(path string, maxSize int64) (*requestLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening request log: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error opening request log: %v", err)
+	}
+
+	return &requestLog{
+		file:    file,
+		maxSize: maxSize,
+		path:    path,
+		size:    info.Size(),
+	}, nil
+}
+
+// write appends an entry to the log, rotating the file first if necessary.
+func (l *requestLog) write(entry *requestLogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err := l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// close closes the log's file.
+func (l *requestLog) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.file.Close()
+}
+
+// rotate moves the current log file aside and starts a new one. The caller
+// must hold the mutex.
+func (l *requestLog) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(l.path, l.path+".1")
+	if err != nil {
+		return err
+	}
+
+	l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	l.size = 0
+	return nil
+}
+
+// responseRecorder wraps an http.ResponseWriter to keep track of the status
+// and body of the response written through it.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	body   bytes.Buffer
+	status int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+//
+// Private functions
+//
+
+// bufferRequestBody reads a request's body and replaces it with a copy, so
+// that it can be both inspected and read by the handler.
+func bufferRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	requestBody, err := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+	return requestBody, err
+}
+
+// startRequestLogEntry prepares to log a request. It buffers the request's
+// body so that it can both be logged and read by the handler, and wraps the
+// response writer to record the response.
+//
+// The returned function should be called once the response has been written
+// to append the entry to the request log and the recording, whichever of them
+// are configured.
+func (s *StubServer) startRequestLogEntry(w http.ResponseWriter, r *http.Request, start time.Time) (http.ResponseWriter, func()) {
+	requestBody, err := bufferRequestBody(r)
+	if err != nil {
+		logMessage(r, "Error reading request body for request log: %v", err)
+	}
+
+	recorder := &responseRecorder{ResponseWriter: w}
+
+	return recorder, func() {
+		entry := &requestLogEntry{
+			Elapsed:     float64(time.Since(start).Microseconds()) / 1000,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Query:       r.URL.RawQuery,
+			RequestBody: string(requestBody),
+			Status:      recorder.status,
+			Time:        start.UTC().Format(time.RFC3339Nano),
+		}
+
+		// Responses are embedded as JSON when possible so that the log is
+		// easy to query, but some (like PDFs) aren't JSON.
+		responseBody := recorder.body.Bytes()
+		if recorder.Header().Get("Content-Encoding") == gzipEncoding {
+			var err error
+			responseBody, err = decompressGzip(responseBody)
+			if err != nil {
+				logMessage(r, "Error decompressing response for request log: %v", err)
+			}
+		}
+		if json.Valid(responseBody) {
+			entry.ResponseBody = json.RawMessage(responseBody)
+		} else if len(responseBody) > 0 {
+			entry.ResponseBody, _ = json.Marshal(string(responseBody))
+		}
+
+		if s.requestLog != nil {
+			err := s.requestLog.write(entry)
+			if err != nil {
+				logMessage(r, "Error writing to request log: %v", err)
+			}
+		}
+
+		if s.recording != nil {
+			err := s.recording.write(entry)
+			if err != nil {
+				logMessage(r, "Error writing to recording: %v", err)
+			}
+		}
+	}
+}
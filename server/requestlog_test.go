@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStubServer_RequestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+
+	server := getStubServer(t, nil)
+	var err error
+	server.requestLog, err = newRequestLog(path, 0)
+	assert.NoError(t, err)
+
+	resp, _ := sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges?limit=1", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	entries := readRequestLog(t, path)
+	assert.Equal(t, 2, len(entries))
+
+	assert.Equal(t, "POST", entries[0].Method)
+	assert.Equal(t, "/v1/charges", entries[0].Path)
+	assert.Equal(t, "amount=123", entries[0].RequestBody)
+	assert.Equal(t, http.StatusOK, entries[0].Status)
+	var charge map[string]interface{}
+	err = json.Unmarshal(entries[0].ResponseBody, &charge)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, charge)
+
+	assert.Equal(t, "GET", entries[1].Method)
+	assert.Equal(t, "limit=1", entries[1].Query)
+	assert.Equal(t, http.StatusUnauthorized, entries[1].Status)
+}
+
+func TestRequestLog_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+
+	log, err := newRequestLog(path, 200)
+	assert.NoError(t, err)
+
+	entry := &requestLogEntry{Method: "GET", Path: "/v1/" + strings.Repeat("a", 100)}
+	for i := 0; i < 3; i++ {
+		err = log.write(entry)
+		assert.NoError(t, err)
+	}
+
+	// Each entry is more than half of the maximum size, so every write after
+	// the first rotates the file
+	assert.Equal(t, 1, len(readRequestLog(t, path)))
+	assert.Equal(t, 1, len(readRequestLog(t, path+".1")))
+}
+
+func TestStubServer_CloseRequestLog(t *testing.T) {
+	dir := t.TempDir()
+
+	server, err := NewStubServer(&testFixtures, &testSpec, &StubServerOptions{
+		RequestLogFile: filepath.Join(dir, "requests.log"),
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, server.Close())
+	assert.Error(t, server.requestLog.write(&requestLogEntry{}))
+
+	// The log is closed again if the server can't be made
+	_, err = NewStubServer(&testFixtures, &testSpec, &StubServerOptions{
+		ReplayFile:     filepath.Join(dir, "doesnt-exist.jsonl"),
+		RequestLogFile: filepath.Join(dir, "requests.log"),
+	})
+	assert.Error(t, err)
+	if _, err := os.Stat("/proc/self/fd"); err == nil {
+		assert.Equal(t, 0, countOpenFiles(t, dir))
+	}
+}
+
+//
+// Private functions
+//
+
+// countOpenFiles counts the files in a directory that the process has open.
+// It only works on systems with a /proc filesystem.
+func countOpenFiles(t *testing.T, dir string) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	assert.NoError(t, err)
+
+	count := 0
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && strings.HasPrefix(target, dir+string(filepath.Separator)) {
+			count++
+		}
+	}
+	return count
+}
+
+func readRequestLog(t *testing.T, path string) []requestLogEntry {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	var entries []requestLogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry requestLogEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		assert.NoError(t, err)
+		entries = append(entries, entry)
+	}
+	assert.NoError(t, scanner.Err())
+	return entries
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/lestrrat-go/jsval"
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Public values
+//
+
+// Modes in which generated responses can be validated against their schemas
+// in the OpenAPI specification before they're sent.
+const (
+	// ResponseValidationLog logs any violations, but still sends the response.
+	ResponseValidationLog = "log"
+
+	// ResponseValidationOff doesn't validate responses. This is the default
+	// because validation is relatively expensive.
+	ResponseValidationOff = "off"
+
+	// ResponseValidationStrict logs any violations and responds with a 500
+	// instead of the invalid response.
+	ResponseValidationStrict = "strict"
+)
+
+//
+// Private functions
+//
+
+// checkResponseValidation checks that a configured response validation mode
+// is one that's supported.
+func checkResponseValidation(mode string) error {
+	switch mode {
+	case ResponseValidationLog, ResponseValidationOff, ResponseValidationStrict:
+		return nil
+	}
+
+	return fmt.Errorf("Unsupported response validation mode '%s'; expected '%s', '%s', or '%s'",
+		mode, ResponseValidationOff, ResponseValidationLog, ResponseValidationStrict)
+}
+
+// getResponseValidator builds a validator for the JSON schema of an
+// operation's successful response, or gets it from the cache if one was
+// already built for the same schema. nil is returned if the operation doesn't
+// respond with JSON.
+func getResponseValidator(operation *spec.Operation, validators *spec.ValidatorCache,
+	components *spec.ComponentsForValidation) (*jsval.JSVal, error) {
+
+	response, ok := operation.Responses[getSuccessStatus(operation)]
+	if !ok {
+		return nil, nil
+	}
+
+	mediaType, ok := response.Content["application/json"]
+	if !ok || mediaType.Schema == nil {
+		return nil, nil
+	}
+
+	return validators.GetValidator(mediaType.Schema, components)
+}
+
+// validateResponse validates response data against a route's response
+// validator.
+//
+// The data is round-tripped through JSON first so that it's validated exactly
+// as the client would receive it, rather than as whichever Go types the
+// generator happened to produce.
+func validateResponse(validator *jsval.JSVal, data interface{}) error {
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	var decodedData interface{}
+	err = json.Unmarshal(encodedData, &decodedData)
+	if err != nil {
+		return err
+	}
+
+	return validator.Validate(decodedData)
+}
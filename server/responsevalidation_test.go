@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+func TestStubServer_ResponseValidation(t *testing.T) {
+	// Break the charge fixture by giving it a customer that's neither an ID
+	// nor an expanded customer
+	invalidFixtures := spec.Fixtures{Resources: map[spec.ResourceID]interface{}{
+		spec.ResourceID("charge"): map[string]interface{}{
+			"customer": 123,
+			"id":       "ch_123",
+		},
+	}}
+
+	t.Run("log", func(t *testing.T) {
+		server := newTestStubServer(t, &testSpec, &invalidFixtures,
+			&testStubServerOptions{responseValidation: ResponseValidationLog})
+
+		var resp *http.Response
+		output := captureStdout(t, func() {
+			resp, _ = sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123",
+				getDefaultHeaders())
+		})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, output, "Response validation error for POST /v1/charges")
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		server := newTestStubServer(t, &testSpec, &invalidFixtures,
+			&testStubServerOptions{responseValidation: ResponseValidationStrict})
+
+		resp, _ := sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123",
+			getDefaultHeaders())
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	})
+}
+
+func TestCheckResponseValidation(t *testing.T) {
+	assert.NoError(t, checkResponseValidation(ResponseValidationOff))
+	assert.NoError(t, checkResponseValidation(ResponseValidationLog))
+	assert.NoError(t, checkResponseValidation(ResponseValidationStrict))
+	assert.Error(t, checkResponseValidation("sometimes"))
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"math/rand"
+)
+
+//
+// Private values
+//
+
+// reviewTestCardNumber is the number of Stripe's test card that has an
+// elevated risk of fraud, so payments made with it are placed in review.
+const reviewTestCardNumber = "4000000000009235"
+
+// reviewTestSources are the test tokens and payment methods for the card
+// with an elevated risk of fraud.
+var reviewTestSources = map[string]bool{
+	"pm_card_riskLevelElevated": true,
+	"tok_riskLevelElevated":     true,
+}
+
+//
+// Private functions
+//
+
+// applyReviewOutcome flags a generated charge for manual review if it was
+// paid with Stripe's test card with an elevated risk of fraud, setting its
+// `outcome` and linking it to a new review. See:
+//
+// https://stripe.com/docs/testing#fraud-prevention
+func applyReviewOutcome(ids *rand.Rand, requestData map[string]interface{}, data map[string]interface{}) {
+	if data["object"] != "charge" || !isReviewTrigger(requestData) {
+		return
+	}
+
+	data["outcome"] = map[string]interface{}{
+		"network_status": "approved_by_network",
+		"reason":         "elevated_risk_level",
+		"risk_level":     "elevated",
+		"risk_score":     75,
+		"rule":           nil,
+		"seller_message": "Stripe evaluated this payment as having elevated " +
+			"risk, and placed it in review.",
+		"type": "manual_review",
+	}
+	data["review"] = newID(ids, "prv")
+}
+
+// isReviewTrigger checks whether a request paid with Stripe's test card with
+// an elevated risk of fraud, either as a token, a payment method, or raw card
+// details.
+func isReviewTrigger(requestData map[string]interface{}) bool {
+	for _, key := range []string{"payment_method", "source"} {
+		if source, ok := requestData[key].(string); ok && reviewTestSources[source] {
+			return true
+		}
+	}
+
+	for _, key := range []string{"card", "source"} {
+		if number, ok := getMap(requestData, key)["number"].(string); ok && number == reviewTestCardNumber {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newReview produces a review that's been opened for a charge based on the
+// review fixture.
+func newReview(s *StubServer, charge map[string]interface{}) map[string]interface{} {
+	review := make(map[string]interface{})
+	if fixture, ok := s.fixtures.Resources["review"].(map[string]interface{}); ok {
+		review = copyObject(fixture)
+	}
+	review["charge"] = charge["id"]
+	review["closed_reason"] = nil
+	review["created"] = s.generationTime().Unix()
+	review["id"] = charge["review"]
+	review["object"] = "review"
+	review["open"] = true
+	review["opened_reason"] = "rule"
+	review["payment_intent"] = charge["payment_intent"]
+	review["reason"] = "rule"
+	return review
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestReviewOutcome(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	for _, params := range []string{
+		"source=tok_riskLevelElevated",
+		"card[number]=4000000000009235&card[exp_month]=12&card[exp_year]=2030",
+	} {
+		resp, body := sendRequestToServer(t, server, "POST", "/v1/charges",
+			"amount=1000&currency=usd&"+params, getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		charge := decodeObject(t, body)
+		outcome := charge["outcome"].(map[string]interface{})
+		assert.Equal(t, "manual_review", outcome["type"])
+		assert.Equal(t, "elevated", outcome["risk_level"])
+		assert.Regexp(t, "^prv_", charge["review"])
+	}
+
+	// Other cards aren't flagged
+	_, body := sendRequestToServer(t, server, "POST", "/v1/charges",
+		"amount=1000&currency=usd&source=tok_visa", getDefaultHeaders())
+	assert.Nil(t, decodeObject(t, body)["review"])
+}
+
+func TestStatefulReviews(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/charges",
+		"amount=1000&currency=usd&source=tok_riskLevelElevated", getDefaultHeaders())
+	charge := decodeObject(t, body)
+	reviewID := charge["review"].(string)
+
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/reviews/"+reviewID,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	review := decodeObject(t, body)
+	assert.Equal(t, charge["id"], review["charge"])
+	assert.Equal(t, true, review["open"])
+	assert.Equal(t, "rule", review["reason"])
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/reviews", "", getDefaultHeaders())
+	reviews := decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, 1, len(reviews))
+	assert.Equal(t, reviewID, reviews[0].(map[string]interface{})["id"])
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/reviews/"+reviewID+"/approve",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	review = decodeObject(t, body)
+	assert.Equal(t, false, review["open"])
+	assert.Equal(t, "approved", review["reason"])
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/reviews/"+reviewID, "", getDefaultHeaders())
+	assert.Equal(t, false, decodeObject(t, body)["open"])
+}
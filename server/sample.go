@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/stripe/stripe-mock/embedded"
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private values
+//
+
+// sampleSpec and sampleFixtures are the bundled OpenAPI spec and fixtures
+// used by GenerateSample. They're large, so they're only loaded the first
+// time that they're needed.
+var (
+	sampleFixtures *spec.Fixtures
+	sampleLoadErr  error
+	sampleOnce     sync.Once
+	sampleSpec     *spec.Spec
+)
+
+//
+// Public functions
+//
+
+// GenerateSample generates a sample object of the named resource (like
+// `charge` or `checkout.session`) from the bundled OpenAPI spec and fixtures,
+// just like stripe-mock would for a response, but without running a server.
+// It's useful for building fixtures in tests that only need a realistic
+// object.
+//
+// Every sample gets a new ID, and the returned object can be modified freely.
+func GenerateSample(resource string) (map[string]interface{}, error) {
+	sampleOnce.Do(func() {
+		sampleSpec, sampleLoadErr = LoadSpec(embedded.OpenAPISpec, "")
+		if sampleLoadErr != nil {
+			return
+		}
+		sampleFixtures, sampleLoadErr = LoadFixtures(embedded.OpenAPIFixtures, "")
+	})
+	if sampleLoadErr != nil {
+		return nil, sampleLoadErr
+	}
+
+	schema, ok := sampleSpec.Components.Schemas[resource]
+	if !ok || schema.XResourceID == "" {
+		return nil, fmt.Errorf("Unknown resource: %s", resource)
+	}
+
+	generator := DataGenerator{sampleSpec.Components.Schemas, sampleFixtures, false}
+	data, err := generator.Generate(&GenerateParams{
+		Schema: &spec.Schema{Ref: "#/components/schemas/" + resource},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sample, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Resource %s didn't generate an object", resource)
+	}
+	return copyObject(sample), nil
+}
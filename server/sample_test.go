@@ -0,0 +1,39 @@
+package server
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+func TestGenerateSample(t *testing.T) {
+	for _, resource := range []string{"charge", "checkout.session", "customer", "subscription"} {
+		sample, err := GenerateSample(resource)
+		assert.NoError(t, err)
+		assert.Equal(t, resource, sample["object"])
+		assert.NotEmpty(t, sample["id"])
+
+		validator, err := spec.GetValidatorForOpenAPI3Schema(
+			&spec.Schema{Ref: "#/components/schemas/" + resource}, realComponentsForValidation)
+		assert.NoError(t, err)
+		assert.NoError(t, validateResponse(validator, sample))
+	}
+
+	// Every sample is a new object
+	sample1, err := GenerateSample("charge")
+	assert.NoError(t, err)
+	sample2, err := GenerateSample("charge")
+	assert.NoError(t, err)
+	assert.NotEqual(t, sample1["id"], sample2["id"])
+}
+
+func TestGenerateSample_UnknownResource(t *testing.T) {
+	_, err := GenerateSample("doesnt_exist")
+	assert.EqualError(t, err, "Unknown resource: doesnt_exist")
+
+	// Schemas that aren't resources can't be generated on their own
+	_, err = GenerateSample("address")
+	assert.EqualError(t, err, "Unknown resource: address")
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"crypto/sha256"
+	"math/big"
+)
+
+//
+// Private values
+//
+
+// clientSecretObjects are the types of objects whose client secrets are
+// derived from their IDs.
+var clientSecretObjects = map[string]bool{
+	"payment_intent": true,
+	"setup_intent":   true,
+}
+
+// secretSuffixLength is the length of the secret part of client secrets and
+// other secrets, which is the same as in the Stripe API.
+const secretSuffixLength = 25
+
+//
+// Private functions
+//
+
+// applyClientSecrets sets the `client_secret` of any payment or setup intents
+// in generated data so that it corresponds to the intent's ID, taking the form
+// `{id}_secret_{suffix}` like in the Stripe API.
+//
+// The suffix is derived from the ID, so an intent always has the same client
+// secret no matter how many times it's generated.
+func applyClientSecrets(data interface{}) {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		if objectType, ok := v["object"].(string); ok && clientSecretObjects[objectType] {
+			id, idOK := v["id"].(string)
+			_, secretOK := v["client_secret"].(string)
+			if idOK && secretOK {
+				v["client_secret"] = id + "_secret_" + secretSuffix(id)
+			}
+		}
+
+		for _, value := range v {
+			applyClientSecrets(value)
+		}
+
+	case []interface{}:
+		for _, value := range v {
+			applyClientSecrets(value)
+		}
+	}
+}
+
+// secretSuffix derives the secret part of a client secret or other secret
+// from the ID of the object that it belongs to.
+func secretSuffix(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	suffix := new(big.Int).SetBytes(sum[:]).Text(62)
+	return suffix[:secretSuffixLength]
+}
@@ -1,16 +1,20 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/lestrrat-go/jsval"
@@ -135,8 +139,25 @@ func (p *PathParamsSecondaryID) appendReplacedID(replacedID string) {
 // returned from Stripe's API.
 type ResponseError struct {
 	ErrorInfo struct {
+		Code        string `json:"code,omitempty"`
+		DeclineCode string `json:"decline_code,omitempty"`
+
+		// DocURL links to the documentation of the error's Code. It's set
+		// along with Code by withCode.
+		DocURL string `json:"doc_url,omitempty"`
+
 		Message string `json:"message"`
-		Type    string `json:"type"`
+
+		// Param is the name of the request parameter that the error is
+		// about, like `amount`, if it's about one.
+		Param string `json:"param,omitempty"`
+
+		// RequestLogURL links to the request in the Dashboard, like in errors
+		// from the Stripe API. It's set when the error is written for
+		// requests that have an ID.
+		RequestLogURL string `json:"request_log_url,omitempty"`
+
+		Type string `json:"type"`
 	} `json:"error"`
 }
 
@@ -164,7 +185,13 @@ func LoadFixtures(embeddedFixtures []byte, fixturesPath string) (*spec.Fixtures,
 	var fixtures spec.Fixtures
 	err = json.Unmarshal(data, &fixtures)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding fixtures: %v", err)
+		return nil, fmt.Errorf("error decoding fixtures%s: %v", describePath(fixturesPath), err)
+	}
+
+	// Any JSON object decodes into fixtures, so make sure that this looks
+	// like fixtures rather than, say, a spec passed by mistake.
+	if len(fixtures.Resources) == 0 {
+		return nil, fmt.Errorf("error decoding fixtures%s: no `resources` found", describePath(fixturesPath))
 	}
 
 	return &fixtures, nil
@@ -174,6 +201,18 @@ func LoadFixtures(embeddedFixtures []byte, fixturesPath string) (*spec.Fixtures,
 //
 // If path is empty, the spec is loaded from internal embedded assets.
 func LoadSpec(embeddedSpec []byte, specPath string) (*spec.Spec, error) {
+	return loadSpec(embeddedSpec, specPath, false)
+}
+
+// LoadSpecStrict loads OpenAPI spec like LoadSpec, but returns an error if
+// the spec contains extensions that stripe-mock doesn't understand or
+// malformed constructs that would otherwise be ignored, like references that
+// don't resolve.
+func LoadSpecStrict(embeddedSpec []byte, specPath string) (*spec.Spec, error) {
+	return loadSpec(embeddedSpec, specPath, true)
+}
+
+func loadSpec(embeddedSpec []byte, specPath string, strict bool) (*spec.Spec, error) {
 	var data []byte
 	var err error
 
@@ -191,10 +230,23 @@ func LoadSpec(embeddedSpec []byte, specPath string) (*spec.Spec, error) {
 		return nil, fmt.Errorf("error loading spec: %v", err)
 	}
 
+	if strict {
+		err = checkSpecStrict(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var stripeSpec spec.Spec
 	err = json.Unmarshal(data, &stripeSpec)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding spec: %v", err)
+		return nil, fmt.Errorf("error decoding spec%s: %v", describePath(specPath), err)
+	}
+
+	// Any JSON object decodes into a spec, so make sure that this looks like
+	// an OpenAPI spec rather than, say, fixtures passed by mistake.
+	if len(stripeSpec.Paths) == 0 {
+		return nil, fmt.Errorf("error decoding spec%s: no `paths` found", describePath(specPath))
 	}
 
 	return &stripeSpec, nil
@@ -203,32 +255,468 @@ func LoadSpec(embeddedSpec []byte, specPath string) (*spec.Spec, error) {
 // StubServer handles incoming HTTP requests and responds to them appropriately
 // based off the set of OpenAPI routes that it's been configured with.
 type StubServer struct {
+	controlToken       string
+	corsOrigin         string
+	declineRules       []declineRule
+	errorRate          float64
+	errorRateStatus    int
+	fixedTime          time.Time
 	fixtures           *spec.Fixtures
+	fuzz               bool
+	injectedHeaders    http.Header
+	logger             *requestLogger
+	maxExpansionDepth  int
+	objectsEndpoint    bool
+	retryAfterFormat   string
 	routes             map[spec.HTTPVerb][]stubServerRoute
 	spec               *spec.Spec
+	specEndpoint       bool
 	strictVersionCheck bool
 	verbose            bool
+
+	// versions holds the specs and routes with which requests for API
+	// versions other than that of spec are handled, keyed by version. Their
+	// routes are built along with the main ones.
+	versions map[string]*versionRouter
+
+	// routeCoverageReport causes operations that can't be fully served to be
+	// listed once the router has been initialized.
+	routeCoverageReport bool
+
+	// warnUnmatchedParams causes a warning to be logged for every request
+	// parameter that isn't declared in its operation's request schema.
+	warnUnmatchedParams bool
+
+	// ready is set once the router has been initialized. Until then, every
+	// request is answered with a 503.
+	ready atomic.Bool
+
+	// store holds objects that have been created or modified by requests so
+	// that they can be reflected in subsequent responses.
+	//
+	// nil unless the server is running in stateful mode.
+	store *objectStore
+
+	// events holds events about objects that have been created, updated, or
+	// deleted by requests. They're kept apart from other objects so that they
+	// don't show up in the objects control endpoint.
+	//
+	// nil unless the server is running in stateful mode.
+	events *objectStore
+
+	// responseValidation is the mode in which generated responses are
+	// validated against the OpenAPI specification before being sent.
+	responseValidation string
+
+	// rateLimiter limits how many requests each API key can make. nil unless
+	// a maximum rate was configured.
+	rateLimiter *rateLimiter
+
+	// idempotency holds the responses to requests sent with an
+	// `Idempotency-Key` so that they can be replayed for retries.
+	idempotency *idempotencyCache
+
+	// requestLog records a transcript of requests and responses. nil unless
+	// a request log file was configured.
+	requestLog *requestLog
+
+	// recording records requests and responses for golden tests. nil unless
+	// a recording file was configured.
+	recording *recording
+
+	// replay holds recorded responses that are served instead of generated
+	// ones. nil unless a replay file was configured.
+	replay *replay
+
+	// rand is the source of randomness for randomized behavior like error
+	// injection. It's seeded so that behavior can be reproduced.
+	rand *lockedRand
+
+	// seeded is whether rand was given a seed, in which case generated
+	// responses are made reproducible.
+	seeded bool
+
+	// webhooks delivers webhook events and records delivery attempts.
+	webhooks *webhookDeliverer
+
+	// proxy forwards requests that aren't mocked to an upstream API. nil
+	// unless an upstream was configured.
+	proxy *upstreamProxy
+}
+
+// StubServerOptions is a collection of options that configure the behavior
+// of a StubServer. They're generally set from command line flags.
+type StubServerOptions struct {
+	// CORSOrigin is the origin from which browsers are allowed to make
+	// cross-origin requests, or `*` to allow any. CORS headers aren't sent
+	// if it's empty.
+	CORSOrigin string
+
+	// ControlToken is a token that requests to stripe-mock's control endpoints
+	// must send in the `X-Stripe-Mock-Token` header. Control endpoints are
+	// open to anyone if it's empty.
+	ControlToken string
+
+	// DeclineRulesFile is the path of a JSON file of rules by which payments
+	// are declined, like those for amounts ending in certain digits. See
+	// loadDeclineRules. Only payments made with Stripe's declining test
+	// payment methods are declined if it's empty.
+	DeclineRulesFile string
+
+	// DeferRouterInitialization causes NewStubServer to return without
+	// initializing the router, which is slow for the full Stripe spec. The
+	// caller must call InitializeRouter, which it can do in the background
+	// while requests are already being answered with a 503.
+	DeferRouterInitialization bool
+
+	// ErrorRate is the fraction of requests, between 0 and 1, that fail with
+	// an injected error. Defaults to 0, so no errors are injected.
+	ErrorRate float64
+
+	// ErrorRateStatus is the HTTP status of injected errors. Defaults to 500.
+	ErrorRateStatus int
+
+	// FixedTime is the time that timestamps in generated responses, like
+	// `created`, are relative to, which makes them reproducible. They're
+	// relative to the current time if it's zero.
+	FixedTime time.Time
+
+	// Fuzz randomizes generated responses within the constraints of their
+	// schemas, seeded by Seed.
+	Fuzz bool
+
+	// InjectedHeaders are headers to add to every response, each in the form
+	// `<name>: <value>`.
+	InjectedHeaders []string
+
+	// ObjectsEndpoint enables control endpoints that list and clear objects
+	// stored in stateful mode.
+	ObjectsEndpoint bool
+
+	// ObjectTTLs maps object types (like `checkout.session`) to how long
+	// objects of that type are kept in stateful mode before they expire, after
+	// which they can no longer be retrieved. Objects of other types never
+	// expire.
+	ObjectTTLs map[string]time.Duration
+
+	// MaxExpansionDepth is how many levels deep a property can be expanded
+	// with `expand`, beyond which requests are rejected with a 400. Defaults
+	// to DefaultMaxExpansionDepth if zero.
+	MaxExpansionDepth int
+
+	// MaxRequestsPerSecond is how many requests are allowed per second for
+	// each API key before requests are rate limited with a 429. Requests
+	// aren't rate limited if it's zero.
+	MaxRequestsPerSecond float64
+
+	// ProxyAPIKey is the key with which requests forwarded to ProxyUpstream
+	// are authorized. Requests keep their own `Authorization` header if it's
+	// empty.
+	ProxyAPIKey string
+
+	// ProxyPaths are path prefixes (like `/v1/terminal`) of requests that are
+	// always forwarded to ProxyUpstream, even if they could be mocked.
+	ProxyPaths []string
+
+	// ProxyUpstream is the base URL of an API (like `https://api.stripe.com`)
+	// to which requests that don't match any route are forwarded, with its
+	// responses relayed back. Unmatched requests get a 404 if it's empty.
+	ProxyUpstream string
+
+	// LogFormat is the format in which requests and responses are logged. One
+	// of LogFormatText (the default if empty) or LogFormatJSON.
+	LogFormat string
+
+	// RecordFile is the path of a file to which every request and its
+	// response are appended as JSON lines for golden tests. Unlike the request
+	// log, it leaves out anything that differs between identical runs, like
+	// timings. Nothing is recorded if it's empty.
+	RecordFile string
+
+	// ReplayFile is the path of a file of recorded responses, in the format
+	// of RecordFile, that are served verbatim instead of generated ones to
+	// valid requests with the same method and path (and query and body, if
+	// recorded). Requests without a recorded response get a generated one.
+	ReplayFile string
+
+	// RequestLogFile is the path of a file to which a transcript of every
+	// request and response is appended as JSON lines. Nothing is logged if
+	// it's empty.
+	RequestLogFile string
+
+	// RequestLogMaxSize is the size in bytes beyond which the request log is
+	// rotated. It's never rotated if zero.
+	RequestLogMaxSize int64
+
+	// ResponseValidation is the mode in which generated responses are
+	// validated against the OpenAPI specification before being sent. One of
+	// ResponseValidationOff (the default if empty), ResponseValidationLog,
+	// or ResponseValidationStrict.
+	ResponseValidation string
+
+	// RetryAfterFormat is the format of the `Retry-After` header sent with
+	// rate limited responses. One of RetryAfterSeconds (the default if
+	// empty) or RetryAfterHTTPDate.
+	RetryAfterFormat string
+
+	// RouteCoverageReport causes operations in the OpenAPI spec that can't be
+	// fully served, like those without a usable response, to be listed at
+	// startup.
+	RouteCoverageReport bool
+
+	// Seed seeds the source of randomness used for randomized behavior so
+	// that it can be reproduced. A seed based on the current time is used if
+	// it's zero.
+	Seed int64
+
+	// SpecEndpoint enables a control endpoint that responds with the loaded
+	// OpenAPI specification.
+	SpecEndpoint bool
+
+	// Stateful enables an in-memory object store that allows some requests to
+	// be reflected into the responses of future requests.
+	Stateful bool
+
+	// StrictVersionCheck causes requests sending a `Stripe-Version` header
+	// that doesn't match the version of the OpenAPI spec to be rejected.
+	StrictVersionCheck bool
+
+	// Verbose enables verbose logging.
+	Verbose bool
+
+	// VersionedSpecs are OpenAPI specs for API versions other than that of
+	// the main spec, keyed by version, like `2020-08-27`. Requests that send
+	// one of these versions in their `Stripe-Version` header are routed and
+	// answered with its spec, and all others with the main one. They share
+	// the main spec's fixtures.
+	VersionedSpecs map[string]*spec.Spec
+
+	// WarnUnmatchedParams causes a warning to be logged for every request
+	// parameter that isn't declared in its operation's request schema, which
+	// helps to spot typos in parameter names.
+	WarnUnmatchedParams bool
+
+	// WebhookSecret is the secret with which webhook events are signed in
+	// their `Stripe-Signature` header, like `whsec_123`. Events aren't signed
+	// if it's empty.
+	WebhookSecret string
+
+	// WebhookURL is the endpoint to which webhook events are delivered.
+	WebhookURL string
 }
 
 // NewStubServer creates a new instance of StubServer
-func NewStubServer(fixtures *spec.Fixtures, spec *spec.Spec, strictVersionCheck, verbose bool) (*StubServer, error) {
+func NewStubServer(fixtures *spec.Fixtures, spec *spec.Spec, options *StubServerOptions) (*StubServer, error) {
+	if options == nil {
+		options = &StubServerOptions{}
+	}
+
+	retryAfterFormat := options.RetryAfterFormat
+	if retryAfterFormat == "" {
+		retryAfterFormat = RetryAfterSeconds
+	}
+	err := checkRetryAfterFormat(retryAfterFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	responseValidation := options.ResponseValidation
+	if responseValidation == "" {
+		responseValidation = ResponseValidationOff
+	}
+	err = checkResponseValidation(responseValidation)
+	if err != nil {
+		return nil, err
+	}
+
+	logFormat := options.LogFormat
+	if logFormat == "" {
+		logFormat = LogFormatText
+	}
+	err = checkLogFormat(logFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	maxExpansionDepth := options.MaxExpansionDepth
+	if maxExpansionDepth == 0 {
+		maxExpansionDepth = DefaultMaxExpansionDepth
+	}
+	err = checkMaxExpansionDepth(maxExpansionDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkRateLimit(options.MaxRequestsPerSecond)
+	if err != nil {
+		return nil, err
+	}
+
+	errorRateStatus := options.ErrorRateStatus
+	if errorRateStatus == 0 {
+		errorRateStatus = http.StatusInternalServerError
+	}
+	err = checkErrorRate(options.ErrorRate, errorRateStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	injectedHeaders, err := parseInjectedHeaders(options.InjectedHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := newUpstreamProxy(options.ProxyUpstream, options.ProxyAPIKey, options.ProxyPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkWebhookSecret(options.WebhookSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	declineRules, err := loadDeclineRules(options.DeclineRulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := newVersionRouters(options.VersionedSpecs)
+	if err != nil {
+		return nil, err
+	}
+
 	s := StubServer{
+		controlToken:       options.ControlToken,
+		corsOrigin:         options.CORSOrigin,
+		declineRules:       declineRules,
+		errorRate:          options.ErrorRate,
+		errorRateStatus:    errorRateStatus,
+		fixedTime:          options.FixedTime,
 		fixtures:           fixtures,
+		fuzz:               options.Fuzz,
+		injectedHeaders:    injectedHeaders,
+		logger:             newRequestLogger(logFormat),
+		maxExpansionDepth:  maxExpansionDepth,
+		objectsEndpoint:    options.ObjectsEndpoint,
+		proxy:              proxy,
+		retryAfterFormat:   retryAfterFormat,
 		spec:               spec,
-		strictVersionCheck: strictVersionCheck,
-		verbose:            verbose,
+		specEndpoint:       options.SpecEndpoint,
+		strictVersionCheck: options.StrictVersionCheck,
+		verbose:            options.Verbose,
+		versions:           versions,
+
+		idempotency:         newIdempotencyCache(),
+		rateLimiter:         newRateLimiter(options.MaxRequestsPerSecond),
+		routeCoverageReport: options.RouteCoverageReport,
+		warnUnmatchedParams: options.WarnUnmatchedParams,
+		rand:                newLockedRand(options.Seed),
+		responseValidation:  responseValidation,
+		seeded:              options.Seed != 0,
+		webhooks:            newWebhookDeliverer(options.WebhookURL, options.WebhookSecret),
 	}
-	err := s.initializeRouter()
-	if err != nil {
-		return nil, err
+	if options.Stateful {
+		s.events = newObjectStore(nil)
+		s.store = newObjectStore(options.ObjectTTLs)
+		s.store.now = s.generationTime
+	}
+	if options.RequestLogFile != "" {
+		s.requestLog, err = newRequestLog(options.RequestLogFile, options.RequestLogMaxSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.RecordFile != "" {
+		s.recording, err = newRecording(options.RecordFile)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if options.ReplayFile != "" {
+		s.replay, err = loadReplay(options.ReplayFile)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if !options.DeferRouterInitialization {
+		err = s.InitializeRouter()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
 	}
 	return &s, nil
 }
 
+// Close closes the files that the server writes to, like its request log and
+// recording. It should only be called once the server has stopped handling
+// requests.
+func (s *StubServer) Close() error {
+	var firstErr error
+	if s.requestLog != nil {
+		firstErr = s.requestLog.close()
+	}
+	if s.recording != nil {
+		if err := s.recording.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // HandleRequest handes an HTTP request directed at the API stub.
 func (s *StubServer) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	fmt.Printf("Request: %v %v\n", r.Method, r.URL.Path)
+	logger := s.logger
+	if logger == nil {
+		logger = defaultRequestLogger
+	}
+	r = logger.startRequest(r)
+
+	if s.requestLog != nil || s.recording != nil {
+		var finishRequestLogEntry func()
+		w, finishRequestLogEntry = s.startRequestLogEntry(w, r, start)
+		defer finishRequestLogEntry()
+	}
+
+	s.setCORSHeaders(w)
+	s.setInjectedHeaders(w)
+
+	if s.corsOrigin != "" && isCORSPreflight(r) {
+		s.writeCORSPreflight(w, r, start)
+		return
+	}
+
+	// Health checks come before everything that could reject them, like
+	// authorization and rate limiting.
+	if isHealthRequest(r) {
+		s.handleHealthRequest(w, r, start)
+		return
+	}
+
+	// Requests that arrive before the router has been initialized can't be
+	// routed, so they're told to try again instead of failing confusingly.
+	if !s.ready.Load() {
+		w.Header().Set("Retry-After", "1")
+		writeResponse(w, r, start, http.StatusServiceUnavailable,
+			createStripeError(typeAPIError, notReady))
+		return
+	}
+
+	if isControlRequest(r) {
+		s.handleControlRequest(w, r, start)
+		return
+	}
+
+	// Injected errors come before anything else so that they can happen for
+	// any request, just like a real outage.
+	if s.shouldInjectError() {
+		s.writeInjectedError(w, r, start)
+		return
+	}
 
 	//
 	// Validate headers
@@ -237,18 +725,39 @@ func (s *StubServer) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	auth := r.Header.Get("Authorization")
 	if !validateAuth(auth) {
 		message := fmt.Sprintf(invalidAuthorization, auth)
+		if isLiveKey(auth) {
+			message = invalidLiveKey
+		}
 		stripeError := createStripeError(typeInvalidRequestError, message)
 		writeResponse(w, r, start, http.StatusUnauthorized, stripeError)
 		return
 	}
 
+	if s.rateLimiter != nil {
+		apiKey, _ := parseAuthKey(auth)
+		if ok, backoff := s.rateLimiter.take(apiKey); !ok {
+			s.writeRateLimited(w, r, start, backoff)
+			return
+		}
+	}
+
+	// Any version is accepted, but it has to look like one.
+	stripeVersion := r.Header.Get("Stripe-Version")
+	if stripeVersion != "" && !stripeVersionPattern.MatchString(stripeVersion) {
+		message := fmt.Sprintf(invalidStripeVersionFormat, stripeVersion)
+		stripeError := createStripeError(typeInvalidRequestError, message)
+		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+		return
+	}
+
 	// If the option `-strict-version-check` is on, any request that sends an
 	// explicit `Stripe-Version` header must have a version that matches that
-	// the one in the OpenAPI spec. This allows the user to optionally
-	// strengthen expectations to protect against an unintended version drift.
+	// the one in the OpenAPI spec (or one of the specs loaded for other
+	// versions). This allows the user to optionally strengthen expectations
+	// to protect against an unintended version drift.
 	if s.strictVersionCheck {
-		stripeVersion := r.Header.Get("Stripe-Version")
-		if stripeVersion != "" && stripeVersion != s.spec.Info.Version {
+		_, versioned := s.versions[stripeVersion]
+		if stripeVersion != "" && stripeVersion != s.spec.Info.Version && !versioned {
 			message := fmt.Sprintf(invalidStripeVersion, stripeVersion, s.spec.Info.Version)
 			stripeError := createStripeError(typeInvalidRequestError, message)
 			writeResponse(w, r, start, http.StatusBadRequest, stripeError)
@@ -256,19 +765,63 @@ func (s *StubServer) HandleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Connect platforms can make requests on behalf of connected accounts,
+	// which have to be named by ID.
+	stripeAccount := r.Header.Get(stripeAccountHeader)
+	if stripeAccount != "" && !stripeAccountPattern.MatchString(stripeAccount) {
+		message := fmt.Sprintf(invalidStripeAccount, stripeAccount)
+		stripeError := createStripeError(typeInvalidRequestError, message)
+		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+		return
+	}
+
+	// Explicitly proxied paths are forwarded as is, without being validated
+	// or even routed.
+	if s.proxy != nil && s.proxy.forwardsPath(r.URL.Path) {
+		s.proxy.serve(w, r, start)
+		return
+	}
+
 	//
 	// Set headers
 	//
 
-	// We don't do anything with the idempotency key for now, but reflect it
-	// back into response headers like the Stripe API does.
+	// Reflect the idempotency key back into response headers like the Stripe
+	// API does.
 	idempotencyKey := r.Header.Get("Idempotency-Key")
 	if idempotencyKey != "" {
 		w.Header().Set("Idempotency-Key", idempotencyKey)
 	}
 
 	// Every response needs a Request-Id header except the invalid authorization
-	w.Header().Set("Request-Id", "req_123")
+	w.Header().Set("Request-Id", s.newRequestID(r))
+
+	// Like the Stripe API, respond with the version that the request was made
+	// with, which defaults to the version of the OpenAPI spec.
+	if stripeVersion == "" && s.spec.Info != nil {
+		stripeVersion = s.spec.Info.Version
+	}
+	if stripeVersion != "" {
+		w.Header().Set("Stripe-Version", stripeVersion)
+		r = r.WithContext(context.WithValue(r.Context(), stripeVersionKey, stripeVersion))
+	}
+
+	// Errors that were asked for skip everything else so that clients can
+	// exercise their error handling deterministically.
+	if s.writeRequestedError(w, r, start) {
+		return
+	}
+
+	// Retried requests get the response that the request got the first time
+	// instead of a newly generated one.
+	cacheKey, idempotent := getIdempotencyCacheKey(r)
+	if idempotent {
+		if response, ok := s.idempotency.get(cacheKey); ok {
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeResponse(w, r, start, response.status, response.data)
+			return
+		}
+	}
 
 	//
 	// Route request
@@ -277,51 +830,87 @@ func (s *StubServer) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	route, pathParams, err := s.routeRequest(r)
 	if err != nil {
 		message := fmt.Sprintf("Couldn't parse path parameters: %v", err)
-		fmt.Printf(message + "\n")
+		logMessage(r, "%s", message)
 		stripeError := createStripeError(typeInvalidRequestError, message)
 		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
 		return
 	}
 
+	if route != nil {
+		setLoggedOperationID(r, route.operation.OperationID)
+	}
+
 	if route == nil {
+		if s.proxy != nil {
+			s.proxy.serve(w, r, start)
+			return
+		}
+
+		// Point out when the path is right but the method is wrong, which is
+		// an easier mistake to fix than a typo in the path.
+		if allowed := s.allowedMethods(r); len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			message := fmt.Sprintf(invalidMethod, r.Method, r.URL.Path, strings.Join(allowed, ", "))
+			stripeError := createStripeError(typeInvalidRequestError, message)
+			writeResponse(w, r, start, http.StatusMethodNotAllowed, stripeError)
+			return
+		}
+
 		message := fmt.Sprintf(invalidRoute, r.Method, r.URL.Path)
 		stripeError := createStripeError(typeInvalidRequestError, message)
 		writeResponse(w, r, start, http.StatusNotFound, stripeError)
 		return
 	}
 
-	response, ok := route.operation.Responses["200"]
-	if !ok {
-		fmt.Printf("Couldn't find 200 response in spec\n")
-		writeResponse(w, r, start, http.StatusInternalServerError,
-			createInternalServerError())
-		return
+	// Requests can select one of the operation's other documented successful
+	// responses, which is useful for testing how clients handle them.
+	responseStatus := getSuccessStatus(route.operation)
+	overriddenStatus := r.Header.Get(responseStatusHeader)
+	if overriddenStatus != "" {
+		_, ok := route.operation.Responses[spec.StatusCode(overriddenStatus)]
+		if !ok || !isSuccessStatus(spec.StatusCode(overriddenStatus)) {
+			message := fmt.Sprintf(invalidResponseStatus, responseStatusHeader,
+				overriddenStatus, r.Method, route.path)
+			stripeError := createStripeError(typeInvalidRequestError, message)
+			writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+			return
+		}
+		responseStatus = spec.StatusCode(overriddenStatus)
 	}
 
-	var responseContent spec.MediaType
-
-	if jsonResponseContent, ok := response.Content["application/json"]; ok && jsonResponseContent.Schema != nil {
-		w.Header().Set("Content-Type", "application/json")
-		responseContent = jsonResponseContent
-	} else if pdfResponseContent, ok := response.Content["application/pdf"]; ok && pdfResponseContent.Schema != nil {
-		w.Header().Set("Content-Type", "application/pdf")
-		responseContent = pdfResponseContent
-	} else {
-		fmt.Printf("Couldn't find application/json or application/pdf in response\n")
+	responseMediaType, responseContent, err := getResponseContent(route.operation, responseStatus)
+	if err != nil {
+		logMessage(r, "%v", err)
 		writeResponse(w, r, start, http.StatusInternalServerError,
 			createInternalServerError())
 		return
 	}
+	if responseMediaType != "" {
+		w.Header().Set("Content-Type", responseMediaType)
+	}
 
 	if s.verbose {
-		fmt.Printf("IDs extracted from route: %+v\n", pathParams)
-		fmt.Printf("Response schema: %s\n", responseContent.Schema)
+		logMessage(r, "IDs extracted from route: %+v", pathParams)
+		logMessage(r, "Response schema: %s", responseContent.Schema)
+	}
+
+	// Replayed responses are matched by request body, which parsing consumes.
+	var requestBody []byte
+	if s.replay != nil {
+		requestBody, err = bufferRequestBody(r)
+		if err != nil {
+			message := fmt.Sprintf("Couldn't read body: %v", err)
+			logMessage(r, "%s", message)
+			stripeError := createStripeError(typeInvalidRequestError, message)
+			writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+			return
+		}
 	}
 
 	requestData, err := param.ParseParams(r)
 	if err != nil {
 		message := fmt.Sprintf("Couldn't parse query/body: %v", err)
-		fmt.Printf(message + "\n")
+		logMessage(r, "%s", message)
 		stripeError := createStripeError(typeInvalidRequestError, message)
 		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
 		return
@@ -329,9 +918,9 @@ func (s *StubServer) HandleRequest(w http.ResponseWriter, r *http.Request) {
 
 	if s.verbose {
 		if requestData != nil {
-			fmt.Printf("Request data: %+v\n", requestData)
+			logMessage(r, "Request data: %+v", requestData)
 		} else {
-			fmt.Printf("Request data: (none)\n")
+			logMessage(r, "Request data: (none)")
 		}
 	}
 
@@ -344,14 +933,109 @@ func (s *StubServer) HandleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	stripeError = validatePathParams(r, route, pathParams)
+	if stripeError != nil {
+		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+		return
+	}
+
+	stripeError = checkMetadata(requestData)
+	if stripeError != nil {
+		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+		return
+	}
+
+	if isEphemeralKeyCreate(r, route) {
+		stripeError := checkEphemeralKeyRequest(r, requestData)
+		if stripeError != nil {
+			writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+			return
+		}
+	}
+
+	if s.writeDecline(w, r, start, route, requestData) {
+		return
+	}
+
+	// Parameters that aren't declared will normally have been rejected by
+	// validation already, but some schemas are permissive enough to let
+	// them through. Optionally point those out because they're probably
+	// typos.
+	if s.warnUnmatchedParams && route.requestSchema != nil {
+		for _, name := range findUndeclaredParams(route.requestSchema, requestData, "") {
+			logMessage(r, "Warning: parameter '%s' isn't declared for %v %v",
+				name, r.Method, route.path)
+		}
+	}
+
+	// Valid requests with a recorded response get it instead of a generated
+	// one.
+	if s.replay != nil && s.writeReplayedResponse(w, r, start, requestBody) {
+		return
+	}
+
+	// The status has already been checked to be a number
+	status, _ := strconv.Atoi(string(responseStatus))
+
+	// Responses without content are only sent once their request has been
+	// validated, but there's nothing to generate for them.
+	if responseContent.Schema == nil {
+		writeEmptyResponse(w, r, start, status)
+		return
+	}
+
 	expansions, rawExpansions := extractExpansions(requestData)
 	if s.verbose {
-		fmt.Printf("Expansions: %+v\n", rawExpansions)
+		logMessage(r, "Expansions: %+v", rawExpansions)
+	}
+
+	if tooDeep := findTooDeepExpansion(rawExpansions, s.maxExpansionDepth); tooDeep != "" {
+		message := fmt.Sprintf(expansionTooDeep, s.maxExpansionDepth, tooDeep)
+		writeResponse(w, r, start, http.StatusBadRequest,
+			createStripeError(typeInvalidRequestError, message))
+		return
+	}
+
+	stripeSpec := s.versionRouter(stripeVersion).spec
+	// The generator's debugging output isn't tied to a request, so it's left
+	// out in LogFormatJSON to keep every line a JSON object.
+	generator := DataGenerator{stripeSpec.Components.Schemas, s.fixtures,
+		s.verbose && logger.format == LogFormatText}
+
+	invalidExpansionPath, err := generator.findInvalidExpansion(responseContent.Schema, rawExpansions)
+	if err != nil {
+		logMessage(r, "Couldn't check expansions: %v", err)
+		writeResponse(w, r, start, http.StatusInternalServerError,
+			createInternalServerError())
+		return
+	}
+	if invalidExpansionPath != "" {
+		message := fmt.Sprintf(invalidExpansion, invalidExpansionPath)
+		writeResponse(w, r, start, http.StatusBadRequest,
+			createStripeError(typeInvalidRequestError, message))
+		return
+	}
+
+	seed, seeded, err := s.requestSeed(r)
+	if err != nil {
+		writeResponse(w, r, start, http.StatusBadRequest,
+			createStripeError(typeInvalidRequestError, err.Error()))
+		return
+	}
+
+	var fuzz, ids *rand.Rand
+	if s.fuzz {
+		fuzz = rand.New(rand.NewSource(seed))
+	}
+	if seeded {
+		ids = rand.New(rand.NewSource(seed))
 	}
 
-	generator := DataGenerator{s.spec.Components.Schemas, s.fixtures, s.verbose}
 	responseData, err := generator.Generate(&GenerateParams{
 		Expansions:    expansions,
+		Fuzz:          fuzz,
+		IDs:           ids,
+		Now:           s.generationTime().Unix(),
 		PathParams:    pathParams,
 		RequestData:   requestData,
 		RequestMethod: r.Method,
@@ -359,31 +1043,114 @@ func (s *StubServer) HandleRequest(w http.ResponseWriter, r *http.Request) {
 		Schema:        responseContent.Schema,
 	})
 	if err != nil {
-		fmt.Printf("Couldn't generate response: %v\n", err)
+		logMessage(r, "Couldn't generate response: %v", err)
 		writeResponse(w, r, start, http.StatusInternalServerError,
 			createInternalServerError())
 		return
 	}
+
+	if isEphemeralKeyCreate(r, route) {
+		if data, ok := responseData.(map[string]interface{}); ok {
+			applyEphemeralKey(s.generationTime().Unix(), requestData, data)
+		}
+	}
+
+	if stripeAccount != "" {
+		applyStripeAccount(stripeAccount, responseData)
+	}
+
+	// In stateful mode, some routes have special handling that reads from and
+	// writes to the object store so that their responses reflect previous
+	// requests.
+	if s.store != nil {
+		var requestErr *requestError
+		responseData, requestErr = s.handleStatefulRequest(route, &statefulRequest{
+			method:      r.Method,
+			pathParams:  pathParams,
+			requestData: requestData,
+			ids:         ids,
+		}, responseData)
+		if requestErr != nil {
+			writeResponse(w, r, start, requestErr.status, requestErr.stripeError)
+			return
+		}
+	}
+
+	// Optionally check that what we're about to send is valid according to
+	// the spec, which helps to catch bugs in the generator and fixtures.
+	// Validators are only built for the default response.
+	if route.responseValidator != nil && overriddenStatus == "" {
+		err := validateResponse(route.responseValidator, responseData)
+		if err != nil {
+			logMessage(r, "Response validation error for %v %v: %v", r.Method, route.path, err)
+
+			if s.responseValidation == ResponseValidationStrict {
+				writeResponse(w, r, start, http.StatusInternalServerError,
+					createInternalServerError())
+				return
+			}
+		}
+	}
+
 	if s.verbose {
 		responseDataJSON, err := json.MarshalIndent(responseData, "", "  ")
 		if err != nil {
 			panic(err)
 		}
-		fmt.Printf("Response data: %s\n", responseDataJSON)
+		logMessage(r, "Response data: %s", responseDataJSON)
+	}
+
+	if idempotent {
+		s.idempotency.put(cacheKey, status, responseData)
+	}
+
+	writeResponse(w, r, start, status, responseData)
+}
+
+// InitializeRouter builds the routes and validators for every operation in
+// the spec (and those loaded for other API versions), after which the server
+// is ready to serve requests. Until then, HandleRequest responds to all of
+// them with a 503.
+//
+// NewStubServer calls it unless DeferRouterInitialization is set, in which
+// case it should be called once the server's handler has been mounted, so
+// that requests that arrive while it runs get a 503 rather than a refused
+// connection.
+func (s *StubServer) InitializeRouter() error {
+	routes, err := s.buildRoutes(s.spec)
+	if err != nil {
+		return err
 	}
-	writeResponse(w, r, start, http.StatusOK, responseData)
+	s.routes = routes
+
+	err = s.initializeVersionRouters()
+	if err != nil {
+		return err
+	}
+
+	if s.routeCoverageReport {
+		s.printRouteCoverageReport()
+	}
+
+	s.ready.Store(true)
+	return nil
 }
 
-func (s *StubServer) initializeRouter() error {
+// buildRoutes builds the routes for the operations in an OpenAPI spec, keyed
+// by method.
+func (s *StubServer) buildRoutes(stripeSpec *spec.Spec) (map[spec.HTTPVerb][]stubServerRoute, error) {
 	var numEndpoints int
 	var numPaths int
-	var numValidators int
 
-	s.routes = make(map[spec.HTTPVerb][]stubServerRoute)
+	routes := make(map[spec.HTTPVerb][]stubServerRoute)
+
+	componentsForValidation := spec.GetComponentsForValidation(&stripeSpec.Components)
 
-	componentsForValidation := spec.GetComponentsForValidation(&s.spec.Components)
+	// Many operations share schemas, like GETs that only take `expand`, so
+	// validators are only built once for each distinct schema.
+	validators := spec.NewValidatorCache()
 
-	for path, verbs := range s.spec.Paths {
+	for path, verbs := range stripeSpec.Paths {
 		numPaths++
 
 		pathPattern, pathParamNames := compilePath(path)
@@ -398,6 +1165,8 @@ func (s *StubServer) initializeRouter() error {
 			var requestMediaType *string
 			var requestSchema *spec.Schema
 			var requestValidator *jsval.JSVal
+			var jsonRequestSchema *spec.Schema
+			var jsonRequestValidator *jsval.JSVal
 
 			// For `GET` requests we build a validator based off a
 			// pseudo-schema constructed from the endpoint's query parameters.
@@ -411,28 +1180,65 @@ func (s *StubServer) initializeRouter() error {
 				requestSchema = spec.BuildQuerySchema(operation)
 
 				var err error
-				requestValidator, err = spec.GetValidatorForOpenAPI3Schema(
+				requestValidator, err = validators.GetValidator(
 					requestSchema, nil)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			} else {
 				requestMediaType, requestSchema = getRequestBodySchema(operation)
+				requestSchema = withLegacyRequestParams(verb, path, requestSchema)
 
 				if requestSchema != nil {
 					var err error
-					requestValidator, err = spec.GetValidatorForOpenAPI3Schema(
+					requestValidator, err = validators.GetValidator(
 						requestSchema, componentsForValidation)
 					if err != nil {
-						return err
+						return nil, err
+					}
+				}
+
+				// JSON bodies are validated against the operation's JSON
+				// schema if it has one besides its main one, and like any
+				// other body otherwise.
+				if requestMediaType != nil && *requestMediaType != param.JSONMediaType {
+					if mediaType, ok := operation.RequestBody.Content[param.JSONMediaType]; ok {
+						jsonRequestSchema = withLegacyRequestParams(verb, path, mediaType.Schema)
+
+						var err error
+						jsonRequestValidator, err = validators.GetValidator(
+							jsonRequestSchema, componentsForValidation)
+						if err != nil {
+							return nil, err
+						}
 					}
 				}
 			}
 
-			// Note that this may be nil if no suitable validator could be
-			// generated.
-			if requestValidator != nil {
-				numValidators++
+			var pathSchema *spec.Schema
+			var pathValidator *jsval.JSVal
+			if len(pathParamNames) > 0 {
+				pathSchema = spec.BuildPathSchema(operation)
+
+				var err error
+				pathValidator, err = validators.GetValidator(
+					pathSchema, nil)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// Response validators are only built if needed because there's
+			// one for every endpoint and they take a while to build.
+			var responseValidator *jsval.JSVal
+			if s.responseValidation == ResponseValidationLog ||
+				s.responseValidation == ResponseValidationStrict {
+
+				var err error
+				responseValidator, err = getResponseValidator(operation, validators, componentsForValidation)
+				if err != nil {
+					return nil, err
+				}
 			}
 
 			// We use whether the route ends with a parameter as a heuristic as
@@ -453,23 +1259,30 @@ func (s *StubServer) initializeRouter() error {
 
 			route := stubServerRoute{
 				hasPrimaryID:     hasPrimaryID,
+				path:             path,
 				pattern:          pathPattern,
 				operation:        operation,
 				pathParamNames:   pathParamNames,
 				requestMediaType: requestMediaType,
 				requestSchema:    requestSchema,
 				requestValidator: requestValidator,
+
+				jsonRequestSchema:    jsonRequestSchema,
+				jsonRequestValidator: jsonRequestValidator,
+				pathSchema:           pathSchema,
+				pathValidator:        pathValidator,
+				responseValidator:    responseValidator,
 			}
 
 			// net/http will always give us verbs in uppercase, so build our
 			// routing table this way too
 			verb = spec.HTTPVerb(strings.ToUpper(string(verb)))
 
-			s.routes[verb] = append(s.routes[verb], route)
+			routes[verb] = append(routes[verb], route)
 		}
 	}
 
-	for _, verbRoutes := range s.routes {
+	for _, verbRoutes := range routes {
 		// After sorting all routes, order them by their number of path
 		// parameters so that paths with static portions will tend to be
 		// preferred over those with dynamic parts.
@@ -482,9 +1295,10 @@ func (s *StubServer) initializeRouter() error {
 		})
 	}
 
-	fmt.Printf("Routing to %v path(s) and %v endpoint(s) with %v validator(s)\n",
-		numPaths, numEndpoints, numValidators)
-	return nil
+	fmt.Printf("Routing to %v path(s) and %v endpoint(s) with %v validator(s) compiled (%v lookup(s) reused from cache)\n",
+		numPaths, numEndpoints, validators.Len(), validators.Hits)
+
+	return routes, nil
 }
 
 // routeRequest tries to find a matching route for the given request. If
@@ -494,7 +1308,7 @@ func (s *StubServer) initializeRouter() error {
 // object (i.e., the route's pattern ended with a parameter). A nil is returned
 // as the second return value when no primary ID is available.
 func (s *StubServer) routeRequest(r *http.Request) (*stubServerRoute, *PathParamsMap, error) {
-	verbRoutes := s.routes[spec.HTTPVerb(r.Method)]
+	verbRoutes := s.versionRouter(requestStripeVersion(r)).routes[spec.HTTPVerb(r.Method)]
 	for _, route := range verbRoutes {
 		matches := route.pattern.FindAllStringSubmatch(r.URL.Path, -1)
 
@@ -572,6 +1386,24 @@ func (s *StubServer) routeRequest(r *http.Request) (*stubServerRoute, *PathParam
 	return nil, nil, nil
 }
 
+// allowedMethods finds the methods with which a request's path can be
+// requested with its API version, in alphabetical order. It's empty if no
+// route matches the path at all.
+func (s *StubServer) allowedMethods(r *http.Request) []string {
+	path := r.URL.Path
+	var methods []string
+	for verb, verbRoutes := range s.versionRouter(requestStripeVersion(r)).routes {
+		for _, route := range verbRoutes {
+			if route.pattern.MatchString(path) {
+				methods = append(methods, string(verb))
+				break
+			}
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
 //
 // Private values
 //
@@ -585,6 +1417,16 @@ const (
 		"key. For example, `Authorization: Bearer sk_test_123`. " +
 		"Authorization was '%s'."
 
+	invalidLiveKey = "stripe-mock only accepts test mode keys, but got a live " +
+		"mode key. Check that you meant to point your integration at " +
+		"stripe-mock."
+
+	invalidResponseStatus = "The `%s` header asked for a %s response, but " +
+		"that isn't a documented successful response of %s %s."
+
+	invalidMethod = "Unsupported method for request URL (%s: %s). " +
+		"It can be requested with: %s."
+
 	invalidRoute = "Unrecognized request URL (%s: %s)."
 
 	invalidStripeVersion = "Version sent in `Stripe-Version` header '%s' " +
@@ -592,8 +1434,13 @@ const (
 		"unintended consequences. This error was shown because stripe-mock  " +
 		"was started with `-stripe-version-check`."
 
+	invalidStripeVersionFormat = "Invalid `Stripe-Version` header '%s': " +
+		"versions look like `2020-08-27`."
+
 	internalServerError = "An internal error occurred."
 
+	notReady = "stripe-mock is still initializing. Try again shortly."
+
 	typeInvalidRequestError = "invalid_request_error"
 )
 
@@ -627,23 +1474,92 @@ var hasPrimaryIDSuffixes = [...]string{
 	"/void",
 }
 
+// legacyRequestParams are parameters that have been removed from the OpenAPI
+// spec, but that older integrations still send and that stripe-mock still
+// honors. They're added to the request schemas of their operations so that
+// they pass validation.
+var legacyRequestParams = map[spec.HTTPVerb]map[spec.Path]map[string]*spec.Schema{
+	"delete": {
+		"/v1/subscriptions/{subscription_exposed_id}": {
+			"at_period_end": {Type: spec.TypeBoolean},
+		},
+	},
+}
+
+// jsonContentType is the Content-Type of JSON responses.
+const jsonContentType = "application/json; charset=utf-8"
+
+// textContentType is the Content-Type of responses that fall back to the text
+// of their status because they have no body.
+const textContentType = "text/plain; charset=utf-8"
+
+// responseStatusHeader is a header with which a request can select which of
+// an operation's documented successful responses it gets, for testing how
+// clients handle statuses other than 200.
+const responseStatusHeader = "Stripe-Mock-Response-Status"
+
 var pathParameterPattern = regexp.MustCompile(`\{(\w+)\}`)
 
+// stripeVersionPattern matches what API versions look like, which is a date
+// that's sometimes followed by the name of a release, like `2020-08-27` or
+// `2024-09-30.acacia`.
+var stripeVersionPattern = regexp.MustCompile(`\A\d{4}-\d{2}-\d{2}(\.[a-z_]+)?\z`)
+
+// errorCodeDocURL is the URL of the documentation of an error code, like
+// `https://stripe.com/docs/error-codes/resource-missing`.
+const errorCodeDocURL = "https://stripe.com/docs/error-codes/%s"
+
+// stripeVersionKey is the request context key of the API version that a
+// request is being handled with. See requestStripeVersion.
+const stripeVersionKey contextKey = "stripeVersion"
+
 //
 // Private types
 //
 
+// contextKey is the type of keys for values that stripe-mock stores on request
+// contexts, so that they don't collide with other packages' keys.
+type contextKey string
+
+// requestError is an error encountered while handling a request that should be
+// reported back to the client as a Stripe error with the given HTTP status.
+type requestError struct {
+	status      int
+	stripeError *ResponseError
+}
+
+// stripeErrorOption sets one of the optional fields of an error created by
+// createStripeError, like its `code` or `param`.
+type stripeErrorOption func(stripeError *ResponseError)
+
 // stubServerRoute is a single route in a StubServer's routing table. It has a
 // pattern to match an incoming path and a description of the method that would
 // be executed in the event of a match.
 type stubServerRoute struct {
 	hasPrimaryID     bool
 	operation        *spec.Operation
+	path             spec.Path
 	pathParamNames   []string
 	pattern          *regexp.Regexp
 	requestMediaType *string
 	requestSchema    *spec.Schema
 	requestValidator *jsval.JSVal
+
+	// jsonRequestSchema and jsonRequestValidator describe and validate JSON
+	// request bodies for operations that have a JSON schema besides their
+	// main one. nil if they don't, in which case JSON bodies are validated
+	// against requestSchema like form bodies.
+	jsonRequestSchema    *spec.Schema
+	jsonRequestValidator *jsval.JSVal
+
+	// pathSchema and pathValidator describe and validate the parameters
+	// extracted from the request path. nil if the path has no parameters.
+	pathSchema    *spec.Schema
+	pathValidator *jsval.JSVal
+
+	// responseValidator validates generated responses. nil unless response
+	// validation is enabled.
+	responseValidator *jsval.JSVal
 }
 
 //
@@ -656,6 +1572,10 @@ type stubServerRoute struct {
 // The first return value is a regular expression. The second is a slice of
 // names for the parameters included in the path in order of their appearance.
 // This slice is `nil` if the path had no parameters.
+//
+// Paths match with or without a single trailing slash, so `/v1/charges/` is
+// routed like `/v1/charges`. Parameters can't be empty or contain slashes, so
+// paths with empty segments like `/v1/charges//ch_123` still don't match.
 func compilePath(path spec.Path) (*regexp.Regexp, []string) {
 	var pathParamNames []string
 	parts := strings.Split(string(path), "/")
@@ -670,15 +1590,20 @@ func compilePath(path spec.Path) (*regexp.Regexp, []string) {
 		if submatches == nil {
 			pattern += `/` + part
 		} else {
-			// Special characters as defined by:
+			// Letters, digits, and the other characters allowed in a path
+			// segment as defined by:
 			//
 			// https://tools.ietf.org/html/rfc3986#section-3.3
-			pattern += `/(?P<` + submatches[0][1] + `>[\w@:%-._~!$&'()*+,;=]+)`
+			//
+			// They're listed explicitly (with `-` last so that it's not
+			// taken as a range) so that IDs like `cus_ABC.123` or
+			// `acct_1:2` are matched in full.
+			pattern += `/(?P<` + submatches[0][1] + `>[A-Za-z0-9_.~!$&'()*+,;=:@%-]+)`
 			pathParamNames = append(pathParamNames, submatches[0][1])
 		}
 	}
 
-	return regexp.MustCompile(pattern + `\z`), pathParamNames
+	return regexp.MustCompile(pattern + `/?\z`), pathParamNames
 }
 
 // Helper to create an internal server error for API issues.
@@ -686,16 +1611,32 @@ func createInternalServerError() *ResponseError {
 	return createStripeError(typeInvalidRequestError, internalServerError)
 }
 
-// This creates a Stripe error to return in case of API errors.
-func createStripeError(errorType string, errorMessage string) *ResponseError {
-	return &ResponseError{
-		ErrorInfo: struct {
-			Message string `json:"message"`
-			Type    string `json:"type"`
-		}{
-			Message: errorMessage,
-			Type:    errorType,
-		},
+// This creates a Stripe error to return in case of API errors. Options like
+// withCode and withParam fill in the error's optional fields.
+func createStripeError(errorType string, errorMessage string, options ...stripeErrorOption) *ResponseError {
+	stripeError := &ResponseError{}
+	stripeError.ErrorInfo.Message = errorMessage
+	stripeError.ErrorInfo.Type = errorType
+	for _, option := range options {
+		option(stripeError)
+	}
+	return stripeError
+}
+
+// withCode sets the `code` of an error created by createStripeError, like
+// `resource_missing`, along with its `doc_url`.
+func withCode(code string) stripeErrorOption {
+	return func(stripeError *ResponseError) {
+		stripeError.ErrorInfo.Code = code
+		stripeError.ErrorInfo.DocURL = fmt.Sprintf(errorCodeDocURL, strings.ReplaceAll(code, "_", "-"))
+	}
+}
+
+// withParam sets the `param` of an error created by createStripeError, which
+// is the name of the request parameter that the error is about.
+func withParam(param string) stripeErrorOption {
+	return func(stripeError *ResponseError) {
+		stripeError.ErrorInfo.Param = param
 	}
 }
 
@@ -725,10 +1666,74 @@ func extractExpansions(data map[string]interface{}) (*ExpansionLevel, []string)
 	return nil, nil
 }
 
+// findUndeclaredParams finds parameters in request data that aren't declared
+// anywhere in the given request schema and returns their names in the
+// form-encoded style that Stripe uses in error messages (e.g.
+// `shipping[adress]`), sorted for stable output.
+//
+// A parameter counts as declared if it's in a schema's properties, if the
+// schema describes its additional properties (like `metadata`), or if the
+// schema is a generic object that doesn't name any properties at all.
+func findUndeclaredParams(schema *spec.Schema, data map[string]interface{}, prefix string) []string {
+	var names []string
+
+	for key, value := range data {
+		name := key
+		if prefix != "" {
+			name = prefix + "[" + key + "]"
+		}
+
+		subSchema, declared := findDeclaringSchema(schema, key)
+		if !declared {
+			names = append(names, name)
+			continue
+		}
+
+		valueMap, ok := value.(map[string]interface{})
+		if ok && subSchema != nil {
+			names = append(names, findUndeclaredParams(subSchema, valueMap, name)...)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// findDeclaringSchema looks for a declaration of the given parameter key in a
+// schema, descending into the branches of `anyOf` if necessary. The first
+// return value is the subschema describing the parameter's value, which is nil
+// if the value isn't described in enough detail to check any further.
+func findDeclaringSchema(schema *spec.Schema, key string) (*spec.Schema, bool) {
+	if subSchema, ok := schema.Properties[key]; ok {
+		return subSchema, true
+	}
+
+	if schema.AdditionalProperties != nil {
+		return schema.AdditionalProperties, true
+	}
+
+	if len(schema.AnyOf) > 0 {
+		for _, anyOfSchema := range schema.AnyOf {
+			if subSchema, ok := findDeclaringSchema(anyOfSchema, key); ok {
+				return subSchema, true
+			}
+		}
+		return nil, false
+	}
+
+	// A generic object that allows anything.
+	if schema.Type == spec.TypeObject && schema.AdditionalPropertiesAllowed &&
+		len(schema.Properties) == 0 {
+		return nil, true
+	}
+
+	return nil, false
+}
+
 // getRequestBodySchema gets the media type and expected request schema for the
 // given operation. We don't expect any endpoint in the Stripe API to have
-// multiple supported media types, so the operation's first media type and
-// request schema is always the one that's returned.
+// multiple supported media types besides JSON, which is always accepted
+// anyway, so another media type is returned if the operation has one.
 //
 // The first value is a media type like "application/x-www-form-urlencoded", or
 // nil if the operation has no request schemas.
@@ -737,17 +1742,74 @@ func getRequestBodySchema(operation *spec.Operation) (*string, *spec.Schema) {
 		return nil, nil
 	}
 
-	for mediaType, spec := range operation.RequestBody.Content {
-		return &mediaType, spec.Schema
+	mediaTypes := make([]string, 0, len(operation.RequestBody.Content))
+	for mediaType := range operation.RequestBody.Content {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	if len(mediaTypes) == 0 {
+		return nil, nil
 	}
 
-	return nil, nil
+	// Sort so that the same media type is picked every time, with JSON last.
+	sort.Slice(mediaTypes, func(i, j int) bool {
+		if (mediaTypes[i] == param.JSONMediaType) != (mediaTypes[j] == param.JSONMediaType) {
+			return mediaTypes[j] == param.JSONMediaType
+		}
+		return mediaTypes[i] < mediaTypes[j]
+	})
+
+	mediaType := mediaTypes[0]
+	return &mediaType, operation.RequestBody.Content[mediaType].Schema
+}
+
+// getResponseContent finds the content of an operation's response with the
+// given status that stripe-mock can generate, along with its media type. An
+// error describing what's missing is returned if there isn't any.
+func getResponseContent(operation *spec.Operation, status spec.StatusCode) (string, spec.MediaType, error) {
+	response, ok := operation.Responses[status]
+	if !ok || status == "" {
+		return "", spec.MediaType{}, fmt.Errorf("Couldn't find 2xx response in spec")
+	}
+
+	// A `204 No Content` response doesn't have a body to generate
+	if status == "204" {
+		return "", spec.MediaType{}, nil
+	}
+
+	for _, mediaType := range []string{"application/json", "application/pdf"} {
+		if content, ok := response.Content[mediaType]; ok && content.Schema != nil {
+			return mediaType, content, nil
+		}
+	}
+
+	return "", spec.MediaType{}, fmt.Errorf(
+		"Couldn't find application/json or application/pdf in response")
+}
+
+// getSuccessStatus finds the status of the successful response that
+// stripe-mock responds with for an operation, which is its lowest documented
+// 2xx status (so 200 if it's documented). It's empty if there isn't one.
+func getSuccessStatus(operation *spec.Operation) spec.StatusCode {
+	var lowest spec.StatusCode
+	for status := range operation.Responses {
+		if isSuccessStatus(status) && (lowest == "" || status < lowest) {
+			lowest = status
+		}
+	}
+	return lowest
 }
 
 func isCurl(userAgent string) bool {
 	return strings.HasPrefix(userAgent, "curl/")
 }
 
+// isSuccessStatus checks whether a status from the spec is a specific 2xx
+// status (rather than a range like `2XX`).
+func isSuccessStatus(status spec.StatusCode) bool {
+	code, err := strconv.Atoi(string(status))
+	return err == nil && code >= 200 && code < 300
+}
+
 // parseExpansionLevel parses a set of raw expansions from a request query
 // string or form and produces a structure more useful for performing actual
 // expansions.
@@ -778,6 +1840,14 @@ func parseExpansionLevel(raw []string) *ExpansionLevel {
 	return level
 }
 
+// requestStripeVersion gets the API version that a request is being handled
+// with, which is the one it sent in `Stripe-Version` or the OpenAPI spec's.
+// It's empty for requests that haven't been through HandleRequest.
+func requestStripeVersion(r *http.Request) string {
+	version, _ := r.Context().Value(stripeVersionKey).(string)
+	return version
+}
+
 // validateAndCoerceRequest validates an incoming request against an OpenAPI
 // schema and does parameter coercion.
 //
@@ -797,11 +1867,15 @@ func validateAndCoerceRequest(
 	// `DELETE` will often have no parameters. When it does, they're in the
 	// body, but we'll ignore content type validation in this one case for
 	// simplicity.
+	//
+	// JSON bodies are accepted for any operation, like in newer versions of
+	// the Stripe API.
+	requestSchema, requestValidator := route.requestSchema, route.requestValidator
 	if r.Method != http.MethodDelete && r.Method != http.MethodGet {
 		contentType := r.Header.Get("Content-Type")
 		if contentType == "" {
 			message := fmt.Sprintf(contentTypeEmpty, *route.requestMediaType)
-			fmt.Printf(message + "\n")
+			logMessage(r, "%s", message)
 			return nil, createStripeError(typeInvalidRequestError, message)
 		}
 
@@ -812,57 +1886,132 @@ func validateAndCoerceRequest(
 		// We want to chop off the `; charset=utf-8` at the end.
 		contentType = strings.Split(contentType, ";")[0]
 
-		if contentType != *route.requestMediaType {
+		if contentType == param.JSONMediaType && route.jsonRequestSchema != nil {
+			requestSchema, requestValidator = route.jsonRequestSchema, route.jsonRequestValidator
+		} else if contentType != *route.requestMediaType && contentType != param.JSONMediaType {
 			message := fmt.Sprintf(contentTypeMismatched, *route.requestMediaType, contentType)
-			fmt.Printf(message + "\n")
+			logMessage(r, "%s", message)
 			return nil, createStripeError(typeInvalidRequestError, message)
 		}
 	}
 
-	err := coercer.CoerceParams(route.requestSchema, requestData)
+	err := coercer.CoerceParams(requestSchema, requestData)
 	if err != nil {
 		message := fmt.Sprintf("Request coercion error: %v", err)
-		fmt.Printf(message + "\n")
+		logMessage(r, "%s", message)
 		return nil, createStripeError(typeInvalidRequestError, message)
 	}
 
-	fmt.Printf("Request data = %+v\n", requestData)
-	err = route.requestValidator.Validate(requestData)
+	logMessage(r, "Request data = %+v", requestData)
+	if r.Method == http.MethodGet {
+		if stripeError := checkListLimit(requestData); stripeError != nil {
+			logMessage(r, "Request validation error: %v", stripeError.ErrorInfo.Message)
+			return nil, stripeError
+		}
+	}
+
+	if stripeError := checkAmounts(requestData); stripeError != nil {
+		logMessage(r, "Request validation error: %v", stripeError.ErrorInfo.Message)
+		return nil, stripeError
+	}
+
+	err = requestValidator.Validate(requestData)
 	if err != nil {
-		message := fmt.Sprintf("Request validation error: %v", err)
-		fmt.Printf(message + "\n")
-		return nil, createStripeError(typeInvalidRequestError, message)
+		logMessage(r, "Request validation error: %v", err)
+		return nil, createValidationError(err, requestSchema, requestData)
 	}
 
 	// All checks were successful.
 	return requestData, nil
 }
 
-func validateAuth(auth string) bool {
-	if auth == "" {
+// validatePathParams validates the parameters extracted from a request's path
+// against their schemas in the operation, like the maximum length of an ID.
+func validatePathParams(r *http.Request, route *stubServerRoute, pathParams *PathParamsMap) *ResponseError {
+	if route.pathValidator == nil || pathParams == nil {
+		return nil
+	}
+
+	// Only parameters that the operation declares are validated, since
+	// specs don't always describe all of them
+	values := make(map[string]interface{})
+	setValue := func(name string, value string) {
+		if _, ok := route.pathSchema.Properties[name]; ok {
+			values[name] = value
+		}
+	}
+	for _, secondaryID := range pathParams.SecondaryIDs {
+		setValue(secondaryID.Name, secondaryID.ID)
+	}
+	if pathParams.PrimaryID != nil {
+		setValue(route.pathParamNames[len(route.pathParamNames)-1], *pathParams.PrimaryID)
+	}
+
+	err := coercer.CoerceParams(route.pathSchema, values)
+	if err != nil {
+		message := fmt.Sprintf("Path parameter coercion error: %v", err)
+		logMessage(r, "%s", message)
+		return createStripeError(typeInvalidRequestError, message)
+	}
+
+	err = route.pathValidator.Validate(values)
+	if err != nil {
+		message := fmt.Sprintf("Path parameter validation error: %v", err)
+		logMessage(r, "%s", message)
+		return createStripeError(typeInvalidRequestError, message)
+	}
+
+	return nil
+}
+
+// isLiveKey checks whether an `Authorization` header holds a well-formed
+// live mode key like `sk_live_123`, which stripe-mock never accepts.
+func isLiveKey(auth string) bool {
+	key, ok := parseAuthKey(auth)
+	if !ok {
 		return false
 	}
 
+	keyParts := strings.Split(key, "_")
+	return len(keyParts) == 3 &&
+		(keyParts[0] == "rk" || keyParts[0] == "sk") &&
+		keyParts[1] == "live" &&
+		keyParts[2] != ""
+}
+
+// parseAuthKey extracts the API key from an `Authorization` header using
+// either the `Basic` or `Bearer` scheme. It reports false if the header is
+// malformed.
+func parseAuthKey(auth string) (string, bool) {
+	if auth == "" {
+		return "", false
+	}
+
 	parts := strings.Split(auth, " ")
 
 	// Expect ["Bearer", "sk_test_123"] or ["Basic", "aaaaa"]
 	if len(parts) != 2 || parts[1] == "" {
-		return false
+		return "", false
 	}
 
-	var key string
 	switch parts[0] {
 	case "Basic":
 		keyBytes, err := base64.StdEncoding.DecodeString(parts[1])
 		if err != nil {
-			return false
+			return "", false
 		}
-		key = string(keyBytes)
+		return string(keyBytes), true
 
 	case "Bearer":
-		key = parts[1]
+		return parts[1], true
+	}
+
+	return "", false
+}
 
-	default:
+func validateAuth(auth string) bool {
+	key, ok := parseAuthKey(auth)
+	if !ok {
 		return false
 	}
 
@@ -873,6 +2022,7 @@ func validateAuth(auth string) bool {
 		return false
 	}
 
+	// Both secret keys and restricted keys (`rk_test_...`) are accepted
 	if keyParts[0] != "rk" && keyParts[0] != "sk" {
 		return false
 	}
@@ -889,19 +2039,61 @@ func validateAuth(auth string) bool {
 	return true
 }
 
-func writeResponse(w http.ResponseWriter, r *http.Request, start time.Time, status int, data interface{}) {
-	if data == nil {
-		data = http.StatusText(status)
+// withLegacyRequestParams returns a request schema extended with any of
+// legacyRequestParams that apply to its operation. The original schema is
+// returned if there aren't any, and it's never modified because it may be
+// shared with other operations.
+func withLegacyRequestParams(verb spec.HTTPVerb, path spec.Path, schema *spec.Schema) *spec.Schema {
+	params, ok := legacyRequestParams[verb][path]
+	if !ok || schema == nil {
+		return schema
+	}
+
+	extended := *schema
+	extended.Properties = make(map[string]*spec.Schema, len(schema.Properties)+len(params))
+	for name, propertySchema := range schema.Properties {
+		extended.Properties[name] = propertySchema
 	}
+	for name, propertySchema := range params {
+		extended.Properties[name] = propertySchema
+	}
+	return &extended
+}
+
+// writeEmptyResponse writes a response that has a status, but no body, like a
+// `204 No Content`.
+func writeEmptyResponse(w http.ResponseWriter, r *http.Request, start time.Time, status int) {
+	w.Header().Set("Stripe-Mock-Version", Version)
+	w.WriteHeader(status)
+	logResponse(r, start, status, w.Header().Get("Request-Id"), false)
+}
 
+func writeResponse(w http.ResponseWriter, r *http.Request, start time.Time, status int, data interface{}) {
 	var encodedData []byte
 	var err error
 
-	// If no special Content-Type has been set, then we default to JSON.
-	if w.Header().Get("Content-Type") == "" {
-		w.Header().Set("Content-Type", "application/json")
+	// If no special Content-Type has been set, then we default to JSON, which
+	// is always UTF-8. Errors are JSON even for operations whose responses
+	// usually aren't, and the fallback for a missing body is plain text.
+	_, isStripeError := data.(*ResponseError)
+	contentType := w.Header().Get("Content-Type")
+	switch {
+	case data == nil:
+		data = http.StatusText(status)
+		w.Header().Set("Content-Type", textContentType)
+	case contentType == "" || contentType == "application/json" || isStripeError:
+		w.Header().Set("Content-Type", jsonContentType)
 	}
 
+	if stripeError, ok := data.(*ResponseError); ok {
+		if requestID := w.Header().Get("Request-Id"); requestID != "" {
+			stripeError.ErrorInfo.RequestLogURL = fmt.Sprintf(requestLogURL, requestID)
+		}
+	}
+
+	// Generated data is made up of maps, whose keys encoding/json always
+	// writes in sorted order, so identical responses are identical byte for
+	// byte and can be compared against golden files.
 	if dataString, ok := data.(string); ok {
 		encodedData = []byte(dataString)
 	} else if !isCurl(r.Header.Get("User-Agent")) {
@@ -912,19 +2104,43 @@ func writeResponse(w http.ResponseWriter, r *http.Request, start time.Time, stat
 	}
 
 	if err != nil {
-		fmt.Printf("Error serializing response: %v\n", err)
+		logMessage(r, "Error serializing response: %v", err)
 		writeResponse(w, r, start, http.StatusInternalServerError, nil)
 		return
 	}
 
+	// Compress the body for clients that accept it, which makes a difference
+	// for large lists and expanded objects on slow networks. Responses vary
+	// by the header whether they're compressed or not so that caches keep
+	// them apart.
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(encodedData) > 0 && acceptsGzip(r) {
+		compressedData, err := compressGzip(encodedData)
+		if err != nil {
+			logMessage(r, "Error compressing response: %v", err)
+		} else {
+			encodedData = compressedData
+			w.Header().Set("Content-Encoding", gzipEncoding)
+		}
+	}
+
 	w.Header().Set("Stripe-Mock-Version", Version)
 
 	w.WriteHeader(status)
 	_, err = w.Write(encodedData)
 	if err != nil {
-		fmt.Printf("Error writing to client: %v\n", err)
+		logMessage(r, "Error writing to client: %v", err)
+	}
+	logResponse(r, start, status, w.Header().Get("Request-Id"), false)
+}
+
+// describePath describes where a spec or fixtures were loaded from for use in
+// error messages. It's empty for the embedded ones.
+func describePath(path string) string {
+	if path == "" {
+		return ""
 	}
-	fmt.Printf("Response: elapsed=%v status=%v\n", time.Now().Sub(start), status)
+	return fmt.Sprintf(" from %s", path)
 }
 
 // isJSONFile judges based on a file's extension whether it's a JSON file. It's
@@ -2,17 +2,23 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/stripe/stripe-mock/embedded"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"path"
 	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/require"
 	"github.com/stripe/stripe-mock/spec"
@@ -285,6 +291,111 @@ func TestCanLoadEmbeddedSpecs(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestCanLoadEmbeddedSpecsStrict(t *testing.T) {
+	_, err := LoadSpecStrict(embedded.OpenAPISpec, "")
+	assert.NoError(t, err)
+	_, err = LoadSpecStrict(embedded.BetaOpenAPISpec, "")
+	assert.NoError(t, err)
+}
+
+func TestLoadSpec_CustomPath(t *testing.T) {
+	dir := t.TempDir()
+
+	specPath := path.Join(dir, "spec.json")
+	err := ioutil.WriteFile(specPath, []byte(`{"paths": {"/v1/charges": {}}}`), 0644)
+	assert.NoError(t, err)
+	stripeSpec, err := LoadSpec(embedded.OpenAPISpec, specPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(stripeSpec.Paths))
+
+	_, err = LoadSpec(embedded.OpenAPISpec, path.Join(dir, "missing.json"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error loading spec")
+
+	_, err = LoadSpec(embedded.OpenAPISpec, path.Join(dir, "spec.yaml"))
+	assert.Error(t, err)
+
+	invalidPath := path.Join(dir, "invalid.json")
+	err = ioutil.WriteFile(invalidPath, []byte(`{"paths":`), 0644)
+	assert.NoError(t, err)
+	_, err = LoadSpec(embedded.OpenAPISpec, invalidPath)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error decoding spec from "+invalidPath)
+
+	// Fixtures aren't a spec, even though they're valid JSON
+	fixturesPath := path.Join(dir, "fixtures.json")
+	err = ioutil.WriteFile(fixturesPath, []byte(`{"resources": {"charge": {}}}`), 0644)
+	assert.NoError(t, err)
+	_, err = LoadSpec(embedded.OpenAPISpec, fixturesPath)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no `paths` found")
+}
+
+func TestLoadFixtures_CustomPath(t *testing.T) {
+	dir := t.TempDir()
+
+	fixturesPath := path.Join(dir, "fixtures.json")
+	err := ioutil.WriteFile(fixturesPath, []byte(`{"resources": {"charge": {}}}`), 0644)
+	assert.NoError(t, err)
+	fixtures, err := LoadFixtures(embedded.OpenAPIFixtures, fixturesPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(fixtures.Resources))
+
+	// A spec isn't fixtures, even though it's valid JSON
+	specPath := path.Join(dir, "spec.json")
+	err = ioutil.WriteFile(specPath, []byte(`{"paths": {"/v1/charges": {}}}`), 0644)
+	assert.NoError(t, err)
+	_, err = LoadFixtures(embedded.OpenAPIFixtures, specPath)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no `resources` found")
+}
+
+func TestLoadSpecStrict(t *testing.T) {
+	dir := t.TempDir()
+	specPath := path.Join(dir, "spec.json")
+	err := ioutil.WriteFile(specPath, []byte(`{
+		"components": {
+			"schemas": {
+				"charge": {
+					"properties": {
+						"customer": {"$ref": "#/components/schemas/customer"},
+						"type": {"type": "strng"}
+					},
+					"type": "object",
+					"x-resourceId": "charge"
+				}
+			}
+		},
+		"paths": {
+			"/v1/charges": {
+				"get": {
+					"responses": {},
+					"x-unknown": true
+				}
+			}
+		},
+		"x-stripeSpecFilename": "spec3"
+	}`), 0644)
+	assert.NoError(t, err)
+
+	// The lenient loader ignores everything it doesn't understand.
+	_, err = LoadSpec(nil, specPath)
+	assert.NoError(t, err)
+
+	_, err = LoadSpecStrict(nil, specPath)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "spec has 3 problem(s)")
+	assert.Contains(t, err.Error(),
+		"unresolvable reference '#/components/schemas/customer' at #/components/schemas/charge/properties/customer/$ref")
+	assert.Contains(t, err.Error(),
+		"invalid schema type 'strng' at #/components/schemas/charge/properties/type/type")
+	assert.Contains(t, err.Error(),
+		"unknown extension 'x-unknown' at #/paths/~1v1~1charges/get")
+
+	// Extensions that are ignored on purpose are allowed.
+	assert.NotContains(t, err.Error(), "x-stripeSpecFilename")
+}
+
 func TestDoubleSlashFixHandler(t *testing.T) {
 	var lastPath string
 
@@ -366,9 +477,8 @@ func TestStubServer_MissingParam(t *testing.T) {
 	errorType, ok := errorInfo["type"]
 	assert.Equal(t, errorType, "invalid_request_error")
 	assert.True(t, ok)
-	message, ok := errorInfo["message"]
-	assert.True(t, ok)
-	assert.Contains(t, message, "object property 'amount' is required")
+	assert.Equal(t, "Missing required param: amount.", errorInfo["message"])
+	assert.Equal(t, "amount", errorInfo["param"])
 }
 
 func TestStubServer_ExtraParam(t *testing.T) {
@@ -399,6 +509,36 @@ func TestStubServer_QueryParam(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestStubServer_QueryInvalidParam(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	// Type mismatches and enum violations in the query are both rejected
+	testCases := map[string]string{
+		"limit=abc":    "Invalid integer: abc",
+		"status=bogus": "Invalid status: must be one of active, all, canceled",
+	}
+	for query, message := range testCases {
+		resp, body := sendRequestToServer(t, server, "GET", "/v1/subscriptions?"+query,
+			"", getDefaultHeaders())
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, string(body), message)
+	}
+}
+
+func TestStubServer_PathInvalidParam(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	// Checkout session IDs are limited to 66 characters
+	resp, body := sendRequestToServer(t, server, "GET",
+		"/v1/checkout/sessions/cs_"+strings.Repeat("a", 70), "", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "Path parameter validation error")
+
+	resp, _ = sendRequestToServer(t, server, "GET",
+		"/v1/checkout/sessions/cs_123", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
 func TestStubServer_QueryExtraParam(t *testing.T) {
 	resp, body := sendRequest(t, "GET", "/v1/charges?limit=10&doesntexist=foo",
 		"", getDefaultHeaders(), nil)
@@ -434,6 +574,30 @@ func TestStubServer_InvalidAuthorization(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf(invalidAuthorization, ""), message)
 }
 
+func TestStubServer_LiveKey(t *testing.T) {
+	headers := getDefaultHeaders()
+	headers["Authorization"] = "Bearer sk_live_123"
+
+	resp, body := sendRequest(t, "GET", "/v1/charges", "", headers, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, string(body), "only accepts test mode keys")
+
+	// Malformed keys still get the usual message
+	headers["Authorization"] = "Bearer sk_live_"
+	_, body = sendRequest(t, "GET", "/v1/charges", "", headers, nil)
+	assert.Contains(t, string(body), "Please authenticate")
+}
+
+func TestIsLiveKey(t *testing.T) {
+	assert.True(t, isLiveKey("Bearer sk_live_123"))
+	assert.True(t, isLiveKey("Bearer rk_live_123"))
+	assert.True(t, isLiveKey("Basic "+encode64("sk_live_123")))
+	assert.False(t, isLiveKey("Bearer sk_test_123"))
+	assert.False(t, isLiveKey("Bearer pk_live_123"))
+	assert.False(t, isLiveKey("Bearer sk_live_"))
+	assert.False(t, isLiveKey("sk_live_123"))
+}
+
 func TestStubServer_InvalidStripeVersion(t *testing.T) {
 	testBadVersion := "2006-01-01"
 
@@ -468,6 +632,50 @@ func TestStubServer_InvalidStripeVersion(t *testing.T) {
 	}
 }
 
+func TestStubServer_EchoesStripeVersion(t *testing.T) {
+	// Defaults to the version of the OpenAPI spec
+	{
+		resp, _ := sendRequest(t, "GET", "/v1/charges", "", getDefaultHeaders(), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, testSpecAPIVersion, resp.Header.Get("Stripe-Version"))
+	}
+
+	// Responds with the requested version, even if it's not the spec's
+	{
+		headers := getDefaultHeaders()
+		headers["Stripe-Version"] = "2024-09-30.acacia"
+
+		resp, _ := sendRequest(t, "GET", "/v1/charges", "", headers, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "2024-09-30.acacia", resp.Header.Get("Stripe-Version"))
+	}
+}
+
+func TestRequestStripeVersion(t *testing.T) {
+	req := httptest.NewRequest("GET", "/v1/charges", nil)
+	assert.Equal(t, "", requestStripeVersion(req))
+
+	req = req.WithContext(context.WithValue(req.Context(), stripeVersionKey, "2020-08-27"))
+	assert.Equal(t, "2020-08-27", requestStripeVersion(req))
+}
+
+func TestStubServer_MalformedStripeVersion(t *testing.T) {
+	headers := getDefaultHeaders()
+	headers["Stripe-Version"] = "latest"
+
+	resp, body := sendRequest(t, "GET", "/v1/charges", "", headers, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var data map[string]interface{}
+	err := json.Unmarshal(body, &data)
+	assert.NoError(t, err)
+	errorInfo, ok := data["error"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "invalid_request_error", errorInfo["type"])
+	assert.Equal(t, fmt.Sprintf(invalidStripeVersionFormat, "latest"),
+		errorInfo["message"])
+}
+
 func TestStubServer_AllowsContentTypeWithParameters(t *testing.T) {
 	headers := getDefaultHeaders()
 	headers["Content-Type"] = "application/x-www-form-urlencoded; charset=utf-8"
@@ -481,20 +689,95 @@ func TestStubServer_SetsSpecialHeaders(t *testing.T) {
 	resp, _ := sendRequest(t, "POST", "/", "", nil, nil)
 	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 	assert.Equal(t, Version, resp.Header.Get("Stripe-Mock-Version"))
-	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, jsonContentType, resp.Header.Get("Content-Type"))
 	_, ok := resp.Header["Request-Id"]
 	assert.False(t, ok)
 
 	resp, _ = sendRequest(t, "POST", "/", "", getDefaultHeaders(), nil)
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 	assert.Equal(t, Version, resp.Header.Get("Stripe-Mock-Version"))
-	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
-	assert.Equal(t, "req_123", resp.Header.Get("Request-Id"))
+	assert.Equal(t, jsonContentType, resp.Header.Get("Content-Type"))
+	assert.Regexp(t, `\Areq_[0-9A-Za-z]{14}\z`, resp.Header.Get("Request-Id"))
+}
+
+func TestStubServer_RequestID(t *testing.T) {
+	server := getStubServer(t, nil)
+
+	// Every request gets its own ID, which errors link to
+	resp, body := sendRequestToServer(t, server, "POST", "/", "", getDefaultHeaders())
+	requestID := resp.Header.Get("Request-Id")
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "https://dashboard.stripe.com/test/logs/"+requestID, errorInfo["request_log_url"])
+
+	resp, _ = sendRequestToServer(t, server, "POST", "/", "", getDefaultHeaders())
+	assert.NotEqual(t, requestID, resp.Header.Get("Request-Id"))
+
+	// Seeded requests always get the same ID
+	headers := getDefaultHeaders()
+	headers["Stripe-Mock-Seed"] = "42"
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges", "", headers)
+	requestID = resp.Header.Get("Request-Id")
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges", "", headers)
+	assert.Equal(t, requestID, resp.Header.Get("Request-Id"))
+
+	// So do sequences of requests to seeded servers
+	var requestIDs [2][]string
+	for i := range requestIDs {
+		server := getStubServer(t, &testStubServerOptions{seed: 42})
+		for j := 0; j < 3; j++ {
+			resp, _ := sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+			requestIDs[i] = append(requestIDs[i], resp.Header.Get("Request-Id"))
+		}
+	}
+	assert.Equal(t, requestIDs[0], requestIDs[1])
+}
+
+func TestStubServer_NotReady(t *testing.T) {
+	// A server whose router hasn't been initialized yet, like one that's
+	// still starting up
+	server, err := NewStubServer(&testFixtures, &testSpec,
+		&StubServerOptions{DeferRouterInitialization: true})
+	assert.NoError(t, err)
+
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, notReady, errorInfo["message"])
+	assert.Equal(t, typeAPIError, errorInfo["type"])
+
+	// Requests keep being answered while the router is initialized in the
+	// background, and are served normally once it's done
+	initialized := make(chan error)
+	go func() { initialized <- server.InitializeRouter() }()
+	for done := false; !done; {
+		select {
+		case err := <-initialized:
+			assert.NoError(t, err)
+			done = true
+		default:
+			resp, _ := sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+			assert.Contains(t, []int{http.StatusOK, http.StatusServiceUnavailable}, resp.StatusCode)
+		}
+	}
+
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestStubServer_SetsOverriddenMockVersion(t *testing.T) {
+	defer func(version string) { Version = version }(Version)
+	Version = "0.1.0"
+
+	resp, _ := sendRequest(t, "GET", "/v1/charges", "", getDefaultHeaders(), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0.1.0", resp.Header.Get("Stripe-Mock-Version"))
 }
 
 func TestStubServer_ParameterValidation(t *testing.T) {
 	resp, body := sendRequest(t, "POST", "/v1/charges", "", getDefaultHeaders(), nil)
-	assert.Contains(t, string(body), "property 'amount' is required")
+	assert.Contains(t, string(body), "Missing required param: amount.")
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 }
 
@@ -529,6 +812,41 @@ func TestStubServer_ErrorsOnEmptyContentType(t *testing.T) {
 		errorInfo["message"])
 }
 
+func TestStubServer_ReflectsRequestFields(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/customers",
+		"email=foo@example.com&metadata[foo]=bar&address[city]=Berlin", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var data map[string]interface{}
+	err := json.Unmarshal(body, &data)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo@example.com", data["email"])
+	assert.Equal(t, map[string]interface{}{"foo": "bar"}, data["metadata"])
+
+	address, ok := data["address"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "Berlin", address["city"])
+	assert.Nil(t, address["line1"])
+}
+
+func TestStubServer_PaginatesLists(t *testing.T) {
+	server := getRealStubServer(t, nil)
+	resp, body := sendRequestToServer(t, server, "GET",
+		"/v1/charges?limit=3&starting_after=ch_list003", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	data := decodeObject(t, body)
+	assert.Equal(t, true, data["has_more"])
+
+	var ids []interface{}
+	for _, item := range data["data"].([]interface{}) {
+		ids = append(ids, item.(map[string]interface{})["id"])
+	}
+	assert.Equal(t, []interface{}{"ch_list004", "ch_list005", "ch_list006"}, ids)
+}
+
 func TestStubServer_AllowsEmptyContentTypeOnDelete(t *testing.T) {
 	headers := getDefaultHeaders()
 	headers["Content-Type"] = ""
@@ -537,9 +855,19 @@ func TestStubServer_AllowsEmptyContentTypeOnDelete(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
+func TestStubServer_RespondsWithDeletedStubOnDelete(t *testing.T) {
+	resp, body := sendRequest(t, "DELETE", "/v1/customers/cus_abc", "", getDefaultHeaders(), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{
+		"deleted": true,
+		"id":      "cus_abc",
+		"object":  "customer",
+	}, decodeObject(t, body))
+}
+
 func TestStubServer_ErrorsOnMismatchedContentType(t *testing.T) {
 	headers := getDefaultHeaders()
-	headers["Content-Type"] = "application/json"
+	headers["Content-Type"] = "text/plain"
 
 	resp, body := sendRequest(t, "POST", "/v1/charges",
 		"amount=123", headers, nil)
@@ -555,10 +883,95 @@ func TestStubServer_ErrorsOnMismatchedContentType(t *testing.T) {
 	assert.Equal(t,
 		fmt.Sprintf(contentTypeMismatched,
 			"application/x-www-form-urlencoded",
-			"application/json"),
+			"text/plain"),
 		errorInfo["message"])
 }
 
+func TestStubServer_AcceptsJSONBody(t *testing.T) {
+	headers := getDefaultHeaders()
+	headers["Content-Type"] = "application/json; charset=utf-8"
+
+	resp, body := sendRequest(t, "POST", "/v1/charges",
+		`{"amount":123}`, headers, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, decodeObject(t, body)["id"])
+
+	// Required parameters are checked like for form-encoded bodies
+	resp, _ = sendRequest(t, "POST", "/v1/charges", `{}`, headers, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, body = sendRequest(t, "POST", "/v1/charges", `{"amount":`, headers, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	errorInfo, ok := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Contains(t, errorInfo["message"], "Request body isn't a valid JSON object")
+}
+
+func TestStubServer_SeedHeader(t *testing.T) {
+	server := getStubServer(t, nil)
+
+	headers := getDefaultHeaders()
+	headers["Stripe-Mock-Seed"] = "42"
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123", headers)
+	_, sameBody := sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123", headers)
+	assert.Equal(t, string(body), string(sameBody))
+
+	headers["Stripe-Mock-Seed"] = "43"
+	_, otherBody := sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123", headers)
+	assert.NotEqual(t, string(body), string(otherBody))
+
+	// Without a seed, every new object gets a random ID
+	_, unseededBody := sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123",
+		getDefaultHeaders())
+	assert.NotEqual(t, string(body), string(unseededBody))
+
+	headers["Stripe-Mock-Seed"] = "abc"
+	resp, _ := sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123", headers)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestStubServer_SeedOption(t *testing.T) {
+	// Servers with the same seed respond to the same sequence of requests
+	// with the same responses
+	var bodies [2][]string
+	for i := range bodies {
+		server := getStubServer(t, &testStubServerOptions{seed: 42})
+		for j := 0; j < 2; j++ {
+			_, body := sendRequestToServer(t, server, "POST", "/v1/charges", "amount=123",
+				getDefaultHeaders())
+			bodies[i] = append(bodies[i], string(body))
+		}
+	}
+	assert.Equal(t, bodies[0], bodies[1])
+	assert.NotEqual(t, bodies[0][0], bodies[0][1])
+}
+
+func TestStubServer_SeedOptionStateful(t *testing.T) {
+	// IDs of objects that stateful mode makes along the way, like the charge
+	// of a confirmed PaymentIntent and the events it records, are
+	// reproducible too
+	var chargeIDs, eventIDs [2]interface{}
+	for i := range chargeIDs {
+		server := getRealStubServer(t, &testStubServerOptions{seed: 42, stateful: true})
+
+		_, body := sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+			"amount=2000&currency=usd&payment_method=pm_card_visa&confirm=true", getDefaultHeaders())
+		chargeIDs[i] = decodeObject(t, body)["latest_charge"]
+
+		_, body = sendRequestToServer(t, server, "GET", "/v1/events", "", getDefaultHeaders())
+		var ids []interface{}
+		for _, event := range decodeObject(t, body)["data"].([]interface{}) {
+			ids = append(ids, event.(map[string]interface{})["id"])
+		}
+		eventIDs[i] = ids
+	}
+	assert.NotEmpty(t, chargeIDs[0])
+	assert.Equal(t, chargeIDs[0], chargeIDs[1])
+	assert.NotEmpty(t, eventIDs[0])
+	assert.Equal(t, eventIDs[0], eventIDs[1])
+}
+
 func TestStubServer_ReflectsIdempotencyKey(t *testing.T) {
 	headers := getDefaultHeaders()
 	headers["Idempotency-Key"] = "my-key"
@@ -568,6 +981,96 @@ func TestStubServer_ReflectsIdempotencyKey(t *testing.T) {
 	assert.Equal(t, "my-key", resp.Header.Get("Idempotency-Key"))
 }
 
+func TestStubServer_ReplaysIdempotentRequests(t *testing.T) {
+	// Fuzzing makes every generated response different
+	server := getStubServer(t, &testStubServerOptions{fuzz: true, seed: 1})
+
+	headers := getDefaultHeaders()
+	headers["Idempotency-Key"] = "my-key"
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/charges",
+		"amount=123", headers)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Idempotent-Replayed"))
+
+	// The same request with the same key gets the same response
+	{
+		replayResp, replayBody := sendRequestToServer(t, server, "POST", "/v1/charges",
+			"amount=123", headers)
+		assert.Equal(t, http.StatusOK, replayResp.StatusCode)
+		assert.Equal(t, "true", replayResp.Header.Get("Idempotent-Replayed"))
+		assert.Equal(t, "my-key", replayResp.Header.Get("Idempotency-Key"))
+		assert.Equal(t, string(body), string(replayBody))
+	}
+
+	// A different key gets a new response
+	{
+		otherHeaders := getDefaultHeaders()
+		otherHeaders["Idempotency-Key"] = "my-other-key"
+
+		otherResp, otherBody := sendRequestToServer(t, server, "POST", "/v1/charges",
+			"amount=123", otherHeaders)
+		assert.Equal(t, "", otherResp.Header.Get("Idempotent-Replayed"))
+		assert.NotEqual(t, string(body), string(otherBody))
+	}
+
+	// So does the same key sent with a different API key
+	{
+		otherHeaders := getDefaultHeaders()
+		otherHeaders["Authorization"] = "Bearer sk_test_456"
+		otherHeaders["Idempotency-Key"] = "my-key"
+
+		otherResp, _ := sendRequestToServer(t, server, "POST", "/v1/charges",
+			"amount=123", otherHeaders)
+		assert.Equal(t, "", otherResp.Header.Get("Idempotent-Replayed"))
+	}
+}
+
+func TestStubServer_TrailingSlash(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, _ := sendRequestToServer(t, server, "GET", "/v1/charges/", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/charges/ch_123/", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ch_123", decodeObject(t, body)["id"])
+
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges//ch_123", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStubServer_MethodNotAllowed(t *testing.T) {
+	resp, body := sendRequest(t, "DELETE", "/v1/charges", "", getDefaultHeaders(), nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, POST", resp.Header.Get("Allow"))
+
+	var data map[string]interface{}
+	err := json.Unmarshal(body, &data)
+	assert.NoError(t, err)
+	errorInfo, ok := data["error"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "invalid_request_error", errorInfo["type"])
+	assert.Equal(t, fmt.Sprintf(invalidMethod, "DELETE", "/v1/charges", "GET, POST"),
+		errorInfo["message"])
+
+	// Paths that aren't known at all are still not found
+	resp, _ = sendRequest(t, "DELETE", "/v1/doesnt-exist", "", getDefaultHeaders(), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Allow"))
+}
+
+func TestStubServer_AllowedMethods(t *testing.T) {
+	server := getStubServer(t, nil)
+	allowedMethods := func(path string) []string {
+		return server.allowedMethods(httptest.NewRequest(http.MethodOptions, path, nil))
+	}
+	assert.Equal(t, []string{"GET", "POST"}, allowedMethods("/v1/charges"))
+	assert.Equal(t, []string{"GET"}, allowedMethods("/v1/charges/ch_123"))
+	assert.Equal(t, []string{"DELETE"}, allowedMethods("/v1/customers/cus_123"))
+	assert.Nil(t, allowedMethods("/v1/doesnt-exist"))
+}
+
 func TestStubServer_RoutesRequest(t *testing.T) {
 	server := getStubServer(t, nil)
 
@@ -668,11 +1171,244 @@ func TestStubServer_RoutesRequest(t *testing.T) {
 	}
 }
 
+func TestStubServer_ExpandsListData(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "GET",
+		"/v1/charges?expand[]=data", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var data map[string]interface{}
+	err := json.Unmarshal(body, &data)
+	assert.NoError(t, err)
+
+	charge := data["data"].([]interface{})[0].(map[string]interface{})
+	for _, field := range []string{"balance_transaction", "customer"} {
+		expanded, ok := charge[field].(map[string]interface{})
+		assert.True(t, ok, "expected %s to be expanded", field)
+		assert.NotEmpty(t, expanded["id"])
+	}
+}
+
+func TestStubServer_ExpandsListDataField(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "GET",
+		"/v1/charges?expand[]=data.customer", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	charges := decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, defaultListLimit, len(charges))
+	for _, item := range charges {
+		charge := item.(map[string]interface{})
+		customer, ok := charge["customer"].(map[string]interface{})
+		assert.True(t, ok, "expected customer to be expanded")
+		assert.Equal(t, "customer", customer["object"])
+
+		// Only the field that was asked for is expanded
+		_, ok = charge["balance_transaction"].(string)
+		assert.True(t, ok)
+	}
+}
+
+func TestStubServer_RejectsInvalidExpansions(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	testCases := []struct {
+		path      string
+		expansion string
+		valid     bool
+	}{
+		{"/v1/charges", "data", true},
+		{"/v1/charges", "data.customer", true},
+		{"/v1/charges", "*", true},
+		{"/v1/invoices/in_123", "lines.data.price", true},
+		{"/v1/invoices/in_123", "customer.default_source", true},
+		{"/v1/charges", "customer", false},
+		{"/v1/charges", "foo", false},
+		{"/v1/charges", "data.foo", false},
+		{"/v1/charges", "data.amount", false},
+		{"/v1/invoices/in_123", "customer.foo", false},
+		{"/v1/invoices/in_123", "amount_due", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path+" "+tc.expansion, func(t *testing.T) {
+			resp, body := sendRequestToServer(t, server, "GET",
+				tc.path+"?expand[]="+tc.expansion, "", getDefaultHeaders())
+
+			if tc.valid {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				return
+			}
+
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+			assert.Equal(t, typeInvalidRequestError, errorInfo["type"])
+			assert.Equal(t,
+				fmt.Sprintf(invalidExpansion, tc.expansion),
+				errorInfo["message"])
+		})
+	}
+}
+
+func TestStubServer_RejectsTooDeepExpansions(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{maxExpansionDepth: 2})
+
+	resp, _ := sendRequestToServer(t, server, "GET",
+		"/v1/invoices/in_123?expand[]=customer.default_source", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := sendRequestToServer(t, server, "GET",
+		"/v1/invoices/in_123?expand[]=lines.data.price", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, typeInvalidRequestError, errorInfo["type"])
+	assert.Equal(t,
+		"You cannot expand more than 2 levels of a property. Property: lines.data.price",
+		errorInfo["message"])
+}
+
+func TestStubServer_WarnsOnUnmatchedParams(t *testing.T) {
+	// The nested address object is permissive enough that a typo in it isn't
+	// caught by validation.
+	params := "address[lin1]=123+Main+St"
+
+	// With warnUnmatchedParams on, a warning is logged
+	{
+		server := getRealStubServer(t, &testStubServerOptions{warnUnmatchedParams: true})
+
+		output := captureStdout(t, func() {
+			resp, _ := sendRequestToServer(t, server, "POST", "/v1/customers",
+				params, getDefaultHeaders())
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+		assert.Contains(t, output,
+			"Warning: parameter 'address[lin1]' isn't declared for POST /v1/customers")
+	}
+
+	// With warnUnmatchedParams off, nothing is logged
+	{
+		server := getRealStubServer(t, nil)
+
+		output := captureStdout(t, func() {
+			resp, _ := sendRequestToServer(t, server, "POST", "/v1/customers",
+				params, getDefaultHeaders())
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+		assert.NotContains(t, output, "Warning")
+	}
+}
+
+// Logs are plain text so that they stay readable when captured in CI, where
+// ANSI color codes would show up as garbage.
+func TestStubServer_LogsWithoutColor(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{warnUnmatchedParams: true})
+	server.verbose = true
+
+	output := captureStdout(t, func() {
+		sendRequestToServer(t, server, "POST", "/v1/customers",
+			"address[lin1]=foo", getDefaultHeaders())
+		sendRequestToServer(t, server, "GET", "/v1/doesnt-exist", "", getDefaultHeaders())
+		sendRequestToServer(t, server, "POST", "/v1/charges",
+			"amount=not-a-number", getDefaultHeaders())
+	})
+	assert.NotEmpty(t, output)
+	assert.NotContains(t, output, "\x1b")
+}
+
 func TestStubServer_JSONResponse(t *testing.T) {
 	resp, _ := sendRequest(t, "GET", "/v1/charges",
 		"", getDefaultHeaders(), nil)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, jsonContentType, resp.Header.Get("Content-Type"))
+}
+
+func TestWriteResponse_ContentType(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/charges", nil)
+
+	w := httptest.NewRecorder()
+	writeResponse(w, r, time.Now(), http.StatusOK, map[string]interface{}{"id": "ch_123"})
+	assert.Equal(t, jsonContentType, w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	writeResponse(w, r, time.Now(), http.StatusBadRequest,
+		createStripeError(typeInvalidRequestError, "Invalid"))
+	assert.Equal(t, jsonContentType, w.Header().Get("Content-Type"))
+
+	// Errors are JSON even if the operation's responses aren't
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/pdf")
+	writeResponse(w, r, time.Now(), http.StatusBadRequest,
+		createStripeError(typeInvalidRequestError, "Invalid"))
+	assert.Equal(t, jsonContentType, w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/pdf")
+	writeResponse(w, r, time.Now(), http.StatusOK, map[string]interface{}{})
+	assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	writeResponse(w, r, time.Now(), http.StatusInternalServerError, nil)
+	assert.Equal(t, textContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, http.StatusText(http.StatusInternalServerError), w.Body.String())
+}
+
+// Response keys are always sorted so that responses are stable and can be
+// compared against golden files.
+func TestStubServer_SortsResponseKeys(t *testing.T) {
+	// Seeded so that request IDs in errors are the same too
+	headers := getDefaultHeaders()
+	headers["Stripe-Mock-Seed"] = "42"
+
+	_, body := sendRequest(t, "GET", "/v1/charges/ch_123",
+		"", headers, nil)
+	for i := 0; i < 5; i++ {
+		_, otherBody := sendRequest(t, "GET", "/v1/charges/ch_123",
+			"", headers, nil)
+		assert.Equal(t, string(body), string(otherBody))
+	}
+
+	// Check every object in the response, including nested ones
+	type container struct {
+		isObject  bool
+		keys      []string
+		expectKey bool
+	}
+	var stack []*container
+	endValue := func() {
+		if len(stack) > 0 && stack[len(stack)-1].isObject {
+			stack[len(stack)-1].expectKey = true
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+
+		switch token {
+		case json.Delim('{'):
+			stack = append(stack, &container{isObject: true, expectKey: true})
+		case json.Delim('['):
+			stack = append(stack, &container{})
+		case json.Delim('}'), json.Delim(']'):
+			top := stack[len(stack)-1]
+			assert.True(t, sort.StringsAreSorted(top.keys), "keys not sorted: %v", top.keys)
+			stack = stack[:len(stack)-1]
+			endValue()
+		default:
+			top := stack[len(stack)-1]
+			if top.isObject && top.expectKey {
+				top.keys = append(top.keys, token.(string))
+				top.expectKey = false
+			} else {
+				endValue()
+			}
+		}
+	}
 }
 
 func TestStubServer_BinaryResponse(t *testing.T) {
@@ -683,6 +1419,86 @@ func TestStubServer_BinaryResponse(t *testing.T) {
 	assert.Equal(t, "Stripe binary response", string(body[:]))
 }
 
+func TestStubServer_SuccessStatuses(t *testing.T) {
+	widgetContent := func(status string) map[string]spec.MediaType {
+		return map[string]spec.MediaType{
+			"application/json": {Schema: &spec.Schema{
+				Type: "object",
+				Properties: map[string]*spec.Schema{
+					"status": {Type: "string", Enum: []interface{}{status}},
+				},
+				Required: []string{"status"},
+			}},
+		}
+	}
+	statusSpec := spec.Spec{
+		Info: &spec.Info{Version: testSpecAPIVersion},
+		Paths: map[spec.Path]map[spec.HTTPVerb]*spec.Operation{
+			"/v1/widgets": {
+				"get": {
+					Responses: map[spec.StatusCode]spec.Response{
+						"202":     {Content: widgetContent("accepted")},
+						"201":     {Content: widgetContent("created")},
+						"default": {Content: widgetContent("error")},
+					},
+				},
+			},
+			"/v1/gadgets": {
+				"get": {
+					Responses: map[spec.StatusCode]spec.Response{
+						"200": {Content: widgetContent("ok")},
+						"202": {Content: widgetContent("accepted")},
+					},
+				},
+				"delete": {
+					RequestBody: &spec.RequestBody{
+						Content: map[string]spec.MediaType{
+							"application/x-www-form-urlencoded": {
+								Schema: &spec.Schema{Type: "object"},
+							},
+						},
+					},
+					Responses: map[spec.StatusCode]spec.Response{
+						"204": {},
+					},
+				},
+			},
+		},
+	}
+	server := newTestStubServer(t, &statusSpec, &testFixtures, &testStubServerOptions{})
+
+	// Without a 200, the lowest 2xx response is used
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/widgets", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "created", decodeObject(t, body)["status"])
+
+	// 200 is preferred when it's documented
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/gadgets", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", decodeObject(t, body)["status"])
+
+	// Another documented 2xx response can be selected with a header
+	headers := getDefaultHeaders()
+	headers[responseStatusHeader] = "202"
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/gadgets", "", headers)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "accepted", decodeObject(t, body)["status"])
+
+	// No Content responses don't have a body
+	resp, body = sendRequestToServer(t, server, "DELETE", "/v1/gadgets", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Content-Type"))
+	assert.Equal(t, 0, len(body))
+
+	// But not one that isn't documented or isn't successful
+	for _, status := range []string{"204", "default"} {
+		headers[responseStatusHeader] = status
+		resp, body = sendRequestToServer(t, server, "GET", "/v1/widgets", "", headers)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, string(body), "isn't a documented successful response")
+	}
+}
+
 func TestGetValidator(t *testing.T) {
 	operation := &spec.Operation{RequestBody: &spec.RequestBody{
 		Content: map[string]spec.MediaType{
@@ -766,6 +1582,18 @@ func TestValidateAuth(t *testing.T) {
 		{"Bearer sk_test_123_extra", false},
 		{"Bearer sk_live_123", false},
 		{"Bearer sk_test_", false},
+
+		// Restricted keys are accepted just like secret keys, but
+		// publishable keys aren't
+		{"Bearer rk_test_abc", true},
+		{"Basic " + encode64("rk_test_abc"), true},
+		{"Bearer sk_test_abc", true},
+		{"Bearer rk_live_abc", false},
+		{"Bearer sk_live_abc", false},
+		{"Bearer pk_test_abc", false},
+		{"Bearer rk_test_", false},
+		{"Bearer garbage", false},
+		{"Bearer xx_test_abc", false},
 	}
 	for _, tc := range testCases {
 		t.Run("Authorization: "+tc.auth, func(t *testing.T) {
@@ -781,13 +1609,17 @@ func TestValidateAuth(t *testing.T) {
 func TestCompilePath(t *testing.T) {
 	{
 		pattern, pathParamNames := compilePath(spec.Path("/v1/charges"))
-		assert.Equal(t, `\A/v1/charges\z`, pattern.String())
+		assert.Equal(t, `\A/v1/charges/?\z`, pattern.String())
 		assert.Equal(t, []string(nil), pathParamNames)
+
+		assert.True(t, pattern.MatchString("/v1/charges"))
+		assert.True(t, pattern.MatchString("/v1/charges/"))
+		assert.False(t, pattern.MatchString("/v1/charges//"))
 	}
 
 	{
 		pattern, pathParamNames := compilePath(spec.Path("/v1/charges/{id}"))
-		assert.Equal(t, `\A/v1/charges/(?P<id>[\w@:%-._~!$&'()*+,;=]+)\z`, pattern.String())
+		assert.Equal(t, `\A/v1/charges/(?P<id>[A-Za-z0-9_.~!$&'()*+,;=:@%-]+)/?\z`, pattern.String())
 		assert.Equal(t, []string{"id"}, pathParamNames)
 
 		// Match
@@ -797,20 +1629,146 @@ func TestCompilePath(t *testing.T) {
 			assert.Equal(t, []string{"/v1/charges/ch_123", "ch_123"}, matches[0])
 		}
 
+		// Match with a trailing slash
+		{
+			matches := pattern.FindAllStringSubmatch("/v1/charges/ch_123/", -1)
+			assert.Equal(t, 1, len(matches))
+			assert.Equal(t, []string{"/v1/charges/ch_123/", "ch_123"}, matches[0])
+		}
+
 		// No match
 		{
 			matches := pattern.FindAllStringSubmatch("/v1/charges", -1)
 			assert.Equal(t, 0, len(matches))
 		}
 
+		// No match for empty segments
+		{
+			for _, path := range []string{"/v1/charges/", "/v1/charges//", "/v1/charges//ch_123"} {
+				matches := pattern.FindAllStringSubmatch(path, -1)
+				assert.Equal(t, 0, len(matches), path)
+			}
+		}
+
 		// Special characters
 		{
-			special := "%-._~!$&'()*+,;="
+			special := "%-._~!$&'()*+,;=:@"
 			matches := pattern.FindAllStringSubmatch("/v1/charges/"+special, -1)
 			assert.Equal(t, 1, len(matches))
 			assert.Equal(t, []string{"/v1/charges/" + special, special}, matches[0])
 		}
+
+		// IDs of various shapes
+		{
+			for _, id := range []string{"cus_ABC.123", "pi_1A2b3C", "price_1HxYz", "acct_1:2"} {
+				matches := pattern.FindAllStringSubmatch("/v1/charges/"+id, -1)
+				assert.Equal(t, 1, len(matches), id)
+				assert.Equal(t, []string{"/v1/charges/" + id, id}, matches[0])
+			}
+		}
+
+		// Characters that aren't allowed in a path segment
+		{
+			for _, id := range []string{"ch_1?2", "ch_1#2", "ch_1\"2", "ch_1 2"} {
+				matches := pattern.FindAllStringSubmatch("/v1/charges/"+id, -1)
+				assert.Equal(t, 0, len(matches), id)
+			}
+		}
+	}
+
+	// Nested routes
+	{
+		pattern, pathParamNames := compilePath(spec.Path("/v1/application_fees/{fee}/refunds/{id}"))
+		assert.Equal(t, []string{"fee", "id"}, pathParamNames)
+
+		matches := pattern.FindAllStringSubmatch("/v1/application_fees/fee_ABC.123/refunds/fr_1A2b3C", -1)
+		assert.Equal(t, 1, len(matches))
+		assert.Equal(t, []string{
+			"/v1/application_fees/fee_ABC.123/refunds/fr_1A2b3C", "fee_ABC.123", "fr_1A2b3C",
+		}, matches[0])
+	}
+}
+
+func TestFindUndeclaredParams(t *testing.T) {
+	schema := &spec.Schema{
+		Type: spec.TypeObject,
+		Properties: map[string]*spec.Schema{
+			"amount": {Type: spec.TypeInteger},
+			"metadata": {
+				Type:                        spec.TypeObject,
+				AdditionalProperties:        &spec.Schema{Type: spec.TypeString},
+				AdditionalPropertiesAllowed: true,
+			},
+			"shipping": {
+				Type:                        spec.TypeObject,
+				AdditionalPropertiesAllowed: true,
+				Properties: map[string]*spec.Schema{
+					"address": {
+						Type:                        spec.TypeObject,
+						AdditionalPropertiesAllowed: true,
+					},
+				},
+			},
+			"source": {
+				AnyOf: []*spec.Schema{
+					{Type: spec.TypeString},
+					{
+						Type: spec.TypeObject,
+						Properties: map[string]*spec.Schema{
+							"number": {Type: spec.TypeString},
+						},
+					},
+				},
+			},
+		},
 	}
+
+	testCases := []struct {
+		data map[string]interface{}
+		want []string
+	}{
+		{
+			map[string]interface{}{
+				"amount":   123,
+				"metadata": map[string]interface{}{"anything": "goes"},
+				"shipping": map[string]interface{}{
+					"address": map[string]interface{}{"line1": "123 Main St"},
+				},
+				"source": map[string]interface{}{"number": "4242424242424242"},
+			},
+			nil,
+		},
+		{
+			map[string]interface{}{
+				"amout": 123,
+				"shipping": map[string]interface{}{
+					"adress": map[string]interface{}{"line1": "123 Main St"},
+				},
+				"source": map[string]interface{}{"nmuber": "4242424242424242"},
+			},
+			[]string{"amout", "shipping[adress]", "source[nmuber]"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%+v", tc.data), func(t *testing.T) {
+			assert.Equal(t, tc.want, findUndeclaredParams(schema, tc.data, ""))
+		})
+	}
+}
+
+func TestCreateStripeError(t *testing.T) {
+	stripeError := createStripeError(typeInvalidRequestError, "No such customer: 'cus_123'")
+	assert.Equal(t, typeInvalidRequestError, stripeError.ErrorInfo.Type)
+	assert.Equal(t, "No such customer: 'cus_123'", stripeError.ErrorInfo.Message)
+	assert.Equal(t, "", stripeError.ErrorInfo.Code)
+	assert.Equal(t, "", stripeError.ErrorInfo.DocURL)
+	assert.Equal(t, "", stripeError.ErrorInfo.Param)
+
+	stripeError = createStripeError(typeInvalidRequestError, "No such customer: 'cus_123'",
+		withCode("resource_missing"), withParam("customer"))
+	assert.Equal(t, "resource_missing", stripeError.ErrorInfo.Code)
+	assert.Equal(t, "https://stripe.com/docs/error-codes/resource-missing", stripeError.ErrorInfo.DocURL)
+	assert.Equal(t, "customer", stripeError.ErrorInfo.Param)
 }
 
 func TestParseExpansionLevel(t *testing.T) {
@@ -868,13 +1826,57 @@ func TestParseExpansionLevel(t *testing.T) {
 //
 
 type testStubServerOptions struct {
-	strictVersionCheck bool
+	controlToken         string
+	corsOrigin           string
+	declineRulesFile     string
+	errorRate            float64
+	fixedTime            time.Time
+	fuzz                 bool
+	injectedHeaders      http.Header
+	maxExpansionDepth    int
+	maxRequestsPerSecond float64
+	objectsEndpoint      bool
+	objectTTLs           map[string]time.Duration
+	proxyAPIKey          string
+	proxyPaths           []string
+	proxyUpstream        string
+	responseValidation   string
+	seed                 int64
+	specEndpoint         bool
+	stateful             bool
+	strictVersionCheck   bool
+	versionedSpecs       map[string]*spec.Spec
+	warnUnmatchedParams  bool
+	webhookSecret        string
+	webhookURL           string
 }
 
 //
 // Private functions
 //
 
+// captureStdout runs the given function and returns everything that it wrote
+// to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	reader, writer, err := os.Pipe()
+	assert.NoError(t, err)
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(reader)
+		output <- string(data)
+	}()
+
+	f()
+
+	writer.Close()
+	return <-output
+}
+
 func encode64(s string) string {
 	return base64.StdEncoding.EncodeToString([]byte(s))
 }
@@ -891,12 +1893,70 @@ func getStubServer(t *testing.T, serverOptions *testStubServerOptions) *StubServ
 		serverOptions = &testStubServerOptions{}
 	}
 
+	return newTestStubServer(t, &testSpec, &testFixtures, serverOptions)
+}
+
+// getRealStubServer is like getStubServer, but uses the real OpenAPI spec and
+// fixtures. It's useful for testing behavior that's specific to particular
+// Stripe resources.
+func getRealStubServer(t *testing.T, serverOptions *testStubServerOptions) *StubServer {
+	if serverOptions == nil {
+		serverOptions = &testStubServerOptions{}
+	}
+
+	return newTestStubServer(t, &realSpec, &realFixtures, serverOptions)
+}
+
+func newTestStubServer(t *testing.T, stubSpec *spec.Spec, fixtures *spec.Fixtures,
+	serverOptions *testStubServerOptions) *StubServer {
+
+	proxy, err := newUpstreamProxy(serverOptions.proxyUpstream,
+		serverOptions.proxyAPIKey, serverOptions.proxyPaths)
+	assert.NoError(t, err)
+
+	declineRules, err := loadDeclineRules(serverOptions.declineRulesFile)
+	assert.NoError(t, err)
+
+	versions, err := newVersionRouters(serverOptions.versionedSpecs)
+	assert.NoError(t, err)
+
+	maxExpansionDepth := serverOptions.maxExpansionDepth
+	if maxExpansionDepth == 0 {
+		maxExpansionDepth = DefaultMaxExpansionDepth
+	}
+
 	server := &StubServer{
-		spec:               &testSpec,
-		fixtures:           &testFixtures,
+		controlToken:       serverOptions.controlToken,
+		corsOrigin:         serverOptions.corsOrigin,
+		declineRules:       declineRules,
+		errorRate:          serverOptions.errorRate,
+		errorRateStatus:    http.StatusInternalServerError,
+		spec:               stubSpec,
+		fixtures:           fixtures,
+		fixedTime:          serverOptions.fixedTime,
+		fuzz:               serverOptions.fuzz,
+		injectedHeaders:    serverOptions.injectedHeaders,
+		maxExpansionDepth:  maxExpansionDepth,
+		objectsEndpoint:    serverOptions.objectsEndpoint,
+		proxy:              proxy,
+		specEndpoint:       serverOptions.specEndpoint,
 		strictVersionCheck: serverOptions.strictVersionCheck,
+		versions:           versions,
+
+		warnUnmatchedParams: serverOptions.warnUnmatchedParams,
+		idempotency:         newIdempotencyCache(),
+		rateLimiter:         newRateLimiter(serverOptions.maxRequestsPerSecond),
+		rand:                newLockedRand(serverOptions.seed),
+		responseValidation:  serverOptions.responseValidation,
+		seeded:              serverOptions.seed != 0,
+		webhooks:            newWebhookDeliverer(serverOptions.webhookURL, serverOptions.webhookSecret),
+	}
+	if serverOptions.stateful {
+		server.events = newObjectStore(nil)
+		server.store = newObjectStore(serverOptions.objectTTLs)
+		server.store.now = server.generationTime
 	}
-	err := server.initializeRouter()
+	err = server.InitializeRouter()
 	assert.NoError(t, err)
 	return server
 }
@@ -905,6 +1965,14 @@ func sendRequest(t *testing.T, method string, url string, params string,
 	headers map[string]string, serverOptions *testStubServerOptions) (*http.Response, []byte) {
 
 	server := getStubServer(t, serverOptions)
+	return sendRequestToServer(t, server, method, url, params, headers)
+}
+
+// sendRequestToServer is like sendRequest, but sends the request to an
+// existing server so that tests can make multiple requests against the same
+// one.
+func sendRequestToServer(t *testing.T, server *StubServer, method string,
+	url string, params string, headers map[string]string) (*http.Response, []byte) {
 
 	fullURL := fmt.Sprintf("https://stripe.com%s", url)
 	req := httptest.NewRequest(method, fullURL, bytes.NewBufferString(params))
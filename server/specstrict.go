@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//
+// Private values
+//
+
+// knownSpecExtensions are the OpenAPI extensions that stripe-mock either
+// understands or knows to be safe to ignore. Strict spec loading rejects any
+// others.
+var knownSpecExtensions = map[string]bool{
+	"x-expandableFields":   true,
+	"x-expansionResources": true,
+	"x-resourceId":         true,
+
+	// Metadata for Stripe's SDKs and server that stripe-mock ignores.
+	"x-stripeBypassValidation": true,
+	"x-stripeEvent":            true,
+	"x-stripeOperations":       true,
+	"x-stripeParam":            true,
+	"x-stripeResource":         true,
+	"x-stripeSpecFilename":     true,
+}
+
+// maxStrictSpecProblems is the maximum number of problems with a spec that
+// are reported by strict spec loading so that errors stay readable.
+const maxStrictSpecProblems = 10
+
+// schemaRefPrefix is the prefix of references to schemas, which are the only
+// kind of reference that stripe-mock can resolve.
+const schemaRefPrefix = "#/components/schemas/"
+
+// securitySchemesPointer is the JSON pointer to a spec's security schemes.
+const securitySchemesPointer = "#/components/securitySchemes"
+
+// validSchemaTypes are the types that a schema can have in OpenAPI 3.
+var validSchemaTypes = map[string]bool{
+	"array":   true,
+	"boolean": true,
+	"integer": true,
+	"number":  true,
+	"object":  true,
+	"string":  true,
+}
+
+//
+// Private functions
+//
+
+// checkSpecStrict looks for constructs in an OpenAPI spec that stripe-mock
+// would otherwise silently ignore or mishandle: extensions that it doesn't
+// understand, references that don't resolve to a schema, and schema types
+// that don't exist. An error describing the problems is returned if there
+// are any.
+func checkSpecStrict(data []byte) error {
+	var root map[string]interface{}
+	err := json.Unmarshal(data, &root)
+	if err != nil {
+		return fmt.Errorf("error decoding spec: %v", err)
+	}
+
+	schemas := getMap(getMap(root, "components"), "schemas")
+
+	var problems []string
+	var walk func(pointer string, value interface{})
+	walk = func(pointer string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				keyPointer := pointer + "/" + escapeJSONPointer(key)
+
+				switch {
+				case strings.HasPrefix(key, "x-"):
+					// Extensions hold values of their own rather than OpenAPI
+					// constructs, so they're not walked into.
+					if !knownSpecExtensions[key] {
+						problems = append(problems,
+							fmt.Sprintf("unknown extension '%s' at %s", key, pointer))
+					}
+					continue
+
+				case key == "$ref":
+					ref, _ := v[key].(string)
+					name := strings.TrimPrefix(ref, schemaRefPrefix)
+					if _, ok := schemas[name]; !ok || name == ref {
+						problems = append(problems,
+							fmt.Sprintf("unresolvable reference '%s' at %s", ref, keyPointer))
+					}
+
+				case key == "type":
+					// `type` is only a schema's type when it's a string; it's also
+					// the name of properties like a charge's `type`. Security
+					// schemes have types of their own (like `http`).
+					schemaType, ok := v[key].(string)
+					if ok && !validSchemaTypes[schemaType] &&
+						!strings.HasPrefix(pointer, securitySchemesPointer) {
+						problems = append(problems,
+							fmt.Sprintf("invalid schema type '%s' at %s", schemaType, keyPointer))
+					}
+				}
+
+				walk(keyPointer, v[key])
+			}
+
+		case []interface{}:
+			for i, item := range v {
+				walk(fmt.Sprintf("%s/%d", pointer, i), item)
+			}
+		}
+	}
+	walk("#", root)
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	count := len(problems)
+	more := ""
+	if count > maxStrictSpecProblems {
+		more = fmt.Sprintf("\n  (and %d more)", count-maxStrictSpecProblems)
+		problems = problems[:maxStrictSpecProblems]
+	}
+	return fmt.Errorf("spec has %d problem(s) that strict loading doesn't allow:\n  %s%s",
+		count, strings.Join(problems, "\n  "), more)
+}
+
+// escapeJSONPointer escapes a key for use in a JSON pointer.
+func escapeJSONPointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,1902 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private types
+//
+
+// statefulHandler is a function that adjusts a generated response for a
+// specific route using the server's object store. It may also write to the
+// store so that the effects of the request are visible to future requests.
+//
+// data is the response generated for the request, and the handler returns
+// the response that should be sent back instead (which is often just the same
+// object after being mutated). A requestError may be returned to send an error
+// to the client instead.
+type statefulHandler func(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError)
+
+// statefulRequest contains the information about an incoming request that's
+// made available to a statefulHandler.
+type statefulRequest struct {
+	method      string
+	pathParams  *PathParamsMap
+	requestData map[string]interface{}
+
+	// ids is the source of randomness that IDs of new objects are drawn from,
+	// or nil if they should be random. See GenerateParams.IDs.
+	ids *rand.Rand
+}
+
+// pathParam returns the value of a path parameter extracted from the request
+// path by its name in the OpenAPI specification. An empty string is returned
+// if there was no such parameter.
+func (r *statefulRequest) pathParam(name string) string {
+	if r.pathParams == nil {
+		return ""
+	}
+
+	for _, secondaryID := range r.pathParams.SecondaryIDs {
+		if secondaryID.Name == name {
+			return secondaryID.ID
+		}
+	}
+
+	return ""
+}
+
+// primaryID returns the primary ID extracted from the request path, which is
+// the ID of the object that the request operates on. An empty string is
+// returned if there was none.
+func (r *statefulRequest) primaryID() string {
+	if r.pathParams == nil || r.pathParams.PrimaryID == nil {
+		return ""
+	}
+	return *r.pathParams.PrimaryID
+}
+
+// statefulRoute identifies a route that has a statefulHandler by its HTTP
+// verb and its path as it appears in the OpenAPI specification.
+type statefulRoute struct {
+	verb string
+	path spec.Path
+}
+
+//
+// Private values
+//
+
+// statefulHandlers maps routes to the handlers that give them special behavior
+// in stateful mode. Routes that don't appear here are served normally.
+var statefulHandlers = map[statefulRoute]statefulHandler{
+	{http.MethodPost, "/v1/billing_portal/sessions"}: handleBillingPortalSessionCreate,
+
+	{http.MethodGet, "/v1/charges"}:           handleObjectList("charge", "customer", "payment_intent"),
+	{http.MethodPost, "/v1/charges"}:          handleChargeCreate,
+	{http.MethodGet, "/v1/charges/{charge}"}:  handleObjectRetrieve,
+	{http.MethodPost, "/v1/charges/{charge}"}: handleObjectUpdate,
+
+	{http.MethodPost, "/v1/coupons"}:          handleCouponCreate,
+	{http.MethodGet, "/v1/coupons/{coupon}"}:  handleObjectRetrieve,
+	{http.MethodPost, "/v1/coupons/{coupon}"}: handleObjectUpdate,
+
+	{http.MethodPost, "/v1/customers"}:            handleCustomerCreate,
+	{http.MethodGet, "/v1/customers/{customer}"}:  handleCustomerRetrieve,
+	{http.MethodPost, "/v1/customers/{customer}"}: handleCustomerUpdate,
+
+	{http.MethodGet, "/v1/customers/{customer}/payment_methods"}: handleCustomerPaymentMethodList,
+	{http.MethodGet, "/v1/customers/{customer}/sources"}:         handleCustomerSourceList,
+	{http.MethodPost, "/v1/customers/{customer}/sources"}:        handleCustomerSourceCreate,
+	{http.MethodGet, "/v1/customers/{customer}/tax_ids"}:         handleCustomerTaxIDList,
+	{http.MethodPost, "/v1/customers/{customer}/tax_ids"}:        handleCustomerTaxIDCreate,
+	{http.MethodGet, "/v1/customers/{customer}/tax_ids/{id}"}:    handleCustomerTaxIDRetrieve,
+	{http.MethodDelete, "/v1/customers/{customer}/tax_ids/{id}"}: handleCustomerTaxIDDelete,
+
+	{http.MethodGet, "/v1/events"}:      handleEventList,
+	{http.MethodGet, "/v1/events/{id}"}: handleEventRetrieve,
+
+	{http.MethodPost, "/v1/invoiceitems"}:            handleInvoiceItemCreate,
+	{http.MethodPost, "/v1/invoices"}:                handleInvoiceCreate,
+	{http.MethodGet, "/v1/invoices/upcoming"}:        handleInvoiceUpcoming,
+	{http.MethodGet, "/v1/invoices/{invoice}"}:       handleObjectRetrieve,
+	{http.MethodPost, "/v1/invoices/{invoice}"}:      handleInvoiceUpdate,
+	{http.MethodGet, "/v1/invoices/{invoice}/lines"}: handleInvoiceLineList,
+
+	{http.MethodPost, "/v1/payment_intents"}:                  handlePaymentIntentCreate,
+	{http.MethodGet, "/v1/payment_intents/{intent}"}:          handleObjectRetrieve,
+	{http.MethodPost, "/v1/payment_intents/{intent}"}:         handleObjectUpdate,
+	{http.MethodPost, "/v1/payment_intents/{intent}/cancel"}:  handlePaymentIntentCancel,
+	{http.MethodPost, "/v1/payment_intents/{intent}/confirm"}: handlePaymentIntentConfirm,
+
+	{http.MethodPost, "/v1/payment_links"}:                          handlePaymentLinkCreate,
+	{http.MethodGet, "/v1/payment_links/{payment_link}"}:            handlePaymentLinkRetrieve,
+	{http.MethodPost, "/v1/payment_links/{payment_link}"}:           handlePaymentLinkUpdate,
+	{http.MethodGet, "/v1/payment_links/{payment_link}/line_items"}: handlePaymentLinkLineItemList,
+
+	{http.MethodGet, "/v1/payment_methods"}:                          handleObjectList("payment_method", "customer", "type"),
+	{http.MethodPost, "/v1/payment_methods"}:                         handleObjectCreate,
+	{http.MethodGet, "/v1/payment_methods/{payment_method}"}:         handleObjectRetrieve,
+	{http.MethodPost, "/v1/payment_methods/{payment_method}"}:        handleObjectUpdate,
+	{http.MethodPost, "/v1/payment_methods/{payment_method}/attach"}: handlePaymentMethodAttach,
+	{http.MethodPost, "/v1/payment_methods/{payment_method}/detach"}: handlePaymentMethodDetach,
+
+	{http.MethodPost, "/v1/prices"}:         handleObjectCreate,
+	{http.MethodGet, "/v1/prices/{price}"}:  handleObjectRetrieve,
+	{http.MethodPost, "/v1/prices/{price}"}: handleObjectUpdate,
+
+	{http.MethodPost, "/v1/products"}:      handleObjectCreate,
+	{http.MethodGet, "/v1/products/{id}"}:  handleObjectRetrieve,
+	{http.MethodPost, "/v1/products/{id}"}: handleObjectUpdate,
+
+	{http.MethodGet, "/v1/reviews"}:                   handleObjectList("review"),
+	{http.MethodGet, "/v1/reviews/{review}"}:          handleObjectRetrieve,
+	{http.MethodPost, "/v1/reviews/{review}/approve"}: handleReviewApprove,
+
+	{http.MethodPost, "/v1/tax_rates"}:            handleObjectCreate,
+	{http.MethodGet, "/v1/tax_rates/{tax_rate}"}:  handleObjectRetrieve,
+	{http.MethodPost, "/v1/tax_rates/{tax_rate}"}: handleObjectUpdate,
+
+	{http.MethodPost, "/v1/refunds"}:                 handleRefundCreate,
+	{http.MethodGet, "/v1/refunds/{refund}"}:         handleObjectRetrieve,
+	{http.MethodPost, "/v1/refunds/{refund}"}:        handleObjectUpdate,
+	{http.MethodPost, "/v1/refunds/{refund}/cancel"}: handleRefundCancel,
+
+	{http.MethodGet, "/v1/transfers"}:                            handleObjectList("transfer", "destination", "transfer_group"),
+	{http.MethodPost, "/v1/transfers"}:                           handleTransferCreate,
+	{http.MethodGet, "/v1/transfers/{id}/reversals"}:             handleTransferReversalList,
+	{http.MethodPost, "/v1/transfers/{id}/reversals"}:            handleTransferReversalCreate,
+	{http.MethodGet, "/v1/transfers/{transfer}"}:                 handleObjectRetrieve,
+	{http.MethodPost, "/v1/transfers/{transfer}"}:                handleObjectUpdate,
+	{http.MethodGet, "/v1/transfers/{transfer}/reversals/{id}"}:  handleObjectRetrieve,
+	{http.MethodPost, "/v1/transfers/{transfer}/reversals/{id}"}: handleObjectUpdate,
+
+	{http.MethodGet, "/v1/subscription_items/{subscription_item}/usage_record_summaries"}: handleUsageRecordSummaryList,
+	{http.MethodPost, "/v1/subscription_items/{subscription_item}/usage_records"}:         handleUsageRecordCreate,
+
+	{http.MethodPost, "/v1/subscriptions"}:                             handleSubscriptionCreate,
+	{http.MethodGet, "/v1/subscriptions/{subscription_exposed_id}"}:    handleObjectRetrieve,
+	{http.MethodPost, "/v1/subscriptions/{subscription_exposed_id}"}:   handleSubscriptionUpdate,
+	{http.MethodDelete, "/v1/subscriptions/{subscription_exposed_id}"}: handleSubscriptionCancel,
+}
+
+const (
+	noSuchObject = "No such %s: '%s'"
+
+	paymentIntentUnexpectedState = "You cannot cancel this PaymentIntent " +
+		"because it has a status of %s. Only a PaymentIntent with one of the " +
+		"following statuses may be canceled: requires_payment_method, " +
+		"requires_capture, requires_confirmation, requires_action, processing."
+
+	refundAlreadyCanceled = "Refund %s has already been canceled."
+
+	refundChargeAlreadyRefunded = "Charge %s has already been refunded."
+
+	refundAmountTooLarge = "Refund amount (%d) is greater than unrefunded " +
+		"amount on charge (%d)."
+
+	transferReversalAmountTooLarge = "Reversal amount (%d) is greater than " +
+		"unreversed amount on transfer (%d)."
+)
+
+// embeddedListLimit is the maximum number of objects included in lists that
+// are embedded in other objects, like a customer's `sources`.
+const embeddedListLimit = 10
+
+// customerSourceObjects are the types of objects that can be a customer's
+// payment sources.
+var customerSourceObjects = map[interface{}]bool{
+	"bank_account": true,
+	"card":         true,
+	"source":       true,
+}
+
+// testPaymentMethodPrefix is the prefix of test payment methods like
+// `pm_card_visa`, which can be used in test mode without creating a payment
+// method first.
+const testPaymentMethodPrefix = "pm_card_"
+
+// lineItemInvoiceItemFields are the fields of an invoice item that are copied
+// to the line item representing it on an invoice.
+var lineItemInvoiceItemFields = []string{
+	"amount",
+	"currency",
+	"description",
+	"discountable",
+	"metadata",
+	"period",
+	"plan",
+	"price",
+	"proration",
+	"quantity",
+	"subscription",
+	"tax_rates",
+}
+
+//
+// Private functions
+//
+
+// handleStatefulRequest runs the statefulHandler for a route if it has one,
+// or the generic one for its resource (see genericStatefulHandler), and
+// otherwise returns the generated response unchanged.
+func (s *StubServer) handleStatefulRequest(route *stubServerRoute, req *statefulRequest, responseData interface{}) (interface{}, *requestError) {
+	handler, ok := statefulHandlers[statefulRoute{req.method, route.path}]
+	if !ok {
+		handler = s.genericStatefulHandler(route, req.method)
+		if handler == nil {
+			return responseData, nil
+		}
+	}
+
+	data, ok := responseData.(map[string]interface{})
+	if !ok {
+		return responseData, nil
+	}
+
+	response, requestErr := handler(s, req, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	expandStoredListItems(s, req, response)
+
+	s.recordObjectEvent(route, req, response)
+	return response, nil
+}
+
+// handleBillingPortalSessionCreate checks that the customer that a billing
+// portal session is being created for exists.
+func handleBillingPortalSessionCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	customer, _ := req.requestData["customer"].(string)
+	if _, ok := s.store.get(customer); !ok {
+		return nil, noSuchObjectError("customer", customer)
+	}
+	return data, nil
+}
+
+// handleChargeCreate stores a new charge, along with the review that it was
+// placed in if it was flagged for review.
+func handleChargeCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	if reviewID, ok := data["review"].(string); ok && reviewID != "" {
+		s.store.put(reviewID, newReview(s, data))
+	}
+
+	return handleObjectCreate(s, req, data)
+}
+
+// handleCouponCreate stores a new coupon. A coupon takes either an amount or a
+// percentage off, so whichever of `amount_off` and `percent_off` wasn't sent
+// is cleared.
+func handleCouponCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	if _, ok := req.requestData["amount_off"]; ok {
+		data["percent_off"] = nil
+	}
+	if _, ok := req.requestData["percent_off"]; ok {
+		data["amount_off"] = nil
+	}
+	if req.requestData["duration"] != nil && req.requestData["duration"] != "repeating" {
+		data["duration_in_months"] = nil
+	}
+
+	return handleObjectCreate(s, req, data)
+}
+
+// handleCustomerCreate stores a new customer, along with a tax ID for each of
+// the request's `tax_id_data`. Its `sources`, `subscriptions`, and `tax_ids`
+// are only included in the response if they're expanded.
+func handleCustomerCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id, ok := data["id"].(string)
+	if !ok {
+		return data, nil
+	}
+
+	taxIDParams, _ := req.requestData["tax_id_data"].([]interface{})
+	taxIDs := make([]map[string]interface{}, len(taxIDParams))
+	for i, params := range taxIDParams {
+		paramsMap, _ := params.(map[string]interface{})
+		taxID, requestErr := newCustomerTaxID(s, req.ids, id, paramsMap)
+		if requestErr != nil {
+			return nil, requestErr
+		}
+		taxIDs[i] = taxID
+	}
+
+	mergeRequestData(data, req.requestData)
+	delete(data, "sources")
+	delete(data, "subscriptions")
+	delete(data, "tax_ids")
+	s.store.put(id, data)
+	for _, taxID := range taxIDs {
+		s.store.put(taxID["id"].(string), taxID)
+	}
+
+	setCustomerLists(s, req, data)
+	return data, nil
+}
+
+// handleCustomerRetrieve responds with a stored customer. If its `sources`,
+// `subscriptions`, or `tax_ids` are expanded, they're filled with the stored
+// objects that belong to the customer.
+func handleCustomerRetrieve(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	customer, requestErr := getStoredObject(s, req.primaryID(), data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	setCustomerLists(s, req, customer)
+	return customer, nil
+}
+
+// handleCustomerUpdate updates a stored customer like handleObjectUpdate, and
+// fills its `sources`, `subscriptions`, and `tax_ids` if they're expanded.
+func handleCustomerUpdate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	object, requestErr := handleObjectUpdate(s, req, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	customer := object.(map[string]interface{})
+	setCustomerLists(s, req, customer)
+	return customer, nil
+}
+
+// handleCustomerPaymentMethodList lists the stored payment methods attached to
+// a customer, newest first. They can be filtered by `type`.
+func handleCustomerPaymentMethodList(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	customer := req.pathParam("customer")
+
+	paymentMethods := s.store.listNewestFirst(func(object map[string]interface{}) bool {
+		if object["object"] != "payment_method" || object["customer"] != customer {
+			return false
+		}
+		paymentMethodType, ok := req.requestData["type"]
+		return !ok || object["type"] == paymentMethodType
+	})
+
+	page, hasMore, requestErr := paginate(paymentMethods, req.requestData)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	data["data"] = page
+	data["has_more"] = hasMore
+	data["url"] = "/v1/customers/" + customer + "/payment_methods"
+	return data, nil
+}
+
+// handleCustomerSourceCreate stores a new payment source attached to a
+// customer. A 404 is returned if the customer hasn't been stored.
+//
+// The response schema could be any kind of payment source (or even an
+// account), so the source is built from the fixture for the kind of object
+// that the `source` parameter refers to: a source for a `src_` ID, a bank
+// account for a `btok_` token, and otherwise a card.
+func handleCustomerSourceCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	customer := req.pathParam("customer")
+	if _, ok := s.store.get(customer); !ok {
+		return nil, noSuchObjectError("customer", customer)
+	}
+
+	sourceParam, _ := req.requestData["source"].(string)
+
+	objectType, id := "card", newID(req.ids, "card")
+	switch {
+	case strings.HasPrefix(sourceParam, "src_"):
+		objectType, id = "source", sourceParam
+	case strings.HasPrefix(sourceParam, "btok_"):
+		objectType, id = "bank_account", newID(req.ids, "ba")
+	}
+
+	source, ok := s.store.get(id)
+	if !ok {
+		source = make(map[string]interface{})
+		if fixture, ok := s.fixtures.Resources[spec.ResourceID(objectType)].(map[string]interface{}); ok {
+			source = copyObject(fixture)
+		}
+		source["id"] = id
+		source["object"] = objectType
+	}
+
+	source["customer"] = customer
+	if metadata, ok := req.requestData["metadata"]; ok {
+		source["metadata"] = metadata
+	}
+
+	s.store.put(id, source)
+	return source, nil
+}
+
+// handleCustomerSourceList lists the stored payment sources attached to a
+// customer, newest first.
+func handleCustomerSourceList(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	customer := req.pathParam("customer")
+
+	page, hasMore, requestErr := paginate(listCustomerSources(s, customer), req.requestData)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	data["data"] = page
+	data["has_more"] = hasMore
+	data["url"] = "/v1/customers/" + customer + "/sources"
+	return data, nil
+}
+
+// handleCustomerTaxIDCreate stores a new tax ID for a customer. A 404 is
+// returned if the customer hasn't been stored.
+func handleCustomerTaxIDCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	customer := req.pathParam("customer")
+	if _, ok := s.store.get(customer); !ok {
+		return nil, noSuchObjectError("customer", customer)
+	}
+
+	taxID, requestErr := newCustomerTaxID(s, req.ids, customer, req.requestData)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	s.store.put(taxID["id"].(string), taxID)
+	return taxID, nil
+}
+
+// handleCustomerTaxIDDelete removes a stored tax ID from a customer.
+func handleCustomerTaxIDDelete(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	if _, requestErr := getCustomerTaxID(s, req.pathParam("customer"), id); requestErr != nil {
+		return nil, requestErr
+	}
+
+	s.store.remove(id)
+	data["id"] = id
+	return data, nil
+}
+
+// handleCustomerTaxIDList lists the stored tax IDs of a customer, newest
+// first.
+func handleCustomerTaxIDList(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	customer := req.pathParam("customer")
+
+	page, hasMore, requestErr := paginate(listCustomerTaxIDs(s, customer), req.requestData)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	data["data"] = page
+	data["has_more"] = hasMore
+	data["url"] = "/v1/customers/" + customer + "/tax_ids"
+	return data, nil
+}
+
+// handleCustomerTaxIDRetrieve responds with a stored tax ID of a customer.
+func handleCustomerTaxIDRetrieve(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	return getCustomerTaxID(s, req.pathParam("customer"), req.primaryID())
+}
+
+// handleEventList lists recorded events, newest first. They can be filtered
+// by `type` or `types` (either of which can end in a wildcard like
+// `customer.*`), and by `delivery_success`, which matches events that still
+// have webhooks pending if it's false.
+func handleEventList(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	var typeFilters []string
+	if eventType, ok := req.requestData["type"].(string); ok {
+		typeFilters = append(typeFilters, eventType)
+	}
+	if eventTypes, ok := req.requestData["types"].([]interface{}); ok {
+		for _, eventType := range eventTypes {
+			if eventType, ok := eventType.(string); ok {
+				typeFilters = append(typeFilters, eventType)
+			}
+		}
+	}
+	deliverySuccess, filterDelivery := req.requestData["delivery_success"].(bool)
+
+	events := s.events.listNewestFirst(func(event map[string]interface{}) bool {
+		if len(typeFilters) > 0 {
+			eventType, _ := event["type"].(string)
+			var matched bool
+			for _, filter := range typeFilters {
+				if matchesEventType(eventType, filter) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+
+		if filterDelivery {
+			pending, _ := toInt64(event["pending_webhooks"])
+			return deliverySuccess == (pending == 0)
+		}
+		return true
+	})
+
+	page, hasMore, requestErr := paginate(events, req.requestData)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	data["data"] = page
+	data["has_more"] = hasMore
+	return data, nil
+}
+
+// handleEventRetrieve responds with a recorded event.
+func handleEventRetrieve(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	event, ok := s.events.get(id)
+	if !ok {
+		return nil, noSuchObjectError("event", id)
+	}
+	return event, nil
+}
+
+// handleInvoiceCreate stores a new invoice, applying any coupons sent with
+// `discounts` as discounts and any tax rates sent with `default_tax_rates`.
+// It starts off without any lines, which are added with invoice items.
+func handleInvoiceCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id, ok := data["id"].(string)
+	if !ok {
+		return data, nil
+	}
+
+	requestErr := applyInvoiceParams(s, req.ids, req.requestData, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	data["amount_paid"] = 0
+	setStoredInvoiceTotals(s, data)
+	s.store.put(id, data)
+	return data, nil
+}
+
+// handleInvoiceItemCreate stores a new invoice item. If it's added to an
+// invoice, a line item for it is also stored so that it's listed in the
+// invoice's lines, and the invoice's totals are updated if it's stored.
+func handleInvoiceItemCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	_, requestErr := handleObjectCreate(s, req, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	invoice, ok := req.requestData["invoice"].(string)
+	if !ok || invoice == "" {
+		return data, nil
+	}
+
+	lineItem := newInvoiceItemLineItem(s, req.ids, data)
+	lineItem["invoice"] = invoice
+
+	s.store.put(lineItem["id"].(string), lineItem)
+
+	if invoiceObject, ok := s.store.get(invoice); ok {
+		setStoredInvoiceTotals(s, invoiceObject)
+		s.store.put(invoice, invoiceObject)
+	}
+	return data, nil
+}
+
+// handleInvoiceUpcoming previews the next invoice for a customer or
+// subscription without storing it.
+//
+// Its lines are produced from the items of the stored subscription (as changed
+// by `subscription_items`) and the customer's pending invoice items, which
+// also make up its totals.
+func handleInvoiceUpcoming(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	customer, _ := req.requestData["customer"].(string)
+
+	var subscriptionItems []interface{}
+	if subscriptionID, ok := req.requestData["subscription"].(string); ok && subscriptionID != "" {
+		subscription, ok := s.store.get(subscriptionID)
+		if !ok {
+			return nil, noSuchObjectError("subscription", subscriptionID)
+		}
+		if customer == "" {
+			customer, _ = subscription["customer"].(string)
+		}
+		if items, ok := subscription["items"].(map[string]interface{}); ok {
+			subscriptionItems, _ = items["data"].([]interface{})
+		}
+		if discounts, ok := subscription["discounts"].([]interface{}); ok {
+			data["discount"] = subscription["discount"]
+			data["discounts"] = discounts
+		}
+		if taxRates, ok := subscription["default_tax_rates"].([]interface{}); ok {
+			data["default_tax_rates"] = taxRates
+		}
+
+		data["currency"] = subscription["currency"]
+		data["subscription"] = subscriptionID
+	}
+
+	if customer != "" {
+		if _, ok := s.store.get(customer); !ok {
+			return nil, noSuchObjectError("customer", customer)
+		}
+		data["customer"] = customer
+	}
+
+	if itemParams, ok := req.requestData["subscription_items"].([]interface{}); ok {
+		subscriptionID, _ := data["subscription"].(string)
+		subscriptionItems = changeSubscriptionItems(s, req.ids, subscriptionID, subscriptionItems, itemParams)
+	}
+
+	lineItems := make([]interface{}, 0, len(subscriptionItems))
+	for _, item := range subscriptionItems {
+		lineItems = append(lineItems, newSubscriptionItemLineItem(s, req.ids, item.(map[string]interface{})))
+	}
+
+	pendingInvoiceItems := s.store.list(func(object map[string]interface{}) bool {
+		invoice, _ := object["invoice"].(string)
+		return object["object"] == "invoiceitem" && customer != "" &&
+			object["customer"] == customer && invoice == ""
+	})
+	for _, invoiceItem := range pendingInvoiceItems {
+		lineItems = append(lineItems, newInvoiceItemLineItem(s, req.ids, invoiceItem))
+	}
+
+	for _, lineItem := range lineItems {
+		lineItemMap := lineItem.(map[string]interface{})
+		lineItemMap["invoice"] = nil
+		if data["currency"] == nil {
+			data["currency"] = lineItemMap["currency"]
+		}
+	}
+
+	// Upcoming invoices are the only ones without an ID
+	delete(data, "id")
+
+	data["amount_paid"] = 0
+	setInvoiceTotals(s, data, lineItems)
+	data["lines"] = map[string]interface{}{
+		"data":     lineItems,
+		"has_more": false,
+		"object":   "list",
+		"url":      "/v1/invoices/upcoming/lines",
+	}
+	data["status"] = "draft"
+	return data, nil
+}
+
+// handleInvoiceUpdate updates a stored invoice like handleObjectUpdate,
+// applying any coupons and tax rates that were sent and updating its totals.
+func handleInvoiceUpdate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	invoice, requestErr := getStoredObject(s, id, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	requestErr = applyInvoiceParams(s, req.ids, req.requestData, invoice)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	setStoredInvoiceTotals(s, invoice)
+	s.store.put(id, invoice)
+	return invoice, nil
+}
+
+// handleInvoiceLineList lists the line items stored for an invoice, paginated
+// according to the request's `limit`, `starting_after`, and `ending_before`.
+func handleInvoiceLineList(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	invoice := req.pathParam("invoice")
+
+	lineItems := s.store.list(func(object map[string]interface{}) bool {
+		return object["object"] == "line_item" && object["invoice"] == invoice
+	})
+
+	page, hasMore, requestErr := paginate(lineItems, req.requestData)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	data["data"] = page
+	data["has_more"] = hasMore
+	return data, nil
+}
+
+// handleObjectCreate stores a newly created object so that it can be
+// retrieved and updated by later requests.
+//
+// Request parameters are merged into the object first so that ones that
+// couldn't be reflected into the generated response (like nested objects that
+// are null in fixtures) are still represented.
+func handleObjectCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id, ok := data["id"].(string)
+	if !ok {
+		return data, nil
+	}
+
+	mergeRequestData(data, req.requestData)
+	s.store.put(id, data)
+	return data, nil
+}
+
+// handleObjectList produces a handler that lists the stored objects of the
+// given type, newest first, and paginates them according to the request's
+// `limit`, `starting_after`, and `ending_before`.
+//
+// Objects can be filtered by the named parameters, each of which only matches
+// objects whose field of the same name is equal to the parameter's value.
+func handleObjectList(objectType string, filterParams ...string) statefulHandler {
+	return func(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+		objects := s.store.listNewestFirst(func(object map[string]interface{}) bool {
+			if object["object"] != objectType {
+				return false
+			}
+			for _, param := range filterParams {
+				value, ok := req.requestData[param]
+				if ok && !valuesEqual(object[param], value) {
+					return false
+				}
+			}
+			return true
+		})
+
+		page, hasMore, requestErr := paginate(objects, req.requestData)
+		if requestErr != nil {
+			return nil, requestErr
+		}
+
+		data["data"] = page
+		data["has_more"] = hasMore
+		return data, nil
+	}
+}
+
+// handleObjectRetrieve responds with a stored object instead of a generated
+// one. A 404 is returned if it hasn't been stored.
+func handleObjectRetrieve(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	object, requestErr := getStoredObject(s, req.primaryID(), data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	return object, nil
+}
+
+// handleObjectUpdate merges request parameters into a stored object, stores
+// the result, and responds with it. A 404 is returned if the object hasn't
+// been stored.
+func handleObjectUpdate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	object, requestErr := getStoredObject(s, id, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	mergeRequestData(object, req.requestData)
+	s.store.put(id, object)
+	return object, nil
+}
+
+// handlePaymentIntentCancel cancels a stored payment intent, recording the
+// `cancellation_reason` sent with the request. Payment intents that have
+// already succeeded or been canceled can't be canceled.
+func handlePaymentIntentCancel(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	paymentIntent, requestErr := getStoredObject(s, id, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	status, _ := paymentIntent["status"].(string)
+	if status == "succeeded" || status == "canceled" {
+		return nil, &requestError{
+			status: http.StatusBadRequest,
+			stripeError: createStripeError(typeInvalidRequestError,
+				fmt.Sprintf(paymentIntentUnexpectedState, status)),
+		}
+	}
+
+	paymentIntent["canceled_at"] = s.generationTime().Unix()
+	paymentIntent["cancellation_reason"] = nil
+	if reason, ok := req.requestData["cancellation_reason"].(string); ok {
+		paymentIntent["cancellation_reason"] = reason
+	}
+	paymentIntent["status"] = "canceled"
+
+	s.store.put(id, paymentIntent)
+	return paymentIntent, nil
+}
+
+// handlePaymentIntentConfirm confirms a stored payment intent, merging any
+// other parameters sent with the confirmation into it first.
+func handlePaymentIntentConfirm(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	paymentIntent, requestErr := getStoredObject(s, id, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	mergeRequestData(paymentIntent, req.requestData)
+	confirmPaymentIntent(s, req.ids, paymentIntent)
+	s.store.put(id, paymentIntent)
+	return paymentIntent, nil
+}
+
+// handlePaymentIntentCreate stores a new payment intent, confirming it right
+// away if it was created with `confirm`.
+func handlePaymentIntentCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id, ok := data["id"].(string)
+	if !ok {
+		return data, nil
+	}
+
+	mergeRequestData(data, req.requestData)
+	if confirm, ok := req.requestData["confirm"].(bool); ok && confirm {
+		confirmPaymentIntent(s, req.ids, data)
+	}
+
+	s.store.put(id, data)
+	return data, nil
+}
+
+// handlePaymentLinkCreate stores a new payment link along with line items for
+// each of the request's `line_items`.
+func handlePaymentLinkCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id, ok := data["id"].(string)
+	if !ok {
+		return data, nil
+	}
+
+	itemParams, _ := req.requestData["line_items"].([]interface{})
+	requestErr := checkPaymentLinkLineItemParams(itemParams)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	// Line items are sent as an array of parameters, but represented as a
+	// list of items, so they can't be merged like other fields.
+	mergeRequestData(data, withoutParams(req.requestData, "line_items"))
+
+	items := make([]map[string]interface{}, len(itemParams))
+	for i, params := range itemParams {
+		paramsMap, _ := params.(map[string]interface{})
+		items[i] = newPaymentLinkLineItem(s, req.ids, paramsMap)
+	}
+	setPaymentLinkLineItems(data, items)
+	if len(items) > 0 {
+		data["currency"] = items[0]["currency"]
+	}
+
+	s.store.put(id, data)
+	setPaymentLinkLineItemsExpansion(req, data)
+	return data, nil
+}
+
+// handlePaymentLinkLineItemList lists the line items of a stored payment link.
+func handlePaymentLinkLineItemList(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.pathParam("payment_link")
+	link, ok := s.store.get(id)
+	if !ok {
+		return nil, noSuchObjectError("payment_link", id)
+	}
+
+	page, hasMore, requestErr := paginate(paymentLinkLineItems(link), req.requestData)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	data["data"] = page
+	data["has_more"] = hasMore
+	data["url"] = "/v1/payment_links/" + id + "/line_items"
+	return data, nil
+}
+
+// handlePaymentLinkRetrieve responds with a stored payment link, including its
+// line items if they're expanded.
+func handlePaymentLinkRetrieve(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	link, requestErr := getStoredObject(s, req.primaryID(), data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	setPaymentLinkLineItemsExpansion(req, link)
+	return link, nil
+}
+
+// handlePaymentLinkUpdate updates a stored payment link like
+// handleObjectUpdate. Its `line_items` parameters change the quantities of
+// the existing line items that they identify by `id`.
+func handlePaymentLinkUpdate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	link, requestErr := getStoredObject(s, id, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	itemParams, _ := req.requestData["line_items"].([]interface{})
+	requestErr = checkPaymentLinkLineItemParams(itemParams)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	items := paymentLinkLineItems(link)
+	for _, params := range itemParams {
+		paramsMap, _ := params.(map[string]interface{})
+		itemID, _ := paramsMap["id"].(string)
+
+		var item map[string]interface{}
+		for _, existing := range items {
+			if existing["id"] == itemID {
+				item = existing
+				break
+			}
+		}
+		if item == nil {
+			return nil, noSuchObjectError("line item", itemID)
+		}
+
+		if quantity, ok := toInt64(paramsMap["quantity"]); ok {
+			setPaymentLinkLineItemQuantity(item, quantity)
+		}
+	}
+
+	mergeRequestData(link, withoutParams(req.requestData, "line_items"))
+	setPaymentLinkLineItems(link, items)
+
+	s.store.put(id, link)
+	setPaymentLinkLineItemsExpansion(req, link)
+	return link, nil
+}
+
+// handlePaymentMethodAttach attaches a stored payment method to the customer
+// given by the `customer` parameter.
+//
+// Like in the Stripe API, attaching a test payment method like `pm_card_visa`
+// produces a new payment method with its own ID.
+func handlePaymentMethodAttach(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	paymentMethod, ok := s.store.get(id)
+	if !ok {
+		if !strings.HasPrefix(id, testPaymentMethodPrefix) {
+			return nil, noSuchObjectError("payment_method", id)
+		}
+		paymentMethod = data
+		paymentMethod["created"] = s.generationTime().Unix()
+		paymentMethod["id"] = newID(req.ids, "pm")
+	}
+
+	paymentMethod["customer"] = req.requestData["customer"]
+	s.store.put(paymentMethod["id"].(string), paymentMethod)
+	return paymentMethod, nil
+}
+
+// handlePaymentMethodDetach detaches a stored payment method from its
+// customer.
+func handlePaymentMethodDetach(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	paymentMethod, requestErr := getStoredObject(s, id, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	paymentMethod["customer"] = nil
+	s.store.put(id, paymentMethod)
+	return paymentMethod, nil
+}
+
+// handleRefundCancel cancels a stored refund and gives the refunded amount
+// back to its charge, if the charge is stored.
+func handleRefundCancel(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+
+	// The status is checked and changed under the same lock so that only one
+	// of several cancellations made at the same time gives the amount back.
+	var refund map[string]interface{}
+	var alreadyCanceled bool
+	ok := s.store.update(id, func(stored map[string]interface{}) {
+		if stored["status"] == "canceled" {
+			alreadyCanceled = true
+			return
+		}
+		stored["status"] = "canceled"
+		refund = copyObject(stored)
+	})
+	if !ok {
+		return nil, noSuchObjectError(data["object"], id)
+	}
+	if alreadyCanceled {
+		return nil, &requestError{
+			status: http.StatusBadRequest,
+			stripeError: createStripeError(typeInvalidRequestError,
+				fmt.Sprintf(refundAlreadyCanceled, id)),
+		}
+	}
+
+	amount, _ := toInt64(refund["amount"])
+	if chargeID, ok := refund["charge"].(string); ok {
+		s.store.update(chargeID, func(charge map[string]interface{}) {
+			addAmountRefunded(charge, -amount)
+		})
+	}
+
+	return refund, nil
+}
+
+// handleRefundCreate stores a new refund and adds its amount to the amount
+// refunded on its charge, if the charge is stored.
+//
+// Like in the real API, a refund without an `amount` refunds whatever remains
+// of the charge, and one for more than that is rejected, as is any refund of a
+// charge that's already been refunded in full.
+func handleRefundCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	chargeID, _ := req.requestData["charge"].(string)
+
+	// The charge is checked and updated under the same lock so that refunds
+	// made at the same time can't add up to more than it.
+	var requestErr *requestError
+	s.store.update(chargeID, func(charge map[string]interface{}) {
+		chargeAmount, _ := toInt64(charge["amount"])
+		amountRefunded, _ := toInt64(charge["amount_refunded"])
+		unrefunded := chargeAmount - amountRefunded
+		if unrefunded <= 0 {
+			requestErr = &requestError{
+				status: http.StatusBadRequest,
+				stripeError: createStripeError(typeInvalidRequestError,
+					fmt.Sprintf(refundChargeAlreadyRefunded, chargeID), withCode("charge_already_refunded")),
+			}
+			return
+		}
+
+		amount, ok := toInt64(req.requestData["amount"])
+		if !ok {
+			amount = unrefunded
+		}
+		if amount > unrefunded {
+			requestErr = &requestError{
+				status: http.StatusBadRequest,
+				stripeError: createStripeError(typeInvalidRequestError,
+					fmt.Sprintf(refundAmountTooLarge, amount, unrefunded), withParam("amount")),
+			}
+			return
+		}
+
+		data["amount"] = amount
+		data["currency"] = charge["currency"]
+		addAmountRefunded(charge, amount)
+	})
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	return handleObjectCreate(s, req, data)
+}
+
+// handleReviewApprove closes a stored review as approved.
+func handleReviewApprove(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	review, requestErr := getStoredObject(s, id, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	review["closed_reason"] = "approved"
+	review["open"] = false
+	review["reason"] = "approved"
+	s.store.put(id, review)
+	return review, nil
+}
+
+// handleSubscriptionCancel cancels a stored subscription, either immediately
+// or, if `at_period_end` is sent, at the end of its current period, in which
+// case it stays active until then.
+func handleSubscriptionCancel(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	subscription, requestErr := getStoredObject(s, id, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	now := s.generationTime().Unix()
+	subscription["canceled_at"] = now
+
+	cancellationDetails := map[string]interface{}{
+		"comment":  nil,
+		"feedback": nil,
+		"reason":   "cancellation_requested",
+	}
+	if params, ok := req.requestData["cancellation_details"].(map[string]interface{}); ok {
+		for key, value := range params {
+			cancellationDetails[key] = value
+		}
+	}
+	subscription["cancellation_details"] = cancellationDetails
+
+	if atPeriodEnd, _ := req.requestData["at_period_end"].(bool); atPeriodEnd {
+		subscription["cancel_at"] = subscription["current_period_end"]
+		subscription["cancel_at_period_end"] = true
+	} else {
+		subscription["cancel_at_period_end"] = false
+		subscription["ended_at"] = now
+		subscription["status"] = "canceled"
+	}
+
+	s.store.put(id, subscription)
+	return subscription, nil
+}
+
+// handleSubscriptionCreate stores a new subscription along with subscription
+// items for each of the request's `items`.
+func handleSubscriptionCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id, ok := data["id"].(string)
+	if !ok {
+		return data, nil
+	}
+
+	// Items are sent as an array of parameters, but represented as a list of
+	// subscription items, so they can't be merged like other fields.
+	mergeRequestData(data, withoutParams(req.requestData,
+		append([]string{"default_tax_rates", "items"}, discountParams...)...))
+
+	if itemParams, ok := req.requestData["items"].([]interface{}); ok {
+		items := changeSubscriptionItems(s, req.ids, id, nil, itemParams)
+		data["items"] = map[string]interface{}{
+			"data":     items,
+			"has_more": false,
+			"object":   "list",
+			"url":      "/v1/subscription_items?subscription=" + id,
+		}
+		if len(items) > 0 {
+			price, _ := items[0].(map[string]interface{})["price"].(map[string]interface{})
+			data["currency"] = price["currency"]
+		}
+	}
+
+	requestErr := applyDiscountParams(s, req.ids, req.requestData, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	requestErr = applyTaxRateParams(s, req.requestData, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	s.store.put(id, data)
+	return data, nil
+}
+
+// handleSubscriptionUpdate updates a stored subscription like
+// handleObjectUpdate, applying any coupons sent with `coupon` or `discounts`
+// as discounts and any tax rates sent with `default_tax_rates`.
+func handleSubscriptionUpdate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	subscription, requestErr := getStoredObject(s, id, data)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	mergeRequestData(subscription, withoutParams(req.requestData,
+		append([]string{"default_tax_rates"}, discountParams...)...))
+	requestErr = applyDiscountParams(s, req.ids, req.requestData, subscription)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	requestErr = applyTaxRateParams(s, req.requestData, subscription)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	s.store.put(id, subscription)
+	return subscription, nil
+}
+
+// handleTransferCreate stores a new transfer, which starts off with no
+// reversals.
+func handleTransferCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	if id, ok := data["id"].(string); ok {
+		data["amount_reversed"] = 0
+		data["reversals"] = map[string]interface{}{
+			"data":     []interface{}{},
+			"has_more": false,
+			"object":   "list",
+			"url":      "/v1/transfers/" + id + "/reversals",
+		}
+		data["reversed"] = false
+	}
+
+	return handleObjectCreate(s, req, data)
+}
+
+// handleTransferReversalCreate stores a new reversal of a stored transfer and
+// adds its amount to the amount reversed on the transfer.
+//
+// Like with refunds, a reversal without an `amount` reverses whatever remains
+// of the transfer, and one for more than that is rejected.
+func handleTransferReversalCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	transferID := req.pathParam("id")
+
+	// The transfer is checked and updated under the same lock so that
+	// reversals made at the same time can't add up to more than it.
+	var requestErr *requestError
+	ok := s.store.update(transferID, func(transfer map[string]interface{}) {
+		transferAmount, _ := toInt64(transfer["amount"])
+		amountReversed, _ := toInt64(transfer["amount_reversed"])
+		unreversed := transferAmount - amountReversed
+
+		amount, ok := toInt64(req.requestData["amount"])
+		if !ok {
+			amount = unreversed
+		}
+		if amount > unreversed {
+			requestErr = &requestError{
+				status: http.StatusBadRequest,
+				stripeError: createStripeError(typeInvalidRequestError,
+					fmt.Sprintf(transferReversalAmountTooLarge, amount, unreversed), withParam("amount")),
+			}
+			return
+		}
+
+		data["amount"] = amount
+		data["currency"] = transfer["currency"]
+		data["transfer"] = transferID
+		mergeRequestData(data, req.requestData)
+
+		transfer["amount_reversed"] = amountReversed + amount
+		transfer["reversed"] = amountReversed+amount >= transferAmount
+
+		if reversals, ok := transfer["reversals"].(map[string]interface{}); ok {
+			reversalList, _ := reversals["data"].([]interface{})
+			reversals["data"] = append([]interface{}{copyObject(data)}, reversalList...)
+		}
+	})
+	if !ok {
+		return nil, noSuchObjectError("transfer", transferID)
+	}
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	return handleObjectCreate(s, req, data)
+}
+
+// handleTransferReversalList lists the reversals stored for a transfer,
+// newest first, paginated according to the request's `limit`,
+// `starting_after`, and `ending_before`.
+func handleTransferReversalList(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	transferID := req.pathParam("id")
+
+	reversals := s.store.listNewestFirst(func(object map[string]interface{}) bool {
+		return object["object"] == "transfer_reversal" && object["transfer"] == transferID
+	})
+
+	page, hasMore, requestErr := paginate(reversals, req.requestData)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	data["data"] = page
+	data["has_more"] = hasMore
+	data["url"] = "/v1/transfers/" + transferID + "/reversals"
+	return data, nil
+}
+
+// handleUsageRecordCreate stores a new usage record so that its quantity is
+// counted in usage record summaries for its subscription item.
+//
+// Like the real API, an `action` of `set` replaces the usage previously
+// reported for the same timestamp instead of adding to it.
+func handleUsageRecordCreate(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	subscriptionItem := req.pathParam("subscription_item")
+
+	data["subscription_item"] = subscriptionItem
+	if timestamp, ok := req.requestData["timestamp"].(string); ok && timestamp == "now" {
+		data["timestamp"] = s.generationTime().Unix()
+	}
+
+	if action, ok := req.requestData["action"].(string); ok && action == "set" {
+		previousRecords := s.store.list(func(object map[string]interface{}) bool {
+			return isUsageRecordFor(object, subscriptionItem) &&
+				valuesEqual(object["timestamp"], data["timestamp"])
+		})
+		for _, record := range previousRecords {
+			s.store.remove(record["id"].(string))
+		}
+	}
+
+	s.store.put(data["id"].(string), data)
+	return data, nil
+}
+
+// handleUsageRecordSummaryList reports the total of all usage records stored
+// for a subscription item in its usage record summaries.
+func handleUsageRecordSummaryList(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	subscriptionItem := req.pathParam("subscription_item")
+
+	records := s.store.list(func(object map[string]interface{}) bool {
+		return isUsageRecordFor(object, subscriptionItem)
+	})
+
+	var totalUsage int64
+	for _, record := range records {
+		quantity, _ := toInt64(record["quantity"])
+		totalUsage += quantity
+	}
+
+	// There's only ever one summary, covering all of the item's usage
+	summaries, _ := data["data"].([]interface{})
+	if len(summaries) > 1 {
+		summaries = summaries[:1]
+	}
+	data["data"] = summaries
+	data["has_more"] = false
+
+	for _, summary := range summaries {
+		summaryMap, ok := summary.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		summaryMap["subscription_item"] = subscriptionItem
+		summaryMap["total_usage"] = totalUsage
+	}
+
+	return data, nil
+}
+
+// addAmountRefunded adds an amount (which may be negative) to the amount
+// refunded on a charge and updates whether the charge is fully refunded.
+func addAmountRefunded(charge map[string]interface{}, amount int64) {
+	chargeAmount, _ := toInt64(charge["amount"])
+	amountRefunded, _ := toInt64(charge["amount_refunded"])
+
+	amountRefunded += amount
+	charge["amount_refunded"] = amountRefunded
+	charge["refunded"] = amountRefunded >= chargeAmount
+}
+
+// confirmPaymentIntent moves a payment intent into the state it'd be in after
+// a successful payment, and stores the charge that it produced.
+//
+// Payment intents with a `capture_method` of `manual` are left waiting to be
+// captured, and all others succeed immediately.
+//
+// If the payment intent has a `setup_future_usage` and a customer, its
+// payment method is also saved to the customer for reuse.
+func confirmPaymentIntent(s *StubServer, ids *rand.Rand, paymentIntent map[string]interface{}) {
+	amount, _ := toInt64(paymentIntent["amount"])
+	manualCapture := paymentIntent["capture_method"] == "manual"
+
+	if setupFutureUsage, ok := paymentIntent["setup_future_usage"].(string); ok && setupFutureUsage != "" {
+		savePaymentMethod(s, ids, paymentIntent)
+	}
+
+	charge := make(map[string]interface{})
+	if fixture, ok := s.fixtures.Resources["charge"].(map[string]interface{}); ok {
+		charge = copyObject(fixture)
+	}
+	charge["amount"] = amount
+	charge["amount_captured"] = amount
+	charge["amount_refunded"] = 0
+	charge["captured"] = !manualCapture
+	charge["created"] = s.generationTime().Unix()
+	charge["currency"] = paymentIntent["currency"]
+	charge["customer"] = paymentIntent["customer"]
+	charge["id"] = newID(ids, "ch")
+	charge["object"] = "charge"
+	charge["paid"] = true
+	charge["payment_intent"] = paymentIntent["id"]
+	charge["payment_method"] = paymentIntent["payment_method"]
+	charge["refunded"] = false
+	charge["status"] = "succeeded"
+	if manualCapture {
+		charge["amount_captured"] = 0
+	}
+	s.store.put(charge["id"].(string), charge)
+
+	paymentIntent["latest_charge"] = charge["id"]
+	if manualCapture {
+		paymentIntent["amount_capturable"] = amount
+		paymentIntent["status"] = "requires_capture"
+	} else {
+		paymentIntent["amount_received"] = amount
+		paymentIntent["status"] = "succeeded"
+	}
+}
+
+// applyInvoiceParams merges request parameters into an invoice, applying any
+// coupons sent with `discounts` as discounts and any tax rates sent with
+// `default_tax_rates`.
+func applyInvoiceParams(s *StubServer, ids *rand.Rand, requestData map[string]interface{}, invoice map[string]interface{}) *requestError {
+	mergeRequestData(invoice, withoutParams(requestData,
+		append([]string{"default_tax_rates"}, discountParams...)...))
+
+	requestErr := applyDiscountParams(s, ids, requestData, invoice)
+	if requestErr != nil {
+		return requestErr
+	}
+	return applyTaxRateParams(s, requestData, invoice)
+}
+
+// changeSubscriptionItems applies subscription item parameters like those of
+// `items` or `subscription_items` to a subscription's items, returning new
+// items and leaving the originals unchanged.
+//
+// Parameters with an `id` change the quantity or price of the item with that
+// ID, or remove it if they're `deleted`. Others add a new item.
+func changeSubscriptionItems(s *StubServer, ids *rand.Rand, subscriptionID string, items []interface{}, itemParams []interface{}) []interface{} {
+	changedItems := make([]interface{}, 0, len(items)+len(itemParams))
+	for _, item := range items {
+		changedItems = append(changedItems, copyValue(item))
+	}
+
+	for _, params := range itemParams {
+		paramsMap, ok := params.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		id, _ := paramsMap["id"].(string)
+		if id == "" {
+			item := newSubscriptionItem(s, ids, subscriptionID)
+			setSubscriptionItemParams(s, ids, item, paramsMap)
+			changedItems = append(changedItems, item)
+			continue
+		}
+
+		for i, item := range changedItems {
+			itemMap := item.(map[string]interface{})
+			if itemMap["id"] != id {
+				continue
+			}
+			if deleted, ok := paramsMap["deleted"].(bool); ok && deleted {
+				changedItems = append(changedItems[:i], changedItems[i+1:]...)
+			} else {
+				setSubscriptionItemParams(s, ids, itemMap, paramsMap)
+			}
+			break
+		}
+	}
+
+	return changedItems
+}
+
+// getStoredObject retrieves an object from the store, producing an error like
+// the one that Stripe would send if it doesn't exist. data is the generated
+// response for the request, which is used to name the type of the missing
+// object.
+func getStoredObject(s *StubServer, id string, data map[string]interface{}) (map[string]interface{}, *requestError) {
+	object, ok := s.store.get(id)
+	if !ok {
+		return nil, noSuchObjectError(data["object"], id)
+	}
+	return object, nil
+}
+
+// getCustomerTaxID retrieves a stored tax ID belonging to a customer. A 404 is
+// returned if it hasn't been stored or belongs to someone else.
+func getCustomerTaxID(s *StubServer, customer string, id string) (map[string]interface{}, *requestError) {
+	taxID, ok := s.store.get(id)
+	if !ok || taxID["object"] != "tax_id" || taxID["customer"] != customer {
+		return nil, noSuchObjectError("tax_id", id)
+	}
+	return taxID, nil
+}
+
+// expandStoredFields replaces the IDs in the fields of an object that are
+// expanded at the given level with copies of the stored objects that they
+// refer to, and expands those in turn as far as the level goes. IDs of objects
+// that haven't been stored are left alone.
+func expandStoredFields(s *StubServer, level *ExpansionLevel, object map[string]interface{}) {
+	for field, fieldLevel := range level.expansions {
+		switch value := object[field].(type) {
+		case string:
+			stored, ok := s.store.get(value)
+			if !ok {
+				continue
+			}
+			object[field] = stored
+			expandStoredFields(s, fieldLevel, stored)
+
+		case map[string]interface{}:
+			expandStoredFields(s, fieldLevel, value)
+		}
+	}
+}
+
+// expandStoredListItems applies expansions through a list's `data`, like
+// `expand[]=data.customer`, to every object in a list of stored objects.
+// Generated lists have their expansions applied by the generator, but stored
+// objects only have IDs in their expandable fields.
+func expandStoredListItems(s *StubServer, req *statefulRequest, response interface{}) {
+	list, ok := response.(map[string]interface{})
+	if !ok || list["object"] != "list" {
+		return
+	}
+
+	expansions, _ := extractExpansions(req.requestData)
+	if expansions == nil || expansions.expansions["data"] == nil {
+		return
+	}
+
+	items, _ := list["data"].([]interface{})
+	for _, item := range items {
+		if object, ok := item.(map[string]interface{}); ok {
+			expandStoredFields(s, expansions.expansions["data"], object)
+		}
+	}
+}
+
+// isExpanded checks whether a field is expanded at the given expansion level,
+// either explicitly or with a wildcard. It's safe to call with a nil level.
+func isExpanded(level *ExpansionLevel, field string) bool {
+	if level == nil {
+		return false
+	}
+	_, ok := level.expansions[field]
+	return ok || level.wildcard
+}
+
+// isUsageRecordFor checks whether an object is a usage record belonging to the
+// given subscription item.
+func isUsageRecordFor(object map[string]interface{}, subscriptionItem string) bool {
+	return object["object"] == "usage_record" &&
+		object["subscription_item"] == subscriptionItem
+}
+
+// listCustomerSources lists the stored payment sources attached to a
+// customer, newest first.
+func listCustomerSources(s *StubServer, customer string) []map[string]interface{} {
+	return s.store.listNewestFirst(func(object map[string]interface{}) bool {
+		return customerSourceObjects[object["object"]] && object["customer"] == customer
+	})
+}
+
+// listCustomerTaxIDs lists the stored tax IDs of a customer, newest first.
+func listCustomerTaxIDs(s *StubServer, customer string) []map[string]interface{} {
+	return s.store.listNewestFirst(func(object map[string]interface{}) bool {
+		return object["object"] == "tax_id" && object["customer"] == customer
+	})
+}
+
+// mergeRequestData merges request parameters into an object like an update
+// in the Stripe API would. Parameters for fields that the object doesn't have
+// are ignored because they're usually instructions (like `expand`) rather
+// than data.
+//
+// Nested objects like `address` are merged rather than replaced, and an empty
+// string unsets a field. In `metadata`, an empty string removes the key
+// altogether, or all keys if sent in place of the whole object.
+func mergeRequestData(object map[string]interface{}, requestData map[string]interface{}) {
+	for key, value := range requestData {
+		if _, ok := object[key]; !ok {
+			continue
+		}
+		object[key] = mergeValue(key, object[key], value)
+	}
+}
+
+// mergeValue merges a single request parameter into the existing value of a
+// field, returning the field's new value.
+func mergeValue(key string, existing interface{}, value interface{}) interface{} {
+	valueMap, ok := value.(map[string]interface{})
+	if !ok {
+		if value == "" {
+			if key == "metadata" {
+				return map[string]interface{}{}
+			}
+			return nil
+		}
+		return copyValue(value)
+	}
+
+	existingMap, ok := existing.(map[string]interface{})
+	if ok {
+		existingMap = copyObject(existingMap)
+	} else {
+		existingMap = make(map[string]interface{})
+	}
+
+	for subKey, subValue := range valueMap {
+		if key == "metadata" && subValue == "" {
+			delete(existingMap, subKey)
+			continue
+		}
+		existingMap[subKey] = mergeValue(subKey, existingMap[subKey], subValue)
+	}
+	return existingMap
+}
+
+// newEmbeddedList builds a list that's embedded in another object, like a
+// customer's `sources`, from the objects that belong in it. Like in the Stripe
+// API, only the first few objects are included.
+func newEmbeddedList(url string, objects []map[string]interface{}) map[string]interface{} {
+	hasMore := len(objects) > embeddedListLimit
+	if hasMore {
+		objects = objects[:embeddedListLimit]
+	}
+
+	data := make([]interface{}, len(objects))
+	for i, object := range objects {
+		data[i] = object
+	}
+
+	return map[string]interface{}{
+		"data":     data,
+		"has_more": hasMore,
+		"object":   "list",
+		"url":      url,
+	}
+}
+
+// newInvoiceItemLineItem produces the line item that represents an invoice
+// item on an invoice.
+func newInvoiceItemLineItem(s *StubServer, ids *rand.Rand, invoiceItem map[string]interface{}) map[string]interface{} {
+	lineItem := make(map[string]interface{})
+	if fixture, ok := s.fixtures.Resources["line_item"].(map[string]interface{}); ok {
+		lineItem = copyObject(fixture)
+	}
+	for _, key := range lineItemInvoiceItemFields {
+		if value, ok := invoiceItem[key]; ok {
+			lineItem[key] = copyValue(value)
+		}
+	}
+	lineItem["amount_excluding_tax"] = invoiceItem["amount"]
+	lineItem["id"] = newID(ids, "il")
+	lineItem["invoice_item"] = invoiceItem["id"]
+	lineItem["object"] = "line_item"
+	lineItem["type"] = "invoiceitem"
+	return lineItem
+}
+
+// newSubscriptionItem produces a subscription item for a subscription based
+// on the subscription item fixture.
+func newSubscriptionItem(s *StubServer, ids *rand.Rand, subscriptionID string) map[string]interface{} {
+	item := make(map[string]interface{})
+	if fixture, ok := s.fixtures.Resources["subscription_item"].(map[string]interface{}); ok {
+		item = copyObject(fixture)
+	}
+	item["created"] = s.generationTime().Unix()
+	item["id"] = newID(ids, "si")
+	item["metadata"] = map[string]interface{}{}
+	item["object"] = "subscription_item"
+	item["quantity"] = 1
+	item["subscription"] = subscriptionID
+	return item
+}
+
+// newSubscriptionItemLineItem produces the line item that bills for a
+// subscription item on an invoice.
+func newSubscriptionItemLineItem(s *StubServer, ids *rand.Rand, item map[string]interface{}) map[string]interface{} {
+	price, _ := item["price"].(map[string]interface{})
+	unitAmount, _ := toInt64(price["unit_amount"])
+	quantity, _ := toInt64(item["quantity"])
+
+	lineItem := make(map[string]interface{})
+	if fixture, ok := s.fixtures.Resources["line_item"].(map[string]interface{}); ok {
+		lineItem = copyObject(fixture)
+	}
+	lineItem["amount"] = unitAmount * quantity
+	lineItem["amount_excluding_tax"] = unitAmount * quantity
+	lineItem["currency"] = price["currency"]
+	lineItem["id"] = newID(ids, "il")
+	lineItem["invoice_item"] = nil
+	lineItem["object"] = "line_item"
+	lineItem["price"] = copyValue(price)
+	lineItem["proration"] = false
+	lineItem["quantity"] = quantity
+	lineItem["subscription"] = item["subscription"]
+	lineItem["subscription_item"] = item["id"]
+	lineItem["type"] = "subscription"
+	lineItem["unit_amount_excluding_tax"] = strconv.FormatInt(unitAmount, 10)
+	return lineItem
+}
+
+// noSuchObjectError produces the error that Stripe sends when an object
+// doesn't exist.
+func noSuchObjectError(objectType interface{}, id string) *requestError {
+	return &requestError{
+		status: http.StatusNotFound,
+		stripeError: createStripeError(typeInvalidRequestError,
+			fmt.Sprintf(noSuchObject, objectType, id), withCode("resource_missing")),
+	}
+}
+
+// setCustomerLists fills the `sources`, `subscriptions`, and `tax_ids` lists
+// of a customer from the store if the request expands them, like the Stripe
+// API, which only includes them when asked to. Canceled subscriptions aren't
+// included.
+func setCustomerLists(s *StubServer, req *statefulRequest, customer map[string]interface{}) {
+	id, _ := customer["id"].(string)
+	expansions, _ := extractExpansions(req.requestData)
+
+	if isExpanded(expansions, "sources") {
+		customer["sources"] = newEmbeddedList("/v1/customers/"+id+"/sources",
+			listCustomerSources(s, id))
+	}
+
+	if isExpanded(expansions, "subscriptions") {
+		subscriptions := s.store.listNewestFirst(func(object map[string]interface{}) bool {
+			return object["object"] == "subscription" && object["customer"] == id &&
+				object["status"] != "canceled"
+		})
+		customer["subscriptions"] = newEmbeddedList("/v1/customers/"+id+"/subscriptions",
+			subscriptions)
+	}
+
+	if isExpanded(expansions, "tax_ids") {
+		customer["tax_ids"] = newEmbeddedList("/v1/customers/"+id+"/tax_ids",
+			listCustomerTaxIDs(s, id))
+	}
+}
+
+// setInvoiceTotals calculates the totals of an invoice from its lines, its
+// discounts, and its default tax rates.
+//
+// Discounts are applied one after the other to what remains of the subtotal,
+// and tax is then calculated on what remains after discounts.
+func setInvoiceTotals(s *StubServer, invoice map[string]interface{}, lineItems []interface{}) {
+	var subtotal int64
+	for _, lineItem := range lineItems {
+		amount, _ := toInt64(lineItem.(map[string]interface{})["amount"])
+		subtotal += amount
+	}
+
+	discounted := subtotal
+	discounts, _ := invoice["discounts"].([]interface{})
+	discountAmounts := make([]interface{}, 0, len(discounts))
+	for _, discountID := range discounts {
+		discount, ok := s.store.get(fmt.Sprint(discountID))
+		if !ok {
+			continue
+		}
+		coupon, _ := discount["coupon"].(map[string]interface{})
+		amount := couponDiscountAmount(coupon, discounted)
+		discounted -= amount
+		discountAmounts = append(discountAmounts, map[string]interface{}{
+			"amount":   amount,
+			"discount": discountID,
+		})
+	}
+
+	taxRates, _ := invoice["default_tax_rates"].([]interface{})
+	taxAmounts, inclusiveTax, exclusiveTax := calculateTaxAmounts(taxRates, discounted)
+
+	total := discounted + exclusiveTax
+	amountPaid, _ := toInt64(invoice["amount_paid"])
+
+	invoice["amount_due"] = total
+	invoice["amount_remaining"] = total - amountPaid
+	invoice["subtotal"] = subtotal
+	invoice["subtotal_excluding_tax"] = subtotal - inclusiveTax
+	invoice["tax"] = inclusiveTax + exclusiveTax
+	invoice["total"] = total
+	invoice["total_discount_amounts"] = discountAmounts
+	invoice["total_excluding_tax"] = discounted - inclusiveTax
+	invoice["total_tax_amounts"] = taxAmounts
+}
+
+// setStoredInvoiceTotals updates the lines and totals of a stored invoice
+// from the line items stored for it.
+func setStoredInvoiceTotals(s *StubServer, invoice map[string]interface{}) {
+	id, _ := invoice["id"].(string)
+	lineItems := s.store.list(func(object map[string]interface{}) bool {
+		return object["object"] == "line_item" && object["invoice"] == id
+	})
+
+	lineItemValues := make([]interface{}, len(lineItems))
+	for i, lineItem := range lineItems {
+		lineItemValues[i] = lineItem
+	}
+
+	setInvoiceTotals(s, invoice, lineItemValues)
+	invoice["lines"] = newEmbeddedList("/v1/invoices/"+id+"/lines", lineItems)
+}
+
+// setSubscriptionItemParams sets the `price` and `quantity` of a subscription
+// item from its parameters.
+//
+// A `price` is looked up in the store, and if it isn't there, the item's
+// existing price is given its ID instead. `price_data` produces a new price.
+func setSubscriptionItemParams(s *StubServer, ids *rand.Rand, item map[string]interface{}, params map[string]interface{}) {
+	if priceID, ok := params["price"].(string); ok && priceID != "" {
+		if price, ok := s.store.get(priceID); ok {
+			item["price"] = price
+		} else if price, ok := item["price"].(map[string]interface{}); ok {
+			price = copyObject(price)
+			price["id"] = priceID
+			item["price"] = price
+		}
+	}
+
+	if priceData, ok := params["price_data"].(map[string]interface{}); ok {
+		price, ok := item["price"].(map[string]interface{})
+		if ok {
+			price = copyObject(price)
+		} else {
+			price = make(map[string]interface{})
+		}
+		mergeRequestData(price, priceData)
+		price["id"] = newID(ids, "price")
+		item["price"] = price
+	}
+
+	if quantity, ok := toInt64(params["quantity"]); ok {
+		item["quantity"] = quantity
+	}
+	if metadata, ok := params["metadata"]; ok {
+		item["metadata"] = mergeValue("metadata", item["metadata"], metadata)
+	}
+}
+
+// savePaymentMethod attaches a payment intent's payment method to its
+// customer and stores it so that it can be reused.
+//
+// Payment methods that aren't stored (like the test payment method
+// `pm_card_visa`) are produced from fixtures. Like in the Stripe API, test
+// payment methods are saved as a new payment method with its own ID, which
+// replaces the one on the payment intent.
+func savePaymentMethod(s *StubServer, ids *rand.Rand, paymentIntent map[string]interface{}) {
+	customer, _ := paymentIntent["customer"].(string)
+	paymentMethodID, _ := paymentIntent["payment_method"].(string)
+	if customer == "" || paymentMethodID == "" {
+		return
+	}
+
+	paymentMethod, ok := s.store.get(paymentMethodID)
+	if !ok {
+		paymentMethod = make(map[string]interface{})
+		if fixture, ok := s.fixtures.Resources["payment_method"].(map[string]interface{}); ok {
+			paymentMethod = copyObject(fixture)
+		}
+		if strings.HasPrefix(paymentMethodID, testPaymentMethodPrefix) {
+			paymentMethodID = newID(ids, "pm")
+		}
+		paymentMethod["created"] = s.generationTime().Unix()
+		paymentMethod["id"] = paymentMethodID
+		paymentMethod["object"] = "payment_method"
+	}
+
+	paymentMethod["customer"] = customer
+	s.store.put(paymentMethodID, paymentMethod)
+	paymentIntent["payment_method"] = paymentMethodID
+}
+
+// toInt64 converts a numeric value of any of the types that might be produced
+// by JSON decoding or parameter coercion to an int64. The second return value
+// is false if the value wasn't numeric.
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// withoutParams copies request parameters, leaving out those with the given
+// names.
+func withoutParams(requestData map[string]interface{}, names ...string) map[string]interface{} {
+	params := make(map[string]interface{}, len(requestData))
+	for key, value := range requestData {
+		params[key] = value
+	}
+	for _, name := range names {
+		delete(params, name)
+	}
+	return params
+}
+
+// valuesEqual compares two generic values, treating numbers of different
+// types as equal if they represent the same integer.
+func valuesEqual(a, b interface{}) bool {
+	aInt, aOK := toInt64(a)
+	bInt, bOK := toInt64(b)
+	if aOK && bOK {
+		return aInt == bInt
+	}
+	return a == b
+}
@@ -0,0 +1,1090 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStatefulUsageRecords(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	for _, quantity := range []string{"10", "20", "30"} {
+		resp, body := sendRequestToServer(t, server, "POST",
+			"/v1/subscription_items/si_123/usage_records",
+			"quantity="+quantity+"&timestamp=now", getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		data := decodeObject(t, body)
+		assert.Equal(t, "usage_record", data["object"])
+		assert.Equal(t, "si_123", data["subscription_item"])
+	}
+
+	// Usage for another subscription item isn't included in the total
+	resp, _ := sendRequestToServer(t, server, "POST",
+		"/v1/subscription_items/si_456/usage_records",
+		"quantity=1000&timestamp=now", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := sendRequestToServer(t, server, "GET",
+		"/v1/subscription_items/si_123/usage_record_summaries", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	data := decodeObject(t, body)
+	summaries := data["data"].([]interface{})
+	assert.Equal(t, 1, len(summaries))
+	summary := summaries[0].(map[string]interface{})
+	assert.Equal(t, "si_123", summary["subscription_item"])
+	assert.Equal(t, float64(60), summary["total_usage"])
+}
+
+func TestStatefulUsageRecords_SetAction(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	for _, params := range []string{
+		"quantity=10&timestamp=1500000000",
+		"quantity=20&timestamp=1600000000",
+		"quantity=5&timestamp=1500000000&action=set",
+	} {
+		resp, _ := sendRequestToServer(t, server, "POST",
+			"/v1/subscription_items/si_123/usage_records", params, getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	_, body := sendRequestToServer(t, server, "GET",
+		"/v1/subscription_items/si_123/usage_record_summaries", "", getDefaultHeaders())
+	summary := decodeObject(t, body)["data"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, float64(25), summary["total_usage"])
+}
+
+func TestStatefulUsageRecords_NotStateful(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, _ := sendRequestToServer(t, server, "POST",
+		"/v1/subscription_items/si_123/usage_records",
+		"quantity=10&timestamp=now", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Without stateful mode, summaries come straight from fixtures
+	_, body := sendRequestToServer(t, server, "GET",
+		"/v1/subscription_items/si_123/usage_record_summaries", "", getDefaultHeaders())
+	summary := decodeObject(t, body)["data"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t,
+		realFixtures.Resources["usage_record_summary"].(map[string]interface{})["total_usage"],
+		summary["total_usage"])
+}
+
+func TestStatefulCustomers_Update(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/customers",
+		"name=A&address[city]=Paris&metadata[foo]=bar&metadata[baz]=qux", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	customerID := decodeObject(t, body)["id"].(string)
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/customers/"+customerID,
+		"email=x&address[country]=FR&metadata[baz]=", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	updated := decodeObject(t, body)
+	assert.Equal(t, customerID, updated["id"])
+	assert.Equal(t, "A", updated["name"])
+	assert.Equal(t, "x", updated["email"])
+
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/customers/"+customerID,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	retrieved := decodeObject(t, body)
+	assert.Equal(t, "A", retrieved["name"])
+	assert.Equal(t, "x", retrieved["email"])
+	assert.Equal(t, map[string]interface{}{
+		"city":        "Paris",
+		"country":     "FR",
+		"line1":       nil,
+		"line2":       nil,
+		"postal_code": nil,
+		"state":       nil,
+	}, retrieved["address"])
+	assert.Equal(t, map[string]interface{}{"foo": "bar"}, retrieved["metadata"])
+}
+
+func TestStatefulCustomers_Missing(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/customers/cus_missing",
+		"email=x", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "No such customer: 'cus_missing'")
+
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/customers/cus_missing",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStatefulCustomers_Expired(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{
+		objectTTLs: map[string]time.Duration{"customer": time.Hour},
+		stateful:   true,
+	})
+
+	now := time.Now()
+	server.store.now = func() time.Time { return now }
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	resp, _ := sendRequestToServer(t, server, "GET", "/v1/customers/"+customerID,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	now = now.Add(time.Hour)
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/customers/"+customerID,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "No such customer: '"+customerID+"'")
+}
+
+func TestStatefulCustomers_ExpiredFixedTime(t *testing.T) {
+	fixedTime := time.Unix(1700000000, 0)
+	server := getRealStubServer(t, &testStubServerOptions{
+		fixedTime:  fixedTime,
+		objectTTLs: map[string]time.Duration{"customer": time.Hour},
+		stateful:   true,
+	})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	// Objects expire by the same clock as generated timestamps
+	server.fixedTime = fixedTime.Add(59 * time.Minute)
+	resp, _ := sendRequestToServer(t, server, "GET", "/v1/customers/"+customerID,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	server.fixedTime = fixedTime.Add(time.Hour)
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/customers/"+customerID,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStatefulCustomers_ExpandSourcesAndSubscriptions(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customer := decodeObject(t, body)
+	customerID := customer["id"].(string)
+	_, ok := customer["sources"]
+	assert.False(t, ok)
+
+	resp, body := sendRequestToServer(t, server, "POST",
+		"/v1/customers/"+customerID+"/sources", "source=tok_visa", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	sourceID := decodeObject(t, body)["id"].(string)
+
+	_, body = sendRequestToServer(t, server, "POST", "/v1/prices",
+		"currency=usd&product=prod_123&unit_amount=1000", getDefaultHeaders())
+	priceID := decodeObject(t, body)["id"].(string)
+
+	_, body = sendRequestToServer(t, server, "POST", "/v1/subscriptions",
+		"customer="+customerID+"&items[0][price]="+priceID, getDefaultHeaders())
+	subscriptionID := decodeObject(t, body)["id"].(string)
+
+	// Objects belonging to other customers aren't included
+	_, body = sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	otherCustomerID := decodeObject(t, body)["id"].(string)
+	resp, _ = sendRequestToServer(t, server, "POST",
+		"/v1/customers/"+otherCustomerID+"/sources", "source=tok_visa", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/v1/customers/"+customerID+"?expand[]=sources&expand[]=subscriptions", "",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	customer = decodeObject(t, body)
+
+	sources := customer["sources"].(map[string]interface{})
+	assert.Equal(t, "list", sources["object"])
+	assert.Equal(t, "/v1/customers/"+customerID+"/sources", sources["url"])
+	assert.Equal(t, false, sources["has_more"])
+	sourcesData := sources["data"].([]interface{})
+	assert.Equal(t, 1, len(sourcesData))
+	assert.Equal(t, sourceID, sourcesData[0].(map[string]interface{})["id"])
+	assert.Equal(t, customerID, sourcesData[0].(map[string]interface{})["customer"])
+
+	subscriptions := customer["subscriptions"].(map[string]interface{})
+	assert.Equal(t, "/v1/customers/"+customerID+"/subscriptions", subscriptions["url"])
+	subscriptionsData := subscriptions["data"].([]interface{})
+	assert.Equal(t, 1, len(subscriptionsData))
+	assert.Equal(t, subscriptionID, subscriptionsData[0].(map[string]interface{})["id"])
+
+	// Without expansions, neither list is included
+	_, body = sendRequestToServer(t, server, "GET", "/v1/customers/"+customerID, "",
+		getDefaultHeaders())
+	customer = decodeObject(t, body)
+	_, ok = customer["sources"]
+	assert.False(t, ok)
+	_, ok = customer["subscriptions"]
+	assert.False(t, ok)
+
+	// Sources can also be listed directly
+	_, body = sendRequestToServer(t, server, "GET",
+		"/v1/customers/"+customerID+"/sources", "", getDefaultHeaders())
+	assert.Equal(t, 1, len(decodeObject(t, body)["data"].([]interface{})))
+}
+
+func TestStatefulCustomers_SourceMissingCustomer(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, _ := sendRequestToServer(t, server, "POST",
+		"/v1/customers/cus_missing/sources", "source=tok_visa", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStatefulInvoiceLines(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/invoices",
+		"customer=cus_123", getDefaultHeaders())
+	invoiceID := decodeObject(t, body)["id"].(string)
+
+	var invoiceItemIDs []string
+	for i := 0; i < 5; i++ {
+		resp, body := sendRequestToServer(t, server, "POST", "/v1/invoiceitems",
+			"customer=cus_123&amount=100&currency=usd&invoice="+invoiceID, getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		invoiceItemIDs = append(invoiceItemIDs, decodeObject(t, body)["id"].(string))
+	}
+
+	// Items on another invoice aren't listed
+	resp, _ := sendRequestToServer(t, server, "POST", "/v1/invoiceitems",
+		"customer=cus_123&amount=100&currency=usd&invoice=in_other", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var listedItemIDs []string
+	params := "limit=2"
+	for page := 0; ; page++ {
+		resp, body := sendRequestToServer(t, server, "GET",
+			"/v1/invoices/"+invoiceID+"/lines?"+params, "", getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		list := decodeObject(t, body)
+		lines := list["data"].([]interface{})
+		assert.True(t, len(lines) <= 2)
+
+		var lastID string
+		for _, line := range lines {
+			lineMap := line.(map[string]interface{})
+			assert.Equal(t, "line_item", lineMap["object"])
+			assert.Equal(t, invoiceID, lineMap["invoice"])
+			listedItemIDs = append(listedItemIDs, lineMap["invoice_item"].(string))
+			lastID = lineMap["id"].(string)
+		}
+
+		if !list["has_more"].(bool) {
+			assert.Equal(t, 2, page)
+			break
+		}
+		params = "limit=2&starting_after=" + lastID
+	}
+	assert.Equal(t, invoiceItemIDs, listedItemIDs)
+}
+
+func TestStatefulInvoices_TaxRates(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/tax_rates",
+		"display_name=VAT&inclusive=false&percentage=20", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	taxRateID := decodeObject(t, body)["id"].(string)
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/invoices",
+		"customer=cus_123&default_tax_rates[]="+taxRateID, getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	invoice := decodeObject(t, body)
+	invoiceID := invoice["id"].(string)
+	assert.Equal(t, float64(0), invoice["total"])
+	taxRates := invoice["default_tax_rates"].([]interface{})
+	assert.Equal(t, 1, len(taxRates))
+	assert.Equal(t, taxRateID, taxRates[0].(map[string]interface{})["id"])
+
+	resp, _ = sendRequestToServer(t, server, "POST", "/v1/invoiceitems",
+		"customer=cus_123&amount=1000&currency=usd&invoice="+invoiceID, getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/invoices/"+invoiceID, "",
+		getDefaultHeaders())
+	invoice = decodeObject(t, body)
+	assert.Equal(t, float64(1000), invoice["subtotal"])
+	assert.Equal(t, float64(200), invoice["tax"])
+	assert.Equal(t, float64(1000), invoice["total_excluding_tax"])
+	assert.Equal(t, float64(1200), invoice["total"])
+	assert.Equal(t, float64(1200), invoice["amount_due"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"amount":            float64(200),
+			"inclusive":         false,
+			"tax_rate":          taxRateID,
+			"taxability_reason": "standard_rated",
+			"taxable_amount":    float64(1000),
+		},
+	}, invoice["total_tax_amounts"])
+	assert.Equal(t, 1, len(invoice["lines"].(map[string]interface{})["data"].([]interface{})))
+
+	// Inclusive tax is part of the total rather than added to it
+	_, body = sendRequestToServer(t, server, "POST", "/v1/tax_rates",
+		"display_name=VAT&inclusive=true&percentage=25", getDefaultHeaders())
+	inclusiveTaxRateID := decodeObject(t, body)["id"].(string)
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/invoices/"+invoiceID,
+		"default_tax_rates[]="+inclusiveTaxRateID, getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	invoice = decodeObject(t, body)
+	assert.Equal(t, float64(200), invoice["tax"])
+	assert.Equal(t, float64(800), invoice["total_excluding_tax"])
+	assert.Equal(t, float64(1000), invoice["total"])
+}
+
+func TestStatefulInvoices_MissingTaxRate(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/invoices",
+		"customer=cus_123&default_tax_rates[]=txr_missing", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "No such tax_rate: 'txr_missing'", errorInfo["message"])
+}
+
+func TestStatefulInvoiceUpcoming(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	_, body = sendRequestToServer(t, server, "POST", "/v1/prices",
+		"currency=eur&product=prod_123&unit_amount=1500", getDefaultHeaders())
+	priceID := decodeObject(t, body)["id"].(string)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/subscriptions",
+		"customer="+customerID+"&items[0][price]="+priceID+"&items[0][quantity]=2",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	subscription := decodeObject(t, body)
+	subscriptionID := subscription["id"].(string)
+	item := subscription["items"].(map[string]interface{})["data"].([]interface{})[0].(map[string]interface{})
+	itemID := item["id"].(string)
+	assert.Equal(t, subscriptionID, item["subscription"])
+
+	// A pending invoice item for the customer is added to the upcoming invoice
+	resp, _ = sendRequestToServer(t, server, "POST", "/v1/invoiceitems",
+		"customer="+customerID+"&amount=500&currency=eur", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/v1/invoices/upcoming?subscription="+subscriptionID, "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	invoice := decodeObject(t, body)
+	assert.Equal(t, "invoice", invoice["object"])
+	_, ok := invoice["id"]
+	assert.False(t, ok)
+	assert.Equal(t, customerID, invoice["customer"])
+	assert.Equal(t, subscriptionID, invoice["subscription"])
+	assert.Equal(t, "eur", invoice["currency"])
+	assert.Equal(t, float64(3500), invoice["amount_due"])
+	assert.Equal(t, float64(3500), invoice["total"])
+
+	lines := invoice["lines"].(map[string]interface{})["data"].([]interface{})
+	assert.Equal(t, 2, len(lines))
+	line := lines[0].(map[string]interface{})
+	assert.Equal(t, "subscription", line["type"])
+	assert.Equal(t, itemID, line["subscription_item"])
+	assert.Equal(t, priceID, line["price"].(map[string]interface{})["id"])
+	assert.Equal(t, float64(2), line["quantity"])
+	assert.Equal(t, float64(3000), line["amount"])
+	assert.Equal(t, "invoiceitem", lines[1].(map[string]interface{})["type"])
+
+	// Changes to subscription items are previewed, but not saved
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/v1/invoices/upcoming?subscription="+subscriptionID+
+			"&subscription_items[0][id]="+itemID+"&subscription_items[0][quantity]=3",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(5000), decodeObject(t, body)["amount_due"])
+
+	_, body = sendRequestToServer(t, server, "GET",
+		"/v1/subscriptions/"+subscriptionID, "", getDefaultHeaders())
+	item = decodeObject(t, body)["items"].(map[string]interface{})["data"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, float64(2), item["quantity"])
+}
+
+func TestStatefulInvoiceUpcoming_Coupon(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/coupons",
+		"id=SAVE20&percent_off=20&duration=forever", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	coupon := decodeObject(t, body)
+	assert.Equal(t, "SAVE20", coupon["id"])
+	assert.Equal(t, float64(20), coupon["percent_off"])
+	assert.Nil(t, coupon["amount_off"])
+
+	_, body = sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	_, body = sendRequestToServer(t, server, "POST", "/v1/prices",
+		"currency=usd&product=prod_123&unit_amount=1500", getDefaultHeaders())
+	priceID := decodeObject(t, body)["id"].(string)
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/subscriptions",
+		"customer="+customerID+"&items[0][price]="+priceID+"&items[0][quantity]=2&coupon=SAVE20",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	subscription := decodeObject(t, body)
+	subscriptionID := subscription["id"].(string)
+
+	discount := subscription["discount"].(map[string]interface{})
+	assert.Equal(t, "discount", discount["object"])
+	assert.Equal(t, "SAVE20", discount["coupon"].(map[string]interface{})["id"])
+	assert.Equal(t, subscriptionID, discount["subscription"])
+	assert.Equal(t, []interface{}{discount["id"]}, subscription["discounts"])
+
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/v1/invoices/upcoming?subscription="+subscriptionID, "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	invoice := decodeObject(t, body)
+	assert.Equal(t, float64(3000), invoice["subtotal"])
+	assert.Equal(t, float64(2400), invoice["total"])
+	assert.Equal(t, float64(2400), invoice["amount_due"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"amount": float64(600), "discount": discount["id"]},
+	}, invoice["total_discount_amounts"])
+
+	// An amount off is applied on top when added with an update
+	_, body = sendRequestToServer(t, server, "POST", "/v1/coupons",
+		"amount_off=500&currency=usd&duration=once", getDefaultHeaders())
+	couponID := decodeObject(t, body)["id"].(string)
+
+	resp, _ = sendRequestToServer(t, server, "POST", "/v1/subscriptions/"+subscriptionID,
+		"discounts[0][coupon]=SAVE20&discounts[1][coupon]="+couponID, getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, body = sendRequestToServer(t, server, "GET",
+		"/v1/invoices/upcoming?subscription="+subscriptionID, "", getDefaultHeaders())
+	assert.Equal(t, float64(1900), decodeObject(t, body)["total"])
+}
+
+func TestStatefulSubscriptions_MissingCoupon(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/subscriptions",
+		"customer="+customerID+"&coupon=MISSING", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "No such coupon: 'MISSING'", errorInfo["message"])
+}
+
+func TestStatefulSubscriptions_Cancel(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/subscriptions",
+		"customer=cus_123", getDefaultHeaders())
+	subscriptionID := decodeObject(t, body)["id"].(string)
+
+	resp, body := sendRequestToServer(t, server, "DELETE",
+		"/v1/subscriptions/"+subscriptionID,
+		"cancellation_details[feedback]=too_expensive", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	subscription := decodeObject(t, body)
+	assert.Equal(t, subscriptionID, subscription["id"])
+	assert.Equal(t, "canceled", subscription["status"])
+	assert.Equal(t, false, subscription["cancel_at_period_end"])
+	assert.NotNil(t, subscription["canceled_at"])
+	assert.Equal(t, subscription["canceled_at"], subscription["ended_at"])
+	cancellationDetails := subscription["cancellation_details"].(map[string]interface{})
+	assert.Equal(t, "too_expensive", cancellationDetails["feedback"])
+
+	_, body = sendRequestToServer(t, server, "GET",
+		"/v1/subscriptions/"+subscriptionID, "", getDefaultHeaders())
+	assert.Equal(t, "canceled", decodeObject(t, body)["status"])
+}
+
+func TestStatefulSubscriptions_CancelAtPeriodEnd(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/subscriptions",
+		"customer=cus_123", getDefaultHeaders())
+	created := decodeObject(t, body)
+
+	resp, body := sendRequestToServer(t, server, "DELETE",
+		"/v1/subscriptions/"+created["id"].(string), "at_period_end=true",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	subscription := decodeObject(t, body)
+	assert.Equal(t, created["status"], subscription["status"])
+	assert.Equal(t, true, subscription["cancel_at_period_end"])
+	assert.Equal(t, created["current_period_end"], subscription["cancel_at"])
+	assert.NotNil(t, subscription["canceled_at"])
+	assert.Equal(t, created["ended_at"], subscription["ended_at"])
+}
+
+func TestStatefulSubscriptions_CancelMissing(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "DELETE",
+		"/v1/subscriptions/sub_missing", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "No such subscription: 'sub_missing'", errorInfo["message"])
+}
+
+func TestStatefulInvoiceUpcoming_MissingSubscription(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "GET",
+		"/v1/invoices/upcoming?subscription=sub_missing", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "No such subscription: 'sub_missing'", errorInfo["message"])
+}
+
+func TestStatefulCharges_FilterByPaymentIntent(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	var paymentIntentIDs []string
+	for i := 0; i < 2; i++ {
+		resp, body := sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+			"amount=2000&currency=usd&payment_method=pm_card_visa&confirm=true", getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		paymentIntent := decodeObject(t, body)
+		assert.Equal(t, "succeeded", paymentIntent["status"])
+		paymentIntentIDs = append(paymentIntentIDs, paymentIntent["id"].(string))
+	}
+
+	// A charge that's not linked to any payment intent
+	resp, _ := sendRequestToServer(t, server, "POST", "/v1/charges",
+		"amount=1000&currency=usd&source=tok_visa", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := sendRequestToServer(t, server, "GET",
+		"/v1/charges?payment_intent="+paymentIntentIDs[0], "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	charges := decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, 1, len(charges))
+	charge := charges[0].(map[string]interface{})
+	assert.Equal(t, paymentIntentIDs[0], charge["payment_intent"])
+	assert.Equal(t, float64(2000), charge["amount"])
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/payment_intents/"+paymentIntentIDs[0],
+		"", getDefaultHeaders())
+	assert.Equal(t, charge["id"], decodeObject(t, body)["latest_charge"])
+
+	// All charges are listed without a filter, newest first
+	_, body = sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+	charges = decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, 3, len(charges))
+	assert.Nil(t, charges[0].(map[string]interface{})["payment_intent"])
+
+	// Unknown payment intents have no charges
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/charges?payment_intent=pi_unknown",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 0, len(decodeObject(t, body)["data"].([]interface{})))
+}
+
+func TestStatefulCharges_ExpandCustomer(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/customers",
+		"email=jane@example.com", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	customerID := decodeObject(t, body)["id"].(string)
+
+	for i := 0; i < 2; i++ {
+		resp, _ = sendRequestToServer(t, server, "POST", "/v1/charges",
+			"amount=1000&currency=usd&source=tok_visa&customer="+customerID, getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/v1/charges?expand[]=data.customer", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	charges := decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, 2, len(charges))
+	for _, item := range charges {
+		customer, ok := item.(map[string]interface{})["customer"].(map[string]interface{})
+		assert.True(t, ok, "expected customer to be expanded")
+		assert.Equal(t, customerID, customer["id"])
+		assert.Equal(t, "jane@example.com", customer["email"])
+	}
+
+	// Without the expansion, charges only have the customer's ID
+	_, body = sendRequestToServer(t, server, "GET", "/v1/charges", "", getDefaultHeaders())
+	charges = decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, customerID, charges[0].(map[string]interface{})["customer"])
+}
+
+func TestStatefulPaymentIntents_Cancel(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=2000&currency=usd", getDefaultHeaders())
+	paymentIntent := decodeObject(t, body)
+	paymentIntentID := paymentIntent["id"].(string)
+	assert.Equal(t, "requires_payment_method", paymentIntent["status"])
+
+	resp, body := sendRequestToServer(t, server, "POST",
+		"/v1/payment_intents/"+paymentIntentID+"/cancel",
+		"cancellation_reason=abandoned", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	paymentIntent = decodeObject(t, body)
+	assert.Equal(t, "canceled", paymentIntent["status"])
+	assert.Equal(t, "abandoned", paymentIntent["cancellation_reason"])
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/payment_intents/"+paymentIntentID,
+		"", getDefaultHeaders())
+	paymentIntent = decodeObject(t, body)
+	assert.Equal(t, "canceled", paymentIntent["status"])
+	assert.Equal(t, "abandoned", paymentIntent["cancellation_reason"])
+}
+
+func TestStatefulPaymentIntents_CancelSucceeded(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=2000&currency=usd&payment_method=pm_card_visa&confirm=true", getDefaultHeaders())
+	paymentIntentID := decodeObject(t, body)["id"].(string)
+
+	resp, body := sendRequestToServer(t, server, "POST",
+		"/v1/payment_intents/"+paymentIntentID+"/cancel", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "it has a status of succeeded")
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/payment_intents/"+paymentIntentID,
+		"", getDefaultHeaders())
+	assert.Equal(t, "succeeded", decodeObject(t, body)["status"])
+}
+
+func TestStatefulPaymentIntents_SetupFutureUsage(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=2000&currency=usd&customer="+customerID+
+			"&payment_method=pm_card_visa&setup_future_usage=off_session&confirm=true",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	paymentIntent := decodeObject(t, body)
+	assert.Equal(t, "succeeded", paymentIntent["status"])
+
+	// Test payment methods are saved as a new payment method
+	paymentMethodID := paymentIntent["payment_method"].(string)
+	assert.NotEqual(t, "pm_card_visa", paymentMethodID)
+
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/payment_methods/"+paymentMethodID,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, customerID, decodeObject(t, body)["customer"])
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/charges/"+paymentIntent["latest_charge"].(string),
+		"", getDefaultHeaders())
+	assert.Equal(t, paymentMethodID, decodeObject(t, body)["payment_method"])
+
+	// A stored payment method is attached as it is
+	_, body = sendRequestToServer(t, server, "POST", "/v1/payment_methods",
+		"type=card&card[number]=4242424242424242&card[exp_month]=12&card[exp_year]=2030",
+		getDefaultHeaders())
+	paymentMethodID = decodeObject(t, body)["id"].(string)
+
+	_, body = sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=2000&currency=usd&customer="+customerID+"&setup_future_usage=on_session",
+		getDefaultHeaders())
+	paymentIntentID := decodeObject(t, body)["id"].(string)
+
+	resp, body = sendRequestToServer(t, server, "POST",
+		"/v1/payment_intents/"+paymentIntentID+"/confirm",
+		"payment_method="+paymentMethodID, getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, paymentMethodID, decodeObject(t, body)["payment_method"])
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/payment_methods/"+paymentMethodID,
+		"", getDefaultHeaders())
+	assert.Equal(t, customerID, decodeObject(t, body)["customer"])
+}
+
+func TestStatefulPaymentIntents_NoSetupFutureUsage(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=2000&currency=usd&customer=cus_123&payment_method=pm_card_visa&confirm=true",
+		getDefaultHeaders())
+	paymentIntent := decodeObject(t, body)
+	assert.Equal(t, "pm_card_visa", paymentIntent["payment_method"])
+
+	resp, _ := sendRequestToServer(t, server, "GET", "/v1/payment_methods/pm_card_visa",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStatefulPaymentMethods_FilterByCustomerAndType(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	// Test payment methods are attached as new payment methods
+	var cardIDs []interface{}
+	for _, testPaymentMethod := range []string{"pm_card_visa", "pm_card_mastercard"} {
+		resp, body := sendRequestToServer(t, server, "POST",
+			"/v1/payment_methods/"+testPaymentMethod+"/attach",
+			"customer="+customerID, getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		paymentMethod := decodeObject(t, body)
+		assert.Equal(t, customerID, paymentMethod["customer"])
+		assert.NotEqual(t, testPaymentMethod, paymentMethod["id"])
+		cardIDs = append([]interface{}{paymentMethod["id"]}, cardIDs...)
+	}
+
+	_, body = sendRequestToServer(t, server, "POST", "/v1/payment_methods",
+		"type=us_bank_account&us_bank_account[account_holder_type]=individual"+
+			"&us_bank_account[account_number]=000123456789&us_bank_account[routing_number]=110000000",
+		getDefaultHeaders())
+	bankAccount := decodeObject(t, body)
+	assert.Equal(t, "us_bank_account", bankAccount["type"])
+
+	resp, _ := sendRequestToServer(t, server, "POST",
+		"/v1/payment_methods/"+bankAccount["id"].(string)+"/attach",
+		"customer="+customerID, getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A card belonging to another customer
+	resp, _ = sendRequestToServer(t, server, "POST", "/v1/payment_methods/pm_card_visa/attach",
+		"customer=cus_other", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	listIDs := func(path string) []interface{} {
+		resp, body := sendRequestToServer(t, server, "GET", path, "", getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var ids []interface{}
+		for _, paymentMethod := range decodeObject(t, body)["data"].([]interface{}) {
+			ids = append(ids, paymentMethod.(map[string]interface{})["id"])
+		}
+		return ids
+	}
+
+	assert.Equal(t, cardIDs, listIDs("/v1/payment_methods?customer="+customerID+"&type=card"))
+	assert.Equal(t, cardIDs, listIDs("/v1/customers/"+customerID+"/payment_methods?type=card"))
+	assert.Equal(t,
+		append([]interface{}{bankAccount["id"]}, cardIDs...),
+		listIDs("/v1/customers/"+customerID+"/payment_methods"))
+
+	// Detached payment methods aren't listed anymore
+	resp, body = sendRequestToServer(t, server, "POST",
+		"/v1/payment_methods/"+cardIDs[0].(string)+"/detach", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, decodeObject(t, body)["customer"])
+	assert.Equal(t, cardIDs[1:], listIDs("/v1/payment_methods?customer="+customerID+"&type=card"))
+
+	// Only test payment methods can be attached without being stored
+	resp, _ = sendRequestToServer(t, server, "POST", "/v1/payment_methods/pm_missing/attach",
+		"customer="+customerID, getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStatefulRefunds(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/charges",
+		"amount=1000&currency=usd&source=tok_visa", getDefaultHeaders())
+	chargeID := decodeObject(t, body)["id"].(string)
+
+	getCharge := func() map[string]interface{} {
+		resp, body := sendRequestToServer(t, server, "GET", "/v1/charges/"+chargeID,
+			"", getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return decodeObject(t, body)
+	}
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/refunds",
+		"charge="+chargeID+"&amount=300", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	refund := decodeObject(t, body)
+	refundID := refund["id"].(string)
+	assert.Equal(t, float64(300), refund["amount"])
+	assert.Equal(t, float64(300), getCharge()["amount_refunded"])
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/refunds",
+		"charge="+chargeID+"&amount=800", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "greater than unrefunded amount")
+
+	// Metadata update
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/refunds/"+refundID,
+		"metadata[reason]=duplicate", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{"reason": "duplicate"}, decodeObject(t, body)["metadata"])
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/refunds/"+refundID,
+		"", getDefaultHeaders())
+	refund = decodeObject(t, body)
+	assert.Equal(t, map[string]interface{}{"reason": "duplicate"}, refund["metadata"])
+	assert.Equal(t, float64(300), refund["amount"])
+
+	// A refund without an amount refunds the rest of the charge
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/refunds",
+		"charge="+chargeID, getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(700), decodeObject(t, body)["amount"])
+	charge := getCharge()
+	assert.Equal(t, float64(1000), charge["amount_refunded"])
+	assert.Equal(t, true, charge["refunded"])
+
+	// Nothing more can be refunded from a fully refunded charge
+	for _, params := range []string{"&amount=1", ""} {
+		resp, body = sendRequestToServer(t, server, "POST", "/v1/refunds",
+			"charge="+chargeID+params, getDefaultHeaders())
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+		assert.Equal(t, "charge_already_refunded", errorInfo["code"])
+		assert.Equal(t, "Charge "+chargeID+" has already been refunded.", errorInfo["message"])
+	}
+
+	// Cancellation gives the refunded amount back to the charge
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/refunds/"+refundID+"/cancel",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "canceled", decodeObject(t, body)["status"])
+	charge = getCharge()
+	assert.Equal(t, float64(700), charge["amount_refunded"])
+	assert.Equal(t, false, charge["refunded"])
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/refunds/"+refundID+"/cancel",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "already been canceled")
+}
+
+func TestStatefulRefunds_Concurrent(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/charges",
+		"amount=1000&currency=usd&source=tok_visa", getDefaultHeaders())
+	chargeID := decodeObject(t, body)["id"].(string)
+
+	// Refunds made at the same time never add up to more than the charge
+	var wg sync.WaitGroup
+	statuses := make([]int, 50)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, _ := sendRequestToServer(t, server, "POST", "/v1/refunds",
+				"charge="+chargeID+"&amount=100", getDefaultHeaders())
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 10, succeeded)
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/charges/"+chargeID,
+		"", getDefaultHeaders())
+	charge := decodeObject(t, body)
+	assert.Equal(t, float64(1000), charge["amount_refunded"])
+	assert.Equal(t, true, charge["refunded"])
+}
+
+func TestStatefulRefunds_ConcurrentCancels(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/charges",
+		"amount=1000&currency=usd&source=tok_visa", getDefaultHeaders())
+	chargeID := decodeObject(t, body)["id"].(string)
+
+	_, body = sendRequestToServer(t, server, "POST", "/v1/refunds",
+		"charge="+chargeID+"&amount=300", getDefaultHeaders())
+	refundID := decodeObject(t, body)["id"].(string)
+
+	// Only one of several cancellations made at the same time succeeds, so
+	// the refunded amount is only given back once
+	var wg sync.WaitGroup
+	statuses := make([]int, 20)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, _ := sendRequestToServer(t, server, "POST",
+				"/v1/refunds/"+refundID+"/cancel", "", getDefaultHeaders())
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/charges/"+chargeID,
+		"", getDefaultHeaders())
+	assert.Equal(t, float64(0), decodeObject(t, body)["amount_refunded"])
+}
+
+func TestStatefulTransfers(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/transfers",
+		"amount=1000&currency=usd&destination=acct_123", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	transferID := decodeObject(t, body)["id"].(string)
+
+	resp, body = sendRequestToServer(t, server, "POST",
+		"/v1/transfers/"+transferID+"/reversals", "amount=400", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	reversal := decodeObject(t, body)
+	assert.Equal(t, "transfer_reversal", reversal["object"])
+	assert.Equal(t, transferID, reversal["transfer"])
+	assert.Equal(t, float64(400), reversal["amount"])
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/transfers/"+transferID,
+		"", getDefaultHeaders())
+	transfer := decodeObject(t, body)
+	assert.Equal(t, float64(400), transfer["amount_reversed"])
+	assert.Equal(t, false, transfer["reversed"])
+	reversals := transfer["reversals"].(map[string]interface{})["data"].([]interface{})
+	assert.Equal(t, 1, len(reversals))
+	assert.Equal(t, reversal["id"], reversals[0].(map[string]interface{})["id"])
+
+	// More than what remains of the transfer can't be reversed
+	resp, body = sendRequestToServer(t, server, "POST",
+		"/v1/transfers/"+transferID+"/reversals", "amount=700", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "Reversal amount (700) is greater than unreversed amount on transfer (600).")
+
+	// Without an amount, the rest of the transfer is reversed
+	resp, body = sendRequestToServer(t, server, "POST",
+		"/v1/transfers/"+transferID+"/reversals", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(600), decodeObject(t, body)["amount"])
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/transfers/"+transferID,
+		"", getDefaultHeaders())
+	transfer = decodeObject(t, body)
+	assert.Equal(t, float64(1000), transfer["amount_reversed"])
+	assert.Equal(t, true, transfer["reversed"])
+
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/v1/transfers/"+transferID+"/reversals", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	reversals = decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, 2, len(reversals))
+	assert.Equal(t, float64(600), reversals[0].(map[string]interface{})["amount"])
+	assert.Equal(t, float64(400), reversals[1].(map[string]interface{})["amount"])
+}
+
+func TestStatefulTransfers_ConcurrentReversals(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/transfers",
+		"amount=1000&currency=usd&destination=acct_123", getDefaultHeaders())
+	transferID := decodeObject(t, body)["id"].(string)
+
+	// Reversals made at the same time never add up to more than the transfer
+	var wg sync.WaitGroup
+	statuses := make([]int, 50)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, _ := sendRequestToServer(t, server, "POST",
+				"/v1/transfers/"+transferID+"/reversals", "amount=100", getDefaultHeaders())
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 10, succeeded)
+
+	_, body = sendRequestToServer(t, server, "GET", "/v1/transfers/"+transferID,
+		"", getDefaultHeaders())
+	transfer := decodeObject(t, body)
+	assert.Equal(t, float64(1000), transfer["amount_reversed"])
+	assert.Equal(t, true, transfer["reversed"])
+
+	_, body = sendRequestToServer(t, server, "GET",
+		"/v1/transfers/"+transferID+"/reversals?limit=100", "", getDefaultHeaders())
+	assert.Equal(t, 10, len(decodeObject(t, body)["data"].([]interface{})))
+}
+
+func TestStatefulTransfers_ReversalMissingTransfer(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	resp, body := sendRequestToServer(t, server, "POST",
+		"/v1/transfers/tr_missing/reversals", "amount=100", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "No such transfer: 'tr_missing'")
+}
+
+func TestMergeRequestData(t *testing.T) {
+	object := map[string]interface{}{
+		"description": "old",
+		"metadata":    map[string]interface{}{"a": "1", "b": "2"},
+		"shipping":    nil,
+	}
+	mergeRequestData(object, map[string]interface{}{
+		"description": "",
+		"expand":      []interface{}{"shipping"},
+		"metadata":    map[string]interface{}{"a": "", "c": "3"},
+		"shipping":    map[string]interface{}{"name": "A"},
+	})
+	assert.Equal(t, map[string]interface{}{
+		"description": nil,
+		"metadata":    map[string]interface{}{"b": "2", "c": "3"},
+		"shipping":    map[string]interface{}{"name": "A"},
+	}, object)
+
+	mergeRequestData(object, map[string]interface{}{"metadata": ""})
+	assert.Equal(t, map[string]interface{}{}, object["metadata"])
+}
+
+//
+// Private functions
+//
+
+func decodeObject(t *testing.T, body []byte) map[string]interface{} {
+	var data map[string]interface{}
+	err := json.Unmarshal(body, &data)
+	assert.NoError(t, err)
+	return data
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// Private types
+//
+
+// objectStore is an in-memory store of objects keyed by their IDs. It's used
+// in stateful mode so that objects created or modified by one request can be
+// reflected into the responses of subsequent requests.
+//
+// Objects are stored as the same generic maps that DataGenerator produces.
+// Callers should consider objects returned from the store as owned by the
+// store, and make a copy with copyObject before mutating them outside of an
+// update.
+//
+// Objects of some types can be made to expire some time after they're first
+// stored, after which the store behaves as if they'd never been stored. Expired
+// objects are hidden right away, and deleted the next time an object is
+// stored.
+//
+// It's safe for concurrent use.
+type objectStore struct {
+	mutex sync.RWMutex
+
+	// expiresAt maps the IDs of objects that expire to when they expire.
+	expiresAt map[string]time.Time
+
+	// ids contains the IDs of all stored objects in the order that they were
+	// first stored. It's used to return objects in a stable order.
+	ids []string
+
+	// objects maps object IDs to objects.
+	objects map[string]map[string]interface{}
+
+	// now returns the current time. It's a field so that the server can make
+	// it the time that responses are generated at, and so that tests can
+	// simulate the passing of time.
+	now func() time.Time
+
+	// ttls maps object types (the value of an object's `object` field) to how
+	// long objects of that type are kept before they expire. Objects of other
+	// types never expire.
+	ttls map[string]time.Duration
+}
+
+// newObjectStore initializes a new, empty objectStore in which objects of the
+// types in ttls expire after the given durations. ttls may be nil.
+func newObjectStore(ttls map[string]time.Duration) *objectStore {
+	return &objectStore{
+		expiresAt: make(map[string]time.Time),
+		objects:   make(map[string]map[string]interface{}),
+		now:       time.Now,
+		ttls:      ttls,
+	}
+}
+
+// clear removes every object from the store and returns the number of objects
+// removed, not counting those that had already expired.
+func (s *objectStore) clear() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := 0
+	for _, id := range s.ids {
+		if _, ok := s.lookup(id); ok {
+			removed++
+		}
+	}
+
+	s.expiresAt = make(map[string]time.Time)
+	s.ids = nil
+	s.objects = make(map[string]map[string]interface{})
+	return removed
+}
+
+// get retrieves a copy of the object with the given ID. The second return
+// value is false if no such object was found.
+func (s *objectStore) get(id string) (map[string]interface{}, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	object, ok := s.lookup(id)
+	if !ok {
+		return nil, false
+	}
+	return copyObject(object), true
+}
+
+// list retrieves copies of all objects for which the given function returns
+// true. Objects are returned in the order in which they were first stored.
+func (s *objectStore) list(match func(object map[string]interface{}) bool) []map[string]interface{} {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var objects []map[string]interface{}
+	for _, id := range s.ids {
+		object, ok := s.lookup(id)
+		if ok && match(object) {
+			objects = append(objects, copyObject(object))
+		}
+	}
+	return objects
+}
+
+// listNewestFirst is like list, but returns objects in the reverse order in
+// which they were first stored, which is the order that the Stripe API lists
+// objects in.
+func (s *objectStore) listNewestFirst(match func(object map[string]interface{}) bool) []map[string]interface{} {
+	objects := s.list(match)
+	for i, j := 0, len(objects)-1; i < j; i, j = i+1, j-1 {
+		objects[i], objects[j] = objects[j], objects[i]
+	}
+	return objects
+}
+
+// put stores a copy of an object under the given ID, replacing any object
+// that was previously stored under it.
+func (s *objectStore) put(id string, object map[string]interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sweep()
+
+	if _, ok := s.objects[id]; !ok {
+		s.ids = append(s.ids, id)
+	}
+
+	// An object's lifetime starts when it's first stored, so replacing it
+	// doesn't extend it.
+	if _, ok := s.lookup(id); !ok {
+		delete(s.expiresAt, id)
+		if objectType, ok := object["object"].(string); ok {
+			if ttl, ok := s.ttls[objectType]; ok {
+				s.expiresAt[id] = s.now().Add(ttl)
+			}
+		}
+	}
+
+	s.objects[id] = copyObject(object)
+}
+
+// remove removes the object with the given ID from the store. The return value
+// is false if no such object was found.
+func (s *objectStore) remove(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.lookup(id); !ok {
+		return false
+	}
+
+	delete(s.expiresAt, id)
+	delete(s.objects, id)
+	for i, storedID := range s.ids {
+		if storedID == id {
+			s.ids = append(s.ids[:i], s.ids[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// removeAll removes all objects for which the given function returns true
+// and returns the number of objects removed.
+func (s *objectStore) removeAll(match func(object map[string]interface{}) bool) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var ids []string
+	removed := 0
+	for _, id := range s.ids {
+		object, ok := s.lookup(id)
+		if ok && match(object) {
+			delete(s.expiresAt, id)
+			delete(s.objects, id)
+			removed++
+			continue
+		}
+		ids = append(ids, id)
+	}
+	s.ids = ids
+	return removed
+}
+
+// update calls the given function with the stored object with the given ID so
+// that it can be modified in place. The return value is false if no such
+// object was found.
+//
+// The store is locked while the function runs, so it shouldn't call back into
+// the store.
+func (s *objectStore) update(id string, modify func(object map[string]interface{})) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	object, ok := s.lookup(id)
+	if !ok {
+		return false
+	}
+	modify(object)
+	return true
+}
+
+// sweep deletes expired objects, which are otherwise only hidden by lookup
+// because it's called with only a read lock held. The caller must hold the
+// mutex for writing.
+func (s *objectStore) sweep() {
+	now := s.now()
+
+	expired := make(map[string]bool)
+	for id, expiresAt := range s.expiresAt {
+		if !now.Before(expiresAt) {
+			expired[id] = true
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	ids := make([]string, 0, len(s.ids)-len(expired))
+	for _, id := range s.ids {
+		if expired[id] {
+			delete(s.expiresAt, id)
+			delete(s.objects, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	s.ids = ids
+}
+
+// lookup finds the object with the given ID, treating it as missing if it's
+// expired. The caller must hold the mutex.
+func (s *objectStore) lookup(id string) (map[string]interface{}, bool) {
+	object, ok := s.objects[id]
+	if !ok {
+		return nil, false
+	}
+	if expiresAt, ok := s.expiresAt[id]; ok && !s.now().Before(expiresAt) {
+		return nil, false
+	}
+	return object, true
+}
+
+//
+// Private functions
+//
+
+// copyObject makes a deep copy of an object so that it can be mutated without
+// affecting the original.
+func copyObject(object map[string]interface{}) map[string]interface{} {
+	return copyValue(object).(map[string]interface{})
+}
+
+// copyValue makes a deep copy of a generic value made up of maps, slices, and
+// scalars.
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, subValue := range v {
+			copied[key] = copyValue(subValue)
+		}
+		return copied
+
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, subValue := range v {
+			copied[i] = copyValue(subValue)
+		}
+		return copied
+	}
+
+	return value
+}
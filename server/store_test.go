@@ -0,0 +1,162 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestObjectStore(t *testing.T) {
+	store := newObjectStore(nil)
+
+	// Missing object
+	{
+		_, ok := store.get("cus_123")
+		assert.False(t, ok)
+	}
+
+	store.put("cus_123", map[string]interface{}{"id": "cus_123", "object": "customer"})
+	store.put("ch_123", map[string]interface{}{"id": "ch_123", "object": "charge"})
+	store.put("cus_456", map[string]interface{}{"id": "cus_456", "object": "customer"})
+
+	// Get
+	{
+		object, ok := store.get("cus_123")
+		assert.True(t, ok)
+		assert.Equal(t, "customer", object["object"])
+	}
+
+	// List in insertion order
+	{
+		objects := store.list(func(object map[string]interface{}) bool {
+			return object["object"] == "customer"
+		})
+		assert.Equal(t, 2, len(objects))
+		assert.Equal(t, "cus_123", objects[0]["id"])
+		assert.Equal(t, "cus_456", objects[1]["id"])
+	}
+
+	// List newest first
+	{
+		objects := store.listNewestFirst(func(object map[string]interface{}) bool {
+			return object["object"] == "customer"
+		})
+		assert.Equal(t, 2, len(objects))
+		assert.Equal(t, "cus_456", objects[0]["id"])
+		assert.Equal(t, "cus_123", objects[1]["id"])
+	}
+
+	// Remove all matching objects
+	{
+		store.put("cus_789", map[string]interface{}{"id": "cus_789", "object": "customer"})
+		removed := store.removeAll(func(object map[string]interface{}) bool {
+			return object["id"] == "cus_456" || object["id"] == "cus_789"
+		})
+		assert.Equal(t, 2, removed)
+		objects := store.list(func(object map[string]interface{}) bool { return true })
+		assert.Equal(t, 2, len(objects))
+		assert.Equal(t, "cus_123", objects[0]["id"])
+		assert.Equal(t, "ch_123", objects[1]["id"])
+	}
+
+	// Replacing an object keeps its original position
+	{
+		store.put("cus_123", map[string]interface{}{"id": "cus_123", "object": "customer", "name": "A"})
+		objects := store.list(func(object map[string]interface{}) bool { return true })
+		assert.Equal(t, 2, len(objects))
+		assert.Equal(t, "cus_123", objects[0]["id"])
+		assert.Equal(t, "A", objects[0]["name"])
+	}
+
+	// Remove
+	{
+		assert.True(t, store.remove("ch_123"))
+		assert.False(t, store.remove("ch_123"))
+		_, ok := store.get("ch_123")
+		assert.False(t, ok)
+	}
+}
+
+func TestObjectStore_CopiesObjects(t *testing.T) {
+	store := newObjectStore(nil)
+
+	object := map[string]interface{}{
+		"id":       "cus_123",
+		"metadata": map[string]interface{}{"foo": "bar"},
+	}
+	store.put("cus_123", object)
+
+	// Mutating the original doesn't affect the stored object
+	object["metadata"].(map[string]interface{})["foo"] = "baz"
+	stored, _ := store.get("cus_123")
+	assert.Equal(t, "bar", stored["metadata"].(map[string]interface{})["foo"])
+
+	// Nor does mutating a retrieved object
+	stored["metadata"].(map[string]interface{})["foo"] = "baz"
+	stored, _ = store.get("cus_123")
+	assert.Equal(t, "bar", stored["metadata"].(map[string]interface{})["foo"])
+}
+
+func TestObjectStore_Update(t *testing.T) {
+	store := newObjectStore(nil)
+	store.put("ch_123", map[string]interface{}{"id": "ch_123", "amount_refunded": 0})
+
+	ok := store.update("ch_123", func(object map[string]interface{}) {
+		object["amount_refunded"] = 100
+	})
+	assert.True(t, ok)
+
+	object, _ := store.get("ch_123")
+	assert.Equal(t, 100, object["amount_refunded"])
+
+	ok = store.update("ch_456", func(object map[string]interface{}) {
+		t.Fatal("Shouldn't be called for a missing object")
+	})
+	assert.False(t, ok)
+}
+
+func TestObjectStore_TTL(t *testing.T) {
+	store := newObjectStore(map[string]time.Duration{"checkout.session": time.Hour})
+
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+
+	store.put("cs_123", map[string]interface{}{"id": "cs_123", "object": "checkout.session"})
+	store.put("cus_123", map[string]interface{}{"id": "cus_123", "object": "customer"})
+
+	// Replacing an object doesn't extend its lifetime
+	now = now.Add(30 * time.Minute)
+	store.put("cs_123", map[string]interface{}{"id": "cs_123", "object": "checkout.session", "status": "open"})
+
+	now = now.Add(29 * time.Minute)
+	object, ok := store.get("cs_123")
+	assert.True(t, ok)
+	assert.Equal(t, "open", object["status"])
+
+	now = now.Add(time.Minute)
+	_, ok = store.get("cs_123")
+	assert.False(t, ok)
+	assert.False(t, store.update("cs_123", func(object map[string]interface{}) {}))
+	assert.False(t, store.remove("cs_123"))
+
+	// Objects of types without a TTL never expire
+	objects := store.list(func(object map[string]interface{}) bool { return true })
+	assert.Equal(t, 1, len(objects))
+	assert.Equal(t, "cus_123", objects[0]["id"])
+
+	// Expired objects are deleted once another object is stored
+	_, ok = store.objects["cs_123"]
+	assert.True(t, ok)
+	store.put("cus_456", map[string]interface{}{"id": "cus_456", "object": "customer"})
+	_, ok = store.objects["cs_123"]
+	assert.False(t, ok)
+	_, ok = store.expiresAt["cs_123"]
+	assert.False(t, ok)
+	assert.Equal(t, []string{"cus_123", "cus_456"}, store.ids)
+
+	// Storing an expired object again starts a new lifetime
+	store.put("cs_123", map[string]interface{}{"id": "cs_123", "object": "checkout.session"})
+	_, ok = store.get("cs_123")
+	assert.True(t, ok)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private functions
+//
+
+// genericStatefulHandler finds a handler for a route that doesn't have one in
+// statefulHandlers, so that in stateful mode the objects of every resource
+// that can be created are stored, even those without special behavior:
+//
+//	POST   /v1/{resources}        creates an object and stores it
+//	GET    /v1/{resources}        lists the stored objects
+//	GET    /v1/{resources}/{id}   retrieves a stored object
+//	POST   /v1/{resources}/{id}   updates a stored object
+//	DELETE /v1/{resources}/{id}   removes a stored object
+//
+// Only top-level resources with a route to create them are handled, because
+// those are the only ones whose objects can all be stored. Others are served
+// normally, and nil is returned for them.
+func (s *StubServer) genericStatefulHandler(route *stubServerRoute, method string) statefulHandler {
+	collection, hasID := splitResourcePath(route.path)
+	if collection == "" || !s.hasRoute(http.MethodPost, collection) {
+		return nil
+	}
+
+	switch {
+	case !hasID && method == http.MethodGet:
+		return handleStoredObjectList
+	case !hasID && method == http.MethodPost:
+		return handleObjectCreate
+	case hasID && method == http.MethodDelete:
+		return handleObjectDelete
+	case hasID && method == http.MethodGet:
+		return handleObjectRetrieve
+	case hasID && method == http.MethodPost:
+		return handleObjectUpdate
+	}
+	return nil
+}
+
+// handleObjectDelete removes a stored object and responds with the stub of
+// the deleted object that was generated for the request. A 404 is returned if
+// it hasn't been stored.
+func handleObjectDelete(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	id := req.primaryID()
+	if !s.store.remove(id) {
+		return nil, noSuchObjectError(data["object"], id)
+	}
+	return data, nil
+}
+
+// handleStoredObjectList lists the stored objects of the type in a generated
+// list like handleObjectList. It's used for resources that don't name the
+// parameters by which they can be filtered, so every parameter with a single
+// value (like `customer=cus_123`) is used as a filter on the field of the
+// same name, for objects that have that field.
+//
+// The type of the objects is that of the generated list's objects, so lists
+// that were generated empty are left as they are.
+func handleStoredObjectList(s *StubServer, req *statefulRequest, data map[string]interface{}) (interface{}, *requestError) {
+	items, _ := data["data"].([]interface{})
+	if len(items) == 0 {
+		return data, nil
+	}
+	item, _ := items[0].(map[string]interface{})
+	objectType, ok := item["object"].(string)
+	if !ok {
+		return data, nil
+	}
+
+	filters := make(map[string]interface{})
+	for name, value := range req.requestData {
+		if nonFilterListParams[name] {
+			continue
+		}
+		switch value.(type) {
+		case bool, float64, int, int64, string:
+			filters[name] = value
+		}
+	}
+
+	objects := s.store.listNewestFirst(func(object map[string]interface{}) bool {
+		if object["object"] != objectType {
+			return false
+		}
+		for name, value := range filters {
+			current, ok := object[name]
+			if ok && !valuesEqual(current, value) {
+				return false
+			}
+		}
+		return true
+	})
+
+	page, hasMore, requestErr := paginate(objects, req.requestData)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	data["data"] = page
+	data["has_more"] = hasMore
+	return data, nil
+}
+
+// hasRoute checks whether the server routes requests with the given method to
+// a path as it appears in the OpenAPI specification.
+func (s *StubServer) hasRoute(method string, path spec.Path) bool {
+	for _, route := range s.routes[spec.HTTPVerb(method)] {
+		if route.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// splitResourcePath gets the path of the collection of a top-level resource
+// from the path of one of its routes, like `/v1/customers` from either
+// `/v1/customers` or `/v1/customers/{customer}`. The second return value is
+// whether the route is for a single object with its ID in the path. The path
+// is empty if the route isn't for a top-level resource.
+func splitResourcePath(path spec.Path) (spec.Path, bool) {
+	parts := strings.Split(strings.TrimPrefix(string(path), "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "v1" || strings.Contains(parts[1], "{") {
+		return "", false
+	}
+
+	collection := spec.Path("/" + parts[0] + "/" + parts[1])
+	if len(parts) == 2 {
+		return collection, false
+	}
+
+	if !strings.HasPrefix(parts[2], "{") || !strings.HasSuffix(parts[2], "}") {
+		return "", false
+	}
+	return collection, true
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+func TestSplitResourcePath(t *testing.T) {
+	testCases := []struct {
+		path       spec.Path
+		collection spec.Path
+		hasID      bool
+	}{
+		{"/v1/webhook_endpoints", "/v1/webhook_endpoints", false},
+		{"/v1/webhook_endpoints/{webhook_endpoint}", "/v1/webhook_endpoints", true},
+		{"/v1/customers/search", "", false},
+		{"/v1/customers/{customer}/balance_transactions", "", false},
+		{"/v1/payment_intents/{intent}/confirm", "", false},
+		{"/v1/terminal/readers", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(string(tc.path), func(t *testing.T) {
+			collection, hasID := splitResourcePath(tc.path)
+			assert.Equal(t, tc.collection, collection)
+			assert.Equal(t, tc.hasID, hasID)
+		})
+	}
+}
+
+func TestStatefulGenericResource(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	// Objects of resources without special handling are stored when created
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/webhook_endpoints",
+		"url=https://example.com/webhooks&enabled_events[]=charge.succeeded&description=Mine",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	id := decodeObject(t, body)["id"].(string)
+
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/webhook_endpoints/"+id,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Mine", decodeObject(t, body)["description"])
+
+	resp, _ = sendRequestToServer(t, server, "POST", "/v1/webhook_endpoints/"+id,
+		"description=Updated", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Lists only have stored objects
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/webhook_endpoints",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	endpoints := decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, 1, len(endpoints))
+	assert.Equal(t, id, endpoints[0].(map[string]interface{})["id"])
+	assert.Equal(t, "Updated", endpoints[0].(map[string]interface{})["description"])
+
+	resp, body = sendRequestToServer(t, server, "DELETE", "/v1/webhook_endpoints/"+id,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, true, decodeObject(t, body)["deleted"])
+
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/webhook_endpoints/"+id,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "No such webhook_endpoint: '"+id+"'", errorInfo["message"])
+
+	resp, _ = sendRequestToServer(t, server, "DELETE", "/v1/webhook_endpoints/"+id,
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Resources that can't be created are still generated
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/balance_transactions/txn_123",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestStatefulGenericResource_ListFilters(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	var customerIDs []string
+	for i := 0; i < 2; i++ {
+		resp, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		customerID := decodeObject(t, body)["id"].(string)
+		customerIDs = append(customerIDs, customerID)
+
+		resp, _ = sendRequestToServer(t, server, "POST", "/v1/invoiceitems",
+			"amount=1000&currency=usd&customer="+customerID, getDefaultHeaders())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/invoiceitems?customer="+customerIDs[0],
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	invoiceItems := decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, 1, len(invoiceItems))
+	assert.Equal(t, customerIDs[0], invoiceItems[0].(map[string]interface{})["customer"])
+
+	// Filters on fields that objects don't have are ignored
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/invoiceitems?pending=true",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, len(decodeObject(t, body)["data"].([]interface{})))
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+//
+// Private values
+//
+
+// taxIDValuePatterns are the formats of the values of some common types of
+// tax IDs. Values of other types are accepted as long as they're not empty.
+var taxIDValuePatterns = map[string]*regexp.Regexp{
+	"au_abn": regexp.MustCompile(`^[0-9]{11}$`),
+	"ca_bn":  regexp.MustCompile(`^[0-9]{9}$`),
+	"eu_vat": regexp.MustCompile(`^[A-Z]{2}[0-9A-Z]{2,13}$`),
+	"gb_vat": regexp.MustCompile(`^GB([0-9]{9}|[0-9]{12}|GD[0-9]{3}|HA[0-9]{3})$`),
+	"in_gst": regexp.MustCompile(`^[0-9]{2}[0-9A-Z]{13}$`),
+	"us_ein": regexp.MustCompile(`^[0-9]{2}-?[0-9]{7}$`),
+}
+
+const taxIDInvalidValue = "Invalid value for %s: '%s'."
+
+//
+// Private functions
+//
+
+// newCustomerTaxID produces a tax ID belonging to a customer from its `type`
+// and `value` parameters. A 400 is returned if the value isn't in the format
+// of its type.
+func newCustomerTaxID(s *StubServer, ids *rand.Rand, customer string, params map[string]interface{}) (map[string]interface{}, *requestError) {
+	taxIDType, _ := params["type"].(string)
+	value, _ := params["value"].(string)
+
+	pattern, ok := taxIDValuePatterns[taxIDType]
+	if value == "" || ok && !pattern.MatchString(value) {
+		return nil, &requestError{
+			status: http.StatusBadRequest,
+			stripeError: createStripeError(typeInvalidRequestError,
+				fmt.Sprintf(taxIDInvalidValue, taxIDType, value),
+				withCode("tax_id_invalid"), withParam("value")),
+		}
+	}
+
+	taxID := make(map[string]interface{})
+	if fixture, ok := s.fixtures.Resources["tax_id"].(map[string]interface{}); ok {
+		taxID = copyObject(fixture)
+	}
+	taxID["country"] = taxIDCountry(taxIDType, value)
+	taxID["created"] = s.generationTime().Unix()
+	taxID["customer"] = customer
+	taxID["id"] = newID(ids, "txi")
+	taxID["object"] = "tax_id"
+	taxID["owner"] = map[string]interface{}{
+		"customer": customer,
+		"type":     "customer",
+	}
+	taxID["type"] = taxIDType
+	taxID["value"] = value
+	return taxID, nil
+}
+
+// taxIDCountry determines the country of a tax ID. EU VAT numbers start with
+// the code of their country, and the types of other tax IDs do.
+func taxIDCountry(taxIDType string, value string) string {
+	if taxIDType == "eu_vat" {
+		return value[:2]
+	}
+	return strings.ToUpper(strings.SplitN(taxIDType, "_", 2)[0])
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestStatefulCustomerTaxIDs(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers",
+		"tax_id_data[0][type]=us_ein&tax_id_data[0][value]=12-3456789", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	resp, body := sendRequestToServer(t, server, "POST",
+		"/v1/customers/"+customerID+"/tax_ids", "type=eu_vat&value=FR12345678901",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	taxID := decodeObject(t, body)
+	taxIDID := taxID["id"].(string)
+	assert.Equal(t, "tax_id", taxID["object"])
+	assert.Equal(t, customerID, taxID["customer"])
+	assert.Equal(t, "eu_vat", taxID["type"])
+	assert.Equal(t, "FR12345678901", taxID["value"])
+	assert.Equal(t, "FR", taxID["country"])
+	assert.Equal(t, customerID, taxID["owner"].(map[string]interface{})["customer"])
+
+	listValues := func(taxIDs []interface{}) []interface{} {
+		var values []interface{}
+		for _, taxID := range taxIDs {
+			values = append(values, taxID.(map[string]interface{})["value"])
+		}
+		return values
+	}
+
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/v1/customers/"+customerID+"/tax_ids", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []interface{}{"FR12345678901", "12-3456789"},
+		listValues(decodeObject(t, body)["data"].([]interface{})))
+
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/v1/customers/"+customerID+"?expand[]=tax_ids", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	taxIDs := decodeObject(t, body)["tax_ids"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"FR12345678901", "12-3456789"},
+		listValues(taxIDs["data"].([]interface{})))
+
+	resp, _ = sendRequestToServer(t, server, "DELETE",
+		"/v1/customers/"+customerID+"/tax_ids/"+taxIDID, "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = sendRequestToServer(t, server, "GET",
+		"/v1/customers/"+customerID+"/tax_ids/"+taxIDID, "", getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStatefulCustomerTaxIDs_Invalid(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{stateful: true})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers", "", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	resp, body := sendRequestToServer(t, server, "POST",
+		"/v1/customers/"+customerID+"/tax_ids", "type=us_ein&value=123",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "Invalid value for us_ein: '123'.", errorInfo["message"])
+
+	resp, body = sendRequestToServer(t, server, "POST",
+		"/v1/customers/cus_missing/tax_ids", "type=us_ein&value=12-3456789",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), "No such customer: 'cus_missing'")
+}
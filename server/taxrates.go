@@ -0,0 +1,70 @@
+package server
+
+import (
+	"math"
+)
+
+//
+// Private functions
+//
+
+// applyTaxRateParams sets the `default_tax_rates` of a subscription or
+// invoice to the stored tax rates named by the request's `default_tax_rates`
+// parameter, which unsets them if it's empty. A 404 is returned if any of the
+// tax rates haven't been stored.
+func applyTaxRateParams(s *StubServer, requestData map[string]interface{}, object map[string]interface{}) *requestError {
+	value, ok := requestData["default_tax_rates"]
+	if !ok {
+		return nil
+	}
+
+	taxRateIDs, _ := value.([]interface{})
+	taxRates := make([]interface{}, 0, len(taxRateIDs))
+	for _, taxRateID := range taxRateIDs {
+		id, _ := taxRateID.(string)
+		taxRate, ok := s.store.get(id)
+		if !ok {
+			return noSuchObjectError("tax_rate", id)
+		}
+		taxRates = append(taxRates, taxRate)
+	}
+
+	object["default_tax_rates"] = taxRates
+	return nil
+}
+
+// calculateTaxAmounts calculates the tax that each of the given tax rates adds
+// to an amount. The tax of an inclusive tax rate is part of the amount, while
+// that of an exclusive one comes on top of it, so they're also returned as
+// separate sums.
+func calculateTaxAmounts(taxRates []interface{}, amount int64) ([]interface{}, int64, int64) {
+	taxAmounts := make([]interface{}, 0, len(taxRates))
+	var inclusiveTax, exclusiveTax int64
+
+	for _, taxRate := range taxRates {
+		taxRateMap, _ := taxRate.(map[string]interface{})
+		percentage, _ := toFloat64(taxRateMap["percentage"])
+		inclusive, _ := taxRateMap["inclusive"].(bool)
+
+		taxableAmount := amount
+		var taxAmount int64
+		if inclusive {
+			taxableAmount = int64(math.Round(float64(amount) / (1 + percentage/100)))
+			taxAmount = amount - taxableAmount
+			inclusiveTax += taxAmount
+		} else {
+			taxAmount = int64(math.Round(float64(amount) * percentage / 100))
+			exclusiveTax += taxAmount
+		}
+
+		taxAmounts = append(taxAmounts, map[string]interface{}{
+			"amount":            taxAmount,
+			"inclusive":         inclusive,
+			"tax_rate":          taxRateMap["id"],
+			"taxability_reason": "standard_rated",
+			"taxable_amount":    taxableAmount,
+		})
+	}
+
+	return taxAmounts, inclusiveTax, exclusiveTax
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestApplyTestCardChecks(t *testing.T) {
+	testCases := []struct {
+		name         string
+		requestCard  map[string]interface{}
+		wantAddress  interface{}
+		wantPostCode interface{}
+		wantCVC      interface{}
+	}{
+		{
+			"ordinary card",
+			map[string]interface{}{"number": "4242424242424242", "cvc": "123", "address_line1": "1 Main St", "address_zip": "94107"},
+			checkPass, checkPass, checkPass,
+		},
+		{
+			"CVC check failure",
+			map[string]interface{}{"number": "4000000000000101", "cvc": "123"},
+			nil, nil, checkFail,
+		},
+		{
+			"CVC check failure without CVC",
+			map[string]interface{}{"number": "4000000000000101"},
+			nil, nil, nil,
+		},
+		{
+			"address check failure",
+			map[string]interface{}{"number": "4000000000000010", "cvc": "123", "address_line1": "1 Main St", "address_zip": "94107"},
+			checkFail, checkFail, checkPass,
+		},
+		{
+			"address checks unavailable",
+			map[string]interface{}{"number": "4000000000000044", "address_line1": "1 Main St", "address_zip": "94107"},
+			checkUnavailable, checkUnavailable, nil,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			data := map[string]interface{}{
+				"card": map[string]interface{}{"cvc_check": checkPass},
+			}
+			applyTestCardChecks(map[string]interface{}{"card": testCase.requestCard}, data)
+
+			card := data["card"].(map[string]interface{})
+			assert.Equal(t, testCase.wantAddress, card["address_line1_check"])
+			assert.Equal(t, testCase.wantPostCode, card["address_zip_check"])
+			assert.Equal(t, testCase.wantCVC, card["cvc_check"])
+		})
+	}
+}
+
+func TestStubServer_TestCardChecks(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/tokens",
+		"card[number]=4000000000000101&card[cvc]=123&card[exp_month]=12&card[exp_year]=2030",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	card := decodeObject(t, body)["card"].(map[string]interface{})
+	assert.Equal(t, "fail", card["cvc_check"])
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/payment_methods",
+		"type=card&card[number]=4000000000000101&card[cvc]=123&card[exp_month]=12&card[exp_year]=2030"+
+			"&billing_details[address][postal_code]=94107",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	checks := decodeObject(t, body)["card"].(map[string]interface{})["checks"].(map[string]interface{})
+	assert.Equal(t, "fail", checks["cvc_check"])
+	assert.Equal(t, "pass", checks["address_postal_code_check"])
+	assert.Nil(t, checks["address_line1_check"])
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private values
+//
+
+// timestampAnchors are the fields of objects that are set to the current time
+// in generated data, in order of preference. An object's other timestamps are
+// moved by as much as the first of these that it has, so that they stay as
+// far apart from it as they are in its fixture, like the end of a
+// subscription's current period staying after its start.
+//
+// They're treated as timestamps even if the OpenAPI spec doesn't give them
+// unixTimeFormat, which it doesn't for a few objects.
+var timestampAnchors = []string{"created", "start_date", "current_period_start"}
+
+// unixTimeFormat is the format of integer properties in the OpenAPI spec that
+// are Unix timestamps.
+const unixTimeFormat = "unix-time"
+
+//
+// Private functions
+//
+
+// applyTimestamps moves the timestamps of generated objects so that they're
+// relative to the given Unix time rather than to when their fixtures were
+// made, which is often years ago. See timestampAnchors. Objects without any
+// of the anchors keep their timestamps as they are.
+//
+// Generated data may share values with fixtures, so objects with moved
+// timestamps are copies rather than the originals.
+func (g *DataGenerator) applyTimestamps(now int64, schema *spec.Schema, data interface{}) interface{} {
+	schema, _, _ = g.maybeDereference(schema, "")
+
+	if len(schema.AnyOf) != 0 {
+		branch := g.findFuzzAnyOfBranch(schema, data)
+		if branch == nil {
+			return data
+		}
+		return g.applyTimestamps(now, branch, data)
+	}
+
+	switch value := data.(type) {
+	case map[string]interface{}:
+		var delta int64
+		var anchored bool
+		for _, anchor := range timestampAnchors {
+			if timestamp, ok := g.unixTimestamp(schema.Properties[anchor], anchor, value[anchor]); ok {
+				delta = now - timestamp
+				anchored = true
+				break
+			}
+		}
+
+		// Keys are visited in order so that the same data always comes out
+		// the same, like when fuzzing.
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		applied := make(map[string]interface{}, len(value))
+		for _, key := range keys {
+			applied[key] = value[key]
+
+			propertySchema, ok := schema.Properties[key]
+			if !ok {
+				continue
+			}
+			if timestamp, ok := g.unixTimestamp(propertySchema, key, value[key]); ok {
+				if anchored {
+					applied[key] = timestamp + delta
+				}
+				continue
+			}
+			applied[key] = g.applyTimestamps(now, propertySchema, value[key])
+		}
+		return applied
+
+	case []interface{}:
+		if schema.Items == nil {
+			return data
+		}
+		applied := make([]interface{}, len(value))
+		for i, item := range value {
+			applied[i] = g.applyTimestamps(now, schema.Items, item)
+		}
+		return applied
+	}
+
+	return data
+}
+
+// generationTime is the time that timestamps in generated responses are
+// relative to, which is the fixed time if one was configured.
+func (s *StubServer) generationTime() time.Time {
+	if !s.fixedTime.IsZero() {
+		return s.fixedTime
+	}
+	return time.Now()
+}
+
+// unixTimestamp gets the value of a property if it's a Unix timestamp, which
+// it is if its schema says so or if it's one of timestampAnchors. The second
+// return value is false if it isn't, or if the value isn't a number (like when
+// it's null).
+func (g *DataGenerator) unixTimestamp(schema *spec.Schema, name string, value interface{}) (int64, bool) {
+	if schema == nil {
+		return 0, false
+	}
+	schema, _, _ = g.maybeDereference(schema, "")
+
+	// Nullable timestamps are sometimes a branch of an `anyOf`
+	if len(schema.AnyOf) != 0 {
+		schema = g.findFuzzAnyOfBranch(schema, value)
+		if schema == nil {
+			return 0, false
+		}
+	}
+
+	if schema.Type != "integer" {
+		return 0, false
+	}
+	if schema.Format != unixTimeFormat && !isTimestampAnchor(name) {
+		return 0, false
+	}
+
+	switch value := value.(type) {
+	case float64:
+		return int64(value), true
+	case int:
+		return int64(value), true
+	case int64:
+		return value, true
+	}
+	return 0, false
+}
+
+// isTimestampAnchor checks whether a field is one of timestampAnchors.
+func isTimestampAnchor(name string) bool {
+	for _, anchor := range timestampAnchors {
+		if anchor == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-mock/spec"
+)
+
+func TestApplyTimestamps(t *testing.T) {
+	timestamp := &spec.Schema{Type: "integer", Format: unixTimeFormat}
+	schema := &spec.Schema{
+		Type: "object",
+		Properties: map[string]*spec.Schema{
+			"amount":             {Type: "integer"},
+			"current_period_end": timestamp,
+			"start_date":         timestamp,
+			"trial_end":          {AnyOf: []*spec.Schema{timestamp}, Nullable: true},
+			"items": {
+				Type: "array",
+				Items: &spec.Schema{
+					Type: "object",
+					Properties: map[string]*spec.Schema{
+						// Anchors are timestamps even without a format
+						"created": {Type: "integer"},
+						"expires": timestamp,
+					},
+				},
+			},
+			"details": {
+				Type: "object",
+				Properties: map[string]*spec.Schema{
+					"expires": timestamp,
+				},
+			},
+		},
+	}
+	data := map[string]interface{}{
+		"amount":             1000.0,
+		"current_period_end": 1500.0,
+		"start_date":         1000.0,
+		"trial_end":          nil,
+		"items": []interface{}{
+			map[string]interface{}{"created": 500.0, "expires": 600.0},
+		},
+		"details": map[string]interface{}{"expires": 700.0},
+	}
+
+	generator := DataGenerator{}
+	applied := generator.applyTimestamps(10000, schema, data).(map[string]interface{})
+
+	assert.Equal(t, 1000.0, applied["amount"])
+	assert.Equal(t, int64(10000), applied["start_date"])
+	assert.Equal(t, int64(10500), applied["current_period_end"])
+	assert.Nil(t, applied["trial_end"])
+
+	item := applied["items"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, int64(10000), item["created"])
+	assert.Equal(t, int64(10100), item["expires"])
+
+	// Objects without an anchor are left alone
+	assert.Equal(t, 700.0, applied["details"].(map[string]interface{})["expires"])
+
+	// The original data isn't changed, since it may be shared with fixtures
+	assert.Equal(t, 1000.0, data["start_date"])
+	assert.Equal(t, 500.0, data["items"].([]interface{})[0].(map[string]interface{})["created"])
+}
+
+func TestStubServer_GeneratesCurrentTimestamps(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	before := time.Now().Unix()
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/customers/cus_123", "",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	created := int64(decodeObject(t, body)["created"].(float64))
+	assert.True(t, created >= before && created <= time.Now().Unix())
+}
+
+func TestStubServer_FixedTime(t *testing.T) {
+	fixedTime := time.Unix(1700000000, 0)
+	server := getRealStubServer(t, &testStubServerOptions{fixedTime: fixedTime})
+
+	resp, body := sendRequestToServer(t, server, "GET", "/v1/subscriptions/sub_123", "",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	subscription := decodeObject(t, body)
+	assert.Equal(t, 1700000000.0, subscription["created"])
+	assert.Equal(t, 1700000000.0, subscription["start_date"])
+	item := subscription["items"].(map[string]interface{})["data"].([]interface{})[0]
+	assert.Equal(t, 1700000000.0, item.(map[string]interface{})["created"])
+
+	// List filters still apply to timestamps
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/customers?created[lte]=1600000000",
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	customer := decodeObject(t, body)["data"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, 1600000000.0, customer["created"])
+}
+
+func TestStubServer_FixedTimeStateful(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{
+		fixedTime: time.Unix(1700000000, 0),
+		stateful:  true,
+	})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/payment_intents",
+		"amount=2000&currency=usd", getDefaultHeaders())
+	paymentIntentID := decodeObject(t, body)["id"].(string)
+
+	// Timestamps set by stateful handlers use the fixed time too
+	resp, body := sendRequestToServer(t, server, "POST",
+		"/v1/payment_intents/"+paymentIntentID+"/cancel", "", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1700000000.0, decodeObject(t, body)["canceled_at"])
+
+	// As do those of the events that they record
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/events?type=payment_intent.*", "",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	events := decodeObject(t, body)["data"].([]interface{})
+	assert.Equal(t, 2, len(events))
+	for _, event := range events {
+		assert.Equal(t, 1700000000.0, event.(map[string]interface{})["created"])
+	}
+	canceled := events[0].(map[string]interface{})["data"].(map[string]interface{})["object"]
+	assert.Equal(t, "canceled", canceled.(map[string]interface{})["status"])
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private values
+//
+
+const (
+	eventTypeMissing = "Please specify the `type` of the event to trigger, " +
+		"like `customer.created`."
+
+	unrecognizedEventType = "Unrecognized event type '%s': expected the type " +
+		"of an object followed by what happened to it, like `customer.created`."
+
+	triggerObjectMismatch = "Object '%s' is a %v, but '%s' events are about %s objects."
+)
+
+//
+// Private functions
+//
+
+// handleTriggerRequest sends an event of the type given by the `type`
+// parameter to the webhook endpoint, like `stripe trigger` does, and responds
+// with the event once it's been delivered.
+//
+// The event is about the object given by `object_id` if it's been stored in
+// stateful mode, and otherwise about a generated object of the event's type,
+// with that ID if one was given. In stateful mode, the event is recorded so
+// that it can be retrieved from `/v1/events` like any other.
+func (s *StubServer) handleTriggerRequest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	eventType := r.FormValue("type")
+	if eventType == "" {
+		stripeError := createStripeError(typeInvalidRequestError, eventTypeMissing,
+			withParam("type"))
+		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+		return
+	}
+
+	objectType, ok := s.eventObjectType(eventType)
+	if !ok {
+		message := fmt.Sprintf(unrecognizedEventType, eventType)
+		stripeError := createStripeError(typeInvalidRequestError, message,
+			withParam("type"))
+		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+		return
+	}
+
+	if s.webhooks.url == "" {
+		stripeError := createStripeError(typeInvalidRequestError, webhookURLMissing)
+		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+		return
+	}
+
+	objectID := r.FormValue("object_id")
+
+	var object map[string]interface{}
+	if objectID != "" && s.store != nil {
+		object, _ = s.store.get(objectID)
+	}
+	if object != nil && object["object"] != objectType {
+		message := fmt.Sprintf(triggerObjectMismatch,
+			objectID, object["object"], eventType, objectType)
+		stripeError := createStripeError(typeInvalidRequestError, message,
+			withParam("object_id"))
+		writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+		return
+	}
+	if object == nil {
+		fixture, _ := s.fixtures.Resources[spec.ResourceID(objectType)].(map[string]interface{})
+		object = copyObject(fixture)
+		if objectID != "" {
+			object["id"] = objectID
+		}
+	}
+
+	event := s.newEvent(nil, eventType, object)
+	event["pending_webhooks"] = 1
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		writeResponse(w, r, start, http.StatusInternalServerError,
+			createInternalServerError())
+		return
+	}
+
+	id := event["id"].(string)
+	if s.events != nil {
+		s.events.put(id, event)
+	}
+	if s.webhooks.deliver(id, payload).Succeeded {
+		event["pending_webhooks"] = 0
+		if s.events != nil {
+			s.events.update(id, func(event map[string]interface{}) {
+				event["pending_webhooks"] = 0
+			})
+		}
+	}
+
+	writeResponse(w, r, start, http.StatusOK, event)
+}
+
+// eventObjectType finds the type of the objects that events of the given type
+// are about, like `subscription` for `customer.subscription.updated`. The
+// second return value is false if there's no fixture for that type of object.
+//
+// Where several types of objects share a prefix, like cards and bank accounts
+// do `customer.source`, the type that comes first alphabetically is used.
+func (s *StubServer) eventObjectType(eventType string) (string, bool) {
+	i := strings.LastIndex(eventType, ".")
+	if i < 1 || i == len(eventType)-1 {
+		return "", false
+	}
+	prefix := eventType[:i]
+
+	candidates := []string{prefix}
+	var prefixed []string
+	for objectType, objectPrefix := range eventTypePrefixes {
+		if objectPrefix == prefix {
+			prefixed = append(prefixed, objectType.(string))
+		}
+	}
+	sort.Strings(prefixed)
+	candidates = append(candidates, prefixed...)
+
+	for _, objectType := range candidates {
+		if _, ok := s.fixtures.Resources[spec.ResourceID(objectType)].(map[string]interface{}); ok {
+			return objectType, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+var formHeaders = map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+
+func TestControl_Trigger(t *testing.T) {
+	var received []map[string]interface{}
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		err := verifyWebhookSignature(body, r.Header.Get(webhookSignatureHeader), "whsec_123")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var event map[string]interface{}
+		json.Unmarshal(body, &event)
+		received = append(received, event)
+	}))
+	defer endpoint.Close()
+
+	server := getRealStubServer(t, &testStubServerOptions{
+		webhookSecret: "whsec_123",
+		webhookURL:    endpoint.URL,
+	})
+
+	resp, body := sendRequestToServer(t, server, "POST", "/_stripe-mock/trigger",
+		"type=customer.subscription.updated&object_id=sub_123", formHeaders)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	event := decodeObject(t, body)
+	assert.Equal(t, "event", event["object"])
+	assert.Equal(t, "customer.subscription.updated", event["type"])
+	assert.Equal(t, float64(0), event["pending_webhooks"])
+
+	// The event was delivered before the response
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, event["id"], received[0]["id"])
+	object := received[0]["data"].(map[string]interface{})["object"].(map[string]interface{})
+	assert.Equal(t, "subscription", object["object"])
+	assert.Equal(t, "sub_123", object["id"])
+}
+
+func TestControl_TriggerStoredObject(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer endpoint.Close()
+
+	server := getRealStubServer(t, &testStubServerOptions{
+		stateful:   true,
+		webhookURL: endpoint.URL,
+	})
+
+	_, body := sendRequestToServer(t, server, "POST", "/v1/customers",
+		"description=Stored", getDefaultHeaders())
+	customerID := decodeObject(t, body)["id"].(string)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/_stripe-mock/trigger",
+		"type=customer.updated&object_id="+customerID, formHeaders)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	event := decodeObject(t, body)
+	object := event["data"].(map[string]interface{})["object"].(map[string]interface{})
+	assert.Equal(t, "Stored", object["description"])
+
+	// The event is recorded like any other
+	resp, body = sendRequestToServer(t, server, "GET", "/v1/events/"+event["id"].(string),
+		"", getDefaultHeaders())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(0), decodeObject(t, body)["pending_webhooks"])
+
+	// The stored object has to be of the event's type
+	resp, body = sendRequestToServer(t, server, "POST", "/_stripe-mock/trigger",
+		"type=charge.succeeded&object_id="+customerID, formHeaders)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "object_id", errorInfo["param"])
+}
+
+func TestControl_TriggerInvalid(t *testing.T) {
+	server := getRealStubServer(t, &testStubServerOptions{webhookURL: "http://localhost:1"})
+
+	testCases := []struct {
+		params  string
+		message string
+	}{
+		{"", eventTypeMissing},
+		{"type=customer", "Unrecognized event type 'customer': expected the type " +
+			"of an object followed by what happened to it, like `customer.created`."},
+		{"type=nonexistent.created", "Unrecognized event type 'nonexistent.created': " +
+			"expected the type of an object followed by what happened to it, like " +
+			"`customer.created`."},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.params, func(t *testing.T) {
+			resp, body := sendRequestToServer(t, server, "POST", "/_stripe-mock/trigger",
+				testCase.params, formHeaders)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+			assert.Equal(t, testCase.message, errorInfo["message"])
+			assert.Equal(t, "type", errorInfo["param"])
+		})
+	}
+
+	// A webhook URL is needed to send the event anywhere
+	server = getRealStubServer(t, nil)
+	resp, body := sendRequestToServer(t, server, "POST", "/_stripe-mock/trigger",
+		"type=customer.created", formHeaders)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, webhookURLMissing, errorInfo["message"])
+}
+
+func TestEventObjectType(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	testCases := []struct {
+		eventType  string
+		objectType string
+	}{
+		{"customer.created", "customer"},
+		{"checkout.session.completed", "checkout.session"},
+		{"customer.subscription.deleted", "subscription"},
+		{"customer.source.created", "bank_account"},
+	}
+	for _, testCase := range testCases {
+		objectType, ok := server.eventObjectType(testCase.eventType)
+		assert.True(t, ok)
+		assert.Equal(t, testCase.objectType, objectType)
+	}
+
+	for _, eventType := range []string{"", "customer", ".created", "customer.", "foo.created"} {
+		_, ok := server.eventObjectType(eventType)
+		assert.False(t, ok)
+	}
+}
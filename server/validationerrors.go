@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private values
+//
+
+const (
+	invalidEnumValue     = "Invalid %s: must be one of %s"
+	missingRequiredParam = "Missing required param: %s."
+)
+
+// enumViolation is the reason that jsval validators give for a value that
+// isn't one of those that its schema allows.
+const enumViolation = "value is not in enumeration"
+
+// Patterns matching the errors of jsval validators, which wrap the error of
+// the constraint that failed in an error for each object property leading to
+// it, like:
+//
+//	validator 0xc000123 failed: object property 'shipping' validation
+//	failed: object property 'name' is required
+var (
+	validatorFailedPattern = regexp.MustCompile(`\Avalidator \S+ failed: `)
+	propertyFailedPattern  = regexp.MustCompile(`\Aobject property '([^']+)' validation failed: `)
+	propertyMissingPattern = regexp.MustCompile(`\Aobject property '([^']+)' is required\z`)
+)
+
+//
+// Private functions
+//
+
+// createValidationError translates an error from validating request
+// parameters against a schema into an error like the Stripe API would respond
+// with, like `Missing required param: amount.` for a required parameter that
+// wasn't sent, or `Invalid status: must be one of active or canceled` for a
+// value that isn't allowed. Errors that it doesn't know how to translate are
+// passed on as they are, but still with the parameter that they're about as
+// their `param`.
+func createValidationError(err error, schema *spec.Schema, requestData map[string]interface{}) *ResponseError {
+	path, reason := parseValidationError(err)
+
+	if reason == enumViolation && schema != nil {
+		if invalidPath, allowed, ok := findInvalidEnumValue(schema, requestData, path); ok {
+			param := formatParamName(invalidPath)
+			return createStripeError(typeInvalidRequestError,
+				fmt.Sprintf(invalidEnumValue, param, formatEnumValues(allowed)),
+				withParam(param))
+		}
+	}
+
+	if match := propertyMissingPattern.FindStringSubmatch(reason); match != nil {
+		path = append(path, match[1])
+		if indexedPath, ok := findMissingParam(requestData, path); ok {
+			path = indexedPath
+		}
+		param := formatParamName(path)
+		return createStripeError(typeInvalidRequestError,
+			fmt.Sprintf(missingRequiredParam, param),
+			withCode("parameter_missing"), withParam(param))
+	}
+
+	// Other errors still point at the parameter that failed validation if
+	// it's known.
+	var options []stripeErrorOption
+	if len(path) != 0 {
+		options = append(options, withParam(formatParamName(path)))
+	}
+	return createStripeError(typeInvalidRequestError,
+		fmt.Sprintf("Request validation error: %v", err), options...)
+}
+
+// findMissingParam finds a parameter that's missing from request data given
+// the path of object properties leading to it, adding the indexes of array
+// items along the way, which validation errors leave out. For example, the
+// path `line_items`, `price` becomes `line_items`, `0`, `price` if the first
+// line item is missing its price. The second return value is false if the
+// parameter isn't missing.
+func findMissingParam(data interface{}, path []string) ([]string, bool) {
+	switch value := data.(type) {
+	case []interface{}:
+		for i, item := range value {
+			if itemPath, ok := findMissingParam(item, path); ok {
+				return append([]string{strconv.Itoa(i)}, itemPath...), true
+			}
+		}
+
+	case map[string]interface{}:
+		property, ok := value[path[0]]
+		if len(path) == 1 {
+			return path, !ok
+		}
+		if subPath, ok := findMissingParam(property, path[1:]); ok {
+			return append([]string{path[0]}, subPath...), true
+		}
+	}
+
+	return nil, false
+}
+
+// findInvalidEnumValue finds a value in request data that isn't one of the
+// values that its schema allows, given the path of object properties leading
+// to it, adding the indexes of array items along the way like
+// findMissingParam. It returns the value's path and the values that would
+// have been allowed. The third return value is false if there's no such value.
+func findInvalidEnumValue(schema *spec.Schema, data interface{}, path []string) ([]string, []interface{}, bool) {
+	if items, ok := data.([]interface{}); ok {
+		if schema.Items == nil {
+			return nil, nil, false
+		}
+		for i, item := range items {
+			if itemPath, allowed, ok := findInvalidEnumValue(schema.Items, item, path); ok {
+				return append([]string{strconv.Itoa(i)}, itemPath...), allowed, true
+			}
+		}
+		return nil, nil, false
+	}
+
+	if len(path) == 0 {
+		allowed := enumValues(schema)
+		if len(allowed) == 0 {
+			return nil, nil, false
+		}
+		for _, value := range allowed {
+			if value == data {
+				return nil, nil, false
+			}
+		}
+		return path, allowed, true
+	}
+
+	object, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, nil, false
+	}
+	value, ok := object[path[0]]
+	if !ok {
+		return nil, nil, false
+	}
+
+	// Parameters that can be cleared are often the branch of an `anyOf`
+	// besides an empty string, so look for the property in each branch.
+	for _, candidate := range append([]*spec.Schema{schema}, schema.AnyOf...) {
+		propertySchema, ok := candidate.Properties[path[0]]
+		if !ok {
+			continue
+		}
+		if subPath, allowed, ok := findInvalidEnumValue(propertySchema, value, path[1:]); ok {
+			return append([]string{path[0]}, subPath...), allowed, true
+		}
+	}
+	return nil, nil, false
+}
+
+// enumValues gets the values that a schema allows if it's an enum, including
+// those of the branches of an `anyOf`. Empty strings, which clear a parameter
+// rather than being one of its values, are left out.
+func enumValues(schema *spec.Schema) []interface{} {
+	var values []interface{}
+	for _, candidate := range append([]*spec.Schema{schema}, schema.AnyOf...) {
+		for _, value := range candidate.Enum {
+			if value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// formatEnumValues lists the values that an enum allows like the Stripe API
+// does in errors, like `active, canceled, or ended`.
+func formatEnumValues(values []interface{}) string {
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		formatted[i] = fmt.Sprint(value)
+	}
+
+	switch len(formatted) {
+	case 1:
+		return formatted[0]
+	case 2:
+		return formatted[0] + " or " + formatted[1]
+	}
+	return strings.Join(formatted[:len(formatted)-1], ", ") + ", or " + formatted[len(formatted)-1]
+}
+
+// formatParamName formats the path of properties leading to a parameter the
+// way that parameters are named in form-encoded requests and the `param` of
+// errors, like `shipping[address][line1]` or `items[0][price]`.
+func formatParamName(path []string) string {
+	var name strings.Builder
+	for i, property := range path {
+		if i == 0 {
+			name.WriteString(property)
+		} else {
+			name.WriteString("[" + property + "]")
+		}
+	}
+	return name.String()
+}
+
+// parseValidationError breaks an error from a jsval validator down into the
+// path of object properties leading to the value that failed validation, and
+// the reason that it failed.
+func parseValidationError(err error) ([]string, string) {
+	reason := validatorFailedPattern.ReplaceAllString(err.Error(), "")
+
+	var path []string
+	for {
+		match := propertyFailedPattern.FindStringSubmatch(reason)
+		if match == nil {
+			return path, reason
+		}
+		path = append(path, match[1])
+		reason = reason[len(match[0]):]
+	}
+}
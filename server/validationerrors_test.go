@@ -0,0 +1,190 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-mock/spec"
+)
+
+func TestCreateValidationError(t *testing.T) {
+	// Required parameters that weren't sent
+	{
+		stripeError := createValidationError(errors.New(
+			"validator 0xc000123 failed: object property 'amount' is required"),
+			nil, map[string]interface{}{})
+		assert.Equal(t, typeInvalidRequestError, stripeError.ErrorInfo.Type)
+		assert.Equal(t, "Missing required param: amount.", stripeError.ErrorInfo.Message)
+		assert.Equal(t, "amount", stripeError.ErrorInfo.Param)
+		assert.Equal(t, "parameter_missing", stripeError.ErrorInfo.Code)
+	}
+
+	// Required parameters nested in others are named like in forms
+	{
+		stripeError := createValidationError(errors.New(
+			"validator 0xc000123 failed: object property 'shipping' validation failed: "+
+				"object property 'address' validation failed: object property 'line1' is required"),
+			nil, map[string]interface{}{"shipping": map[string]interface{}{"address": map[string]interface{}{}}})
+		assert.Equal(t, "Missing required param: shipping[address][line1].",
+			stripeError.ErrorInfo.Message)
+		assert.Equal(t, "shipping[address][line1]", stripeError.ErrorInfo.Param)
+	}
+
+	// Array items are named by their index
+	{
+		stripeError := createValidationError(errors.New(
+			"validator 0xc000123 failed: object property 'items' validation failed: "+
+				"object property 'price' is required"),
+			nil, map[string]interface{}{"items": []interface{}{
+				map[string]interface{}{"price": "price_123"},
+				map[string]interface{}{"quantity": 2},
+			}})
+		assert.Equal(t, "Missing required param: items[1][price].", stripeError.ErrorInfo.Message)
+		assert.Equal(t, "items[1][price]", stripeError.ErrorInfo.Param)
+	}
+
+	// Other errors are passed on as they are
+	{
+		stripeError := createValidationError(errors.New(
+			"validator 0xc000123 failed: additional properties are not allowed"),
+			nil, map[string]interface{}{})
+		assert.Equal(t,
+			"Request validation error: validator 0xc000123 failed: additional properties are not allowed",
+			stripeError.ErrorInfo.Message)
+		assert.Equal(t, "", stripeError.ErrorInfo.Param)
+	}
+
+	// ...but still point at the parameter that failed validation
+	{
+		stripeError := createValidationError(errors.New(
+			"validator 0xc000123 failed: object property 'recurring' validation failed: "+
+				"object property 'interval' validation failed: value is not in enumeration"),
+			nil, map[string]interface{}{})
+		assert.Equal(t, "recurring[interval]", stripeError.ErrorInfo.Param)
+	}
+}
+
+func TestCreateValidationError_Enum(t *testing.T) {
+	enumErr := func(path ...string) error {
+		message := "validator 0xc000123 failed: "
+		for _, property := range path {
+			message += "object property '" + property + "' validation failed: "
+		}
+		return errors.New(message + enumViolation)
+	}
+
+	schema := &spec.Schema{
+		Type: "object",
+		Properties: map[string]*spec.Schema{
+			"status": {Type: "string", Enum: []interface{}{"active", "canceled", "ended"}},
+			"tax_exempt": {
+				Type: "string",
+				Enum: []interface{}{"", "exempt", "none", "reverse"},
+			},
+			"items": {
+				Type: "array",
+				Items: &spec.Schema{
+					Type: "object",
+					Properties: map[string]*spec.Schema{
+						"interval": {Type: "string", Enum: []interface{}{"month", "year"}},
+					},
+				},
+			},
+			"payment_settings": {
+				AnyOf: []*spec.Schema{
+					{
+						Type: "object",
+						Properties: map[string]*spec.Schema{
+							"save": {Type: "string", Enum: []interface{}{"off"}},
+						},
+					},
+					{Type: "string", Enum: []interface{}{""}},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		err         error
+		requestData map[string]interface{}
+		message     string
+		param       string
+	}{
+		{
+			enumErr("status"),
+			map[string]interface{}{"status": "bogus"},
+			"Invalid status: must be one of active, canceled, or ended",
+			"status",
+		},
+		{
+			enumErr("tax_exempt"),
+			map[string]interface{}{"tax_exempt": "bogus"},
+			"Invalid tax_exempt: must be one of exempt, none, or reverse",
+			"tax_exempt",
+		},
+		{
+			enumErr("items", "interval"),
+			map[string]interface{}{"items": []interface{}{
+				map[string]interface{}{"interval": "month"},
+				map[string]interface{}{"interval": "fortnight"},
+			}},
+			"Invalid items[1][interval]: must be one of month or year",
+			"items[1][interval]",
+		},
+		{
+			enumErr("payment_settings", "save"),
+			map[string]interface{}{"payment_settings": map[string]interface{}{"save": "on"}},
+			"Invalid payment_settings[save]: must be one of off",
+			"payment_settings[save]",
+		},
+	}
+	for _, testCase := range testCases {
+		stripeError := createValidationError(testCase.err, schema, testCase.requestData)
+		assert.Equal(t, typeInvalidRequestError, stripeError.ErrorInfo.Type)
+		assert.Equal(t, testCase.message, stripeError.ErrorInfo.Message)
+		assert.Equal(t, testCase.param, stripeError.ErrorInfo.Param)
+	}
+
+	// Values that can't be found are passed on as they are
+	stripeError := createValidationError(enumErr("status"), schema, map[string]interface{}{})
+	assert.Contains(t, stripeError.ErrorInfo.Message, "Request validation error")
+	assert.Equal(t, "status", stripeError.ErrorInfo.Param)
+}
+
+func TestStubServer_InvalidEnumParam(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/prices",
+		"currency=usd&unit_amount=100&product=prod_123&recurring[interval]=fortnight",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "Invalid recurring[interval]: must be one of day, month, week, or year",
+		errorInfo["message"])
+	assert.Equal(t, "recurring[interval]", errorInfo["param"])
+}
+
+func TestStubServer_MissingNestedParam(t *testing.T) {
+	server := getRealStubServer(t, nil)
+
+	resp, body := sendRequestToServer(t, server, "POST", "/v1/prices",
+		"currency=usd&recurring[usage_type]=metered", getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	errorInfo := decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, typeInvalidRequestError, errorInfo["type"])
+	assert.Equal(t, "Missing required param: recurring[interval].", errorInfo["message"])
+	assert.Equal(t, "recurring[interval]", errorInfo["param"])
+
+	resp, body = sendRequestToServer(t, server, "POST", "/v1/payment_links",
+		"line_items[0][price]=price_123&line_items[0][quantity]=1&line_items[1][quantity]=1",
+		getDefaultHeaders())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	errorInfo = decodeObject(t, body)["error"].(map[string]interface{})
+	assert.Equal(t, "Missing required param: line_items[1][price].", errorInfo["message"])
+	assert.Equal(t, "line_items[1][price]", errorInfo["param"])
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+//
+// Private types
+//
+
+// versionRouter is an OpenAPI spec for a particular API version along with
+// the routes built for it, with which requests for that version are handled.
+type versionRouter struct {
+	routes map[spec.HTTPVerb][]stubServerRoute
+	spec   *spec.Spec
+}
+
+//
+// Private functions
+//
+
+// newVersionRouters creates routers for specs keyed by API version. Their
+// routes are left to be built by initializeVersionRouters.
+func newVersionRouters(specs map[string]*spec.Spec) (map[string]*versionRouter, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	routers := make(map[string]*versionRouter, len(specs))
+	for version, versionSpec := range specs {
+		if !stripeVersionPattern.MatchString(version) {
+			return nil, fmt.Errorf("Invalid API version '%s' for a spec; expected "+
+				"a version like '2020-08-27' or '2024-09-30.acacia'", version)
+		}
+		if versionSpec == nil {
+			return nil, fmt.Errorf("No spec given for API version '%s'", version)
+		}
+		routers[version] = &versionRouter{spec: versionSpec}
+	}
+	return routers, nil
+}
+
+// initializeVersionRouters builds the routes of the specs for other API
+// versions. They're built in order of version so that what's logged about
+// them always comes out the same.
+func (s *StubServer) initializeVersionRouters() error {
+	versions := make([]string, 0, len(s.versions))
+	for version := range s.versions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+
+	for _, version := range versions {
+		fmt.Printf("Building routes for API version %s\n", version)
+
+		router := s.versions[version]
+		routes, err := s.buildRoutes(router.spec)
+		if err != nil {
+			return fmt.Errorf("Error building routes for API version %s: %v", version, err)
+		}
+		router.routes = routes
+	}
+	return nil
+}
+
+// versionRouter gets the router with which requests for an API version are
+// handled, which is the main spec's unless a spec was loaded for the version.
+func (s *StubServer) versionRouter(version string) *versionRouter {
+	if router, ok := s.versions[version]; ok {
+		return router
+	}
+	return &versionRouter{routes: s.routes, spec: s.spec}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/stripe/stripe-mock/spec"
+)
+
+// getVersionedSpec gets a spec for another API version that's like the test
+// spec, except that it calls charges payments.
+func getVersionedSpec(version string) *spec.Spec {
+	versionedSpec := testSpec
+	versionedSpec.Info = &spec.Info{Version: version}
+	versionedSpec.Paths = map[spec.Path]map[spec.HTTPVerb]*spec.Operation{
+		"/v1/payments": testSpec.Paths["/v1/charges"],
+	}
+	return &versionedSpec
+}
+
+func TestNewVersionRouters(t *testing.T) {
+	routers, err := newVersionRouters(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, routers)
+
+	routers, err = newVersionRouters(map[string]*spec.Spec{
+		"2099-01-01": getVersionedSpec("2099-01-01"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(routers))
+
+	_, err = newVersionRouters(map[string]*spec.Spec{"latest": &testSpec})
+	assert.Error(t, err)
+
+	_, err = newVersionRouters(map[string]*spec.Spec{"2099-01-01": nil})
+	assert.Error(t, err)
+}
+
+func TestStubServer_VersionedSpecs(t *testing.T) {
+	server := getStubServer(t, &testStubServerOptions{
+		versionedSpecs: map[string]*spec.Spec{
+			"2099-01-01": getVersionedSpec("2099-01-01"),
+		},
+	})
+
+	versionHeaders := func(version string) map[string]string {
+		headers := getDefaultHeaders()
+		headers["Stripe-Version"] = version
+		return headers
+	}
+
+	// Requests for the version are routed with its spec
+	resp, _ := sendRequestToServer(t, server, "GET", "/v1/payments", "", versionHeaders("2099-01-01"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2099-01-01", resp.Header.Get("Stripe-Version"))
+
+	resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges", "", versionHeaders("2099-01-01"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Requests for other versions, or without one, fall back to the main spec
+	for _, headers := range []map[string]string{getDefaultHeaders(), versionHeaders("2020-08-27")} {
+		resp, _ = sendRequestToServer(t, server, "GET", "/v1/charges", "", headers)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, _ = sendRequestToServer(t, server, "GET", "/v1/payments", "", headers)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+
+	// Methods that aren't allowed are those of the version's spec
+	resp, _ = sendRequestToServer(t, server, "DELETE", "/v1/payments", "", versionHeaders("2099-01-01"))
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, POST", resp.Header.Get("Allow"))
+}
+
+func TestStubServer_VersionedSpecsStrictVersionCheck(t *testing.T) {
+	server := getStubServer(t, &testStubServerOptions{
+		strictVersionCheck: true,
+		versionedSpecs: map[string]*spec.Spec{
+			"2099-01-01": getVersionedSpec("2099-01-01"),
+		},
+	})
+
+	for version, status := range map[string]int{
+		testSpecAPIVersion: http.StatusOK,
+		"2099-01-01":       http.StatusOK,
+		"2020-08-27":       http.StatusBadRequest,
+	} {
+		headers := getDefaultHeaders()
+		headers["Stripe-Version"] = version
+		path := "/v1/charges"
+		if version == "2099-01-01" {
+			path = "/v1/payments"
+		}
+		resp, _ := sendRequestToServer(t, server, "GET", path, "", headers)
+		assert.Equal(t, status, resp.StatusCode, version)
+	}
+}
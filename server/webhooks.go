@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Private types
+//
+
+// webhookAttempt is a record of a single attempt to deliver a webhook event.
+type webhookAttempt struct {
+	// Created is the time of the attempt as a Unix timestamp.
+	Created int64 `json:"created"`
+
+	// Error is a description of why a delivery failed before getting a
+	// response, like if the endpoint couldn't be reached.
+	Error string `json:"error,omitempty"`
+
+	// EventID is the ID of the event that was being delivered.
+	EventID string `json:"event_id"`
+
+	// Forced is true if the attempt was made to fail through the control
+	// endpoint instead of actually being sent.
+	Forced bool `json:"forced"`
+
+	// Status is the HTTP status that the endpoint responded with, or 0 if
+	// there was no response.
+	Status int `json:"status"`
+
+	// Succeeded is true if the endpoint responded with a 2xx status.
+	Succeeded bool `json:"succeeded"`
+}
+
+// webhookDeliverer sends webhook events to a configured endpoint and keeps a
+// record of every attempt so that it can be inspected through a control
+// endpoint.
+//
+// Failures can be scripted by asking for some number of upcoming deliveries to
+// fail, which allows retry handling to be tested without having to make the
+// receiving endpoint itself flaky.
+//
+// It's safe for concurrent use.
+type webhookDeliverer struct {
+	client *http.Client
+	mutex  sync.Mutex
+
+	// attempts contains every delivery attempt in the order that they were
+	// made.
+	attempts []webhookAttempt
+
+	// failNext is the number of upcoming deliveries that should fail without
+	// being sent.
+	failNext int
+
+	// secret is the secret with which payloads are signed in the
+	// webhookSignatureHeader. Payloads aren't signed if it's empty.
+	secret string
+
+	// url is the endpoint to which events are sent.
+	url string
+}
+
+// newWebhookDeliverer initializes a new webhookDeliverer that sends events to
+// the given URL, signed with the given secret if it isn't empty.
+func newWebhookDeliverer(url string, secret string) *webhookDeliverer {
+	return &webhookDeliverer{
+		client: &http.Client{Timeout: webhookTimeout},
+		secret: secret,
+		url:    url,
+	}
+}
+
+// deliver sends an event's payload to the webhook endpoint and records the
+// attempt. It's considered a failure if the endpoint responds with anything
+// other than a 2xx status.
+//
+// If failures have been requested with failNextDeliveries, the payload isn't
+// sent at all, and a failed attempt is recorded as if the endpoint had
+// responded with a 500.
+func (d *webhookDeliverer) deliver(eventID string, payload []byte) webhookAttempt {
+	attempt := webhookAttempt{
+		Created: time.Now().Unix(),
+		EventID: eventID,
+	}
+
+	d.mutex.Lock()
+	forceFailure := d.failNext > 0
+	if forceFailure {
+		d.failNext--
+	}
+	d.mutex.Unlock()
+
+	if forceFailure {
+		attempt.Forced = true
+		attempt.Status = http.StatusInternalServerError
+	} else {
+		d.send(&attempt, payload)
+	}
+
+	d.mutex.Lock()
+	d.attempts = append(d.attempts, attempt)
+	d.mutex.Unlock()
+
+	return attempt
+}
+
+// failNextDeliveries causes the next count deliveries to fail.
+func (d *webhookDeliverer) failNextDeliveries(count int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.failNext = count
+}
+
+// listAttempts returns a copy of all delivery attempts made so far.
+func (d *webhookDeliverer) listAttempts() []webhookAttempt {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]webhookAttempt{}, d.attempts...)
+}
+
+// pendingFailures returns the number of upcoming deliveries that will fail.
+func (d *webhookDeliverer) pendingFailures() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.failNext
+}
+
+// reset forgets all delivery attempts made so far and any upcoming deliveries
+// that were made to fail.
+func (d *webhookDeliverer) reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.attempts = nil
+	d.failNext = 0
+}
+
+// send POSTs a payload to the webhook endpoint and fills the outcome into
+// the given attempt.
+func (d *webhookDeliverer) send(attempt *webhookAttempt, payload []byte) {
+	if d.url == "" {
+		attempt.Error = webhookURLMissing
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.secret != "" {
+		req.Header.Set(webhookSignatureHeader,
+			signWebhookPayload(payload, d.secret, time.Now().Unix()))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return
+	}
+	resp.Body.Close()
+
+	attempt.Status = resp.StatusCode
+	attempt.Succeeded = resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+//
+// Private values
+//
+
+const (
+	invalidWebhookFailureCount = "Invalid count '%s'; expected a non-negative integer."
+
+	webhookURLMissing = "No webhook URL is configured. Start stripe-mock " +
+		"with `-webhook-url` to deliver events."
+)
+
+// webhookSecretPrefix is the prefix of webhook signing secrets.
+const webhookSecretPrefix = "whsec_"
+
+// webhookSignatureHeader is the header in which webhook payloads are signed
+// so that endpoints can verify that they came from Stripe.
+const webhookSignatureHeader = "Stripe-Signature"
+
+// webhookTimeout is the maximum amount of time to wait for a webhook endpoint
+// to respond before considering the delivery failed.
+const webhookTimeout = 10 * time.Second
+
+//
+// Private functions
+//
+
+// checkWebhookSecret checks that a configured webhook signing secret looks
+// like one from Stripe, so that endpoints can verify signatures with the same
+// secret that they'd use with Stripe.
+func checkWebhookSecret(secret string) error {
+	if secret != "" && (!strings.HasPrefix(secret, webhookSecretPrefix) || secret == webhookSecretPrefix) {
+		return fmt.Errorf("Webhook secret must start with `%s`, like `%s123`",
+			webhookSecretPrefix, webhookSecretPrefix)
+	}
+	return nil
+}
+
+// handleWebhookAttemptsRequest responds with a list of all attempts to
+// deliver webhook events that have been made so far.
+func (s *StubServer) handleWebhookAttemptsRequest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	writeResponse(w, r, start, http.StatusOK, map[string]interface{}{
+		"object": "list",
+		"data":   s.webhooks.listAttempts(),
+	})
+}
+
+// handleWebhookFailNextRequest causes upcoming webhook deliveries to fail as
+// if the endpoint had responded with a 500. The number of deliveries to fail
+// is taken from the `count` parameter, and defaults to one.
+func (s *StubServer) handleWebhookFailNextRequest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	count := 1
+	if rawCount := r.FormValue("count"); rawCount != "" {
+		var err error
+		count, err = strconv.Atoi(rawCount)
+		if err != nil || count < 0 {
+			message := fmt.Sprintf(invalidWebhookFailureCount, rawCount)
+			stripeError := createStripeError(typeInvalidRequestError, message)
+			writeResponse(w, r, start, http.StatusBadRequest, stripeError)
+			return
+		}
+	}
+
+	s.webhooks.failNextDeliveries(count)
+
+	writeResponse(w, r, start, http.StatusOK, map[string]interface{}{
+		"pending_failures": s.webhooks.pendingFailures(),
+	})
+}
+
+// signWebhookPayload computes the value of the webhookSignatureHeader for a
+// payload sent at the given Unix timestamp, like `t=1492774577,v1=5257a8...`.
+// It's signed the same way as Stripe signs webhook events, so it can be
+// verified with the official libraries: the `v1` signature is an HMAC-SHA256
+// of the timestamp and the payload joined by a dot, keyed with the whole
+// secret including its prefix.
+func signWebhookPayload(payload []byte, secret string, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
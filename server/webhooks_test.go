@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestWebhookDeliverer_Deliver(t *testing.T) {
+	var received int
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer endpoint.Close()
+
+	deliverer := newWebhookDeliverer(endpoint.URL, "")
+	attempt := deliverer.deliver("evt_123", []byte(`{}`))
+	assert.Equal(t, 1, received)
+	assert.Equal(t, http.StatusOK, attempt.Status)
+	assert.True(t, attempt.Succeeded)
+	assert.False(t, attempt.Forced)
+
+	endpoint.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	attempt = deliverer.deliver("evt_456", []byte(`{}`))
+	assert.Equal(t, http.StatusBadRequest, attempt.Status)
+	assert.False(t, attempt.Succeeded)
+
+	assert.Equal(t, 2, len(deliverer.listAttempts()))
+}
+
+func TestWebhookDeliverer_NoURL(t *testing.T) {
+	attempt := newWebhookDeliverer("", "").deliver("evt_123", []byte(`{}`))
+	assert.False(t, attempt.Succeeded)
+	assert.Equal(t, webhookURLMissing, attempt.Error)
+}
+
+func TestControl_WebhookFailNext(t *testing.T) {
+	var received int
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer endpoint.Close()
+
+	server := getStubServer(t, &testStubServerOptions{webhookURL: endpoint.URL})
+
+	resp, body := sendRequestToServer(t, server, "POST",
+		"/_stripe-mock/webhooks/fail_next", "count=2",
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(2), decodeObject(t, body)["pending_failures"])
+
+	for _, eventID := range []string{"evt_1", "evt_2", "evt_3"} {
+		server.webhooks.deliver(eventID, []byte(`{}`))
+	}
+
+	// Only the delivery after the forced failures reaches the endpoint
+	assert.Equal(t, 1, received)
+
+	resp, body = sendRequestToServer(t, server, "GET",
+		"/_stripe-mock/webhooks/attempts", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var list struct {
+		Data []webhookAttempt `json:"data"`
+	}
+	err := json.Unmarshal(body, &list)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(list.Data))
+
+	for i, eventID := range []string{"evt_1", "evt_2"} {
+		assert.Equal(t, eventID, list.Data[i].EventID)
+		assert.Equal(t, http.StatusInternalServerError, list.Data[i].Status)
+		assert.True(t, list.Data[i].Forced)
+		assert.False(t, list.Data[i].Succeeded)
+	}
+
+	assert.Equal(t, "evt_3", list.Data[2].EventID)
+	assert.Equal(t, http.StatusOK, list.Data[2].Status)
+	assert.False(t, list.Data[2].Forced)
+	assert.True(t, list.Data[2].Succeeded)
+}
+
+func TestControl_WebhookFailNext_InvalidCount(t *testing.T) {
+	resp, body := sendRequest(t, "POST", "/_stripe-mock/webhooks/fail_next", "count=lots",
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(body), "Invalid count 'lots'")
+}
+
+func TestWebhookDeliverer_Signature(t *testing.T) {
+	var signature string
+	var payload []byte
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(webhookSignatureHeader)
+		payload, _ = io.ReadAll(r.Body)
+	}))
+	defer endpoint.Close()
+
+	deliverer := newWebhookDeliverer(endpoint.URL, "whsec_test_secret")
+	attempt := deliverer.deliver("evt_123", []byte(`{"id":"evt_123"}`))
+	assert.True(t, attempt.Succeeded)
+	assert.Equal(t, `{"id":"evt_123"}`, string(payload))
+	assert.NoError(t, verifyWebhookSignature(payload, signature, "whsec_test_secret"))
+
+	// Payloads aren't signed without a secret
+	newWebhookDeliverer(endpoint.URL, "").deliver("evt_456", []byte(`{}`))
+	assert.Equal(t, "", signature)
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	payload := []byte(`{"id":"evt_123"}`)
+
+	// Computed independently of stripe-mock
+	assert.Equal(t,
+		"t=1492774577,v1=8ed42c0d25530bc93d008bd5adc906be714034303647887660f36d0957d2a273",
+		signWebhookPayload(payload, "whsec_test_secret", 1492774577))
+
+	now := time.Now().Unix()
+	signature := signWebhookPayload(payload, "whsec_test_secret", now)
+	assert.NoError(t, verifyWebhookSignature(payload, signature, "whsec_test_secret"))
+	assert.Error(t, verifyWebhookSignature(payload, signature, "whsec_other_secret"))
+	assert.Error(t, verifyWebhookSignature([]byte(`{"id":"evt_456"}`), signature, "whsec_test_secret"))
+
+	signature = signWebhookPayload(payload, "whsec_test_secret", now-600)
+	assert.Error(t, verifyWebhookSignature(payload, signature, "whsec_test_secret"))
+}
+
+func TestCheckWebhookSecret(t *testing.T) {
+	assert.NoError(t, checkWebhookSecret(""))
+	assert.NoError(t, checkWebhookSecret("whsec_123"))
+	assert.Error(t, checkWebhookSecret("whsec_"))
+	assert.Error(t, checkWebhookSecret("sk_test_123"))
+}
+
+// verifyWebhookSignature verifies a signature the same way as Stripe's
+// libraries do, like `webhook.ConstructEvent` in stripe-go: the header can
+// contain several `v1` signatures, any of which has to match, and its
+// timestamp has to be within five minutes of the current time.
+func verifyWebhookSignature(payload []byte, header string, secret string) error {
+	var timestamp int64
+	var signatures [][]byte
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("malformed header")
+		}
+		switch parts[0] {
+		case "t":
+			var err error
+			timestamp, err = strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return err
+			}
+		case "v1":
+			signature, err := hex.DecodeString(parts[1])
+			if err != nil {
+				continue
+			}
+			signatures = append(signatures, signature)
+		}
+	}
+
+	if time.Since(time.Unix(timestamp, 0)) > 300*time.Second {
+		return errors.New("timestamp outside tolerance")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		if hmac.Equal(expected, signature) {
+			return nil
+		}
+	}
+	return errors.New("no matching signature")
+}
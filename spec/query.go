@@ -1,9 +1,26 @@
 package spec
 
+// BuildPathSchema builds a JSON schema that will be used to validate the
+// parameters extracted from the path of an incoming request. Like query
+// parameters, they're described outside of any JSON schema in an operation.
+//
+// Path parameters are always strings, so those with no schema are assumed to
+// be one.
+func BuildPathSchema(operation *Operation) *Schema {
+	return buildParameterSchema(operation, ParameterPath, TypeString)
+}
+
 // BuildQuerySchema builds a JSON schema that will be used to validate query
 // parameters on the incoming request. Unlike request bodies, OpenAPI puts
 // query parameters in a different, non-JSON schema part of an operation.
 func BuildQuerySchema(operation *Operation) *Schema {
+	return buildParameterSchema(operation, ParameterQuery, TypeObject)
+}
+
+// buildParameterSchema builds a JSON schema for an object whose properties
+// are the operation's parameters in the given location. Parameters with no
+// schema are given one of the given type.
+func buildParameterSchema(operation *Operation, in string, defaultType string) *Schema {
 	schema := &Schema{
 		AdditionalProperties:        nil,
 		AdditionalPropertiesAllowed: false,
@@ -17,13 +34,13 @@ func BuildQuerySchema(operation *Operation) *Schema {
 	}
 
 	for _, param := range operation.Parameters {
-		if param.In != ParameterQuery {
+		if param.In != in {
 			continue
 		}
 
 		paramSchema := param.Schema
 		if paramSchema == nil {
-			paramSchema = &Schema{Type: TypeObject}
+			paramSchema = &Schema{Type: defaultType}
 		}
 		schema.Properties[param.Name] = paramSchema
 
@@ -81,3 +81,37 @@ func TestBuildQuerySchema(t *testing.T) {
 		assert.Equal(t, TypeObject, paramSchema.Type)
 	}
 }
+
+func TestBuildPathSchema(t *testing.T) {
+	operation := &Operation{
+		Parameters: []*Parameter{
+			{
+				In:       ParameterPath,
+				Name:     "customer",
+				Required: true,
+				Schema: &Schema{
+					MaxLength: 5000,
+					Type:      TypeString,
+				},
+			},
+			{
+				In:       ParameterPath,
+				Name:     "id",
+				Required: true,
+			},
+			{
+				In:   ParameterQuery,
+				Name: "limit",
+			},
+		},
+	}
+	schema := BuildPathSchema(operation)
+
+	assert.Equal(t, false, schema.AdditionalPropertiesAllowed)
+	assert.Equal(t, 2, len(schema.Properties))
+	assert.Equal(t, []string{"customer", "id"}, schema.Required)
+	assert.Equal(t, 5000, schema.Properties["customer"].MaxLength)
+
+	// Path parameters with no schema are strings
+	assert.Equal(t, TypeString, schema.Properties["id"].Type)
+}
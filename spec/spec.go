@@ -198,7 +198,7 @@ type MediaType struct {
 // specification.
 type Operation struct {
 	Description string                  `json:"description"`
-	OperationID string                  `json:"operation_id"`
+	OperationID string                  `json:"operationId"`
 	Parameters  []*Parameter            `json:"parameters"`
 	RequestBody *RequestBody            `json:"requestBody"`
 	Responses   map[StatusCode]Response `json:"responses"`
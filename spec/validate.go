@@ -1,6 +1,9 @@
 package spec
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+
 	"github.com/lestrrat-go/jsschema"
 	"github.com/lestrrat-go/jsval"
 	"github.com/lestrrat-go/jsval/builder"
@@ -12,11 +15,76 @@ type ComponentsForValidation struct {
 	root interface{}
 }
 
+// ValidatorCache gets validators like GetValidatorForOpenAPI3Schema, but only
+// builds one once for identical schemas and returns the same one every time
+// after that. Building validators for the whole Stripe spec is slow, and many
+// of its operations share schemas.
+//
+// It isn't safe for concurrent use, but the validators it returns are.
+type ValidatorCache struct {
+	// Hits is the number of times that a validator was returned from the
+	// cache instead of being built.
+	Hits int
+
+	validators map[validatorCacheKey]*jsval.JSVal
+}
+
+// NewValidatorCache initializes a new, empty ValidatorCache.
+func NewValidatorCache() *ValidatorCache {
+	return &ValidatorCache{validators: make(map[validatorCacheKey]*jsval.JSVal)}
+}
+
+// Len is the number of distinct validators that have been built. Together
+// with Hits, it adds up to the number of validators that were asked for.
+func (c *ValidatorCache) Len() int {
+	return len(c.validators)
+}
+
+// GetValidator gets a JSON Schema validator for a given OpenAPI schema and set
+// of JSON Schema components, building it only if one hasn't been built for an
+// identical schema and the same components already.
+func (c *ValidatorCache) GetValidator(oaiSchema *Schema, components *ComponentsForValidation) (*jsval.JSVal, error) {
+	jsonSchemaAsJSON := getJSONSchemaForOpenAPI3Schema(oaiSchema)
+
+	// The JSON Schema is hashed rather than the OpenAPI one because it's what
+	// the validator is built from. Its maps are encoded with their keys
+	// sorted, so identical schemas always have the same hash.
+	data, err := json.Marshal(jsonSchemaAsJSON)
+	if err != nil {
+		return nil, err
+	}
+	key := validatorCacheKey{components: components, hash: sha256.Sum256(data)}
+
+	if validator, ok := c.validators[key]; ok {
+		c.Hits++
+		return validator, nil
+	}
+
+	validator, err := getValidatorForJSONSchema(jsonSchemaAsJSON, components)
+	if err != nil {
+		return nil, err
+	}
+	c.validators[key] = validator
+	return validator, nil
+}
+
+// validatorCacheKey identifies validators in a ValidatorCache. Components are
+// compared by identity, which is enough because the same ones are used for
+// all of a spec's validators.
+type validatorCacheKey struct {
+	components *ComponentsForValidation
+	hash       [sha256.Size]byte
+}
+
 // GetValidatorForOpenAPI3Schema gets a JSON Schema validator for a given
 // OpenAPI specification and set of JSON Schema components.
 func GetValidatorForOpenAPI3Schema(oaiSchema *Schema, components *ComponentsForValidation) (*jsval.JSVal, error) {
-	jsonSchemaAsJSON := getJSONSchemaForOpenAPI3Schema(oaiSchema)
+	return getValidatorForJSONSchema(getJSONSchemaForOpenAPI3Schema(oaiSchema), components)
+}
 
+// getValidatorForJSONSchema gets a JSON Schema validator for a JSON Schema
+// represented as JSON and set of JSON Schema components.
+func getValidatorForJSONSchema(jsonSchemaAsJSON map[string]interface{}, components *ComponentsForValidation) (*jsval.JSVal, error) {
 	jsonSchema := schema.New()
 	err := jsonSchema.Extract(jsonSchemaAsJSON)
 	if err != nil {
@@ -99,7 +167,9 @@ func getJSONSchemaForOpenAPI3Schema(oai *Schema) map[string]interface{} {
 		jss["items"] = getJSONSchemaForOpenAPI3Schema(oai.Items)
 	}
 	if oai.MaxLength != 0 {
-		jss["maxLength"] = oai.MaxLength
+		// The schema parser only accepts numbers as they'd be decoded from
+		// JSON, and silently ignores a maxLength of any other type.
+		jss["maxLength"] = float64(oai.MaxLength)
 	}
 	if oai.Pattern != "" {
 		jss["pattern"] = oai.Pattern
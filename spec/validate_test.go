@@ -29,6 +29,17 @@ func TestValidator_Nullable(t *testing.T) {
 	assert.Error(t, v.Validate(123))
 }
 
+func TestValidator_MaxLength(t *testing.T) {
+	schema := Schema{
+		Type:      "string",
+		MaxLength: 5,
+	}
+	v, err := GetValidatorForOpenAPI3Schema(&schema, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, v.Validate("hello"))
+	assert.Error(t, v.Validate("hello!"))
+}
+
 func TestValidator_Reference(t *testing.T) {
 	fooSchema := Schema{
 		Type: "string",
@@ -47,3 +58,49 @@ func TestValidator_Reference(t *testing.T) {
 	assert.NoError(t, v.Validate("hello"))
 	assert.Error(t, v.Validate(123))
 }
+
+func TestValidatorCache(t *testing.T) {
+	cache := NewValidatorCache()
+
+	v1, err := cache.GetValidator(&Schema{Type: "string", MaxLength: 5}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cache.Hits)
+	assert.Equal(t, 1, cache.Len())
+
+	// An identical schema gets the same validator
+	v2, err := cache.GetValidator(&Schema{Type: "string", MaxLength: 5}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cache.Hits)
+	assert.Equal(t, 1, cache.Len())
+	assert.True(t, v1 == v2)
+
+	// Schemas that differ in any way get their own
+	v3, err := cache.GetValidator(&Schema{Type: "string", MaxLength: 6}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cache.Hits)
+	assert.True(t, v1 != v3)
+	assert.Error(t, v1.Validate("hello!"))
+	assert.NoError(t, v3.Validate("hello!"))
+
+	v4, err := cache.GetValidator(&Schema{
+		Type:                        "object",
+		AdditionalPropertiesAllowed: true,
+		AdditionalProperties:        &Schema{Type: "string"},
+	}, nil)
+	assert.NoError(t, err)
+	v5, err := cache.GetValidator(&Schema{
+		Type:                        "object",
+		AdditionalPropertiesAllowed: true,
+		AdditionalProperties:        &Schema{Type: "integer"},
+	}, nil)
+	assert.NoError(t, err)
+	assert.True(t, v4 != v5)
+
+	// So do identical schemas with different components
+	components := GetComponentsForValidation(&Components{})
+	v6, err := cache.GetValidator(&Schema{Type: "string", MaxLength: 5}, components)
+	assert.NoError(t, err)
+	assert.True(t, v1 != v6)
+	assert.Equal(t, 1, cache.Hits)
+	assert.Equal(t, 5, cache.Len())
+}